@@ -0,0 +1,266 @@
+package aggregate
+
+import (
+	"OnlineStore/apierror"
+	"OnlineStore/pagination"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Sections of OrderDetails that are fetched from another service than the
+// order and may fail on their own.
+const (
+	SectionUser     = "user"
+	SectionProducts = "products"
+	SectionPayments = "payments"
+)
+
+// OrderDetails is everything an order page shows, gathered from the order,
+// user, product and payment services. A section whose service failed is
+// left empty and the problem it answered with is reported in Errors under
+// the section's name.
+type OrderDetails struct {
+	Order json.RawMessage `json:"order" swaggertype:"object"`
+	User  json.RawMessage `json:"user" swaggertype:"object"`
+	// Items are the order's lines, each with the product as it is now.
+	Items []ItemDetails `json:"items"`
+	// Payments are every payment made for the order.
+	Payments []json.RawMessage           `json:"payments" swaggertype:"array,object"`
+	Errors   map[string]apierror.Problem `json:"errors,omitempty"`
+}
+
+// ItemDetails is one line of an order. UnitPrice is the price the order was
+// placed at; Product is null if the product has since been deleted or the
+// product service failed.
+type ItemDetails struct {
+	ProductID int             `json:"product_id"`
+	Quantity  int             `json:"quantity"`
+	UnitPrice json.RawMessage `json:"unit_price" swaggertype:"string"`
+	Product   json.RawMessage `json:"product" swaggertype:"object"`
+}
+
+// OrderDetailsHandler answers GET /api/orders/{id}/details. The services
+// are called through api, the gateway's proxy, so each call has the
+// caller's identity and the proxy's timeouts, retries and circuit breakers.
+// The order and its payments are fetched at once, and then the user and
+// the products. If the order itself cannot be fetched its service's answer
+// is returned as it is.
+type OrderDetailsHandler struct {
+	api http.Handler
+}
+
+func NewOrderDetailsHandler(api http.Handler) *OrderDetailsHandler {
+	return &OrderDetailsHandler{api: api}
+}
+
+// order is the part of an order the other sections are fetched by.
+type order struct {
+	UserID int `json:"user_id"`
+	Items  []struct {
+		ProductID int             `json:"product_id"`
+		Quantity  int             `json:"quantity"`
+		UnitPrice json.RawMessage `json:"unit_price"`
+	} `json:"items"`
+}
+
+func (h *OrderDetailsHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	id := mux.Vars(request)["id"]
+	details := OrderDetails{Items: []ItemDetails{}}
+	errs := map[string]apierror.Problem{}
+	var mu sync.Mutex
+	fail := func(section string, err apierror.Problem) {
+		mu.Lock()
+		defer mu.Unlock()
+		errs[section] = err
+	}
+
+	var orderResponse *response
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		orderResponse = h.get(request, "/api/orders/"+id, nil)
+	}()
+	go func() {
+		defer wg.Done()
+		payments, err := h.payments(request, id)
+		if err != nil {
+			fail(SectionPayments, *err)
+			return
+		}
+		details.Payments = payments
+	}()
+	wg.Wait()
+
+	if orderResponse.status != http.StatusOK {
+		orderResponse.writeTo(writer)
+		return
+	}
+	var o order
+	if err := json.Unmarshal(orderResponse.body, &o); err != nil {
+		apierror.Write(writer, request, apierror.Wrap(apierror.BadGateway, "order service answered with an invalid order", err))
+		return
+	}
+	details.Order = orderResponse.body
+
+	var products map[int]json.RawMessage
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		resp := h.get(request, "/api/users/"+strconv.Itoa(o.UserID), nil)
+		if resp.status != http.StatusOK {
+			fail(SectionUser, resp.problem())
+			return
+		}
+		details.User = resp.body
+	}()
+	go func() {
+		defer wg.Done()
+		ids := make([]int, len(o.Items))
+		for i, item := range o.Items {
+			ids[i] = item.ProductID
+		}
+		var err *apierror.Problem
+		if products, err = h.products(request, ids); err != nil {
+			fail(SectionProducts, *err)
+		}
+	}()
+	wg.Wait()
+
+	for _, item := range o.Items {
+		details.Items = append(details.Items, ItemDetails{
+			ProductID: item.ProductID,
+			Quantity:  item.Quantity,
+			UnitPrice: item.UnitPrice,
+			Product:   products[item.ProductID],
+		})
+	}
+	if len(errs) > 0 {
+		details.Errors = errs
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(details)
+}
+
+// payments returns the order's payments. The payment service answers 404
+// when there are none.
+func (h *OrderDetailsHandler) payments(request *http.Request, orderID string) ([]json.RawMessage, *apierror.Problem) {
+	resp := h.get(request, "/api/payments/search", url.Values{"order_id": {orderID}})
+	switch resp.status {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return []json.RawMessage{}, nil
+	default:
+		err := resp.problem()
+		return nil, &err
+	}
+	var payments []json.RawMessage
+	if err := json.Unmarshal(resp.body, &payments); err != nil {
+		return nil, invalidAnswer(request, "payment", err)
+	}
+	return payments, nil
+}
+
+// products returns the products with the given ids by id, a page at a time.
+// Deleted products are missing.
+func (h *OrderDetailsHandler) products(request *http.Request, ids []int) (map[int]json.RawMessage, *apierror.Problem) {
+	products := map[int]json.RawMessage{}
+	for start := 0; start < len(ids); start += pagination.MaxLimit {
+		batch := ids[start:min(start+pagination.MaxLimit, len(ids))]
+		params := make([]string, len(batch))
+		for i, id := range batch {
+			params[i] = strconv.Itoa(id)
+		}
+		resp := h.get(request, "/api/products", url.Values{"ids": {strings.Join(params, ",")}, "limit": {strconv.Itoa(len(batch))}})
+		if resp.status != http.StatusOK {
+			err := resp.problem()
+			return nil, &err
+		}
+		var page struct {
+			Items []json.RawMessage `json:"items"`
+		}
+		if err := json.Unmarshal(resp.body, &page); err != nil {
+			return nil, invalidAnswer(request, "product", err)
+		}
+		for _, product := range page.Items {
+			var p struct {
+				ID int `json:"id"`
+			}
+			if err := json.Unmarshal(product, &p); err != nil {
+				return nil, invalidAnswer(request, "product", err)
+			}
+			products[p.ID] = product
+		}
+	}
+	return products, nil
+}
+
+func invalidAnswer(request *http.Request, service string, err error) *apierror.Problem {
+	problem := apierror.NewProblem(request, apierror.Wrap(apierror.BadGateway, service+" service answered with invalid JSON", err))
+	problem.Upstream = service
+	return &problem
+}
+
+// get sends a GET request for path through the proxy on behalf of the
+// client that sent request, and returns the answer. The call has the
+// client's request ID, so the services log it too.
+func (h *OrderDetailsHandler) get(request *http.Request, path string, query url.Values) *response {
+	out := (&http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Path: path, RawQuery: query.Encode()},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{"Accept": {"application/json"}},
+		Host:       request.Host,
+		RemoteAddr: request.RemoteAddr,
+	}).WithContext(request.Context())
+	if id := apierror.RequestIDFrom(request); id != "" {
+		out.Header.Set(apierror.RequestIDHeader, id)
+	}
+	resp := &response{header: http.Header{}, status: http.StatusOK}
+	h.api.ServeHTTP(resp, out)
+	return resp
+}
+
+// response is an answer the proxy wrote in memory.
+type response struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        []byte
+}
+
+func (r *response) Header() http.Header { return r.header }
+
+func (r *response) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+}
+
+func (r *response) Write(p []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	r.body = append(r.body, p...)
+	return len(p), nil
+}
+
+func (r *response) writeTo(writer http.ResponseWriter) {
+	for key, values := range r.header {
+		writer.Header()[key] = values
+	}
+	writer.WriteHeader(r.status)
+	writer.Write(r.body)
+}
+
+// problem is the problem a failed answer describes.
+func (r *response) problem() apierror.Problem {
+	return apierror.ParseProblem(r.status, r.body)
+}
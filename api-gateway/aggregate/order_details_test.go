@@ -0,0 +1,143 @@
+package aggregate
+
+import (
+	"OnlineStore/apierror"
+	"OnlineStore/auth"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeAPI answers for the services behind the gateway and records the
+// requests it got and who sent them.
+type fakeAPI struct {
+	mu         sync.Mutex
+	requests   []string
+	requestIDs []string
+	callers    []int
+	answers    map[string]func(http.ResponseWriter)
+}
+
+func newFakeAPI() *fakeAPI {
+	return &fakeAPI{answers: map[string]func(http.ResponseWriter){
+		"/api/orders/7": jsonAnswer(http.StatusOK, `{"id":7,"user_id":3,"total_price":"25.00","status":"paid",
+			"items":[{"product_id":1,"quantity":2,"unit_price":"5.00"},{"product_id":2,"quantity":1,"unit_price":"15.00"}]}`),
+		"/api/users/3":         jsonAnswer(http.StatusOK, `{"id":3,"username":"alice"}`),
+		"/api/products":        jsonAnswer(http.StatusOK, `{"items":[{"id":1,"name":"Pen","price":"6.00"},{"id":2,"name":"Book","price":"15.00"}],"total":2}`),
+		"/api/payments/search": jsonAnswer(http.StatusOK, `[{"id":9,"order_id":7,"status":"captured"}]`),
+	}}
+}
+
+func jsonAnswer(status int, body string) func(http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.requests = append(f.requests, r.URL.RequestURI())
+	f.requestIDs = append(f.requestIDs, r.Header.Get(apierror.RequestIDHeader))
+	if claims, ok := auth.FromContext(r.Context()); ok {
+		f.callers = append(f.callers, claims.UserID)
+	}
+	answer, ok := f.answers[r.URL.Path]
+	f.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	answer(w)
+}
+
+func getDetails(t *testing.T, api http.Handler) (*httptest.ResponseRecorder, OrderDetails) {
+	req := httptest.NewRequest(http.MethodGet, "/api/orders/7/details", nil)
+	req = req.WithContext(auth.WithClaims(req.Context(), &auth.Claims{UserID: 3, Role: auth.RoleCustomer}))
+	req = mux.SetURLVars(req, map[string]string{"id": "7"})
+	req.Header.Set(apierror.RequestIDHeader, "req-7")
+	rr := httptest.NewRecorder()
+	NewOrderDetailsHandler(api).ServeHTTP(rr, req)
+
+	var details OrderDetails
+	if rr.Code == http.StatusOK {
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &details))
+	}
+	return rr, details
+}
+
+func TestOrderDetailsComposesEverySection(t *testing.T) {
+	api := newFakeAPI()
+	rr, details := getDetails(t, api)
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"id":3,"username":"alice"}`, string(details.User))
+	require.Len(t, details.Items, 2)
+	assert.Equal(t, 1, details.Items[0].ProductID)
+	assert.Equal(t, 2, details.Items[0].Quantity)
+	assert.JSONEq(t, `"5.00"`, string(details.Items[0].UnitPrice))
+	assert.JSONEq(t, `{"id":1,"name":"Pen","price":"6.00"}`, string(details.Items[0].Product))
+	require.Len(t, details.Payments, 1)
+	assert.JSONEq(t, `{"id":9,"order_id":7,"status":"captured"}`, string(details.Payments[0]))
+	assert.Empty(t, details.Errors)
+
+	assert.ElementsMatch(t, []string{
+		"/api/orders/7",
+		"/api/payments/search?order_id=7",
+		"/api/users/3",
+		"/api/products?ids=1%2C2&limit=2",
+	}, api.requests)
+	assert.Equal(t, []int{3, 3, 3, 3}, api.callers, "every call is made as the caller")
+	assert.Equal(t, []string{"req-7", "req-7", "req-7", "req-7"}, api.requestIDs, "every call has the caller's request ID")
+}
+
+func TestOrderDetailsReportsFailedSections(t *testing.T) {
+	api := newFakeAPI()
+	api.answers["/api/products"] = jsonAnswer(http.StatusServiceUnavailable,
+		`{"type":"urn:onlinestore:problem:unavailable","title":"Service unavailable","status":503,
+			"detail":"product service is failing; requests to it are paused","upstream":"product","retry_after":5}`)
+	api.answers["/api/users/3"] = func(w http.ResponseWriter) {
+		http.Error(w, "user not found", http.StatusNotFound)
+	}
+	rr, details := getDetails(t, api)
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, "null", string(details.User))
+	require.Len(t, details.Items, 2)
+	assert.JSONEq(t, "null", string(details.Items[0].Product))
+	assert.Len(t, details.Payments, 1)
+	assert.Equal(t, map[string]apierror.Problem{
+		SectionProducts: {
+			Type: "urn:onlinestore:problem:unavailable", Title: "Service unavailable", Status: 503,
+			Detail: "product service is failing; requests to it are paused", Upstream: "product", RetryAfter: 5,
+		},
+		SectionUser: {Type: "about:blank", Title: "Not Found", Status: 404, Detail: "user not found"},
+	}, details.Errors)
+}
+
+func TestOrderDetailsWithoutPayments(t *testing.T) {
+	api := newFakeAPI()
+	delete(api.answers, "/api/payments/search")
+	rr, details := getDetails(t, api)
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.NotNil(t, details.Payments)
+	assert.Empty(t, details.Payments)
+	assert.Empty(t, details.Errors)
+}
+
+func TestOrderDetailsPassesOnOrderFailure(t *testing.T) {
+	api := newFakeAPI()
+	delete(api.answers, "/api/orders/7")
+	rr, _ := getDetails(t, api)
+
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.NotContains(t, api.requests, "/api/users/3")
+}
@@ -0,0 +1,15 @@
+package handlers
+
+import "net/http"
+
+// @Summary Get upstream circuit breakers
+// @Description The state of the circuit breaker of every service behind the gateway. An open breaker answers
+// @Description requests to its service with 503 until retry_after seconds have passed.
+// @Tags admin
+// @Produce json
+// @Success 200 {array} proxy.BreakerStatus
+// @Security BearerAuth
+// @Router /api/admin/upstreams [get]
+func GetUpstreamsHandler(writer http.ResponseWriter, request *http.Request) {
+	gateway.ServeBreakers(writer, request)
+}
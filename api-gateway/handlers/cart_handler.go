@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"net/http"
+)
+
+type InputCartItem struct {
+	ProductID int `json:"product_id"`
+	Quantity  int `json:"quantity"`
+}
+
+type InputCartQuantity struct {
+	Quantity int `json:"quantity"`
+}
+
+// @Summary Get the cart
+// @Description The caller's cart at current prices, with a warning on items short of stock.
+// @Tags cart
+// @Produce json
+// @Success 200 {object} models.Cart
+// @Security BearerAuth
+// @Router /api/cart [get]
+// @Failure 500 {object} apierror.Problem "Internal server error"
+func GetCartHandler(writer http.ResponseWriter, request *http.Request) {
+	forward(writer, request)
+}
+
+// @Summary Add a product to the cart
+// @Description Adds quantity, default 1, to any of the product already in the cart.
+// @Tags cart
+// @Accept json
+// @Produce json
+// @Param item body InputCartItem true "Product and quantity"
+// @Success 200 {object} models.Cart
+// @Security BearerAuth
+// @Router /api/cart/items [post]
+// @Failure 400 {object} apierror.Problem "Unknown product or invalid quantity"
+// @Failure 500 {object} apierror.Problem "Internal server error"
+func AddCartItemHandler(writer http.ResponseWriter, request *http.Request) {
+	forward(writer, request)
+}
+
+// @Summary Change a cart item's quantity
+// @Description A quantity of 0 removes the product from the cart.
+// @Tags cart
+// @Accept json
+// @Produce json
+// @Param product_id path int true "Product ID"
+// @Param item body InputCartQuantity true "New quantity"
+// @Success 200 {object} models.Cart
+// @Security BearerAuth
+// @Router /api/cart/items/{product_id} [put]
+// @Failure 400 {object} apierror.Problem "Invalid quantity"
+// @Failure 404 {object} apierror.Problem "Product not in the cart"
+// @Failure 500 {object} apierror.Problem "Internal server error"
+func UpdateCartItemHandler(writer http.ResponseWriter, request *http.Request) {
+	forward(writer, request)
+}
+
+// @Summary Remove a product from the cart
+// @Tags cart
+// @Produce json
+// @Param product_id path int true "Product ID"
+// @Success 200 {object} models.Cart
+// @Security BearerAuth
+// @Router /api/cart/items/{product_id} [delete]
+// @Failure 404 {object} apierror.Problem "Product not in the cart"
+// @Failure 500 {object} apierror.Problem "Internal server error"
+func RemoveCartItemHandler(writer http.ResponseWriter, request *http.Request) {
+	forward(writer, request)
+}
+
+// @Summary Check out the cart
+// @Description Orders everything in the cart at current prices and empties it. If any product is short of
+// @Description stock nothing is ordered and the cart is kept.
+// @Tags cart
+// @Produce json
+// @Param Idempotency-Key header string false "Replays the first response for retries with the same key"
+// @Success 201 {object} models.Order
+// @Security BearerAuth
+// @Router /api/cart/checkout [post]
+// @Failure 400 {object} apierror.Problem "Items priced in different currencies"
+// @Failure 409 {object} apierror.Problem "Cart is empty, not enough stock, or Idempotency-Key conflict"
+// @Failure 429 {object} apierror.Problem "Too many requests"
+// @Failure 500 {object} apierror.Problem "Internal server error"
+func CheckoutCartHandler(writer http.ResponseWriter, request *http.Request) {
+	forward(writer, request)
+}
@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"net/http"
+)
+
+type InputCheckout struct {
+	Items []InputOrderItem `json:"items"`
+	Card  InputCard        `json:"card"`
+	Email string           `json:"email"`
+	Phone string           `json:"phone"`
+}
+
+// @Summary Place and pay for an order
+// @Description Reserves the stock and creates the order, charges the card and marks the order paid. If the
+// @Description payment fails the order is cancelled and its stock returned. A checkout whose payment is still
+// @Description being decided answers 202; poll GET /api/checkout/{id} for the outcome.
+// @Tags checkout
+// @Accept json
+// @Produce json
+// @Param checkout body InputCheckout true "Items and card"
+// @Param Idempotency-Key header string false "Replays the first response for retries with the same key"
+// @Success 201 {object} models.Checkout "Order placed and paid"
+// @Success 202 {object} models.Checkout "Payment not decided yet"
+// @Security BearerAuth
+// @Router /api/checkout [post]
+// @Failure 400 {object} apierror.Problem "Invalid items"
+// @Failure 402 {object} models.Checkout "Payment failed; the order was cancelled"
+// @Failure 409 {object} apierror.Problem "Not enough stock, or Idempotency-Key conflict"
+// @Failure 429 {object} apierror.Problem "Too many requests"
+// @Failure 500 {object} apierror.Problem "Internal server error"
+func CheckoutHandler(writer http.ResponseWriter, request *http.Request) {
+	forward(writer, request)
+}
+
+// @Summary Get a checkout
+// @Tags checkout
+// @Produce json
+// @Param id path int true "Checkout ID"
+// @Success 200 {object} models.Checkout
+// @Security BearerAuth
+// @Router /api/checkout/{id} [get]
+// @Failure 404 {object} apierror.Problem "Checkout not found"
+// @Failure 500 {object} apierror.Problem "Internal server error"
+func GetCheckoutHandler(writer http.ResponseWriter, request *http.Request) {
+	forward(writer, request)
+}
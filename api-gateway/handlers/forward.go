@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"OnlineStore/api-gateway/aggregate"
+	"OnlineStore/api-gateway/proxy"
+	"github.com/joho/godotenv"
+	"log"
+	"net/http"
+)
+
+// gateway forwards every endpoint to the service that owns it. The handlers
+// in this package only document the API for Swagger; they all forward.
+var gateway *proxy.Proxy
+
+// orderDetails composes an order page from several services through gateway.
+var orderDetails *aggregate.OrderDetailsHandler
+
+func init() {
+	if err := godotenv.Load(); err != nil {
+		log.Println("Error loading .env file")
+	}
+	var err error
+	gateway, err = proxy.FromEnv()
+	if err != nil {
+		log.Fatalf("Error configuring service routes: %v", err)
+	}
+	orderDetails = aggregate.NewOrderDetailsHandler(gateway)
+}
+
+// forward passes request on to its service through the shared proxy.
+func forward(writer http.ResponseWriter, request *http.Request) {
+	gateway.ServeHTTP(writer, request)
+}
@@ -1,56 +1,45 @@
 package handlers
 
 import (
-	"github.com/gorilla/mux"
-	"github.com/joho/godotenv"
-	"io"
-	"log"
+	"OnlineStore/money"
+	_ "OnlineStore/pagination"
 	"net/http"
-	"os"
 )
 
-var urlOrdersService string
+type InputOrder struct {
+	UserID int              `json:"user_id"`
+	Items  []InputOrderItem `json:"items"`
+	// ProductIDs is the legacy shape, one entry per unit; prefer Items.
+	ProductIDs []int `json:"product_ids,omitempty"`
+}
 
-func init() {
-	if err := godotenv.Load(); err != nil {
-		log.Println("Error loading .env file")
-	}
-	urlOrdersService = os.Getenv("ORDER_SERVICE_URL") + "/orders"
+type InputOrderItem struct {
+	ProductID int `json:"product_id"`
+	Quantity  int `json:"quantity"`
 }
 
-type InputOrder struct {
-	UserID     int    `json:"user_id"`
-	Status     string `json:"status"`
-	ProductIDs []int  `json:"product_ids"`
+// InputPayOrder is the optional body of POST /api/orders/{id}/pay.
+type InputPayOrder struct {
+	Amount *money.Money `json:"amount,omitempty"`
 }
 
 // @Summary Get all orders
+// @Description Admins get every order, customers their own.
 // @Tags orders
 // @Produce json
-// @Success 200 {array} models.Order
+// @Param user_id query int false "Filter by user ID"
+// @Param status query string false "Filter by status"
+// @Param limit query int false "Page size, 1 to 100" default(20)
+// @Param offset query int false "Items to skip; pass the previous page's next" default(0)
+// @Param sort query string false "Sort key" Enums(id, order_date, total_price, status)
+// @Param order query string false "Sort direction" Enums(asc, desc)
+// @Success 200 {object} pagination.Page[models.Order]
+// @Security BearerAuth
 // @Router /api/orders [get]
-// @Failure 404 {string} string "No orders found"
-// @Failure 500 {string} string "Internal server error"
+// @Failure 400 {object} apierror.Problem "Invalid pagination parameters"
+// @Failure 500 {object} apierror.Problem "Internal server error"
 func GetOrdersHandler(writer http.ResponseWriter, request *http.Request) {
-	req, err := http.NewRequest(http.MethodGet, urlOrdersService, nil)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-	writer.Header().Set("Content-Type", "application/json")
-	writer.WriteHeader(resp.StatusCode)
-	_, err = io.Copy(writer, resp.Body)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	forward(writer, request)
 }
 
 // @Summary Get order by ID
@@ -58,31 +47,28 @@ func GetOrdersHandler(writer http.ResponseWriter, request *http.Request) {
 // @Produce json
 // @Param id path int true "Order ID"
 // @Success 200 {object} models.Order
+// @Security BearerAuth
 // @Router /api/orders/{id} [get]
-// @Failure 404 {string} string "Order not found"
-// @Failure 500 {string} string "Internal server error"
+// @Failure 404 {object} apierror.Problem "Order not found"
+// @Failure 500 {object} apierror.Problem "Internal server error"
 func GetOrderByIDHandler(writer http.ResponseWriter, request *http.Request) {
-	vars := mux.Vars(request)
-	id := vars["id"]
-	req, err := http.NewRequest(http.MethodGet, urlOrdersService+"/"+id, nil)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-	writer.Header().Set("Content-Type", "application/json")
-	writer.WriteHeader(resp.StatusCode)
-	_, err = io.Copy(writer, resp.Body)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	forward(writer, request)
+}
+
+// @Summary Get order details
+// @Description The order with its user, the current product of each item and its payments, gathered in one
+// @Description request. If the user, product or payment service fails, its section is left empty and the
+// @Description failure is reported in errors under the section's name; the answer is still 200.
+// @Tags orders
+// @Produce json
+// @Param id path int true "Order ID"
+// @Success 200 {object} aggregate.OrderDetails
+// @Security BearerAuth
+// @Router /api/orders/{id}/details [get]
+// @Failure 404 {object} apierror.Problem "Order not found"
+// @Failure 500 {object} apierror.Problem "Internal server error"
+func GetOrderDetailsHandler(writer http.ResponseWriter, request *http.Request) {
+	orderDetails.ServeHTTP(writer, request)
 }
 
 // @Summary Create a new order
@@ -90,30 +76,16 @@ func GetOrderByIDHandler(writer http.ResponseWriter, request *http.Request) {
 // @Accept json
 // @Produce json
 // @Param order body InputOrder true "Order object"
+// @Param Idempotency-Key header string false "Replays the first response for retries with the same key"
 // @Success 201 {string} string "Order created"
+// @Security BearerAuth
 // @Router /api/orders [post]
-// @Failure 400 {string} string "Missing required fields"
-// @Failure 500 {string} string "Internal server error"
+// @Failure 400 {object} apierror.Problem "Missing required fields"
+// @Failure 409 {object} apierror.Problem "Idempotency-Key reused with a different body, or still in progress"
+// @Failure 429 {object} apierror.Problem "Too many requests"
+// @Failure 500 {object} apierror.Problem "Internal server error"
 func CreateOrderHandler(writer http.ResponseWriter, request *http.Request) {
-	req, err := http.NewRequest(http.MethodPost, urlOrdersService, request.Body)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-	writer.Header().Set("Content-Type", "application/json")
-	writer.WriteHeader(resp.StatusCode)
-	_, err = io.Copy(writer, resp.Body)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	forward(writer, request)
 }
 
 // @Summary Update order by ID
@@ -123,62 +95,24 @@ func CreateOrderHandler(writer http.ResponseWriter, request *http.Request) {
 // @Param id path int true "Order ID"
 // @Param order body InputOrder true "Order object"
 // @Success 200 {string} string "Order updated"
+// @Security BearerAuth
 // @Router /api/orders/{id} [put]
-// @Failure 400 {string} string "Missing required fields"
-// @Failure 404 {string} string "Order not found"
-// @Failure 500 {string} string "Internal server error"
+// @Failure 400 {object} apierror.Problem "Missing required fields"
+// @Failure 404 {object} apierror.Problem "Order not found"
+// @Failure 500 {object} apierror.Problem "Internal server error"
 func UpdateOrderHandler(writer http.ResponseWriter, request *http.Request) {
-	vars := mux.Vars(request)
-	id := vars["id"]
-	req, err := http.NewRequest(http.MethodPut, urlOrdersService+"/"+id, request.Body)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-	writer.Header().Set("Content-Type", "application/json")
-	writer.WriteHeader(resp.StatusCode)
-	_, err = io.Copy(writer, resp.Body)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	forward(writer, request)
 }
 
 // @Summary Delete order by ID
 // @Tags orders
 // @Param id path int true "Order ID"
 // @Success 204 {string} string "Order deleted"
+// @Security BearerAuth
 // @Router /api/orders/{id} [delete]
-// @Failure 500 {string} string "Internal server error"
+// @Failure 500 {object} apierror.Problem "Internal server error"
 func DeleteOrderHandler(writer http.ResponseWriter, request *http.Request) {
-	vars := mux.Vars(request)
-	id := vars["id"]
-	req, err := http.NewRequest(http.MethodDelete, urlOrdersService+"/"+id, nil)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-	writer.Header().Set("Content-Type", "application/json")
-	writer.WriteHeader(resp.StatusCode)
-	_, err = io.Copy(writer, resp.Body)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	forward(writer, request)
 }
 
 // @Summary Search orders
@@ -187,22 +121,43 @@ func DeleteOrderHandler(writer http.ResponseWriter, request *http.Request) {
 // @Param user_id query int false "User ID"
 // @Param status query string false "Order status"
 // @Success 200 {array} models.Order
+// @Security BearerAuth
 // @Router /api/orders/search [get]
-// @Failure 400 {string} string "Missing required fields"
-// @Failure 500 {string} string "Internal server error"
+// @Failure 400 {object} apierror.Problem "Missing required fields"
+// @Failure 500 {object} apierror.Problem "Internal server error"
 func SearchOrderHandler(writer http.ResponseWriter, request *http.Request) {
-	queryParams := request.URL.Query()
-	resp, err := http.Get(urlOrdersService + "/search?" + queryParams.Encode())
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-	writer.Header().Set("Content-Type", "application/json")
-	writer.WriteHeader(resp.StatusCode)
-	_, err = io.Copy(writer, resp.Body)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	forward(writer, request)
+}
+
+// @Summary Change order status
+// @Description Customers may only cancel; pay, ship, deliver and refund are for admins.
+// @Description pay may be given the amount paid, which must still be the order's total.
+// @Tags orders
+// @Accept json
+// @Produce json
+// @Param id path int true "Order ID"
+// @Param action path string true "Status transition" Enums(pay, ship, deliver, cancel, refund)
+// @Param payment body InputPayOrder false "Amount paid, for pay only"
+// @Success 200 {object} models.Order
+// @Security BearerAuth
+// @Router /api/orders/{id}/{action} [post]
+// @Failure 403 {object} apierror.Problem "Only admins may pay, ship, deliver or refund"
+// @Failure 404 {object} apierror.Problem "Order not found"
+// @Failure 409 {object} apierror.Problem "Illegal status transition, or the amount paid is not the order's total"
+// @Failure 500 {object} apierror.Problem "Internal server error"
+func TransitionOrderHandler(writer http.ResponseWriter, request *http.Request) {
+	forward(writer, request)
+}
+
+// @Summary Get order status history
+// @Tags orders
+// @Produce json
+// @Param id path int true "Order ID"
+// @Success 200 {array} models.OrderStatusChange
+// @Security BearerAuth
+// @Router /api/orders/{id}/history [get]
+// @Failure 404 {object} apierror.Problem "Order not found"
+// @Failure 500 {object} apierror.Problem "Internal server error"
+func GetOrderStatusHistoryHandler(writer http.ResponseWriter, request *http.Request) {
+	forward(writer, request)
 }
@@ -1,51 +1,54 @@
 package handlers
 
 import (
+	"OnlineStore/money"
+	_ "OnlineStore/pagination"
 	_ "OnlineStore/payment-service/models"
-	"github.com/gorilla/mux"
-	"github.com/joho/godotenv"
-	"io"
-	"log"
+	_ "OnlineStore/payment-service/services"
 	"net/http"
-	"os"
 )
 
-var urlPaymentService string
+type InputPayment struct {
+	UserID  int         `json:"user_id"`
+	OrderID int         `json:"order_id"`
+	Amount  money.Money `json:"amount"`
+	Card    InputCard   `json:"card"`
+	Email   string      `json:"email"`
+	Phone   string      `json:"phone"`
+}
 
-func init() {
-	if err := godotenv.Load(); err != nil {
-		log.Println("Error loading .env file")
-	}
-	urlPaymentService = os.Getenv("PAYMENT_SERVICE_URL") + "/payments"
+// InputRefund refunds the given amount, or everything not yet refunded when
+// the amount is left out.
+type InputRefund struct {
+	Amount *money.Money `json:"amount,omitempty"`
+	Reason string       `json:"reason"`
 }
 
-type InputPayment struct {
-	UserID  int     `json:"user_id"`
-	OrderID int     `json:"order_id"`
-	Amount  float64 `json:"amount"`
+type InputCard struct {
+	Number     string `json:"number"`
+	ExpDate    string `json:"exp_date"`
+	CVC        string `json:"cvc"`
+	HolderName string `json:"holder_name"`
 }
 
 // @Summary Get all payments
+// @Description Admins get every payment, customers their own.
 // @Tags payments
 // @Produce json
-// @Success 200 {array} models.Payment
+// @Param user_id query int false "Filter by user ID"
+// @Param order_id query int false "Filter by order ID"
+// @Param status query string false "Filter by payment status"
+// @Param limit query int false "Page size, 1 to 100" default(20)
+// @Param offset query int false "Items to skip; pass the previous page's next" default(0)
+// @Param sort query string false "Sort key" Enums(id, payment_date, amount, payment_status)
+// @Param order query string false "Sort direction" Enums(asc, desc)
+// @Success 200 {object} pagination.Page[models.Payment]
+// @Security BearerAuth
 // @Router /api/payments [get]
-// @Failure 404 {string} string "No payments found"
-// @Failure 500 {string} string "Internal server error"
+// @Failure 400 {object} apierror.Problem "Invalid pagination parameters"
+// @Failure 500 {object} apierror.Problem "Internal server error"
 func GetPaymentsHandler(writer http.ResponseWriter, request *http.Request) {
-	resp, err := http.Get(urlPaymentService)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-	writer.Header().Set("Content-Type", "application/json")
-	writer.WriteHeader(resp.StatusCode)
-	_, err = io.Copy(writer, resp.Body)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	forward(writer, request)
 }
 
 // @Summary Get payment by ID
@@ -53,26 +56,12 @@ func GetPaymentsHandler(writer http.ResponseWriter, request *http.Request) {
 // @Produce json
 // @Param id path int true "Payment ID"
 // @Success 200 {object} models.Payment
+// @Security BearerAuth
 // @Router /api/payments/{id} [get]
-// @Failure 404 {string} string "Payment not found"
-// @Failure 500 {string} string "Internal server error"
+// @Failure 404 {object} apierror.Problem "Payment not found"
+// @Failure 500 {object} apierror.Problem "Internal server error"
 func GetPaymentByIDHandler(writer http.ResponseWriter, request *http.Request) {
-	vars := mux.Vars(request)
-	id := vars["id"]
-
-	resp, err := http.Get(urlPaymentService + "/" + id)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-	writer.Header().Set("Content-Type", "application/json")
-	writer.WriteHeader(resp.StatusCode)
-	_, err = io.Copy(writer, resp.Body)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	forward(writer, request)
 }
 
 // @Summary Create a new payment
@@ -80,25 +69,66 @@ func GetPaymentByIDHandler(writer http.ResponseWriter, request *http.Request) {
 // @Accept json
 // @Produce json
 // @Param payment body InputPayment true "Payment object"
-// @Success 201 {string} string "Payment created"
+// @Param Idempotency-Key header string false "Replays the first response for retries with the same key"
+// @Success 201 {object} models.Payment
+// @Success 202 {object} models.Payment "Gateway timed out, payment pending"
+// @Security BearerAuth
 // @Router /api/payments [post]
-// @Failure 400 {string} string "Missing required fields"
-// @Failure 500 {string} string "Internal server error"
+// @Failure 400 {object} apierror.Problem "Missing card details, or amount is not the order's total"
+// @Failure 404 {object} apierror.Problem "Order not found"
+// @Failure 409 {object} apierror.Problem "Order is not pending or already has a payment, or Idempotency-Key reused with a different body or still in progress"
+// @Failure 429 {object} apierror.Problem "Too many requests"
+// @Failure 500 {object} apierror.Problem "Internal server error"
 func CreatePaymentHandler(writer http.ResponseWriter, request *http.Request) {
-	resp, err := http.Post(urlPaymentService, "application/json", request.Body)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-	writer.Header().Set("Content-Type", "application/json")
+	forward(writer, request)
+}
+
+// @Summary Refund a payment
+// @Description Refunds all or part of a captured payment through the payment gateway.
+// @Tags payments
+// @Accept json
+// @Produce json
+// @Param id path int true "Payment ID"
+// @Param refund body InputRefund false "Refund amount and reason"
+// @Param Idempotency-Key header string false "Replays the first response for retries with the same key"
+// @Success 201 {object} models.Refund
+// @Success 202 {object} models.Refund "Gateway timed out, refund pending"
+// @Security BearerAuth
+// @Router /api/payments/{id}/refunds [post]
+// @Failure 404 {object} apierror.Problem "Payment not found"
+// @Failure 409 {object} apierror.Problem "Payment not refundable or refund exceeds captured amount"
+// @Failure 500 {object} apierror.Problem "Internal server error"
+// @Failure 502 {object} apierror.Problem "Gateway rejected the refund; it is recorded as failed"
+func CreatePaymentRefundHandler(writer http.ResponseWriter, request *http.Request) {
+	forward(writer, request)
+}
+
+// @Summary Get refunds of a payment
+// @Tags payments
+// @Produce json
+// @Param id path int true "Payment ID"
+// @Success 200 {array} models.Refund
+// @Security BearerAuth
+// @Router /api/payments/{id}/refunds [get]
+// @Failure 404 {object} apierror.Problem "Payment not found"
+// @Failure 500 {object} apierror.Problem "Internal server error"
+func GetPaymentRefundsHandler(writer http.ResponseWriter, request *http.Request) {
+	forward(writer, request)
+}
 
-	writer.WriteHeader(resp.StatusCode)
-	_, err = io.Copy(writer, resp.Body)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
+// @Summary Receive an epay payment callback
+// @Description epay's postLink (and, under /failure, failurePostLink) callback.
+// @Tags payments
+// @Accept json
+// @Produce json
+// @Param callback body services.EpayCallback true "Callback sent by epay"
+// @Success 200 {object} models.Payment
+// @Router /api/payments/webhooks/epay [post]
+// @Failure 401 {object} apierror.Problem "Invalid callback signature"
+// @Failure 404 {object} apierror.Problem "Unknown invoice"
+// @Failure 503 {object} apierror.Problem "Payment gateway unavailable"
+func EpayWebhookHandler(writer http.ResponseWriter, request *http.Request) {
+	forward(writer, request)
 }
 
 // @Summary Update payment by ID
@@ -108,68 +138,24 @@ func CreatePaymentHandler(writer http.ResponseWriter, request *http.Request) {
 // @Param id path int true "Payment ID"
 // @Param payment body InputPayment true "Payment object"
 // @Success 200 {string} string "Payment updated"
+// @Security BearerAuth
 // @Router /api/payments/{id} [put]
-// @Failure 400 {string} string "Missing required fields"
-// @Failure 404 {string} string "Payment not found"
-// @Failure 500 {string} string "Internal server error"
+// @Failure 400 {object} apierror.Problem "Missing required fields"
+// @Failure 404 {object} apierror.Problem "Payment not found"
+// @Failure 500 {object} apierror.Problem "Internal server error"
 func UpdatePaymentHandler(writer http.ResponseWriter, request *http.Request) {
-	vars := mux.Vars(request)
-	id := vars["id"]
-
-	client := &http.Client{}
-	req, err := http.NewRequest(http.MethodPut, urlPaymentService+"/"+id, request.Body)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	resp, err := client.Do(req)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-	writer.Header().Set("Content-Type", "application/json")
-
-	writer.WriteHeader(resp.StatusCode)
-	_, err = io.Copy(writer, resp.Body)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	forward(writer, request)
 }
 
 // @Summary Delete payment by ID
 // @Tags payments
 // @Param id path int true "Payment ID"
 // @Success 204 {string} string "Payment deleted"
+// @Security BearerAuth
 // @Router /api/payments/{id} [delete]
-// @Failure 500 {string} string "Internal server error"
+// @Failure 500 {object} apierror.Problem "Internal server error"
 func DeletePaymentHandler(writer http.ResponseWriter, request *http.Request) {
-	vars := mux.Vars(request)
-	id := vars["id"]
-
-	client := &http.Client{}
-	req, err := http.NewRequest(http.MethodDelete, urlPaymentService+"/"+id, nil)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	resp, err := client.Do(req)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-	writer.Header().Set("Content-Type", "application/json")
-
-	writer.WriteHeader(resp.StatusCode)
-	_, err = io.Copy(writer, resp.Body)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	forward(writer, request)
 }
 
 // @Summary Search payments
@@ -179,23 +165,10 @@ func DeletePaymentHandler(writer http.ResponseWriter, request *http.Request) {
 // @Param user_id query int false "User ID"
 // @Param status query string false "Payment status"
 // @Success 200 {array} models.Payment
+// @Security BearerAuth
 // @Router /api/payments/search [get]
-// @Failure 400 {string} string "Missing required fields"
-// @Failure 500 {string} string "Internal server error"
+// @Failure 400 {object} apierror.Problem "Missing required fields"
+// @Failure 500 {object} apierror.Problem "Internal server error"
 func SearchPaymentHandler(writer http.ResponseWriter, request *http.Request) {
-	query := request.URL.Query()
-	resp, err := http.Get(urlPaymentService + "/search?" + query.Encode())
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-	writer.Header().Set("Content-Type", "application/json")
-
-	writer.WriteHeader(resp.StatusCode)
-	_, err = io.Copy(writer, resp.Body)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	forward(writer, request)
 }
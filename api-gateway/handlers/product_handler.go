@@ -1,59 +1,43 @@
 package handlers
 
 import (
+	"OnlineStore/money"
+	_ "OnlineStore/pagination"
 	_ "OnlineStore/product-service/models"
-	"github.com/gorilla/mux"
-	"github.com/joho/godotenv"
-	"io"
-	"log"
 	"net/http"
-	"os"
 )
 
-var urlProductsService string
-
-func init() {
-	if err := godotenv.Load(); err != nil {
-		log.Println("Error loading .env file")
-	}
-	urlProductsService = os.Getenv("PRODUCT_SERVICE_URL") + "/products"
-}
-
 type InputProduct struct {
-	Name        string  `json:"name"`
-	Description string  `json:"description"`
-	Price       float64 `json:"price"`
-	Category    string  `json:"category"`
-	Quantity    int     `json:"quantity"`
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Price       money.Money `json:"price"`
+	Category    string      `json:"category"`
+	Quantity    int         `json:"quantity"`
 }
 
 // @Summary Get all products
+// @Description Filters combine; products must match all of them.
 // @Tags products
 // @Produce json
-// @Success 200 {array} models.Product
+// @Param ids query string false "Comma-separated product IDs, e.g. 1,2,3"
+// @Param name query string false "Part of the name, case-insensitive"
+// @Param category query string false "Filter by category"
+// @Param min_price query string false "Lowest price, e.g. 1500.00"
+// @Param max_price query string false "Highest price, e.g. 4999.99"
+// @Param currency query string false "Currency of min_price and max_price" default(KZT)
+// @Param in_stock query bool false "Only products with quantity left"
+// @Param added_from query string false "Added on or after this date, e.g. 2024-01-31"
+// @Param added_to query string false "Added on or before this date"
+// @Param limit query int false "Page size, 1 to 100" default(20)
+// @Param offset query int false "Items to skip; pass the previous page's next" default(0)
+// @Param sort query string false "Sort key" Enums(id, name, price, quantity, date_added)
+// @Param order query string false "Sort direction" Enums(asc, desc)
+// @Success 200 {object} pagination.Page[models.Product]
 // @Router /api/products [get]
-// @Failure 404 {string} string "No products found"
-// @Failure 500 {string} string "Internal server error"
+// @Failure 400 {object} apierror.Problem "Invalid filter or pagination parameters"
+// @Failure 500 {object} apierror.Problem "Internal server error"
 func GetProductsHandler(writer http.ResponseWriter, request *http.Request) {
-	req, err := http.NewRequest(http.MethodGet, urlProductsService, nil)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-	writer.Header().Set("Content-Type", "application/json")
-	writer.WriteHeader(resp.StatusCode)
-	_, err = io.Copy(writer, resp.Body)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	forward(writer, request)
 }
 
 // @Summary Get product by ID
@@ -62,30 +46,10 @@ func GetProductsHandler(writer http.ResponseWriter, request *http.Request) {
 // @Param id path int true "Product ID"
 // @Success 200 {object} models.Product
 // @Router /api/products/{id} [get]
-// @Failure 404 {string} string "Product not found"
-// @Failure 500 {string} string "Internal server error"
+// @Failure 404 {object} apierror.Problem "Product not found"
+// @Failure 500 {object} apierror.Problem "Internal server error"
 func GetProductByIDHandler(writer http.ResponseWriter, request *http.Request) {
-	vars := mux.Vars(request)
-	id := vars["id"]
-	req, err := http.NewRequest(http.MethodGet, urlProductsService+"/"+id, nil)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-	writer.Header().Set("Content-Type", "application/json")
-	writer.WriteHeader(resp.StatusCode)
-	_, err = io.Copy(writer, resp.Body)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	forward(writer, request)
 }
 
 // @Summary Create a new product
@@ -94,29 +58,12 @@ func GetProductByIDHandler(writer http.ResponseWriter, request *http.Request) {
 // @Produce json
 // @Param product body InputProduct true "Product object"
 // @Success 201 {string} string "Product created"
+// @Security BearerAuth
 // @Router /api/products [post]
-// @Failure 400 {string} string "Missing required fields"
-// @Failure 500 {string} string "Internal server error"
+// @Failure 400 {object} apierror.Problem "Missing required fields"
+// @Failure 500 {object} apierror.Problem "Internal server error"
 func CreateProductHandler(writer http.ResponseWriter, request *http.Request) {
-	req, err := http.NewRequest(http.MethodPost, urlProductsService, request.Body)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-	writer.Header().Set("Content-Type", "application/json")
-	writer.WriteHeader(resp.StatusCode)
-	_, err = io.Copy(writer, resp.Body)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	forward(writer, request)
 }
 
 // @Summary Update product by ID
@@ -126,86 +73,63 @@ func CreateProductHandler(writer http.ResponseWriter, request *http.Request) {
 // @Param id path int true "Product ID"
 // @Param product body InputProduct true "Product object"
 // @Success 200 {string} string "Product updated"
+// @Security BearerAuth
 // @Router /api/products/{id} [put]
-// @Failure 400 {string} string "Missing required fields"
-// @Failure 404 {string} string "Product not found"
-// @Failure 500 {string} string "Internal server error"
+// @Failure 400 {object} apierror.Problem "Missing required fields"
+// @Failure 404 {object} apierror.Problem "Product not found"
+// @Failure 500 {object} apierror.Problem "Internal server error"
 func UpdateProductHandler(writer http.ResponseWriter, request *http.Request) {
-	vars := mux.Vars(request)
-	id := vars["id"]
-	req, err := http.NewRequest(http.MethodPut, urlProductsService+"/"+id, request.Body)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-	writer.Header().Set("Content-Type", "application/json")
-	writer.WriteHeader(resp.StatusCode)
-	_, err = io.Copy(writer, resp.Body)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	forward(writer, request)
 }
 
 // @Summary Delete product by ID
 // @Tags products
 // @Param id path int true "Product ID"
 // @Success 204 {string} string "Product deleted"
+// @Security BearerAuth
 // @Router /api/products/{id} [delete]
-// @Failure 500 {string} string "Internal server error"
+// @Failure 500 {object} apierror.Problem "Internal server error"
 func DeleteProductHandler(writer http.ResponseWriter, request *http.Request) {
-	vars := mux.Vars(request)
-	id := vars["id"]
-	req, err := http.NewRequest(http.MethodDelete, urlProductsService+"/"+id, nil)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-	writer.Header().Set("Content-Type", "application/json")
-	writer.WriteHeader(resp.StatusCode)
-	_, err = io.Copy(writer, resp.Body)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	forward(writer, request)
 }
 
 // @Summary Search products
+// @Description With q, ranks the products matching its words in their name or description, best first, and
+// @Description highlights where they matched. If nothing matches it suggests similarly spelled product names.
+// @Description Without q it is the same as GET /api/products. The filters apply either way.
 // @Tags products
 // @Produce json
-// @Param name query string false "Product name"
-// @Param category query string false "Product category"
-// @Success 200 {array} models.Product
+// @Param q query string false "Search terms; quoted phrases, or, and -word to exclude work as in web search"
+// @Param name query string false "Part of the name, case-insensitive"
+// @Param category query string false "Filter by category"
+// @Param min_price query string false "Lowest price, e.g. 1500.00"
+// @Param max_price query string false "Highest price, e.g. 4999.99"
+// @Param currency query string false "Currency of min_price and max_price" default(KZT)
+// @Param in_stock query bool false "Only products with quantity left"
+// @Param added_from query string false "Added on or after this date, e.g. 2024-01-31"
+// @Param added_to query string false "Added on or before this date"
+// @Param limit query int false "Page size, 1 to 100" default(20)
+// @Param offset query int false "Items to skip; pass the previous page's next" default(0)
+// @Param sort query string false "Sort key; relevance only with q" Enums(relevance, id, name, price, quantity, date_added)
+// @Param order query string false "Sort direction" Enums(asc, desc)
+// @Success 200 {object} models.ProductSearchResults
 // @Router /api/products/search [get]
-// @Failure 400 {string} string "Missing required fields"
-// @Failure 500 {string} string "Internal server error"
+// @Failure 400 {object} apierror.Problem "Invalid filter or pagination parameters"
+// @Failure 500 {object} apierror.Problem "Internal server error"
 func SearchProductHandler(writer http.ResponseWriter, request *http.Request) {
-	queryParams := request.URL.Query()
-	resp, err := http.Get(urlProductsService + "/search?" + queryParams.Encode())
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-	writer.Header().Set("Content-Type", "application/json")
-	writer.WriteHeader(resp.StatusCode)
-	_, err = io.Copy(writer, resp.Body)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	forward(writer, request)
+}
+
+// @Summary Suggest product names
+// @Description Product names similar to q, most similar first, tolerating typos.
+// @Tags products
+// @Produce json
+// @Param q query string true "Partial or misspelled name"
+// @Param limit query int false "How many names, 1 to 20" default(5)
+// @Success 200 {array} string
+// @Router /api/products/suggest [get]
+// @Failure 400 {object} apierror.Problem "Missing q or invalid limit"
+// @Failure 500 {object} apierror.Problem "Internal server error"
+func SuggestProductsHandler(writer http.ResponseWriter, request *http.Request) {
+	forward(writer, request)
 }
@@ -1,55 +1,66 @@
 package handlers
 
 import (
+	_ "OnlineStore/pagination"
 	_ "OnlineStore/user-service/models"
-	"github.com/gorilla/mux"
-	"github.com/joho/godotenv"
-	"io"
-	"log"
 	"net/http"
-	"os"
 )
 
-var urlUsersService string
+type InputUser struct {
+	UserName string `json:"username"`
+	Email    string `json:"email"`
+	Address  string `json:"address"`
+	Role     string `json:"role"`
+	Password string `json:"password"`
+}
 
-func init() {
-	if err := godotenv.Load(); err != nil {
-		log.Println("Error loading .env file")
-	}
-	urlUsersService = os.Getenv("USER_SERVICE_URL") + "/users"
+type InputLogin struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
 }
 
-type InputUser struct {
+type InputRegister struct {
 	UserName string `json:"username"`
 	Email    string `json:"email"`
 	Address  string `json:"address"`
-	Role     string `json:"role"`
+	Password string `json:"password"`
+}
+
+type InputChangePassword struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type InputForgotPassword struct {
+	Email string `json:"email"`
+}
+
+type InputResetPassword struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+type TokenOutput struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
 }
 
 // @Summary Get all users
 // @Tags users
 // @Produce json
-// @Success 200 {array} models.User
+// @Param role query string false "Filter by role"
+// @Param limit query int false "Page size, 1 to 100" default(20)
+// @Param offset query int false "Items to skip; pass the previous page's next" default(0)
+// @Param sort query string false "Sort key" Enums(id, username, email, registration_date, role)
+// @Param order query string false "Sort direction" Enums(asc, desc)
+// @Success 200 {object} pagination.Page[models.User]
+// @Security BearerAuth
 // @Router /api/users [get]
-// @Failure 404 {string} string "No users found"
-// @Failure 500 {string} string "Internal server error"
+// @Failure 400 {object} apierror.Problem "Invalid pagination parameters"
+// @Failure 500 {object} apierror.Problem "Internal server error"
 func GetUsersHandler(writer http.ResponseWriter, request *http.Request) {
-	req, err := http.NewRequest(http.MethodGet, urlUsersService, nil)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-
-	writer.Header().Set("Content-Type", "application/json")
-	writer.WriteHeader(resp.StatusCode)
-	_, err = io.Copy(writer, resp.Body)
+	forward(writer, request)
 }
 
 // @Summary Get user by ID
@@ -57,28 +68,12 @@ func GetUsersHandler(writer http.ResponseWriter, request *http.Request) {
 // @Produce json
 // @Param id path int true "User ID"
 // @Success 200 {object} models.User
+// @Security BearerAuth
 // @Router /api/users/{id} [get]
-// @Failure 404 {string} string "User not found"
-// @Failure 500 {string} string "Internal server error"
+// @Failure 404 {object} apierror.Problem "User not found"
+// @Failure 500 {object} apierror.Problem "Internal server error"
 func GetUserByIDHandler(writer http.ResponseWriter, request *http.Request) {
-	vars := mux.Vars(request)
-	id := vars["id"]
-	req, err := http.NewRequest(http.MethodGet, urlUsersService+"/"+id, nil)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-
-	writer.Header().Set("Content-Type", "application/json")
-	writer.WriteHeader(resp.StatusCode)
-	_, err = io.Copy(writer, resp.Body)
+	forward(writer, request)
 }
 
 // @Summary Create a new user
@@ -86,27 +81,15 @@ func GetUserByIDHandler(writer http.ResponseWriter, request *http.Request) {
 // @Accept json
 // @Produce json
 // @Param user body InputUser true "User object"
+// @Description Admin only; customers sign up with /api/users/register.
 // @Success 201 {string} string "User created"
+// @Security BearerAuth
 // @Router /api/users [post]
-// @Failure 400 {string} string "Missing required fields"
-// @Failure 500 {string} string "Internal server error"
+// @Failure 400 {object} apierror.Problem "Missing required fields"
+// @Failure 409 {object} apierror.Problem "Email already registered"
+// @Failure 500 {object} apierror.Problem "Internal server error"
 func CreateUserHandler(writer http.ResponseWriter, request *http.Request) {
-	req, err := http.NewRequest(http.MethodPost, urlUsersService, request.Body)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-
-	writer.Header().Set("Content-Type", "application/json")
-	writer.WriteHeader(resp.StatusCode)
-	_, err = io.Copy(writer, resp.Body)
+	forward(writer, request)
 }
 
 // @Summary Update user by ID
@@ -116,56 +99,24 @@ func CreateUserHandler(writer http.ResponseWriter, request *http.Request) {
 // @Param id path int true "User ID"
 // @Param user body InputUser true "User object"
 // @Success 200 {string} string "User updated"
+// @Security BearerAuth
 // @Router /api/users/{id} [put]
-// @Failure 400 {string} string "Missing required fields"
-// @Failure 404 {string} string "User not found"
-// @Failure 500 {string} string "Internal server error"
+// @Failure 400 {object} apierror.Problem "Missing required fields"
+// @Failure 404 {object} apierror.Problem "User not found"
+// @Failure 500 {object} apierror.Problem "Internal server error"
 func UpdateUserHandler(writer http.ResponseWriter, request *http.Request) {
-	vars := mux.Vars(request)
-	id := vars["id"]
-	req, err := http.NewRequest(http.MethodPut, urlUsersService+"/"+id, request.Body)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-
-	writer.Header().Set("Content-Type", "application/json")
-	writer.WriteHeader(resp.StatusCode)
-	_, err = io.Copy(writer, resp.Body)
+	forward(writer, request)
 }
 
 // @Summary Delete user by ID
 // @Tags users
 // @Param id path int true "User ID"
 // @Success 204 {string} string "User deleted"
+// @Security BearerAuth
 // @Router /api/users/{id} [delete]
-// @Failure 500 {string} string "Internal server error"
+// @Failure 500 {object} apierror.Problem "Internal server error"
 func DeleteUserHandler(writer http.ResponseWriter, request *http.Request) {
-	vars := mux.Vars(request)
-	id := vars["id"]
-	req, err := http.NewRequest(http.MethodDelete, urlUsersService+"/"+id, nil)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-
-	writer.Header().Set("Content-Type", "application/json")
-	writer.WriteHeader(resp.StatusCode)
-	_, err = io.Copy(writer, resp.Body)
+	forward(writer, request)
 }
 
 // @Summary Search user
@@ -175,22 +126,89 @@ func DeleteUserHandler(writer http.ResponseWriter, request *http.Request) {
 // @Param email query string false "User email"
 // @Param role query string false "User role"
 // @Success 200 {array} models.User
+// @Security BearerAuth
 // @Router /api/users/search [get]
-// @Failure 400 {string} string "Missing required fields"
-// @Failure 500 {string} string "Internal server error"
+// @Failure 400 {object} apierror.Problem "Missing required fields"
+// @Failure 500 {object} apierror.Problem "Internal server error"
 func SearchUserHandler(writer http.ResponseWriter, request *http.Request) {
-	queryParams := request.URL.Query()
-	resp, err := http.Get(urlUsersService + "/search?" + queryParams.Encode())
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-
-	writer.Header().Set("Content-Type", "application/json")
-	writer.WriteHeader(resp.StatusCode)
-	_, err = io.Copy(writer, resp.Body)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-	}
+	forward(writer, request)
+}
+
+// @Summary Log in
+// @Description Exchanges an email and password for a bearer access token.
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param credentials body InputLogin true "Login credentials"
+// @Success 200 {object} TokenOutput
+// @Router /api/users/login [post]
+// @Failure 400 {object} apierror.Problem "Missing required fields"
+// @Failure 401 {object} apierror.Problem "Invalid email or password"
+// @Failure 429 {object} apierror.Problem "Too many attempts or account locked"
+// @Failure 500 {object} apierror.Problem "Internal server error"
+func LoginHandler(writer http.ResponseWriter, request *http.Request) {
+	forward(writer, request)
+}
+
+// @Summary Register
+// @Description Signs up a customer account; the role is always customer.
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param user body InputRegister true "New account"
+// @Success 201 {string} string "User registered"
+// @Router /api/users/register [post]
+// @Failure 400 {object} apierror.Problem "Missing required fields or weak password"
+// @Failure 409 {object} apierror.Problem "Email already registered"
+// @Failure 500 {object} apierror.Problem "Internal server error"
+func RegisterHandler(writer http.ResponseWriter, request *http.Request) {
+	forward(writer, request)
+}
+
+// @Summary Change password
+// @Description Changes the caller's own password.
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param id path int true "User ID"
+// @Param passwords body InputChangePassword true "Current and new password"
+// @Success 200 {string} string "Password changed"
+// @Security BearerAuth
+// @Router /api/users/{id}/password [put]
+// @Failure 400 {object} apierror.Problem "Weak password"
+// @Failure 403 {object} apierror.Problem "Wrong current password"
+// @Failure 404 {object} apierror.Problem "User not found"
+// @Failure 429 {object} apierror.Problem "Account locked"
+// @Failure 500 {object} apierror.Problem "Internal server error"
+func ChangePasswordHandler(writer http.ResponseWriter, request *http.Request) {
+	forward(writer, request)
+}
+
+// @Summary Request a password reset
+// @Description Sends a one-time reset token to the account, if the email is registered.
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param email body InputForgotPassword true "Account email"
+// @Success 202 {string} string "Reset requested"
+// @Router /api/users/password/forgot [post]
+// @Failure 429 {object} apierror.Problem "Too many attempts"
+// @Failure 500 {object} apierror.Problem "Internal server error"
+// @Failure 503 {object} apierror.Problem "Password reset is not configured"
+func ForgotPasswordHandler(writer http.ResponseWriter, request *http.Request) {
+	forward(writer, request)
+}
+
+// @Summary Reset password
+// @Description Sets a new password using a one-time reset token.
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param reset body InputResetPassword true "Reset token and new password"
+// @Success 200 {string} string "Password reset"
+// @Router /api/users/password/reset [post]
+// @Failure 400 {object} apierror.Problem "Invalid or expired token, or weak password"
+// @Failure 500 {object} apierror.Problem "Internal server error"
+func ResetPasswordHandler(writer http.ResponseWriter, request *http.Request) {
+	forward(writer, request)
 }
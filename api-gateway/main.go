@@ -1,7 +1,10 @@
 package main
 
 import (
+	"OnlineStore/api-gateway/ratelimit"
 	"OnlineStore/api-gateway/routes"
+	"OnlineStore/apierror"
+	"OnlineStore/auth"
 	_ "OnlineStore/docs"
 	"context"
 	"github.com/gorilla/mux"
@@ -19,18 +22,33 @@ import (
 // @description This is online store service API
 // @host onlinestore-bq6f.onrender.com
 // @BasePath /
+// @securityDefinitions.apikey BearerAuth
+// @in header
+// @name Authorization
+// @description "Bearer " followed by the access_token from POST /api/users/login
 func main() {
 	if err := godotenv.Load(); err != nil {
 		log.Println("Error loading .env file")
 	}
 
+	tokens, err := auth.TokensFromEnv()
+	if err != nil {
+		log.Fatalf("Error configuring tokens: %v", err)
+	}
+
+	limiter, err := ratelimit.FromEnv()
+	if err != nil {
+		log.Fatalf("Error configuring rate limits: %v", err)
+	}
+
 	router := mux.NewRouter()
-	routes.Routes(router)
+	apierror.Routes(router)
+	routes.Routes(router, tokens, limiter)
 
 	port := "10000"
 	server := &http.Server{
 		Addr:    ":" + port,
-		Handler: router,
+		Handler: apierror.RequestID(router),
 	}
 
 	go gracefulShutdown(server)
@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"OnlineStore/apierror"
+	"OnlineStore/auth"
+	"net/http"
+	"strings"
+)
+
+// Authenticate verifies the bearer token, if the request has one, and puts
+// its claims in the request context. Identity headers sent by the client are
+// always dropped, so the only identity passed on to the services is one the
+// gateway verified. Requests without a token continue anonymously; routes
+// that need a caller are wrapped in RequireRole.
+func Authenticate(tokens *auth.Tokens) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			request.Header.Del(auth.UserIDHeader)
+			request.Header.Del(auth.UserRoleHeader)
+
+			header := request.Header.Get("Authorization")
+			if header == "" {
+				next.ServeHTTP(writer, request)
+				return
+			}
+			token, ok := strings.CutPrefix(header, "Bearer ")
+			if !ok {
+				unauthorized(writer, request, apierror.New(apierror.Unauthorized, "Authorization must be a Bearer token"))
+				return
+			}
+			claims, err := tokens.Verify(token)
+			if err != nil {
+				unauthorized(writer, request, err)
+				return
+			}
+			next.ServeHTTP(writer, request.WithContext(auth.WithClaims(request.Context(), claims)))
+		})
+	}
+}
+
+// RequireRole lets a request through only if it was authenticated with one of
+// roles: 401 without a token, 403 with a token for another role.
+func RequireRole(roles ...string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(writer http.ResponseWriter, request *http.Request) {
+			claims, ok := auth.FromContext(request.Context())
+			if !ok {
+				unauthorized(writer, request, apierror.New(apierror.Unauthorized, "authentication required"))
+				return
+			}
+			for _, role := range roles {
+				if claims.Role == role {
+					next(writer, request)
+					return
+				}
+			}
+			apierror.Write(writer, request, apierror.New(apierror.Forbidden, "your role may not use this endpoint"))
+		}
+	}
+}
+
+func unauthorized(writer http.ResponseWriter, request *http.Request, err error) {
+	writer.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+	apierror.Write(writer, request, err)
+}
@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"OnlineStore/auth"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthenticateAndRequireRole(t *testing.T) {
+	tokens := auth.NewTokens("secret", time.Hour)
+	var forwardedID string
+	handler := Authenticate(tokens)(RequireRole(auth.RoleAdmin)(func(w http.ResponseWriter, r *http.Request) {
+		forwardedID = r.Header.Get(auth.UserIDHeader)
+		w.WriteHeader(http.StatusOK)
+	}))
+	send := func(token string, spoofedID string) int {
+		req := httptest.NewRequest(http.MethodDelete, "/api/users/1", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		if spoofedID != "" {
+			req.Header.Set(auth.UserIDHeader, spoofedID)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	adminToken, _, _ := tokens.Issue(1, auth.RoleAdmin)
+	customerToken, _, _ := tokens.Issue(2, auth.RoleCustomer)
+
+	assert.Equal(t, http.StatusUnauthorized, send("", "1"))
+	assert.Equal(t, http.StatusUnauthorized, send("not-a-token", ""))
+	assert.Equal(t, http.StatusForbidden, send(customerToken, "1"))
+	assert.Equal(t, http.StatusOK, send(adminToken, "99"))
+	assert.Empty(t, forwardedID, "client identity headers must be dropped")
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	StateClosed   = "closed"
+	StateOpen     = "open"
+	StateHalfOpen = "half_open"
+)
+
+// probeWait is how long requests are told to wait while a half-open
+// breaker's trial request is still in flight.
+const probeWait = time.Second
+
+// breaker is the circuit breaker of one upstream. It opens after a run of
+// consecutive failures and then fails requests fast for the cooldown. After
+// that one trial request is let through: its success closes the breaker, its
+// failure opens it again.
+type breaker struct {
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newBreaker() *breaker {
+	return &breaker{state: StateClosed}
+}
+
+// allow reports whether a request may be sent now and, if not, how long to
+// wait before trying again.
+func (b *breaker) allow(now time.Time, cooldown time.Duration) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == StateOpen {
+		if wait := b.openedAt.Add(cooldown).Sub(now); wait > 0 {
+			return false, wait
+		}
+		b.state = StateHalfOpen
+		b.probing = false
+	}
+	if b.state == StateHalfOpen {
+		if b.probing {
+			return false, probeWait
+		}
+		b.probing = true
+	}
+	return true, 0
+}
+
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state = StateClosed
+	b.failures = 0
+	b.probing = false
+}
+
+func (b *breaker) failure(now time.Time, threshold int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.state == StateHalfOpen || b.failures >= threshold {
+		b.state = StateOpen
+		b.openedAt = now
+	}
+	b.probing = false
+}
+
+// abandon forgets a request that ended without telling anything about the
+// upstream, such as one the client cancelled.
+func (b *breaker) abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// BreakerStatus is the state of one upstream's circuit breaker.
+type BreakerStatus struct {
+	Upstream string `json:"upstream"`
+	State    string `json:"state"`
+	// Failures counts consecutive failed requests.
+	Failures int        `json:"failures"`
+	OpenedAt *time.Time `json:"opened_at,omitempty"`
+	// RetryAfter is how many seconds an open breaker keeps failing fast.
+	RetryAfter int `json:"retry_after,omitempty"`
+}
+
+func (b *breaker) status(upstream string, now time.Time, cooldown time.Duration) BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	status := BreakerStatus{Upstream: upstream, State: b.state, Failures: b.failures}
+	if b.state != StateClosed {
+		openedAt := b.openedAt
+		status.OpenedAt = &openedAt
+	}
+	if b.state == StateOpen {
+		status.RetryAfter = retryAfterSeconds(b.openedAt.Add(cooldown).Sub(now))
+	}
+	return status
+}
+
+// retryAfterSeconds rounds wait up to whole seconds, as Retry-After needs.
+func retryAfterSeconds(wait time.Duration) int {
+	if wait <= 0 {
+		return 0
+	}
+	return int((wait + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"OnlineStore/apierror"
+	"OnlineStore/auth"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Route sends requests whose path is Prefix, or starts with Prefix and a
+// slash, to Upstream: Prefix is replaced by Upstream's path and the rest of
+// the request, query included, is passed on unchanged. Routes with the same
+// Name lead to the same service and share its circuit breaker. A request
+// that takes longer than Timeout, retries included, is abandoned.
+type Route struct {
+	Prefix   string
+	Name     string
+	Upstream *url.URL
+	Timeout  time.Duration
+}
+
+// DefaultTimeout is the timeout of routes that do not set one.
+const DefaultTimeout = 10 * time.Second
+
+// services maps each API resource to the service that owns it: the
+// service's name, which prefixes the environment variables holding its
+// address and timeout, the path the resource is served under there, and the
+// default timeout. Payments wait on the payment gateway, and orders on
+// payments during checkout, so they get longer.
+var services = []struct {
+	prefix, name, path string
+	timeout            time.Duration
+}{
+	{"/api/users", "user", "/users", DefaultTimeout},
+	{"/api/products", "product", "/products", DefaultTimeout},
+	{"/api/orders", "order", "/orders", DefaultTimeout},
+	{"/api/cart", "order", "/cart", 45 * time.Second},
+	{"/api/checkout", "order", "/checkout", 45 * time.Second},
+	{"/api/payments", "payment", "/payments", 40 * time.Second},
+}
+
+// RoutesFromEnv returns the API's routes. Each service's address is read
+// from <NAME>_SERVICE_URL, such as ORDER_SERVICE_URL, and its timeout in
+// seconds from <NAME>_SERVICE_TIMEOUT, overriding the defaults above.
+func RoutesFromEnv() ([]Route, error) {
+	routes := make([]Route, 0, len(services))
+	for _, service := range services {
+		env := strings.ToUpper(service.name) + "_SERVICE"
+		upstream, err := url.Parse(os.Getenv(env+"_URL") + service.path)
+		if err != nil {
+			return nil, err
+		}
+		timeout := service.timeout
+		if value := os.Getenv(env + "_TIMEOUT"); value != "" {
+			seconds, err := strconv.Atoi(value)
+			if err != nil || seconds <= 0 {
+				return nil, fmt.Errorf("%s_TIMEOUT must be a positive number of seconds", env)
+			}
+			timeout = time.Duration(seconds) * time.Second
+		}
+		routes = append(routes, Route{Prefix: service.prefix, Name: service.name, Upstream: upstream, Timeout: timeout})
+	}
+	return routes, nil
+}
+
+// Options are how the proxy copes with failing upstreams.
+type Options struct {
+	// Retries is how many more times an idempotent request is sent after
+	// the upstream failed it.
+	Retries     int
+	BackoffBase time.Duration
+	BackoffMax  time.Duration
+	// BreakerFailures consecutive failures open an upstream's breaker for
+	// BreakerCooldown.
+	BreakerFailures int
+	BreakerCooldown time.Duration
+}
+
+var DefaultOptions = Options{
+	Retries:         2,
+	BackoffBase:     100 * time.Millisecond,
+	BackoffMax:      time.Second,
+	BreakerFailures: 5,
+	BreakerCooldown: 30 * time.Second,
+}
+
+// NewTransport returns the connection pool shared by all routes.
+func NewTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = 100
+	transport.MaxIdleConnsPerHost = 20
+	transport.IdleConnTimeout = 90 * time.Second
+	return transport
+}
+
+// Proxy forwards requests to the upstream of the route with the longest
+// matching prefix. Method, headers, body, query and the upstream's status
+// and headers pass through unchanged, except that the caller verified by
+// the auth middleware is sent in the trusted identity headers and the
+// client's address in X-Forwarded-For.
+type Proxy struct {
+	routes   []Route
+	proxies  []*httputil.ReverseProxy
+	names    []string
+	breakers map[string]*breaker
+	options  Options
+}
+
+func New(routes []Route, transport http.RoundTripper, options Options) *Proxy {
+	routes = append([]Route(nil), routes...)
+	sort.SliceStable(routes, func(i, j int) bool { return len(routes[i].Prefix) > len(routes[j].Prefix) })
+
+	p := &Proxy{routes: routes, breakers: map[string]*breaker{}, options: options}
+	for i, route := range routes {
+		if route.Name == "" {
+			routes[i].Name = route.Upstream.Host
+		}
+		if route.Timeout == 0 {
+			routes[i].Timeout = DefaultTimeout
+		}
+		route := routes[i]
+		if p.breakers[route.Name] == nil {
+			p.breakers[route.Name] = newBreaker()
+			p.names = append(p.names, route.Name)
+		}
+		p.proxies = append(p.proxies, &httputil.ReverseProxy{
+			Rewrite: func(r *httputil.ProxyRequest) { rewrite(r, route) },
+			Transport: &upstreamTransport{
+				name:    route.Name,
+				next:    transport,
+				breaker: p.breakers[route.Name],
+				options: options,
+			},
+			ErrorHandler: upstreamError(route.Name),
+		})
+	}
+	sort.Strings(p.names)
+	return p
+}
+
+// FromEnv builds the proxy for RoutesFromEnv over a NewTransport pool, with
+// the DefaultOptions.
+func FromEnv() (*Proxy, error) {
+	routes, err := RoutesFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return New(routes, NewTransport(), DefaultOptions), nil
+}
+
+func (p *Proxy) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	for i, route := range p.routes {
+		if route.matches(request.URL.Path) {
+			ctx, cancel := context.WithTimeout(request.Context(), route.Timeout)
+			defer cancel()
+			ctx = context.WithValue(ctx, clientPathKey{}, request.URL.Path)
+			p.proxies[i].ServeHTTP(writer, request.WithContext(ctx))
+			return
+		}
+	}
+	apierror.Write(writer, request, apierror.New(apierror.NotFound, "no service serves "+request.URL.Path))
+}
+
+// clientPathKey keeps the path the client asked for, as the request the
+// proxy's error handler gets has the upstream's path.
+type clientPathKey struct{}
+
+// Breakers returns the state of every upstream's circuit breaker, by name.
+func (p *Proxy) Breakers() []BreakerStatus {
+	now := time.Now()
+	statuses := make([]BreakerStatus, 0, len(p.names))
+	for _, name := range p.names {
+		statuses = append(statuses, p.breakers[name].status(name, now, p.options.BreakerCooldown))
+	}
+	return statuses
+}
+
+// ServeBreakers answers with Breakers as JSON.
+func (p *Proxy) ServeBreakers(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(p.Breakers())
+}
+
+func (route Route) matches(path string) bool {
+	rest, ok := strings.CutPrefix(path, route.Prefix)
+	return ok && (rest == "" || strings.HasPrefix(rest, "/"))
+}
+
+func rewrite(r *httputil.ProxyRequest, route Route) {
+	rest := strings.TrimPrefix(r.In.URL.Path, route.Prefix)
+	r.Out.URL.Scheme = route.Upstream.Scheme
+	r.Out.URL.Host = route.Upstream.Host
+	r.Out.URL.Path = route.Upstream.Path + rest
+	r.Out.URL.RawPath = ""
+	r.Out.Host = route.Upstream.Host
+	r.SetXForwarded()
+
+	r.Out.Header.Del(auth.UserIDHeader)
+	r.Out.Header.Del(auth.UserRoleHeader)
+	if claims, ok := auth.FromContext(r.In.Context()); ok {
+		r.Out.Header.Set(auth.UserIDHeader, strconv.Itoa(claims.UserID))
+		r.Out.Header.Set(auth.UserRoleHeader, claims.Role)
+	}
+}
+
+// upstreamError answers 503 while the upstream's breaker is open, 504 when
+// it did not answer in time, and 502 when it could not be reached, with a
+// problem naming the upstream.
+func upstreamError(upstream string) func(http.ResponseWriter, *http.Request, error) {
+	return func(writer http.ResponseWriter, request *http.Request, err error) {
+		failure := apierror.New(apierror.BadGateway, upstream+" service could not be reached")
+		retryAfter := 0
+		var open *errCircuitOpen
+		switch {
+		case errors.As(err, &open):
+			failure = apierror.New(apierror.Unavailable, upstream+" service is failing; requests to it are paused")
+			retryAfter = retryAfterSeconds(open.retryAfter)
+			writer.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		case errors.Is(err, context.Canceled):
+			// The client has gone; nobody reads the answer.
+			return
+		case isTimeout(err):
+			failure = apierror.New(apierror.Timeout, upstream+" service did not answer in time")
+		}
+		if failure.Kind != apierror.Unavailable {
+			log.Printf("Proxy %s %s [%s]: %v", request.Method, request.URL.Path, apierror.RequestIDFrom(request), err)
+		}
+		problem := apierror.NewProblem(request, failure)
+		if path, ok := request.Context().Value(clientPathKey{}).(string); ok {
+			problem.Instance = path
+		}
+		problem.Upstream = upstream
+		problem.RetryAfter = retryAfter
+		apierror.WriteProblem(writer, problem)
+	}
+}
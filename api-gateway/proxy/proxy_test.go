@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"OnlineStore/auth"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// upstream is a service that records the last request it received.
+type upstream struct {
+	*httptest.Server
+	request *http.Request
+	body    string
+}
+
+func newUpstream(t *testing.T, handler http.HandlerFunc) *upstream {
+	u := &upstream{}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		u.request, u.body = r, string(body)
+		handler(w, r)
+	}))
+	t.Cleanup(u.Close)
+	return u
+}
+
+// testOptions retry without waiting, so the tests stay fast.
+var testOptions = Options{Retries: 2, BreakerFailures: 5, BreakerCooldown: time.Minute}
+
+func route(t *testing.T, prefix, upstreamURL string) Route {
+	target, err := url.Parse(upstreamURL)
+	require.NoError(t, err)
+	return Route{Prefix: prefix, Upstream: target}
+}
+
+func TestProxyPassesRequestAndResponseThrough(t *testing.T) {
+	orders := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("brewed"))
+	})
+	proxy := New([]Route{route(t, "/api/orders", orders.URL+"/orders")}, NewTransport(), testOptions)
+
+	req := httptest.NewRequest(http.MethodPut, "/api/orders/7/items?limit=5&sort=id", strings.NewReader(`{"quantity":2}`))
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	req.Header.Set("Idempotency-Key", "abc")
+	req.Header.Set("Accept-Language", "kk")
+	rr := httptest.NewRecorder()
+	proxy.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusTeapot, rr.Code)
+	assert.Equal(t, "brewed", rr.Body.String())
+	assert.Equal(t, "text/plain", rr.Header().Get("Content-Type"))
+	assert.Equal(t, "true", rr.Header().Get("Idempotent-Replayed"))
+
+	require.NotNil(t, orders.request)
+	assert.Equal(t, http.MethodPut, orders.request.Method)
+	assert.Equal(t, "/orders/7/items", orders.request.URL.Path)
+	assert.Equal(t, "limit=5&sort=id", orders.request.URL.RawQuery)
+	assert.Equal(t, `{"quantity":2}`, orders.body)
+	assert.Equal(t, "application/merge-patch+json", orders.request.Header.Get("Content-Type"))
+	assert.Equal(t, "abc", orders.request.Header.Get("Idempotency-Key"))
+	assert.Equal(t, "kk", orders.request.Header.Get("Accept-Language"))
+	assert.Equal(t, "192.0.2.1", orders.request.Header.Get("X-Forwarded-For"))
+}
+
+func TestProxySendsVerifiedIdentityOnly(t *testing.T) {
+	users := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {})
+	proxy := New([]Route{route(t, "/api/users", users.URL+"/users")}, NewTransport(), testOptions)
+
+	send := func(req *http.Request) {
+		req.Header.Set(auth.UserIDHeader, "1")
+		req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
+		req.Header.Set("X-Forwarded-For", "10.0.0.1")
+		proxy.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	send(httptest.NewRequest(http.MethodGet, "/api/users", nil))
+	assert.Empty(t, users.request.Header.Get(auth.UserIDHeader))
+	assert.Empty(t, users.request.Header.Get(auth.UserRoleHeader))
+	assert.Equal(t, "192.0.2.1", users.request.Header.Get("X-Forwarded-For"))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/users/5", nil)
+	send(req.WithContext(auth.WithClaims(req.Context(), &auth.Claims{UserID: 5, Role: auth.RoleCustomer})))
+	assert.Equal(t, "5", users.request.Header.Get(auth.UserIDHeader))
+	assert.Equal(t, auth.RoleCustomer, users.request.Header.Get(auth.UserRoleHeader))
+}
+
+func TestProxyPicksLongestPrefix(t *testing.T) {
+	orders := newUpstream(t, func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("orders")) })
+	carts := newUpstream(t, func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("carts")) })
+	proxy := New([]Route{
+		route(t, "/api", orders.URL),
+		route(t, "/api/cart", carts.URL+"/cart"),
+	}, NewTransport(), testOptions)
+
+	get := func(path string) (int, string) {
+		rr := httptest.NewRecorder()
+		proxy.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		return rr.Code, rr.Body.String()
+	}
+
+	_, body := get("/api/cart/items")
+	assert.Equal(t, "carts", body)
+	assert.Equal(t, "/cart/items", carts.request.URL.Path)
+	_, body = get("/api/cartography")
+	assert.Equal(t, "orders", body)
+	assert.Equal(t, "/cartography", orders.request.URL.Path)
+	code, _ := get("/health")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestProxyReportsUnreachableUpstream(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	payments := route(t, "/api/payments", down.URL+"/payments")
+	payments.Name = "payment"
+	proxy := New([]Route{payments}, NewTransport(), testOptions)
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/api/payments", nil)
+	req.Header.Set("X-Request-ID", "req-1")
+	proxy.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadGateway, rr.Code)
+	assert.Equal(t, "application/problem+json", rr.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"type":"urn:onlinestore:problem:bad-gateway","title":"Bad gateway","status":502,
+		"detail":"payment service could not be reached","instance":"/api/payments","request_id":"req-1","upstream":"payment"}`, rr.Body.String())
+}
+
+func TestRoutesFromEnv(t *testing.T) {
+	t.Setenv("ORDER_SERVICE_URL", "http://order-service:10003")
+	routes, err := RoutesFromEnv()
+	require.NoError(t, err)
+
+	upstreams := map[string]string{}
+	for _, route := range routes {
+		upstreams[route.Prefix] = route.Upstream.String()
+	}
+	assert.Equal(t, "http://order-service:10003/cart", upstreams["/api/cart"])
+	assert.Equal(t, "http://order-service:10003/checkout", upstreams["/api/checkout"])
+
+	t.Setenv("USER_SERVICE_TIMEOUT", "3")
+	routes, err = RoutesFromEnv()
+	require.NoError(t, err)
+	for _, route := range routes {
+		if route.Name == "user" {
+			assert.Equal(t, 3*time.Second, route.Timeout)
+		}
+	}
+	t.Setenv("USER_SERVICE_TIMEOUT", "soon")
+	_, err = RoutesFromEnv()
+	assert.Error(t, err)
+}
@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"OnlineStore/idempotency"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+)
+
+// maxRetryBody is the largest request body kept in memory so the request can
+// be sent again. Larger requests are sent once.
+const maxRetryBody = 1 << 20
+
+// errCircuitOpen is returned instead of sending a request while the
+// upstream's breaker is open.
+type errCircuitOpen struct {
+	upstream   string
+	retryAfter time.Duration
+}
+
+func (e *errCircuitOpen) Error() string {
+	return fmt.Sprintf("%s is unavailable; retry in %s", e.upstream, e.retryAfter)
+}
+
+// upstreamTransport sends requests to one upstream through its circuit
+// breaker, retrying those that are safe to repeat.
+type upstreamTransport struct {
+	name    string
+	next    http.RoundTripper
+	breaker *breaker
+	options Options
+}
+
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	retryable := t.options.Retries > 0 && isIdempotent(req)
+	var body []byte
+	if retryable && req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(req.Body, maxRetryBody+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(body) > maxRetryBody {
+			req.Body = readCloser{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+			retryable = false
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		allowed, wait := t.breaker.allow(time.Now(), t.options.BreakerCooldown)
+		if !allowed {
+			return nil, &errCircuitOpen{upstream: t.name, retryAfter: wait}
+		}
+
+		out := req
+		if retryable {
+			out = req.Clone(req.Context())
+			if body != nil {
+				out.Body = io.NopCloser(bytes.NewReader(body))
+			}
+		}
+		resp, err := t.next.RoundTrip(out)
+
+		switch {
+		case err == nil && !upstreamFailed(resp.StatusCode):
+			t.breaker.success()
+			return resp, nil
+		case errors.Is(err, context.Canceled):
+			t.breaker.abandon()
+			return nil, err
+		}
+		t.breaker.failure(time.Now(), t.options.BreakerFailures)
+
+		if !retryable || attempt >= t.options.Retries || req.Context().Err() != nil {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, maxRetryBody))
+			resp.Body.Close()
+		}
+		if err := sleep(req.Context(), t.options.backoff(attempt)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// upstreamFailed reports whether status means the upstream, rather than the
+// request, is at fault.
+func upstreamFailed(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// isIdempotent reports whether sending req twice has the same effect as
+// sending it once: its method is idempotent, or the service deduplicates it
+// by its Idempotency-Key.
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return req.Header.Get(idempotency.Header) != ""
+}
+
+// backoff is how long to wait before retrying after the given attempt: a
+// random duration up to BackoffBase doubled for each attempt, capped at
+// BackoffMax, so clients retrying together spread out.
+func (o Options) backoff(attempt int) time.Duration {
+	ceiling := o.BackoffBase << attempt
+	if ceiling <= 0 || ceiling > o.BackoffMax {
+		ceiling = o.BackoffMax
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// isTimeout reports whether err is the upstream taking too long.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout()
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
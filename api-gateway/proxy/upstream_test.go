@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"OnlineStore/apierror"
+	"OnlineStore/idempotency"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyUpstream fails its first failures requests with 503 and answers the
+// rest, counting them all.
+func flakyUpstream(t *testing.T, failures int32) (*upstream, *atomic.Int32) {
+	var calls atomic.Int32
+	u := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	return u, &calls
+}
+
+func serve(proxy *Proxy, method, path, body string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	rr := httptest.NewRecorder()
+	proxy.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestProxyRetriesIdempotentRequests(t *testing.T) {
+	orders, calls := flakyUpstream(t, 2)
+	proxy := New([]Route{route(t, "/api/orders", orders.URL+"/orders")}, NewTransport(), testOptions)
+
+	rr := serve(proxy, http.MethodGet, "/api/orders/1", "", nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, int32(3), calls.Load())
+
+	// A POST may have had an effect, so it is sent once.
+	calls.Store(0)
+	rr = serve(proxy, http.MethodPost, "/api/orders", `{"items":[]}`, nil)
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, int32(1), calls.Load())
+
+	// Unless the service deduplicates it; the body is sent again each time.
+	calls.Store(0)
+	rr = serve(proxy, http.MethodPost, "/api/orders", `{"items":[]}`, http.Header{idempotency.Header: {"k1"}})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, int32(3), calls.Load())
+	assert.Equal(t, `{"items":[]}`, orders.body)
+}
+
+func TestProxyGivesUpAfterRetries(t *testing.T) {
+	orders, calls := flakyUpstream(t, 10)
+	proxy := New([]Route{route(t, "/api/orders", orders.URL+"/orders")}, NewTransport(), testOptions)
+
+	rr := serve(proxy, http.MethodGet, "/api/orders", "", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, int32(1+testOptions.Retries), calls.Load())
+}
+
+func TestProxyTimesOutHungUpstream(t *testing.T) {
+	release := make(chan struct{})
+	hung := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})
+	defer close(release)
+	orders := route(t, "/api/orders", hung.URL+"/orders")
+	orders.Name = "order"
+	orders.Timeout = 50 * time.Millisecond
+	proxy := New([]Route{orders}, NewTransport(), testOptions)
+
+	start := time.Now()
+	rr := serve(proxy, http.MethodGet, "/api/orders", "", nil)
+	assert.Equal(t, http.StatusGatewayTimeout, rr.Code)
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	var body apierror.Problem
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body))
+	assert.Equal(t, apierror.Problem{
+		Type:     "urn:onlinestore:problem:timeout",
+		Title:    "Gateway timeout",
+		Status:   http.StatusGatewayTimeout,
+		Detail:   "order service did not answer in time",
+		Instance: "/api/orders",
+		Upstream: "order",
+	}, body)
+}
+
+func TestBreakerOpensAndRecovers(t *testing.T) {
+	orders, calls := flakyUpstream(t, 3)
+	carts := route(t, "/api/cart", orders.URL+"/cart")
+	carts.Name = "order"
+	ordersRoute := route(t, "/api/orders", orders.URL+"/orders")
+	ordersRoute.Name = "order"
+	options := Options{BreakerFailures: 3, BreakerCooldown: time.Minute}
+	proxy := New([]Route{ordersRoute, carts}, NewTransport(), options)
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusServiceUnavailable, serve(proxy, http.MethodGet, "/api/orders", "", nil).Code)
+	}
+
+	// Open: every route to the service fails fast without calling it.
+	rr := serve(proxy, http.MethodGet, "/api/cart", "", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, int32(3), calls.Load())
+	assert.Equal(t, "60", rr.Header().Get("Retry-After"))
+	var body apierror.Problem
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body))
+	assert.Equal(t, "urn:onlinestore:problem:unavailable", body.Type)
+	assert.Equal(t, "order", body.Upstream)
+	assert.Equal(t, 60, body.RetryAfter)
+
+	statuses := proxy.Breakers()
+	require.Len(t, statuses, 1)
+	assert.Equal(t, StateOpen, statuses[0].State)
+	assert.Equal(t, 3, statuses[0].Failures)
+	assert.NotNil(t, statuses[0].OpenedAt)
+
+	// After the cooldown one trial request goes through and closes it.
+	proxy.breakers["order"].openedAt = time.Now().Add(-time.Minute)
+	assert.Equal(t, http.StatusOK, serve(proxy, http.MethodGet, "/api/orders", "", nil).Code)
+	assert.Equal(t, StateClosed, proxy.Breakers()[0].State)
+}
+
+func TestBreakerHalfOpenAllowsOneProbe(t *testing.T) {
+	b := newBreaker()
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		b.failure(now, 2)
+	}
+	allowed, wait := b.allow(now, time.Minute)
+	assert.False(t, allowed)
+	assert.Equal(t, time.Minute, wait)
+
+	later := now.Add(time.Minute)
+	allowed, _ = b.allow(later, time.Minute)
+	assert.True(t, allowed)
+	allowed, wait = b.allow(later, time.Minute)
+	assert.False(t, allowed, "only one trial request at a time")
+	assert.Equal(t, probeWait, wait)
+
+	// A failed trial opens the breaker again for a whole cooldown.
+	b.failure(later, 2)
+	allowed, _ = b.allow(later.Add(time.Second), time.Minute)
+	assert.False(t, allowed)
+}
+
+func TestServeBreakers(t *testing.T) {
+	proxy := New([]Route{
+		route(t, "/api/users", "http://user-service/users"),
+		route(t, "/api/orders", "http://order-service/orders"),
+	}, NewTransport(), testOptions)
+
+	rr := httptest.NewRecorder()
+	proxy.ServeBreakers(rr, httptest.NewRequest(http.MethodGet, "/api/admin/upstreams", nil))
+	assert.JSONEq(t, `[
+		{"upstream": "order-service", "state": "closed", "failures": 0},
+		{"upstream": "user-service", "state": "closed", "failures": 0}
+	]`, rr.Body.String())
+}
@@ -0,0 +1,191 @@
+package ratelimit
+
+import (
+	"OnlineStore/apierror"
+	"OnlineStore/auth"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// APIKeyHeader carries a client's API key.
+const APIKeyHeader = "X-API-Key"
+
+// Rule limits each client's requests to one route. Method "*" matches any
+// method, and a "*" segment in Path matches any one segment, as in
+// "/api/orders/*/pay". Path "*" matches every path.
+type Rule struct {
+	Method string
+	Path   string
+	Limit  Limit
+}
+
+func (r Rule) String() string {
+	return r.Method + " " + r.Path
+}
+
+func (r Rule) matches(method, path string) bool {
+	if r.Method != "*" && r.Method != method {
+		return false
+	}
+	if r.Path == "*" {
+		return true
+	}
+	want := strings.Split(r.Path, "/")
+	got := strings.Split(path, "/")
+	if len(want) != len(got) {
+		return false
+	}
+	for i := range want {
+		if want[i] != "*" && want[i] != got[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// DefaultRules guard the routes that create orders, charge cards or search,
+// and give every other route a generous limit.
+var DefaultRules = []Rule{
+	{"POST", "/api/orders", Limit{10, time.Minute}},
+	{"POST", "/api/cart/checkout", Limit{10, time.Minute}},
+	{"POST", "/api/checkout", Limit{10, time.Minute}},
+	{"POST", "/api/payments", Limit{10, time.Minute}},
+	{"GET", "/api/products", Limit{120, time.Minute}},
+	{"GET", "/api/products/search", Limit{60, time.Minute}},
+	{"GET", "/api/products/suggest", Limit{120, time.Minute}},
+	{"GET", "/api/orders/search", Limit{60, time.Minute}},
+	{"GET", "/api/payments/search", Limit{60, time.Minute}},
+	{"GET", "/api/users/search", Limit{60, time.Minute}},
+	{"*", "*", Limit{600, time.Minute}},
+}
+
+// ParseRules reads rules written as "METHOD /path=REQUESTS/PERIOD" and
+// separated by commas, such as "POST /api/orders=5/1m,GET *=100/10s".
+func ParseRules(value string) ([]Rule, error) {
+	var rules []Rule
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		route, limit, ok := strings.Cut(entry, "=")
+		method, path, ok2 := strings.Cut(strings.TrimSpace(route), " ")
+		requests, period, ok3 := strings.Cut(limit, "/")
+		if !ok || !ok2 || !ok3 {
+			return nil, fmt.Errorf("rate limit %q must look like \"POST /api/orders=10/1m\"", entry)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(requests))
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("rate limit %q must allow a positive number of requests", entry)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(period))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("rate limit %q must have a positive period, such as 1m", entry)
+		}
+		rules = append(rules, Rule{Method: strings.ToUpper(method), Path: strings.TrimSpace(path), Limit: Limit{n, d}})
+	}
+	return rules, nil
+}
+
+// Limiter applies the first rule that matches a request to the client that
+// sent it. Each client has its own bucket per rule.
+type Limiter struct {
+	Rules []Rule
+	Store Store
+	// APIKeys are the API keys clients are told apart by. Other keys are
+	// ignored, so clients cannot escape their limit by making keys up.
+	APIKeys map[string]bool
+}
+
+// FromEnv builds an in-memory Limiter. RATE_LIMITS adds rules, in the
+// format of ParseRules, that take precedence over DefaultRules, and
+// RATE_LIMIT_API_KEYS lists the accepted API keys, separated by commas.
+func FromEnv() (*Limiter, error) {
+	rules, err := ParseRules(os.Getenv("RATE_LIMITS"))
+	if err != nil {
+		return nil, err
+	}
+	apiKeys := map[string]bool{}
+	for _, key := range strings.Split(os.Getenv("RATE_LIMIT_API_KEYS"), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			apiKeys[key] = true
+		}
+	}
+	return &Limiter{Rules: append(rules, DefaultRules...), Store: NewMemoryStore(), APIKeys: apiKeys}, nil
+}
+
+// Client identifies who sent request: a known API key, else the user the
+// token was issued to, else the client's address.
+func (l *Limiter) Client(request *http.Request) string {
+	if key := request.Header.Get(APIKeyHeader); key != "" && l.APIKeys[key] {
+		return "key:" + key
+	}
+	if claims, ok := auth.FromContext(request.Context()); ok {
+		return "user:" + strconv.Itoa(claims.UserID)
+	}
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		host = request.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// Middleware answers 429 Too Many Requests once a client has used up its
+// limit for a route, and reports the limit in RateLimit-* headers. It must
+// run after authentication, so users are told apart. If the store fails,
+// requests are let through rather than refused.
+func (l *Limiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		rule, ok := l.rule(request)
+		if !ok {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		result, err := l.Store.Take(request.Context(), rule.String()+"|"+l.Client(request), rule.Limit)
+		if err != nil {
+			log.Printf("Rate limit store: %v", err)
+			next.ServeHTTP(writer, request)
+			return
+		}
+
+		header := writer.Header()
+		header.Set("RateLimit-Limit", strconv.Itoa(rule.Limit.Requests))
+		header.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		header.Set("RateLimit-Reset", strconv.Itoa(seconds(result.Reset)))
+		header.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", rule.Limit.Requests, seconds(rule.Limit.Period)))
+		if result.Allowed {
+			next.ServeHTTP(writer, request)
+			return
+		}
+
+		retryAfter := seconds(result.RetryAfter)
+		header.Set("Retry-After", strconv.Itoa(retryAfter))
+		problem := apierror.NewProblem(request, apierror.New(apierror.RateLimited,
+			fmt.Sprintf("at most %d requests per %s to %s", rule.Limit.Requests, rule.Limit.Period, rule)))
+		problem.RetryAfter = retryAfter
+		apierror.WriteProblem(writer, problem)
+	})
+}
+
+func (l *Limiter) rule(request *http.Request) (Rule, bool) {
+	for _, rule := range l.Rules {
+		if rule.matches(request.Method, request.URL.Path) {
+			return rule, true
+		}
+	}
+	return Rule{}, false
+}
+
+// seconds rounds d up to whole seconds, as the headers need.
+func seconds(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	return int((d + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,141 @@
+package ratelimit
+
+import (
+	"OnlineStore/apierror"
+	"OnlineStore/auth"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStoreRefillsBucket(t *testing.T) {
+	now := time.Unix(0, 0)
+	store := NewMemoryStore()
+	store.now = func() time.Time { return now }
+	limit := Limit{Requests: 2, Period: time.Minute}
+
+	result, _ := store.Take(context.Background(), "a", limit)
+	assert.Equal(t, Result{Allowed: true, Remaining: 1, Reset: 30 * time.Second}, result)
+	result, _ = store.Take(context.Background(), "a", limit)
+	assert.Equal(t, Result{Allowed: true, Remaining: 0, Reset: time.Minute}, result)
+	result, _ = store.Take(context.Background(), "a", limit)
+	assert.False(t, result.Allowed)
+	assert.Equal(t, 30*time.Second, result.RetryAfter)
+
+	// Buckets are separate per key, and refill one token per 30 seconds.
+	result, _ = store.Take(context.Background(), "b", limit)
+	assert.True(t, result.Allowed)
+	now = now.Add(30 * time.Second)
+	result, _ = store.Take(context.Background(), "a", limit)
+	assert.True(t, result.Allowed)
+	result, _ = store.Take(context.Background(), "a", limit)
+	assert.False(t, result.Allowed)
+}
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules(" post /api/orders=5/1m, GET /api/orders/*/history=100/10s ")
+	require.NoError(t, err)
+	assert.Equal(t, []Rule{
+		{Method: "POST", Path: "/api/orders", Limit: Limit{5, time.Minute}},
+		{Method: "GET", Path: "/api/orders/*/history", Limit: Limit{100, 10 * time.Second}},
+	}, rules)
+	assert.True(t, rules[1].matches(http.MethodGet, "/api/orders/42/history"))
+	assert.False(t, rules[1].matches(http.MethodGet, "/api/orders/42"))
+
+	for _, bad := range []string{"POST /api/orders", "/api/orders=5/1m", "POST /api/orders=0/1m", "POST /api/orders=5/soon"} {
+		_, err := ParseRules(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func newTestLimiter(store Store) *Limiter {
+	return &Limiter{
+		Rules: []Rule{
+			{Method: "POST", Path: "/api/orders", Limit: Limit{2, time.Minute}},
+			{Method: "*", Path: "*", Limit: Limit{100, time.Minute}},
+		},
+		Store:   store,
+		APIKeys: map[string]bool{"partner": true},
+	}
+}
+
+func send(handler http.Handler, method, path string, prepare func(*http.Request) *http.Request) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if prepare != nil {
+		req = prepare(req)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestMiddlewareLimitsEachClientPerRoute(t *testing.T) {
+	handler := newTestLimiter(NewMemoryStore()).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rr := send(handler, http.MethodPost, "/api/orders", nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "2", rr.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "1", rr.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "30", rr.Header().Get("RateLimit-Reset"))
+	assert.Equal(t, "2;w=60", rr.Header().Get("RateLimit-Policy"))
+
+	send(handler, http.MethodPost, "/api/orders", nil)
+	rr = send(handler, http.MethodPost, "/api/orders", nil)
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "0", rr.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "30", rr.Header().Get("Retry-After"))
+	assert.Equal(t, apierror.ContentType, rr.Header().Get("Content-Type"))
+	var body apierror.Problem
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body))
+	assert.Equal(t, apierror.TypePrefix+string(apierror.RateLimited), body.Type)
+	assert.Equal(t, http.StatusTooManyRequests, body.Status)
+	assert.Equal(t, 30, body.RetryAfter)
+
+	// Other routes have their own buckets.
+	assert.Equal(t, http.StatusOK, send(handler, http.MethodGet, "/api/orders", nil).Code)
+
+	// A signed-in user is limited apart from their address.
+	asUser := func(r *http.Request) *http.Request {
+		return r.WithContext(auth.WithClaims(r.Context(), &auth.Claims{UserID: 7, Role: auth.RoleCustomer}))
+	}
+	assert.Equal(t, http.StatusOK, send(handler, http.MethodPost, "/api/orders", asUser).Code)
+
+	// Made-up API keys change nothing; known ones get their own bucket.
+	withKey := func(key string) func(*http.Request) *http.Request {
+		return func(r *http.Request) *http.Request {
+			r.Header.Set(APIKeyHeader, key)
+			return r
+		}
+	}
+	assert.Equal(t, http.StatusTooManyRequests, send(handler, http.MethodPost, "/api/orders", withKey("made-up")).Code)
+	assert.Equal(t, http.StatusOK, send(handler, http.MethodPost, "/api/orders", withKey("partner")).Code)
+}
+
+type failingStore struct{}
+
+func (failingStore) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	return Result{}, errors.New("store unavailable")
+}
+
+func TestMiddlewareLetsRequestsThroughWhenStoreFails(t *testing.T) {
+	handler := newTestLimiter(failingStore{}).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, send(handler, http.MethodPost, "/api/orders", nil).Code)
+	}
+}
+
+func TestDefaultRulesCoverEveryRoute(t *testing.T) {
+	limiter := &Limiter{Rules: DefaultRules}
+	rule, ok := limiter.rule(httptest.NewRequest(http.MethodDelete, "/api/users/1", nil))
+	require.True(t, ok)
+	assert.Equal(t, "* *", rule.String())
+	rule, _ = limiter.rule(httptest.NewRequest(http.MethodPost, "/api/orders", nil))
+	assert.Equal(t, 10, rule.Limit.Requests)
+}
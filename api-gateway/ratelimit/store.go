@@ -0,0 +1,103 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Limit is a token bucket: it holds up to Requests tokens and is refilled at
+// Requests per Period, so a client may burst Requests at once and then keep
+// up Requests per Period.
+type Limit struct {
+	Requests int
+	Period   time.Duration
+}
+
+// Result is the outcome of taking a token.
+type Result struct {
+	Allowed bool
+	// Remaining is how many tokens are left in the bucket.
+	Remaining int
+	// RetryAfter is how long until the next token, when none was left.
+	RetryAfter time.Duration
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+}
+
+// Store holds the token buckets. MemoryStore keeps them in the gateway's
+// memory; a shared store, such as Redis, lets several gateways enforce the
+// same limits.
+type Store interface {
+	// Take takes a token from the bucket under key, refilled as limit says,
+	// if there is one.
+	Take(ctx context.Context, key string, limit Limit) (Result, error)
+}
+
+// MemoryStore is a Store for a single gateway.
+type MemoryStore struct {
+	now func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastEvict time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	// full is when the bucket will be full again, after which it can be
+	// forgotten.
+	full time.Time
+}
+
+// evictInterval is how often buckets that have refilled are dropped, so
+// clients that stop sending do not accumulate.
+const evictInterval = time.Minute
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{now: time.Now, buckets: make(map[string]*bucket)}
+}
+
+func (s *MemoryStore) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.evict(now)
+	capacity := float64(limit.Requests)
+	perToken := limit.Period / time.Duration(limit.Requests)
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, updated: now}
+		s.buckets[key] = b
+	}
+	b.tokens = math.Min(capacity, b.tokens+float64(now.Sub(b.updated))/float64(perToken))
+	b.updated = now
+
+	result := Result{}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = time.Duration((1 - b.tokens) * float64(perToken))
+	}
+	result.Remaining = int(b.tokens)
+	result.Reset = time.Duration((capacity - b.tokens) * float64(perToken))
+	b.full = now.Add(result.Reset)
+	return result, nil
+}
+
+func (s *MemoryStore) evict(now time.Time) {
+	if now.Sub(s.lastEvict) < evictInterval {
+		return
+	}
+	s.lastEvict = now
+	for key, b := range s.buckets {
+		if !now.Before(b.full) {
+			delete(s.buckets, key)
+		}
+	}
+}
@@ -2,13 +2,18 @@ package routes
 
 import (
 	"OnlineStore/api-gateway/handlers"
+	"OnlineStore/api-gateway/middleware"
+	"OnlineStore/api-gateway/ratelimit"
+	"OnlineStore/auth"
 	_ "OnlineStore/docs"
 	"github.com/gorilla/mux"
 	httpSwagger "github.com/swaggo/http-swagger"
 	"net/http"
 )
 
-func Routes(router *mux.Router) {
+// Routes registers the API. Routes not wrapped in admin or customer are
+// public. Every API request counts against the caller's rate limits.
+func Routes(router *mux.Router, tokens *auth.Tokens, limiter *ratelimit.Limiter) {
 	router.HandleFunc("/health-check", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
@@ -17,36 +22,69 @@ func Routes(router *mux.Router) {
 	router.PathPrefix("/swagger/").Handler(httpSwagger.WrapHandler)
 
 	router = router.PathPrefix("/api").Subrouter()
+	router.Use(middleware.Authenticate(tokens))
+	router.Use(limiter.Middleware)
+	admin := middleware.RequireRole(auth.RoleAdmin)
+	customer := middleware.RequireRole(auth.RoleAdmin, auth.RoleCustomer)
 
 	usersRouter := router.PathPrefix("/users").Subrouter()
-	usersRouter.HandleFunc("", handlers.GetUsersHandler).Methods(http.MethodGet)
-	usersRouter.HandleFunc("/{id:[0-9]+}", handlers.GetUserByIDHandler).Methods(http.MethodGet)
-	usersRouter.HandleFunc("", handlers.CreateUserHandler).Methods(http.MethodPost)
-	usersRouter.HandleFunc("/{id:[0-9]+}", handlers.UpdateUserHandler).Methods(http.MethodPut)
-	usersRouter.HandleFunc("/{id:[0-9]+}", handlers.DeleteUserHandler).Methods(http.MethodDelete)
-	usersRouter.HandleFunc("/search", handlers.SearchUserHandler).Methods(http.MethodGet)
+	usersRouter.HandleFunc("", admin(handlers.GetUsersHandler)).Methods(http.MethodGet)
+	usersRouter.HandleFunc("/{id:[0-9]+}", customer(handlers.GetUserByIDHandler)).Methods(http.MethodGet)
+	usersRouter.HandleFunc("", admin(handlers.CreateUserHandler)).Methods(http.MethodPost)
+	usersRouter.HandleFunc("/{id:[0-9]+}", customer(handlers.UpdateUserHandler)).Methods(http.MethodPut)
+	usersRouter.HandleFunc("/{id:[0-9]+}", admin(handlers.DeleteUserHandler)).Methods(http.MethodDelete)
+	usersRouter.HandleFunc("/search", admin(handlers.SearchUserHandler)).Methods(http.MethodGet)
+	usersRouter.HandleFunc("/login", handlers.LoginHandler).Methods(http.MethodPost)
+	usersRouter.HandleFunc("/register", handlers.RegisterHandler).Methods(http.MethodPost)
+	usersRouter.HandleFunc("/{id:[0-9]+}/password", customer(handlers.ChangePasswordHandler)).Methods(http.MethodPut)
+	usersRouter.HandleFunc("/password/forgot", handlers.ForgotPasswordHandler).Methods(http.MethodPost)
+	usersRouter.HandleFunc("/password/reset", handlers.ResetPasswordHandler).Methods(http.MethodPost)
 
 	productsRouter := router.PathPrefix("/products").Subrouter()
 	productsRouter.HandleFunc("", handlers.GetProductsHandler).Methods(http.MethodGet)
 	productsRouter.HandleFunc("/{id:[0-9]+}", handlers.GetProductByIDHandler).Methods(http.MethodGet)
-	productsRouter.HandleFunc("", handlers.CreateProductHandler).Methods(http.MethodPost)
-	productsRouter.HandleFunc("/{id:[0-9]+}", handlers.UpdateProductHandler).Methods(http.MethodPut)
-	productsRouter.HandleFunc("/{id:[0-9]+}", handlers.DeleteProductHandler).Methods(http.MethodDelete)
+	productsRouter.HandleFunc("", admin(handlers.CreateProductHandler)).Methods(http.MethodPost)
+	productsRouter.HandleFunc("/{id:[0-9]+}", admin(handlers.UpdateProductHandler)).Methods(http.MethodPut)
+	productsRouter.HandleFunc("/{id:[0-9]+}", admin(handlers.DeleteProductHandler)).Methods(http.MethodDelete)
 	productsRouter.HandleFunc("/search", handlers.SearchProductHandler).Methods(http.MethodGet)
+	productsRouter.HandleFunc("/suggest", handlers.SuggestProductsHandler).Methods(http.MethodGet)
 
 	ordersRouter := router.PathPrefix("/orders").Subrouter()
-	ordersRouter.HandleFunc("", handlers.GetOrdersHandler).Methods(http.MethodGet)
-	ordersRouter.HandleFunc("/{id:[0-9]+}", handlers.GetOrderByIDHandler).Methods(http.MethodGet)
-	ordersRouter.HandleFunc("", handlers.CreateOrderHandler).Methods(http.MethodPost)
-	ordersRouter.HandleFunc("/{id:[0-9]+}", handlers.UpdateOrderHandler).Methods(http.MethodPut)
-	ordersRouter.HandleFunc("/{id:[0-9]+}", handlers.DeleteOrderHandler).Methods(http.MethodDelete)
-	ordersRouter.HandleFunc("/search", handlers.SearchOrderHandler).Methods(http.MethodGet)
+	ordersRouter.HandleFunc("", customer(handlers.GetOrdersHandler)).Methods(http.MethodGet)
+	ordersRouter.HandleFunc("/{id:[0-9]+}", customer(handlers.GetOrderByIDHandler)).Methods(http.MethodGet)
+	ordersRouter.HandleFunc("", customer(handlers.CreateOrderHandler)).Methods(http.MethodPost)
+	ordersRouter.HandleFunc("/{id:[0-9]+}", customer(handlers.UpdateOrderHandler)).Methods(http.MethodPut)
+	ordersRouter.HandleFunc("/{id:[0-9]+}", admin(handlers.DeleteOrderHandler)).Methods(http.MethodDelete)
+	ordersRouter.HandleFunc("/search", customer(handlers.SearchOrderHandler)).Methods(http.MethodGet)
+	ordersRouter.HandleFunc("/{id:[0-9]+}/history", customer(handlers.GetOrderStatusHistoryHandler)).Methods(http.MethodGet)
+	ordersRouter.HandleFunc("/{id:[0-9]+}/details", customer(handlers.GetOrderDetailsHandler)).Methods(http.MethodGet)
+	ordersRouter.HandleFunc("/{id:[0-9]+}/{action:cancel}", customer(handlers.TransitionOrderHandler)).Methods(http.MethodPost)
+	// Orders are paid by the payment-service once the money is captured;
+	// customers pay through /api/payments.
+	ordersRouter.HandleFunc("/{id:[0-9]+}/{action:pay|ship|deliver|refund}", admin(handlers.TransitionOrderHandler)).Methods(http.MethodPost)
+
+	cartRouter := router.PathPrefix("/cart").Subrouter()
+	cartRouter.HandleFunc("", customer(handlers.GetCartHandler)).Methods(http.MethodGet)
+	cartRouter.HandleFunc("/items", customer(handlers.AddCartItemHandler)).Methods(http.MethodPost)
+	cartRouter.HandleFunc("/items/{product_id:[0-9]+}", customer(handlers.UpdateCartItemHandler)).Methods(http.MethodPut)
+	cartRouter.HandleFunc("/items/{product_id:[0-9]+}", customer(handlers.RemoveCartItemHandler)).Methods(http.MethodDelete)
+	cartRouter.HandleFunc("/checkout", customer(handlers.CheckoutCartHandler)).Methods(http.MethodPost)
+
+	checkoutRouter := router.PathPrefix("/checkout").Subrouter()
+	checkoutRouter.HandleFunc("", customer(handlers.CheckoutHandler)).Methods(http.MethodPost)
+	checkoutRouter.HandleFunc("/{id:[0-9]+}", customer(handlers.GetCheckoutHandler)).Methods(http.MethodGet)
 
 	paymentRouter := router.PathPrefix("/payments").Subrouter()
-	paymentRouter.HandleFunc("", handlers.GetPaymentsHandler).Methods(http.MethodGet)
-	paymentRouter.HandleFunc("/{id:[0-9]+}", handlers.GetPaymentByIDHandler).Methods(http.MethodGet)
-	paymentRouter.HandleFunc("", handlers.CreatePaymentHandler).Methods(http.MethodPost)
-	paymentRouter.HandleFunc("/{id:[0-9]+}", handlers.UpdatePaymentHandler).Methods(http.MethodPut)
-	paymentRouter.HandleFunc("/{id:[0-9]+}", handlers.DeletePaymentHandler).Methods(http.MethodDelete)
-	paymentRouter.HandleFunc("/search", handlers.SearchPaymentHandler).Methods(http.MethodGet)
+	paymentRouter.HandleFunc("", customer(handlers.GetPaymentsHandler)).Methods(http.MethodGet)
+	paymentRouter.HandleFunc("/{id:[0-9]+}", customer(handlers.GetPaymentByIDHandler)).Methods(http.MethodGet)
+	paymentRouter.HandleFunc("", customer(handlers.CreatePaymentHandler)).Methods(http.MethodPost)
+	paymentRouter.HandleFunc("/{id:[0-9]+}", admin(handlers.UpdatePaymentHandler)).Methods(http.MethodPut)
+	paymentRouter.HandleFunc("/{id:[0-9]+}", admin(handlers.DeletePaymentHandler)).Methods(http.MethodDelete)
+	paymentRouter.HandleFunc("/search", customer(handlers.SearchPaymentHandler)).Methods(http.MethodGet)
+	paymentRouter.HandleFunc("/{id:[0-9]+}/refunds", customer(handlers.GetPaymentRefundsHandler)).Methods(http.MethodGet)
+	paymentRouter.HandleFunc("/{id:[0-9]+}/refunds", admin(handlers.CreatePaymentRefundHandler)).Methods(http.MethodPost)
+	paymentRouter.HandleFunc("/webhooks/epay", handlers.EpayWebhookHandler).Methods(http.MethodPost)
+	paymentRouter.HandleFunc("/webhooks/epay/{kind:failure}", handlers.EpayWebhookHandler).Methods(http.MethodPost)
+
+	router.HandleFunc("/admin/upstreams", admin(handlers.GetUpstreamsHandler)).Methods(http.MethodGet)
 }
@@ -0,0 +1,36 @@
+package routes
+
+import (
+	"OnlineStore/api-gateway/ratelimit"
+	"OnlineStore/auth"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func post(t *testing.T, router http.Handler, tokens *auth.Tokens, role, path string) int {
+	token, _, err := tokens.Issue(3, role)
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, path, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr.Code
+}
+
+func TestOrderTransitionsByRole(t *testing.T) {
+	tokens := auth.NewTokens("test-secret", time.Hour)
+	router := mux.NewRouter()
+	Routes(router, tokens, &ratelimit.Limiter{Store: ratelimit.NewMemoryStore()})
+
+	for _, action := range []string{"pay", "ship", "deliver", "refund"} {
+		assert.Equal(t, http.StatusForbidden, post(t, router, tokens, auth.RoleCustomer, "/api/orders/7/"+action), action)
+	}
+	assert.NotEqual(t, http.StatusForbidden, post(t, router, tokens, auth.RoleCustomer, "/api/orders/7/cancel"))
+	assert.NotEqual(t, http.StatusForbidden, post(t, router, tokens, auth.RoleAdmin, "/api/orders/7/pay"))
+}
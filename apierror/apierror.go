@@ -0,0 +1,192 @@
+// Package apierror is how the services and the gateway report failures. Code
+// returns an *Error of the Kind that fits, and Write turns any error into an
+// RFC 7807 problem+json answer with the matching status. Errors of no kind
+// are internal: they are logged, and the client only learns that the request
+// failed, so SQL and driver messages never leak.
+package apierror
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// ContentType is the media type of problem answers.
+const ContentType = "application/problem+json"
+
+// TypePrefix starts the type URI of every problem; the Kind follows it.
+const TypePrefix = "urn:onlinestore:problem:"
+
+// Kind is a class of failure. It decides the status and the type of the
+// problem the client gets.
+type Kind string
+
+const (
+	Internal          Kind = "internal"
+	Validation        Kind = "validation"
+	Unauthorized      Kind = "unauthorized"
+	Forbidden         Kind = "forbidden"
+	NotFound          Kind = "not-found"
+	MethodNotAllowed  Kind = "method-not-allowed"
+	Conflict          Kind = "conflict"
+	Gone              Kind = "gone"
+	InsufficientStock Kind = "insufficient-stock"
+	AmountMismatch    Kind = "amount-mismatch"
+	RateLimited       Kind = "rate-limited"
+	BadGateway        Kind = "bad-gateway"
+	Unavailable       Kind = "unavailable"
+	Timeout           Kind = "timeout"
+)
+
+var kinds = map[Kind]struct {
+	status int
+	title  string
+}{
+	Internal:          {http.StatusInternalServerError, "Internal error"},
+	Validation:        {http.StatusBadRequest, "Invalid request"},
+	Unauthorized:      {http.StatusUnauthorized, "Unauthorized"},
+	Forbidden:         {http.StatusForbidden, "Forbidden"},
+	NotFound:          {http.StatusNotFound, "Not found"},
+	MethodNotAllowed:  {http.StatusMethodNotAllowed, "Method not allowed"},
+	Conflict:          {http.StatusConflict, "Conflict"},
+	Gone:              {http.StatusGone, "Gone"},
+	InsufficientStock: {http.StatusConflict, "Insufficient stock"},
+	AmountMismatch:    {http.StatusConflict, "Amount mismatch"},
+	RateLimited:       {http.StatusTooManyRequests, "Too many requests"},
+	BadGateway:        {http.StatusBadGateway, "Bad gateway"},
+	Unavailable:       {http.StatusServiceUnavailable, "Service unavailable"},
+	Timeout:           {http.StatusGatewayTimeout, "Gateway timeout"},
+}
+
+// Status is the HTTP status of kind.
+func (k Kind) Status() int {
+	if kind, ok := kinds[k]; ok {
+		return kind.status
+	}
+	return http.StatusInternalServerError
+}
+
+// Error is a failure the client may be told about. Message is shown to the
+// client as the problem's detail, followed by Err, if set, so Err must not
+// hold anything internal.
+type Error struct {
+	Kind    Kind
+	Message string
+	Err     error
+}
+
+func New(kind Kind, message string) *Error {
+	return &Error{Kind: kind, Message: message}
+}
+
+// Wrap is an Error of kind caused by err, such as a malformed body.
+func Wrap(kind Kind, message string, err error) *Error {
+	return &Error{Kind: kind, Message: message, Err: err}
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Message
+	}
+	return e.Message + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// KindOf is the kind of the first Error in err's chain. A missing row is
+// NotFound, and anything else Internal.
+func KindOf(err error) Kind {
+	var e *Error
+	switch {
+	case errors.As(err, &e):
+		return e.Kind
+	case errors.Is(err, sql.ErrNoRows):
+		return NotFound
+	default:
+		return Internal
+	}
+}
+
+// Problem is an RFC 7807 problem details object. RetryAfter and Upstream
+// are extensions the gateway sets when a service is failing.
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	// RetryAfter is how many seconds to wait before trying again, when
+	// known.
+	RetryAfter int    `json:"retry_after,omitempty"`
+	Upstream   string `json:"upstream,omitempty"`
+}
+
+// NewProblem is the problem describing err as the answer to request.
+// Internal errors are logged with the request ID and described only
+// generically.
+func NewProblem(request *http.Request, err error) Problem {
+	kind := KindOf(err)
+	problem := Problem{
+		Type:      TypePrefix + string(kind),
+		Title:     kinds[kind].title,
+		Status:    kind.Status(),
+		Detail:    err.Error(),
+		Instance:  request.URL.Path,
+		RequestID: RequestIDFrom(request),
+	}
+	switch {
+	case kind == Internal:
+		log.Printf("%s %s [%s]: %v", request.Method, request.URL.Path, problem.RequestID, err)
+		problem.Detail = "the request could not be completed"
+	case errors.Is(err, sql.ErrNoRows):
+		problem.Detail = "not found"
+	}
+	return problem
+}
+
+// ParseProblem reads the body of a failed answer from another service. An
+// answer that is not a problem, such as one from a proxy in between, is
+// described by its status and body.
+func ParseProblem(status int, body []byte) Problem {
+	var problem Problem
+	if json.Unmarshal(body, &problem) == nil && problem.Type != "" {
+		if problem.Status == 0 {
+			problem.Status = status
+		}
+		return problem
+	}
+	return Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: strings.TrimSpace(string(body)),
+	}
+}
+
+// Write answers request with the problem describing err.
+func Write(writer http.ResponseWriter, request *http.Request, err error) {
+	WriteProblem(writer, NewProblem(request, err))
+}
+
+// Routes answers requests router has no route for with problems, instead
+// of the router's plain text.
+func Routes(router *mux.Router) {
+	router.NotFoundHandler = http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		Write(writer, request, New(NotFound, "no endpoint at "+request.URL.Path))
+	})
+	router.MethodNotAllowedHandler = http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		Write(writer, request, New(MethodNotAllowed, request.Method+" is not allowed on "+request.URL.Path))
+	})
+}
+
+func WriteProblem(writer http.ResponseWriter, problem Problem) {
+	writer.Header().Set("Content-Type", ContentType)
+	writer.Header().Del("Content-Length")
+	writer.WriteHeader(problem.Status)
+	json.NewEncoder(writer).Encode(problem)
+}
@@ -0,0 +1,129 @@
+package apierror
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errTaken = New(Conflict, "email is already taken")
+
+func TestKindOf(t *testing.T) {
+	assert.Equal(t, Conflict, KindOf(errTaken))
+	assert.Equal(t, Conflict, KindOf(fmt.Errorf("creating user: %w", errTaken)))
+	assert.Equal(t, NotFound, KindOf(sql.ErrNoRows))
+	assert.Equal(t, Internal, KindOf(errors.New("pq: connection refused")))
+
+	assert.Equal(t, http.StatusConflict, InsufficientStock.Status())
+	assert.Equal(t, http.StatusInternalServerError, Kind("unknown").Status())
+}
+
+func TestErrorMessage(t *testing.T) {
+	assert.Equal(t, "email is already taken", errTaken.Error())
+	cause := errors.New("unexpected EOF")
+	err := Wrap(Validation, "invalid body", cause)
+	assert.Equal(t, "invalid body: unexpected EOF", err.Error())
+	assert.True(t, errors.Is(err, cause))
+}
+
+func write(err error) (*httptest.ResponseRecorder, Problem) {
+	req := httptest.NewRequest(http.MethodPost, "/users", nil)
+	req.Header.Set(RequestIDHeader, "req-1")
+	rr := httptest.NewRecorder()
+	Write(rr, req, err)
+
+	var problem Problem
+	json.Unmarshal(rr.Body.Bytes(), &problem)
+	return rr, problem
+}
+
+func TestWrite(t *testing.T) {
+	rr, problem := write(fmt.Errorf("creating user: %w", errTaken))
+
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Equal(t, ContentType, rr.Header().Get("Content-Type"))
+	assert.Equal(t, Problem{
+		Type:      "urn:onlinestore:problem:conflict",
+		Title:     "Conflict",
+		Status:    http.StatusConflict,
+		Detail:    "creating user: email is already taken",
+		Instance:  "/users",
+		RequestID: "req-1",
+	}, problem)
+}
+
+func TestWriteHidesInternalErrors(t *testing.T) {
+	rr, problem := write(errors.New(`pq: relation "users" does not exist`))
+
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	assert.Equal(t, TypePrefix+string(Internal), problem.Type)
+	assert.Equal(t, "the request could not be completed", problem.Detail)
+	assert.NotContains(t, rr.Body.String(), "pq:")
+	assert.Equal(t, "req-1", problem.RequestID)
+}
+
+func TestWriteMissingRow(t *testing.T) {
+	rr, problem := write(sql.ErrNoRows)
+
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Equal(t, "not found", problem.Detail)
+	assert.NotEmpty(t, rr.Body.String())
+}
+
+func TestParseProblem(t *testing.T) {
+	body := `{"type":"urn:onlinestore:problem:insufficient-stock","title":"Insufficient stock","status":409,"detail":"only 2 left"}`
+	problem := ParseProblem(http.StatusConflict, []byte(body))
+	assert.Equal(t, TypePrefix+string(InsufficientStock), problem.Type)
+	assert.Equal(t, "only 2 left", problem.Detail)
+
+	problem = ParseProblem(http.StatusBadGateway, []byte("upstream connect error\n"))
+	assert.Equal(t, Problem{Type: "about:blank", Title: "Bad Gateway", Status: http.StatusBadGateway, Detail: "upstream connect error"}, problem)
+}
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	handler := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = RequestIDFrom(r)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(RequestIDHeader, "client-42")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, "client-42", seen)
+	assert.Equal(t, "client-42", rr.Header().Get(RequestIDHeader))
+
+	for _, bad := range []string{"", "two words", "line\nbreak", strings.Repeat("x", 129)} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(RequestIDHeader, bad)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Len(t, seen, 32, "%q", bad)
+		assert.Equal(t, seen, rr.Header().Get(RequestIDHeader))
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	router := mux.NewRouter()
+	Routes(router)
+	router.HandleFunc("/users", func(http.ResponseWriter, *http.Request) {}).Methods(http.MethodGet)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/nowhere", nil))
+	require.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Equal(t, ContentType, rr.Header().Get("Content-Type"))
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, "/users", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+	assert.Contains(t, rr.Body.String(), TypePrefix+string(MethodNotAllowed))
+}
@@ -0,0 +1,53 @@
+package apierror
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// RequestIDHeader carries the ID of a request. The gateway assigns it, and
+// the services it forwards to reuse it, so a problem can be traced through
+// every service's log.
+const RequestIDHeader = "X-Request-ID"
+
+const maxRequestIDLength = 128
+
+// RequestID makes sure every request has an ID, keeping a valid one the
+// client sent, and returns it in the response's X-Request-ID header.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		id := request.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+			request.Header.Set(RequestIDHeader, id)
+		}
+		writer.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// RequestIDFrom is the ID RequestID gave request.
+func RequestIDFrom(request *http.Request) string {
+	return request.Header.Get(RequestIDHeader)
+}
+
+// validRequestID accepts short IDs of printable ASCII, so a client cannot
+// write anything else into the logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,109 @@
+// Package auth issues and verifies the JWT access tokens users log in with,
+// and carries the authenticated caller between the gateway and the services.
+package auth
+
+import (
+	"OnlineStore/apierror"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	RoleAdmin    = "admin"
+	RoleCustomer = "customer"
+)
+
+// Headers the api-gateway uses to pass the authenticated caller to the
+// services. The gateway drops any the client sent, so services behind it can
+// trust them.
+const (
+	UserIDHeader   = "X-User-ID"
+	UserRoleHeader = "X-User-Role"
+)
+
+const defaultTokenTTL = time.Hour
+
+var ErrInvalidToken = apierror.New(apierror.Unauthorized, "invalid token")
+
+// Claims identifies the caller an access token was issued to.
+type Claims struct {
+	UserID int    `json:"uid"`
+	Role   string `json:"role"`
+	jwt.RegisteredClaims
+}
+
+// Tokens issues and verifies HS256 access tokens.
+type Tokens struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+func NewTokens(secret string, ttl time.Duration) *Tokens {
+	return &Tokens{secret: []byte(secret), ttl: ttl}
+}
+
+// TokensFromEnv reads the signing secret from JWT_SECRET and the token
+// lifetime from JWT_TTL in minutes.
+func TokensFromEnv() (*Tokens, error) {
+	secret := os.Getenv("JWT_SECRET")
+	if secret == "" {
+		return nil, fmt.Errorf("JWT_SECRET is not set")
+	}
+	ttl := defaultTokenTTL
+	if minutes, err := strconv.Atoi(os.Getenv("JWT_TTL")); err == nil && minutes > 0 {
+		ttl = time.Duration(minutes) * time.Minute
+	}
+	return NewTokens(secret, ttl), nil
+}
+
+// Issue returns a signed access token for the user and when it expires.
+func (t *Tokens) Issue(userID int, role string) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(t.ttl)
+	claims := Claims{
+		UserID: userID,
+		Role:   role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.Itoa(userID),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(t.secret)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token, expiresAt, nil
+}
+
+// Verify checks the token's signature and expiry and returns its claims.
+func (t *Tokens) Verify(token string) (*Claims, error) {
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) {
+		return t.secret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if claims.UserID == 0 || claims.Role == "" {
+		return nil, fmt.Errorf("%w: missing user", ErrInvalidToken)
+	}
+	return claims, nil
+}
+
+type contextKey struct{}
+
+func WithClaims(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, contextKey{}, claims)
+}
+
+// FromContext returns the authenticated caller, if there is one.
+func FromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(contextKey{}).(*Claims)
+	return claims, ok
+}
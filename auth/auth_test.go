@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokens(t *testing.T) {
+	tokens := NewTokens("secret", time.Hour)
+
+	token, expiresAt, err := tokens.Issue(7, RoleCustomer)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), expiresAt, time.Minute)
+
+	claims, err := tokens.Verify(token)
+	require.NoError(t, err)
+	assert.Equal(t, 7, claims.UserID)
+	assert.Equal(t, RoleCustomer, claims.Role)
+
+	// Test token signed with another secret
+	_, err = NewTokens("other", time.Hour).Verify(token)
+	assert.True(t, errors.Is(err, ErrInvalidToken))
+
+	// Test expired token
+	expired, _, err := NewTokens("secret", -time.Minute).Issue(7, RoleCustomer)
+	require.NoError(t, err)
+	_, err = tokens.Verify(expired)
+	assert.True(t, errors.Is(err, ErrInvalidToken))
+
+	// Test tampered token
+	_, err = tokens.Verify(token + "x")
+	assert.True(t, errors.Is(err, ErrInvalidToken))
+}
+
+func TestCallerOwns(t *testing.T) {
+	request := httptest.NewRequest("GET", "/orders/1", nil)
+	request.Header.Set(UserIDHeader, "7")
+	request.Header.Set(UserRoleHeader, RoleCustomer)
+	caller := CallerFromRequest(request)
+
+	assert.True(t, caller.Owns(7))
+	assert.False(t, caller.Owns(8))
+	assert.True(t, Caller{UserID: 1, Role: RoleAdmin}.Owns(8))
+	// Test an anonymous caller owns nothing, not even unowned resources
+	anonymous := CallerFromRequest(httptest.NewRequest("GET", "/orders/1", nil))
+	assert.False(t, anonymous.Owns(0))
+}
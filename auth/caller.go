@@ -0,0 +1,30 @@
+package auth
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// Caller is the user a service request is made on behalf of, as passed on by
+// the api-gateway. The zero Caller is anonymous and owns nothing.
+type Caller struct {
+	UserID int
+	Role   string
+}
+
+// CallerFromRequest reads the caller from the trusted identity headers.
+func CallerFromRequest(request *http.Request) Caller {
+	userID, _ := strconv.Atoi(request.Header.Get(UserIDHeader))
+	return Caller{UserID: userID, Role: request.Header.Get(UserRoleHeader)}
+}
+
+func (c Caller) IsAdmin() bool {
+	return c.Role == RoleAdmin
+}
+
+// Owns reports whether the caller may see and change a resource belonging to
+// userID. Admins own everything. Services answer 404 for resources the
+// caller does not own, so their existence does not leak.
+func (c Caller) Owns(userID int) bool {
+	return c.IsAdmin() || (c.UserID != 0 && c.UserID == userID)
+}
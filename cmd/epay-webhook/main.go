@@ -0,0 +1,75 @@
+// Command epay-webhook replays a recorded epay callback against a local
+// payment-service, signed with EPAY_WEBHOOK_SECRET, so the callback endpoints
+// can be exercised without the real provider.
+package main
+
+import (
+	"OnlineStore/payment-service/services"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/joho/godotenv"
+	"io"
+	"log"
+	"net/http"
+	"os"
+)
+
+const fixtures = "payment-service/controllers/testdata/"
+
+func main() {
+	if err := godotenv.Load(); err != nil {
+		log.Println("Error loading .env file")
+	}
+
+	target := flag.String("url", "http://localhost:10004/payments/webhooks/epay", "postLink endpoint of the payment-service")
+	invoiceID := flag.String("invoice", "", "invoice_id of the payment to settle (required)")
+	amount := flag.String("amount", "", "amount in major units, e.g. 150.00; defaults to the fixture's")
+	failure := flag.Bool("failure", false, "replay the failurePostLink callback instead")
+	fixture := flag.String("fixture", "", "callback JSON to replay instead of the bundled fixtures")
+	flag.Parse()
+
+	if *invoiceID == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	secret := os.Getenv("EPAY_WEBHOOK_SECRET")
+	if secret == "" {
+		log.Fatal("EPAY_WEBHOOK_SECRET must be set")
+	}
+
+	path, url := fixtures+"epay_postlink.json", *target
+	if *failure {
+		path, url = fixtures+"epay_failure_postlink.json", *target+"/failure"
+	}
+	if *fixture != "" {
+		path = *fixture
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Error reading fixture: %v", err)
+	}
+
+	var callback map[string]interface{}
+	if err := json.Unmarshal(data, &callback); err != nil {
+		log.Fatalf("Error decoding fixture: %v", err)
+	}
+	callback["invoiceId"] = *invoiceID
+	if *amount != "" {
+		callback["amount"] = json.Number(*amount)
+	}
+	callback["secret_hash"] = services.EpaySecretHash(secret, *invoiceID)
+	body, err := json.Marshal(callback)
+	if err != nil {
+		log.Fatalf("Error encoding callback: %v", err)
+	}
+
+	resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Fatalf("Error sending callback: %v", err)
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(resp.Body)
+	fmt.Printf("%s\n%s\n", resp.Status, respBody)
+}
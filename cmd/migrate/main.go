@@ -0,0 +1,134 @@
+package main
+
+import (
+	db "OnlineStore"
+	"errors"
+	"fmt"
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/joho/godotenv"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+)
+
+const usage = `usage: migrate <service> <command> [arg]
+
+Each service has its own database and migrations; service is one of user,
+product, order or payment.
+
+commands:
+  up [n]        apply all or n pending migrations
+  down [n]      roll back all or n applied migrations
+  goto <v>      migrate up or down to version v
+  force <v>     set version v without running migrations (clears dirty state)
+  status        print the current version and dirty flag`
+
+func main() {
+	if err := godotenv.Load(); err != nil {
+		log.Println("Error loading .env file")
+	}
+
+	if len(os.Args) < 3 || !slices.Contains(db.Services, os.Args[1]) {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	service, command := os.Args[1], os.Args[2]
+
+	database, err := db.InitializeDB(service)
+	if err != nil {
+		log.Fatalf("Error initializing database: %v", err)
+	}
+
+	m, err := db.NewMigrate(database, service)
+	if err != nil {
+		log.Fatalf("Error loading migrations: %v", err)
+	}
+	defer m.Close()
+
+	if err := run(m, command, os.Args[3:]); err != nil {
+		log.Fatalf("migrate %s %s: %v", service, command, err)
+	}
+}
+
+func run(m *migrate.Migrate, command string, args []string) error {
+	switch command {
+	case "up":
+		n, err := optionalSteps(args)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ignoreNoChange(m.Up())
+		}
+		return ignoreNoChange(m.Steps(n))
+	case "down":
+		n, err := optionalSteps(args)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ignoreNoChange(m.Down())
+		}
+		return ignoreNoChange(m.Steps(-n))
+	case "goto":
+		v, err := requiredVersion(args)
+		if err != nil {
+			return err
+		}
+		return ignoreNoChange(m.Migrate(v))
+	case "force":
+		v, err := requiredVersion(args)
+		if err != nil {
+			return err
+		}
+		return m.Force(int(v))
+	case "status":
+		return printStatus(m)
+	default:
+		return fmt.Errorf("unknown command %q\n%s", command, usage)
+	}
+}
+
+func printStatus(m *migrate.Migrate) error {
+	version, dirty, err := m.Version()
+	if errors.Is(err, migrate.ErrNilVersion) {
+		fmt.Println("version: none (no migrations applied)")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("version: %d\ndirty: %t\n", version, dirty)
+	return nil
+}
+
+func optionalSteps(args []string) (int, error) {
+	if len(args) == 0 {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid step count %q", args[0])
+	}
+	return n, nil
+}
+
+func requiredVersion(args []string) (uint, error) {
+	if len(args) == 0 {
+		return 0, fmt.Errorf("version is required")
+	}
+	v, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid version %q", args[0])
+	}
+	return uint(v), nil
+}
+
+func ignoreNoChange(err error) error {
+	if errors.Is(err, migrate.ErrNoChange) {
+		log.Println("no change")
+		return nil
+	}
+	return err
+}
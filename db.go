@@ -5,13 +5,28 @@ import (
 	"fmt"
 	"github.com/golang-migrate/migrate/v4"
 	"github.com/golang-migrate/migrate/v4/database/postgres"
+	_ "github.com/golang-migrate/migrate/v4/source/file"
 	"os"
+	"strings"
 )
 
-func InitializeDB() (*sql.DB, error) {
-	dbURL := os.Getenv("DATABASE_URL")
+// Services lists the services that own a database, by the name used in
+// their settings: the order-service reads ORDER_DATABASE_URL and keeps its
+// migrations in order-service/migrations.
+var Services = []string{"user", "product", "order", "payment"}
+
+// InitializeDB connects to the database service owns, given by
+// <SERVICE>_DATABASE_URL. Services without one share DATABASE_URL, which is
+// fine for running locally: no service reads another's tables, and the ones
+// several services create, like outbox_events, are defined identically.
+func InitializeDB(service string) (*sql.DB, error) {
+	envName := strings.ToUpper(service) + "_DATABASE_URL"
+	dbURL := os.Getenv(envName)
+	if dbURL == "" {
+		dbURL = os.Getenv("DATABASE_URL")
+	}
 	if dbURL == "" {
-		return nil, fmt.Errorf("DATABASE_URL is not set")
+		return nil, fmt.Errorf("neither %s nor DATABASE_URL is set", envName)
 	}
 
 	db, err := sql.Open("postgres", dbURL)
@@ -25,14 +40,31 @@ func InitializeDB() (*sql.DB, error) {
 	return db, nil
 }
 
-func MigrateUp(db *sql.DB) error {
-	driver, err := postgres.WithInstance(db, &postgres.Config{})
+// MigrationsEnabled reports whether a service should apply pending
+// migrations on startup (RUN_MIGRATIONS=true).
+func MigrationsEnabled() bool {
+	return os.Getenv("RUN_MIGRATIONS") == "true"
+}
+
+// NewMigrate builds a migrator for the service's migrations in db, read from
+// MIGRATIONS_URL or else ./<service>-service/migrations. Each service records
+// its version in its own <service>_schema_migrations table, so services
+// sharing a database do not interfere. Closing the returned migrator also
+// closes db.
+func NewMigrate(db *sql.DB, service string) (*migrate.Migrate, error) {
+	driver, err := postgres.WithInstance(db, &postgres.Config{MigrationsTable: service + "_schema_migrations"})
 	if err != nil {
-		return err
+		return nil, err
+	}
+	sourceURL := os.Getenv("MIGRATIONS_URL")
+	if sourceURL == "" {
+		sourceURL = "file://" + service + "-service/migrations"
 	}
-	m, err := migrate.NewWithDatabaseInstance(
-		"file://migrations",
-		"postgres", driver)
+	return migrate.NewWithDatabaseInstance(sourceURL, "postgres", driver)
+}
+
+func MigrateUp(db *sql.DB, service string) error {
+	m, err := NewMigrate(db, service)
 	if err != nil {
 		return err
 	}
@@ -15,171 +15,181 @@ const docTemplate = `{
     "host": "{{.Host}}",
     "basePath": "{{.BasePath}}",
     "paths": {
-        "/api/orders": {
+        "/api/admin/upstreams": {
             "get": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "The state of the circuit breaker of every service behind the gateway. An open breaker answers\nrequests to its service with 503 until retry_after seconds have passed.",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "orders"
+                    "admin"
                 ],
-                "summary": "Get all orders",
+                "summary": "Get upstream circuit breakers",
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
                             "type": "array",
                             "items": {
-                                "$ref": "#/definitions/models.Order"
+                                "$ref": "#/definitions/proxy.BreakerStatus"
                             }
                         }
-                    },
-                    "404": {
-                        "description": "No orders found",
-                        "schema": {
-                            "type": "string"
-                        }
-                    },
-                    "500": {
-                        "description": "Internal server error",
-                        "schema": {
-                            "type": "string"
-                        }
                     }
                 }
-            },
-            "post": {
-                "consumes": [
-                    "application/json"
+            }
+        },
+        "/api/cart": {
+            "get": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
                 ],
+                "description": "The caller's cart at current prices, with a warning on items short of stock.",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "orders"
-                ],
-                "summary": "Create a new order",
-                "parameters": [
-                    {
-                        "description": "Order object",
-                        "name": "order",
-                        "in": "body",
-                        "required": true,
-                        "schema": {
-                            "$ref": "#/definitions/handlers.InputOrder"
-                        }
-                    }
+                    "cart"
                 ],
+                "summary": "Get the cart",
                 "responses": {
-                    "201": {
-                        "description": "Order created",
-                        "schema": {
-                            "type": "string"
-                        }
-                    },
-                    "400": {
-                        "description": "Missing required fields",
+                    "200": {
+                        "description": "OK",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/models.Cart"
                         }
                     },
                     "500": {
                         "description": "Internal server error",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/apierror.Problem"
                         }
                     }
                 }
             }
         },
-        "/api/orders/search": {
-            "get": {
+        "/api/cart/checkout": {
+            "post": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Orders everything in the cart at current prices and empties it. If any product is short of\nstock nothing is ordered and the cart is kept.",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "orders"
+                    "cart"
                 ],
-                "summary": "Search orders",
+                "summary": "Check out the cart",
                 "parameters": [
-                    {
-                        "type": "integer",
-                        "description": "User ID",
-                        "name": "user_id",
-                        "in": "query"
-                    },
                     {
                         "type": "string",
-                        "description": "Order status",
-                        "name": "status",
-                        "in": "query"
+                        "description": "Replays the first response for retries with the same key",
+                        "name": "Idempotency-Key",
+                        "in": "header"
                     }
                 ],
                 "responses": {
-                    "200": {
-                        "description": "OK",
+                    "201": {
+                        "description": "Created",
                         "schema": {
-                            "type": "array",
-                            "items": {
-                                "$ref": "#/definitions/models.Order"
-                            }
+                            "$ref": "#/definitions/models.Order"
                         }
                     },
                     "400": {
-                        "description": "Missing required fields",
+                        "description": "Items priced in different currencies",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    },
+                    "409": {
+                        "description": "Cart is empty, not enough stock, or Idempotency-Key conflict",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    },
+                    "429": {
+                        "description": "Too many requests",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
                         }
                     },
                     "500": {
                         "description": "Internal server error",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/apierror.Problem"
                         }
                     }
                 }
             }
         },
-        "/api/orders/{id}": {
-            "get": {
+        "/api/cart/items": {
+            "post": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Adds quantity, default 1, to any of the product already in the cart.",
+                "consumes": [
+                    "application/json"
+                ],
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "orders"
+                    "cart"
                 ],
-                "summary": "Get order by ID",
+                "summary": "Add a product to the cart",
                 "parameters": [
                     {
-                        "type": "integer",
-                        "description": "Order ID",
-                        "name": "id",
-                        "in": "path",
-                        "required": true
+                        "description": "Product and quantity",
+                        "name": "item",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/handlers.InputCartItem"
+                        }
                     }
                 ],
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/models.Order"
+                            "$ref": "#/definitions/models.Cart"
                         }
                     },
-                    "404": {
-                        "description": "Order not found",
+                    "400": {
+                        "description": "Unknown product or invalid quantity",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/apierror.Problem"
                         }
                     },
                     "500": {
                         "description": "Internal server error",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/apierror.Problem"
                         }
                     }
                 }
-            },
+            }
+        },
+        "/api/cart/items/{product_id}": {
             "put": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "A quantity of 0 removes the product from the cart.",
                 "consumes": [
                     "application/json"
                 ],
@@ -187,118 +197,106 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "tags": [
-                    "orders"
+                    "cart"
                 ],
-                "summary": "Update order by ID",
+                "summary": "Change a cart item's quantity",
                 "parameters": [
                     {
                         "type": "integer",
-                        "description": "Order ID",
-                        "name": "id",
+                        "description": "Product ID",
+                        "name": "product_id",
                         "in": "path",
                         "required": true
                     },
                     {
-                        "description": "Order object",
-                        "name": "order",
+                        "description": "New quantity",
+                        "name": "item",
                         "in": "body",
                         "required": true,
                         "schema": {
-                            "$ref": "#/definitions/handlers.InputOrder"
+                            "$ref": "#/definitions/handlers.InputCartQuantity"
                         }
                     }
                 ],
                 "responses": {
                     "200": {
-                        "description": "Order updated",
+                        "description": "OK",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/models.Cart"
                         }
                     },
                     "400": {
-                        "description": "Missing required fields",
+                        "description": "Invalid quantity",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/apierror.Problem"
                         }
                     },
                     "404": {
-                        "description": "Order not found",
+                        "description": "Product not in the cart",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/apierror.Problem"
                         }
                     },
                     "500": {
                         "description": "Internal server error",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/apierror.Problem"
                         }
                     }
                 }
             },
             "delete": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "produces": [
+                    "application/json"
+                ],
                 "tags": [
-                    "orders"
+                    "cart"
                 ],
-                "summary": "Delete order by ID",
+                "summary": "Remove a product from the cart",
                 "parameters": [
                     {
                         "type": "integer",
-                        "description": "Order ID",
-                        "name": "id",
+                        "description": "Product ID",
+                        "name": "product_id",
                         "in": "path",
                         "required": true
                     }
                 ],
-                "responses": {
-                    "204": {
-                        "description": "Order deleted",
-                        "schema": {
-                            "type": "string"
-                        }
-                    },
-                    "500": {
-                        "description": "Internal server error",
-                        "schema": {
-                            "type": "string"
-                        }
-                    }
-                }
-            }
-        },
-        "/api/payments": {
-            "get": {
-                "produces": [
-                    "application/json"
-                ],
-                "tags": [
-                    "payments"
-                ],
-                "summary": "Get all payments",
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "type": "array",
-                            "items": {
-                                "$ref": "#/definitions/models.Payment"
-                            }
+                            "$ref": "#/definitions/models.Cart"
                         }
                     },
                     "404": {
-                        "description": "No payments found",
+                        "description": "Product not in the cart",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/apierror.Problem"
                         }
                     },
                     "500": {
                         "description": "Internal server error",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/apierror.Problem"
                         }
                     }
                 }
-            },
+            }
+        },
+        "/api/checkout": {
             "post": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Reserves the stock and creates the order, charges the card and marks the order paid. If the\npayment fails the order is cancelled and its stock returned. A checkout whose payment is still\nbeing decided answers 202; poll GET /api/checkout/{id} for the outcome.",
                 "consumes": [
                     "application/json"
                 ],
@@ -306,109 +304,90 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "tags": [
-                    "payments"
+                    "checkout"
                 ],
-                "summary": "Create a new payment",
+                "summary": "Place and pay for an order",
                 "parameters": [
                     {
-                        "description": "Payment object",
-                        "name": "payment",
+                        "description": "Items and card",
+                        "name": "checkout",
                         "in": "body",
                         "required": true,
                         "schema": {
-                            "$ref": "#/definitions/handlers.InputPayment"
+                            "$ref": "#/definitions/handlers.InputCheckout"
                         }
+                    },
+                    {
+                        "type": "string",
+                        "description": "Replays the first response for retries with the same key",
+                        "name": "Idempotency-Key",
+                        "in": "header"
                     }
                 ],
                 "responses": {
                     "201": {
-                        "description": "Payment created",
+                        "description": "Order placed and paid",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/models.Checkout"
                         }
                     },
-                    "400": {
-                        "description": "Missing required fields",
+                    "202": {
+                        "description": "Payment not decided yet",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/models.Checkout"
                         }
                     },
-                    "500": {
-                        "description": "Internal server error",
+                    "400": {
+                        "description": "Invalid items",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/apierror.Problem"
                         }
-                    }
-                }
-            }
-        },
-        "/api/payments/search": {
-            "get": {
-                "produces": [
-                    "application/json"
-                ],
-                "tags": [
-                    "payments"
-                ],
-                "summary": "Search payments",
-                "parameters": [
-                    {
-                        "type": "integer",
-                        "description": "Order ID",
-                        "name": "order_id",
-                        "in": "query"
                     },
-                    {
-                        "type": "integer",
-                        "description": "User ID",
-                        "name": "user_id",
-                        "in": "query"
+                    "402": {
+                        "description": "Payment failed; the order was cancelled",
+                        "schema": {
+                            "$ref": "#/definitions/models.Checkout"
+                        }
                     },
-                    {
-                        "type": "string",
-                        "description": "Payment status",
-                        "name": "status",
-                        "in": "query"
-                    }
-                ],
-                "responses": {
-                    "200": {
-                        "description": "OK",
+                    "409": {
+                        "description": "Not enough stock, or Idempotency-Key conflict",
                         "schema": {
-                            "type": "array",
-                            "items": {
-                                "$ref": "#/definitions/models.Payment"
-                            }
+                            "$ref": "#/definitions/apierror.Problem"
                         }
                     },
-                    "400": {
-                        "description": "Missing required fields",
+                    "429": {
+                        "description": "Too many requests",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/apierror.Problem"
                         }
                     },
                     "500": {
                         "description": "Internal server error",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/apierror.Problem"
                         }
                     }
                 }
             }
         },
-        "/api/payments/{id}": {
+        "/api/checkout/{id}": {
             "get": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "payments"
+                    "checkout"
                 ],
-                "summary": "Get payment by ID",
+                "summary": "Get a checkout",
                 "parameters": [
                     {
                         "type": "integer",
-                        "description": "Payment ID",
+                        "description": "Checkout ID",
                         "name": "id",
                         "in": "path",
                         "required": true
@@ -418,143 +397,116 @@ const docTemplate = `{
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/models.Payment"
+                            "$ref": "#/definitions/models.Checkout"
                         }
                     },
                     "404": {
-                        "description": "Payment not found",
+                        "description": "Checkout not found",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/apierror.Problem"
                         }
                     },
                     "500": {
                         "description": "Internal server error",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/apierror.Problem"
                         }
                     }
                 }
-            },
-            "put": {
-                "consumes": [
-                    "application/json"
+            }
+        },
+        "/api/orders": {
+            "get": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
                 ],
+                "description": "Admins get every order, customers their own.",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "payments"
+                    "orders"
                 ],
-                "summary": "Update payment by ID",
+                "summary": "Get all orders",
                 "parameters": [
                     {
                         "type": "integer",
-                        "description": "Payment ID",
-                        "name": "id",
-                        "in": "path",
-                        "required": true
+                        "description": "Filter by user ID",
+                        "name": "user_id",
+                        "in": "query"
                     },
                     {
-                        "description": "Payment object",
-                        "name": "payment",
-                        "in": "body",
-                        "required": true,
-                        "schema": {
-                            "$ref": "#/definitions/handlers.InputPayment"
-                        }
-                    }
-                ],
-                "responses": {
-                    "200": {
-                        "description": "Payment updated",
-                        "schema": {
-                            "type": "string"
-                        }
-                    },
-                    "400": {
-                        "description": "Missing required fields",
-                        "schema": {
-                            "type": "string"
-                        }
+                        "type": "string",
+                        "description": "Filter by status",
+                        "name": "status",
+                        "in": "query"
                     },
-                    "404": {
-                        "description": "Payment not found",
-                        "schema": {
-                            "type": "string"
-                        }
+                    {
+                        "type": "integer",
+                        "default": 20,
+                        "description": "Page size, 1 to 100",
+                        "name": "limit",
+                        "in": "query"
                     },
-                    "500": {
-                        "description": "Internal server error",
-                        "schema": {
-                            "type": "string"
-                        }
-                    }
-                }
-            },
-            "delete": {
-                "tags": [
-                    "payments"
-                ],
-                "summary": "Delete payment by ID",
-                "parameters": [
                     {
                         "type": "integer",
-                        "description": "Payment ID",
-                        "name": "id",
-                        "in": "path",
-                        "required": true
-                    }
-                ],
-                "responses": {
-                    "204": {
-                        "description": "Payment deleted",
-                        "schema": {
-                            "type": "string"
-                        }
+                        "default": 0,
+                        "description": "Items to skip; pass the previous page's next",
+                        "name": "offset",
+                        "in": "query"
                     },
-                    "500": {
-                        "description": "Internal server error",
-                        "schema": {
-                            "type": "string"
-                        }
+                    {
+                        "enum": [
+                            "id",
+                            "order_date",
+                            "total_price",
+                            "status"
+                        ],
+                        "type": "string",
+                        "description": "Sort key",
+                        "name": "sort",
+                        "in": "query"
+                    },
+                    {
+                        "enum": [
+                            "asc",
+                            "desc"
+                        ],
+                        "type": "string",
+                        "description": "Sort direction",
+                        "name": "order",
+                        "in": "query"
                     }
-                }
-            }
-        },
-        "/api/products": {
-            "get": {
-                "produces": [
-                    "application/json"
                 ],
-                "tags": [
-                    "products"
-                ],
-                "summary": "Get all products",
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "type": "array",
-                            "items": {
-                                "$ref": "#/definitions/models.Product"
-                            }
+                            "$ref": "#/definitions/pagination.Page-models_Order"
                         }
                     },
-                    "404": {
-                        "description": "No products found",
+                    "400": {
+                        "description": "Invalid pagination parameters",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/apierror.Problem"
                         }
                     },
                     "500": {
                         "description": "Internal server error",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/apierror.Problem"
                         }
                     }
                 }
             },
             "post": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
                 "consumes": [
                     "application/json"
                 ],
@@ -562,23 +514,29 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "tags": [
-                    "products"
+                    "orders"
                 ],
-                "summary": "Create a new product",
+                "summary": "Create a new order",
                 "parameters": [
                     {
-                        "description": "Product object",
-                        "name": "product",
+                        "description": "Order object",
+                        "name": "order",
                         "in": "body",
                         "required": true,
                         "schema": {
-                            "$ref": "#/definitions/handlers.InputProduct"
+                            "$ref": "#/definitions/handlers.InputOrder"
                         }
+                    },
+                    {
+                        "type": "string",
+                        "description": "Replays the first response for retries with the same key",
+                        "name": "Idempotency-Key",
+                        "in": "header"
                     }
                 ],
                 "responses": {
                     "201": {
-                        "description": "Product created",
+                        "description": "Order created",
                         "schema": {
                             "type": "string"
                         }
@@ -586,38 +544,55 @@ const docTemplate = `{
                     "400": {
                         "description": "Missing required fields",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    },
+                    "409": {
+                        "description": "Idempotency-Key reused with a different body, or still in progress",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    },
+                    "429": {
+                        "description": "Too many requests",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
                         }
                     },
                     "500": {
                         "description": "Internal server error",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/apierror.Problem"
                         }
                     }
                 }
             }
         },
-        "/api/products/search": {
+        "/api/orders/search": {
             "get": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "products"
+                    "orders"
                 ],
-                "summary": "Search products",
+                "summary": "Search orders",
                 "parameters": [
                     {
-                        "type": "string",
-                        "description": "Product name",
-                        "name": "name",
+                        "type": "integer",
+                        "description": "User ID",
+                        "name": "user_id",
                         "in": "query"
                     },
                     {
                         "type": "string",
-                        "description": "Product category",
-                        "name": "category",
+                        "description": "Order status",
+                        "name": "status",
                         "in": "query"
                     }
                 ],
@@ -627,38 +602,43 @@ const docTemplate = `{
                         "schema": {
                             "type": "array",
                             "items": {
-                                "$ref": "#/definitions/models.Product"
+                                "$ref": "#/definitions/models.Order"
                             }
                         }
                     },
                     "400": {
                         "description": "Missing required fields",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/apierror.Problem"
                         }
                     },
                     "500": {
                         "description": "Internal server error",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/apierror.Problem"
                         }
                     }
                 }
             }
         },
-        "/api/products/{id}": {
+        "/api/orders/{id}": {
             "get": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "products"
+                    "orders"
                 ],
-                "summary": "Get product by ID",
+                "summary": "Get order by ID",
                 "parameters": [
                     {
                         "type": "integer",
-                        "description": "Product ID",
+                        "description": "Order ID",
                         "name": "id",
                         "in": "path",
                         "required": true
@@ -668,24 +648,29 @@ const docTemplate = `{
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/models.Product"
+                            "$ref": "#/definitions/models.Order"
                         }
                     },
                     "404": {
-                        "description": "Product not found",
+                        "description": "Order not found",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/apierror.Problem"
                         }
                     },
                     "500": {
                         "description": "Internal server error",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/apierror.Problem"
                         }
                     }
                 }
             },
             "put": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
                 "consumes": [
                     "application/json"
                 ],
@@ -693,30 +678,30 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "tags": [
-                    "products"
+                    "orders"
                 ],
-                "summary": "Update product by ID",
+                "summary": "Update order by ID",
                 "parameters": [
                     {
                         "type": "integer",
-                        "description": "Product ID",
+                        "description": "Order ID",
                         "name": "id",
                         "in": "path",
                         "required": true
                     },
                     {
-                        "description": "Product object",
-                        "name": "product",
+                        "description": "Order object",
+                        "name": "order",
                         "in": "body",
                         "required": true,
                         "schema": {
-                            "$ref": "#/definitions/handlers.InputProduct"
+                            "$ref": "#/definitions/handlers.InputOrder"
                         }
                     }
                 ],
                 "responses": {
                     "200": {
-                        "description": "Product updated",
+                        "description": "Order updated",
                         "schema": {
                             "type": "string"
                         }
@@ -724,32 +709,37 @@ const docTemplate = `{
                     "400": {
                         "description": "Missing required fields",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/apierror.Problem"
                         }
                     },
                     "404": {
-                        "description": "Product not found",
+                        "description": "Order not found",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/apierror.Problem"
                         }
                     },
                     "500": {
                         "description": "Internal server error",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/apierror.Problem"
                         }
                     }
                 }
             },
             "delete": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
                 "tags": [
-                    "products"
+                    "orders"
                 ],
-                "summary": "Delete product by ID",
+                "summary": "Delete order by ID",
                 "parameters": [
                     {
                         "type": "integer",
-                        "description": "Product ID",
+                        "description": "Order ID",
                         "name": "id",
                         "in": "path",
                         "required": true
@@ -757,7 +747,7 @@ const docTemplate = `{
                 ],
                 "responses": {
                     "204": {
-                        "description": "Product deleted",
+                        "description": "Order deleted",
                         "schema": {
                             "type": "string"
                         }
@@ -765,183 +755,287 @@ const docTemplate = `{
                     "500": {
                         "description": "Internal server error",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/apierror.Problem"
                         }
                     }
                 }
             }
         },
-        "/api/users": {
+        "/api/orders/{id}/details": {
             "get": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "The order with its user, the current product of each item and its payments, gathered in one\nrequest. If the user, product or payment service fails, its section is left empty and the\nfailure is reported in errors under the section's name; the answer is still 200.",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "users"
+                    "orders"
+                ],
+                "summary": "Get order details",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Order ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
                 ],
-                "summary": "Get all users",
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "type": "array",
-                            "items": {
-                                "$ref": "#/definitions/models.User"
-                            }
+                            "$ref": "#/definitions/aggregate.OrderDetails"
                         }
                     },
                     "404": {
-                        "description": "No users found",
+                        "description": "Order not found",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/apierror.Problem"
                         }
                     },
                     "500": {
                         "description": "Internal server error",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/apierror.Problem"
                         }
                     }
                 }
-            },
-            "post": {
-                "consumes": [
-                    "application/json"
+            }
+        },
+        "/api/orders/{id}/history": {
+            "get": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
                 ],
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "users"
+                    "orders"
                 ],
-                "summary": "Create a new user",
+                "summary": "Get order status history",
                 "parameters": [
                     {
-                        "description": "User object",
-                        "name": "user",
-                        "in": "body",
-                        "required": true,
-                        "schema": {
-                            "$ref": "#/definitions/handlers.InputUser"
-                        }
+                        "type": "integer",
+                        "description": "Order ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
                     }
                 ],
                 "responses": {
-                    "201": {
-                        "description": "User created",
+                    "200": {
+                        "description": "OK",
                         "schema": {
-                            "type": "string"
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/models.OrderStatusChange"
+                            }
                         }
                     },
-                    "400": {
-                        "description": "Missing required fields",
+                    "404": {
+                        "description": "Order not found",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/apierror.Problem"
                         }
                     },
                     "500": {
                         "description": "Internal server error",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/apierror.Problem"
                         }
                     }
                 }
             }
         },
-        "/api/users/search": {
-            "get": {
+        "/api/orders/{id}/{action}": {
+            "post": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Customers may only cancel; pay, ship, deliver and refund are for admins.\npay may be given the amount paid, which must still be the order's total.",
+                "consumes": [
+                    "application/json"
+                ],
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "users"
+                    "orders"
                 ],
-                "summary": "Search user",
+                "summary": "Change order status",
                 "parameters": [
                     {
-                        "type": "string",
-                        "description": "User name",
-                        "name": "name",
-                        "in": "query"
+                        "type": "integer",
+                        "description": "Order ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
                     },
                     {
+                        "enum": [
+                            "pay",
+                            "ship",
+                            "deliver",
+                            "cancel",
+                            "refund"
+                        ],
                         "type": "string",
-                        "description": "User email",
-                        "name": "email",
-                        "in": "query"
+                        "description": "Status transition",
+                        "name": "action",
+                        "in": "path",
+                        "required": true
                     },
                     {
-                        "type": "string",
-                        "description": "User role",
-                        "name": "role",
-                        "in": "query"
+                        "description": "Amount paid, for pay only",
+                        "name": "payment",
+                        "in": "body",
+                        "schema": {
+                            "$ref": "#/definitions/handlers.InputPayOrder"
+                        }
                     }
                 ],
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "type": "array",
-                            "items": {
-                                "$ref": "#/definitions/models.User"
-                            }
+                            "$ref": "#/definitions/models.Order"
                         }
                     },
-                    "400": {
-                        "description": "Missing required fields",
+                    "403": {
+                        "description": "Only admins may pay, ship, deliver or refund",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Order not found",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    },
+                    "409": {
+                        "description": "Illegal status transition, or the amount paid is not the order's total",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
                         }
                     },
                     "500": {
                         "description": "Internal server error",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/apierror.Problem"
                         }
                     }
                 }
             }
         },
-        "/api/users/{id}": {
+        "/api/payments": {
             "get": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Admins get every payment, customers their own.",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "users"
+                    "payments"
                 ],
-                "summary": "Get user by ID",
+                "summary": "Get all payments",
                 "parameters": [
                     {
                         "type": "integer",
-                        "description": "User ID",
-                        "name": "id",
-                        "in": "path",
-                        "required": true
+                        "description": "Filter by user ID",
+                        "name": "user_id",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Filter by order ID",
+                        "name": "order_id",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Filter by payment status",
+                        "name": "status",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "default": 20,
+                        "description": "Page size, 1 to 100",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "default": 0,
+                        "description": "Items to skip; pass the previous page's next",
+                        "name": "offset",
+                        "in": "query"
+                    },
+                    {
+                        "enum": [
+                            "id",
+                            "payment_date",
+                            "amount",
+                            "payment_status"
+                        ],
+                        "type": "string",
+                        "description": "Sort key",
+                        "name": "sort",
+                        "in": "query"
+                    },
+                    {
+                        "enum": [
+                            "asc",
+                            "desc"
+                        ],
+                        "type": "string",
+                        "description": "Sort direction",
+                        "name": "order",
+                        "in": "query"
                     }
                 ],
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/models.User"
+                            "$ref": "#/definitions/pagination.Page-models_Payment"
                         }
                     },
-                    "404": {
-                        "description": "User not found",
+                    "400": {
+                        "description": "Invalid pagination parameters",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/apierror.Problem"
                         }
                     },
                     "500": {
                         "description": "Internal server error",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/apierror.Problem"
                         }
                     }
                 }
             },
-            "put": {
+            "post": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
                 "consumes": [
                     "application/json"
                 ],
@@ -949,112 +1043,1780 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "tags": [
-                    "users"
+                    "payments"
                 ],
-                "summary": "Update user by ID",
+                "summary": "Create a new payment",
                 "parameters": [
                     {
-                        "type": "integer",
-                        "description": "User ID",
-                        "name": "id",
-                        "in": "path",
-                        "required": true
-                    },
-                    {
-                        "description": "User object",
-                        "name": "user",
+                        "description": "Payment object",
+                        "name": "payment",
                         "in": "body",
                         "required": true,
                         "schema": {
-                            "$ref": "#/definitions/handlers.InputUser"
+                            "$ref": "#/definitions/handlers.InputPayment"
                         }
+                    },
+                    {
+                        "type": "string",
+                        "description": "Replays the first response for retries with the same key",
+                        "name": "Idempotency-Key",
+                        "in": "header"
                     }
                 ],
                 "responses": {
-                    "200": {
-                        "description": "User updated",
+                    "201": {
+                        "description": "Created",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/models.Payment"
+                        }
+                    },
+                    "202": {
+                        "description": "Gateway timed out, payment pending",
+                        "schema": {
+                            "$ref": "#/definitions/models.Payment"
                         }
                     },
                     "400": {
-                        "description": "Missing required fields",
+                        "description": "Missing card details, or amount is not the order's total",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/apierror.Problem"
                         }
                     },
                     "404": {
-                        "description": "User not found",
+                        "description": "Order not found",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    },
+                    "409": {
+                        "description": "Order is not pending or already has a payment, or Idempotency-Key reused with a different body or still in progress",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    },
+                    "429": {
+                        "description": "Too many requests",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
                         }
                     },
                     "500": {
                         "description": "Internal server error",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/apierror.Problem"
                         }
                     }
                 }
-            },
-            "delete": {
+            }
+        },
+        "/api/payments/search": {
+            "get": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "produces": [
+                    "application/json"
+                ],
                 "tags": [
-                    "users"
+                    "payments"
                 ],
-                "summary": "Delete user by ID",
+                "summary": "Search payments",
                 "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Order ID",
+                        "name": "order_id",
+                        "in": "query"
+                    },
                     {
                         "type": "integer",
                         "description": "User ID",
-                        "name": "id",
-                        "in": "path",
-                        "required": true
+                        "name": "user_id",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Payment status",
+                        "name": "status",
+                        "in": "query"
                     }
                 ],
                 "responses": {
-                    "204": {
-                        "description": "User deleted",
+                    "200": {
+                        "description": "OK",
                         "schema": {
-                            "type": "string"
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/models.Payment"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Missing required fields",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
                         }
                     },
                     "500": {
                         "description": "Internal server error",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/apierror.Problem"
                         }
                     }
                 }
             }
-        }
-    },
-    "definitions": {
-        "handlers.InputOrder": {
-            "type": "object",
-            "properties": {
-                "product_ids": {
-                    "type": "array",
-                    "items": {
-                        "type": "integer"
+        },
+        "/api/payments/webhooks/epay": {
+            "post": {
+                "description": "epay's postLink (and, under /failure, failurePostLink) callback.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "payments"
+                ],
+                "summary": "Receive an epay payment callback",
+                "parameters": [
+                    {
+                        "description": "Callback sent by epay",
+                        "name": "callback",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/services.EpayCallback"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/models.Payment"
+                        }
+                    },
+                    "401": {
+                        "description": "Invalid callback signature",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Unknown invoice",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    },
+                    "503": {
+                        "description": "Payment gateway unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
                     }
-                },
-                "status": {
-                    "type": "string"
-                },
-                "user_id": {
-                    "type": "integer"
                 }
             }
         },
-        "handlers.InputPayment": {
-            "type": "object",
-            "properties": {
+        "/api/payments/{id}": {
+            "get": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "payments"
+                ],
+                "summary": "Get payment by ID",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Payment ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/models.Payment"
+                        }
+                    },
+                    "404": {
+                        "description": "Payment not found",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    }
+                }
+            },
+            "put": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "payments"
+                ],
+                "summary": "Update payment by ID",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Payment ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Payment object",
+                        "name": "payment",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/handlers.InputPayment"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Payment updated",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "400": {
+                        "description": "Missing required fields",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Payment not found",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    }
+                }
+            },
+            "delete": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "tags": [
+                    "payments"
+                ],
+                "summary": "Delete payment by ID",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Payment ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "Payment deleted",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/payments/{id}/refunds": {
+            "get": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "payments"
+                ],
+                "summary": "Get refunds of a payment",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Payment ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/models.Refund"
+                            }
+                        }
+                    },
+                    "404": {
+                        "description": "Payment not found",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    }
+                }
+            },
+            "post": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Refunds all or part of a captured payment through the payment gateway.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "payments"
+                ],
+                "summary": "Refund a payment",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Payment ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Refund amount and reason",
+                        "name": "refund",
+                        "in": "body",
+                        "schema": {
+                            "$ref": "#/definitions/handlers.InputRefund"
+                        }
+                    },
+                    {
+                        "type": "string",
+                        "description": "Replays the first response for retries with the same key",
+                        "name": "Idempotency-Key",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "Created",
+                        "schema": {
+                            "$ref": "#/definitions/models.Refund"
+                        }
+                    },
+                    "202": {
+                        "description": "Gateway timed out, refund pending",
+                        "schema": {
+                            "$ref": "#/definitions/models.Refund"
+                        }
+                    },
+                    "404": {
+                        "description": "Payment not found",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    },
+                    "409": {
+                        "description": "Payment not refundable or refund exceeds captured amount",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    },
+                    "502": {
+                        "description": "Gateway rejected the refund; it is recorded as failed",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/products": {
+            "get": {
+                "description": "Filters combine; products must match all of them.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "products"
+                ],
+                "summary": "Get all products",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Comma-separated product IDs, e.g. 1,2,3",
+                        "name": "ids",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Part of the name, case-insensitive",
+                        "name": "name",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Filter by category",
+                        "name": "category",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Lowest price, e.g. 1500.00",
+                        "name": "min_price",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Highest price, e.g. 4999.99",
+                        "name": "max_price",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "default": "KZT",
+                        "description": "Currency of min_price and max_price",
+                        "name": "currency",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Only products with quantity left",
+                        "name": "in_stock",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Added on or after this date, e.g. 2024-01-31",
+                        "name": "added_from",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Added on or before this date",
+                        "name": "added_to",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "default": 20,
+                        "description": "Page size, 1 to 100",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "default": 0,
+                        "description": "Items to skip; pass the previous page's next",
+                        "name": "offset",
+                        "in": "query"
+                    },
+                    {
+                        "enum": [
+                            "id",
+                            "name",
+                            "price",
+                            "quantity",
+                            "date_added"
+                        ],
+                        "type": "string",
+                        "description": "Sort key",
+                        "name": "sort",
+                        "in": "query"
+                    },
+                    {
+                        "enum": [
+                            "asc",
+                            "desc"
+                        ],
+                        "type": "string",
+                        "description": "Sort direction",
+                        "name": "order",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/pagination.Page-models_Product"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid filter or pagination parameters",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    }
+                }
+            },
+            "post": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "products"
+                ],
+                "summary": "Create a new product",
+                "parameters": [
+                    {
+                        "description": "Product object",
+                        "name": "product",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/handlers.InputProduct"
+                        }
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "Product created",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "400": {
+                        "description": "Missing required fields",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/products/search": {
+            "get": {
+                "description": "With q, ranks the products matching its words in their name or description, best first, and\nhighlights where they matched. If nothing matches it suggests similarly spelled product names.\nWithout q it is the same as GET /api/products. The filters apply either way.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "products"
+                ],
+                "summary": "Search products",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Search terms; quoted phrases, or, and -word to exclude work as in web search",
+                        "name": "q",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Part of the name, case-insensitive",
+                        "name": "name",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Filter by category",
+                        "name": "category",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Lowest price, e.g. 1500.00",
+                        "name": "min_price",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Highest price, e.g. 4999.99",
+                        "name": "max_price",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "default": "KZT",
+                        "description": "Currency of min_price and max_price",
+                        "name": "currency",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Only products with quantity left",
+                        "name": "in_stock",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Added on or after this date, e.g. 2024-01-31",
+                        "name": "added_from",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Added on or before this date",
+                        "name": "added_to",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "default": 20,
+                        "description": "Page size, 1 to 100",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "default": 0,
+                        "description": "Items to skip; pass the previous page's next",
+                        "name": "offset",
+                        "in": "query"
+                    },
+                    {
+                        "enum": [
+                            "relevance",
+                            "id",
+                            "name",
+                            "price",
+                            "quantity",
+                            "date_added"
+                        ],
+                        "type": "string",
+                        "description": "Sort key; relevance only with q",
+                        "name": "sort",
+                        "in": "query"
+                    },
+                    {
+                        "enum": [
+                            "asc",
+                            "desc"
+                        ],
+                        "type": "string",
+                        "description": "Sort direction",
+                        "name": "order",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/models.ProductSearchResults"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid filter or pagination parameters",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/products/suggest": {
+            "get": {
+                "description": "Product names similar to q, most similar first, tolerating typos.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "products"
+                ],
+                "summary": "Suggest product names",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Partial or misspelled name",
+                        "name": "q",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "default": 5,
+                        "description": "How many names, 1 to 20",
+                        "name": "limit",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "type": "string"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Missing q or invalid limit",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/products/{id}": {
+            "get": {
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "products"
+                ],
+                "summary": "Get product by ID",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Product ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/models.Product"
+                        }
+                    },
+                    "404": {
+                        "description": "Product not found",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    }
+                }
+            },
+            "put": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "products"
+                ],
+                "summary": "Update product by ID",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Product ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Product object",
+                        "name": "product",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/handlers.InputProduct"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Product updated",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "400": {
+                        "description": "Missing required fields",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Product not found",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    }
+                }
+            },
+            "delete": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "tags": [
+                    "products"
+                ],
+                "summary": "Delete product by ID",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Product ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "Product deleted",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/users": {
+            "get": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "users"
+                ],
+                "summary": "Get all users",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Filter by role",
+                        "name": "role",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "default": 20,
+                        "description": "Page size, 1 to 100",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "default": 0,
+                        "description": "Items to skip; pass the previous page's next",
+                        "name": "offset",
+                        "in": "query"
+                    },
+                    {
+                        "enum": [
+                            "id",
+                            "username",
+                            "email",
+                            "registration_date",
+                            "role"
+                        ],
+                        "type": "string",
+                        "description": "Sort key",
+                        "name": "sort",
+                        "in": "query"
+                    },
+                    {
+                        "enum": [
+                            "asc",
+                            "desc"
+                        ],
+                        "type": "string",
+                        "description": "Sort direction",
+                        "name": "order",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/pagination.Page-models_User"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid pagination parameters",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    }
+                }
+            },
+            "post": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Admin only; customers sign up with /api/users/register.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "users"
+                ],
+                "summary": "Create a new user",
+                "parameters": [
+                    {
+                        "description": "User object",
+                        "name": "user",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/handlers.InputUser"
+                        }
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "User created",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "400": {
+                        "description": "Missing required fields",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    },
+                    "409": {
+                        "description": "Email already registered",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/users/login": {
+            "post": {
+                "description": "Exchanges an email and password for a bearer access token.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "users"
+                ],
+                "summary": "Log in",
+                "parameters": [
+                    {
+                        "description": "Login credentials",
+                        "name": "credentials",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/handlers.InputLogin"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/handlers.TokenOutput"
+                        }
+                    },
+                    "400": {
+                        "description": "Missing required fields",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Invalid email or password",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    },
+                    "429": {
+                        "description": "Too many attempts or account locked",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/users/password/forgot": {
+            "post": {
+                "description": "Sends a one-time reset token to the account, if the email is registered.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "users"
+                ],
+                "summary": "Request a password reset",
+                "parameters": [
+                    {
+                        "description": "Account email",
+                        "name": "email",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/handlers.InputForgotPassword"
+                        }
+                    }
+                ],
+                "responses": {
+                    "202": {
+                        "description": "Reset requested",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "429": {
+                        "description": "Too many attempts",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    },
+                    "503": {
+                        "description": "Password reset is not configured",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/users/password/reset": {
+            "post": {
+                "description": "Sets a new password using a one-time reset token.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "users"
+                ],
+                "summary": "Reset password",
+                "parameters": [
+                    {
+                        "description": "Reset token and new password",
+                        "name": "reset",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/handlers.InputResetPassword"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Password reset",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid or expired token, or weak password",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/users/register": {
+            "post": {
+                "description": "Signs up a customer account; the role is always customer.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "users"
+                ],
+                "summary": "Register",
+                "parameters": [
+                    {
+                        "description": "New account",
+                        "name": "user",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/handlers.InputRegister"
+                        }
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "User registered",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "400": {
+                        "description": "Missing required fields or weak password",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    },
+                    "409": {
+                        "description": "Email already registered",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/users/search": {
+            "get": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "users"
+                ],
+                "summary": "Search user",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "User name",
+                        "name": "name",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "User email",
+                        "name": "email",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "User role",
+                        "name": "role",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/models.User"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Missing required fields",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/users/{id}": {
+            "get": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "users"
+                ],
+                "summary": "Get user by ID",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "User ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/models.User"
+                        }
+                    },
+                    "404": {
+                        "description": "User not found",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    }
+                }
+            },
+            "put": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "users"
+                ],
+                "summary": "Update user by ID",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "User ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "User object",
+                        "name": "user",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/handlers.InputUser"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "User updated",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "400": {
+                        "description": "Missing required fields",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "User not found",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    }
+                }
+            },
+            "delete": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "tags": [
+                    "users"
+                ],
+                "summary": "Delete user by ID",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "User ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "User deleted",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/users/{id}/password": {
+            "put": {
+                "security": [
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Changes the caller's own password.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "users"
+                ],
+                "summary": "Change password",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "User ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Current and new password",
+                        "name": "passwords",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/handlers.InputChangePassword"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Password changed",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "400": {
+                        "description": "Weak password",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Wrong current password",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "User not found",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    },
+                    "429": {
+                        "description": "Account locked",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/apierror.Problem"
+                        }
+                    }
+                }
+            }
+        }
+    },
+    "definitions": {
+        "aggregate.ItemDetails": {
+            "type": "object",
+            "properties": {
+                "product": {
+                    "type": "object"
+                },
+                "product_id": {
+                    "type": "integer"
+                },
+                "quantity": {
+                    "type": "integer"
+                },
+                "unit_price": {
+                    "type": "string"
+                }
+            }
+        },
+        "aggregate.OrderDetails": {
+            "type": "object",
+            "properties": {
+                "errors": {
+                    "type": "object",
+                    "additionalProperties": {
+                        "$ref": "#/definitions/apierror.Problem"
+                    }
+                },
+                "items": {
+                    "description": "Items are the order's lines, each with the product as it is now.",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/aggregate.ItemDetails"
+                    }
+                },
+                "order": {
+                    "type": "object"
+                },
+                "payments": {
+                    "description": "Payments are every payment made for the order.",
+                    "type": "array",
+                    "items": {
+                        "type": "object"
+                    }
+                },
+                "user": {
+                    "type": "object"
+                }
+            }
+        },
+        "apierror.Problem": {
+            "type": "object",
+            "properties": {
+                "detail": {
+                    "type": "string"
+                },
+                "instance": {
+                    "type": "string"
+                },
+                "request_id": {
+                    "type": "string"
+                },
+                "retry_after": {
+                    "description": "RetryAfter is how many seconds to wait before trying again, when\nknown.",
+                    "type": "integer"
+                },
+                "status": {
+                    "type": "integer"
+                },
+                "title": {
+                    "type": "string"
+                },
+                "type": {
+                    "type": "string"
+                },
+                "upstream": {
+                    "type": "string"
+                }
+            }
+        },
+        "handlers.InputCard": {
+            "type": "object",
+            "properties": {
+                "cvc": {
+                    "type": "string"
+                },
+                "exp_date": {
+                    "type": "string"
+                },
+                "holder_name": {
+                    "type": "string"
+                },
+                "number": {
+                    "type": "string"
+                }
+            }
+        },
+        "handlers.InputCartItem": {
+            "type": "object",
+            "properties": {
+                "product_id": {
+                    "type": "integer"
+                },
+                "quantity": {
+                    "type": "integer"
+                }
+            }
+        },
+        "handlers.InputCartQuantity": {
+            "type": "object",
+            "properties": {
+                "quantity": {
+                    "type": "integer"
+                }
+            }
+        },
+        "handlers.InputChangePassword": {
+            "type": "object",
+            "properties": {
+                "current_password": {
+                    "type": "string"
+                },
+                "new_password": {
+                    "type": "string"
+                }
+            }
+        },
+        "handlers.InputCheckout": {
+            "type": "object",
+            "properties": {
+                "card": {
+                    "$ref": "#/definitions/handlers.InputCard"
+                },
+                "email": {
+                    "type": "string"
+                },
+                "items": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/handlers.InputOrderItem"
+                    }
+                },
+                "phone": {
+                    "type": "string"
+                }
+            }
+        },
+        "handlers.InputForgotPassword": {
+            "type": "object",
+            "properties": {
+                "email": {
+                    "type": "string"
+                }
+            }
+        },
+        "handlers.InputLogin": {
+            "type": "object",
+            "properties": {
+                "email": {
+                    "type": "string"
+                },
+                "password": {
+                    "type": "string"
+                }
+            }
+        },
+        "handlers.InputOrder": {
+            "type": "object",
+            "properties": {
+                "items": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/handlers.InputOrderItem"
+                    }
+                },
+                "product_ids": {
+                    "description": "ProductIDs is the legacy shape, one entry per unit; prefer Items.",
+                    "type": "array",
+                    "items": {
+                        "type": "integer"
+                    }
+                },
+                "user_id": {
+                    "type": "integer"
+                }
+            }
+        },
+        "handlers.InputOrderItem": {
+            "type": "object",
+            "properties": {
+                "product_id": {
+                    "type": "integer"
+                },
+                "quantity": {
+                    "type": "integer"
+                }
+            }
+        },
+        "handlers.InputPayOrder": {
+            "type": "object",
+            "properties": {
                 "amount": {
-                    "type": "number"
+                    "$ref": "#/definitions/money.Money"
+                }
+            }
+        },
+        "handlers.InputPayment": {
+            "type": "object",
+            "properties": {
+                "amount": {
+                    "$ref": "#/definitions/money.Money"
+                },
+                "card": {
+                    "$ref": "#/definitions/handlers.InputCard"
+                },
+                "email": {
+                    "type": "string"
                 },
                 "order_id": {
                     "type": "integer"
                 },
+                "phone": {
+                    "type": "string"
+                },
                 "user_id": {
                     "type": "integer"
                 }
@@ -1066,34 +2828,162 @@ const docTemplate = `{
                 "category": {
                     "type": "string"
                 },
-                "description": {
-                    "type": "string"
+                "description": {
+                    "type": "string"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "price": {
+                    "$ref": "#/definitions/money.Money"
+                },
+                "quantity": {
+                    "type": "integer"
+                }
+            }
+        },
+        "handlers.InputRefund": {
+            "type": "object",
+            "properties": {
+                "amount": {
+                    "$ref": "#/definitions/money.Money"
+                },
+                "reason": {
+                    "type": "string"
+                }
+            }
+        },
+        "handlers.InputRegister": {
+            "type": "object",
+            "properties": {
+                "address": {
+                    "type": "string"
+                },
+                "email": {
+                    "type": "string"
+                },
+                "password": {
+                    "type": "string"
+                },
+                "username": {
+                    "type": "string"
+                }
+            }
+        },
+        "handlers.InputResetPassword": {
+            "type": "object",
+            "properties": {
+                "new_password": {
+                    "type": "string"
+                },
+                "token": {
+                    "type": "string"
+                }
+            }
+        },
+        "handlers.InputUser": {
+            "type": "object",
+            "properties": {
+                "address": {
+                    "type": "string"
+                },
+                "email": {
+                    "type": "string"
+                },
+                "password": {
+                    "type": "string"
+                },
+                "role": {
+                    "type": "string"
+                },
+                "username": {
+                    "type": "string"
+                }
+            }
+        },
+        "handlers.TokenOutput": {
+            "type": "object",
+            "properties": {
+                "access_token": {
+                    "type": "string"
+                },
+                "expires_in": {
+                    "type": "integer"
+                },
+                "token_type": {
+                    "type": "string"
+                }
+            }
+        },
+        "models.Cart": {
+            "type": "object",
+            "properties": {
+                "items": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/models.CartItem"
+                    }
+                },
+                "total": {
+                    "$ref": "#/definitions/money.Money"
+                },
+                "user_id": {
+                    "type": "integer"
+                }
+            }
+        },
+        "models.CartItem": {
+            "type": "object",
+            "properties": {
+                "available": {
+                    "type": "integer"
+                },
+                "line_total": {
+                    "$ref": "#/definitions/money.Money"
                 },
                 "name": {
                     "type": "string"
                 },
-                "price": {
-                    "type": "number"
+                "product_id": {
+                    "type": "integer"
                 },
                 "quantity": {
                     "type": "integer"
+                },
+                "unit_price": {
+                    "$ref": "#/definitions/money.Money"
+                },
+                "warning": {
+                    "type": "string"
                 }
             }
         },
-        "handlers.InputUser": {
+        "models.Checkout": {
             "type": "object",
             "properties": {
-                "address": {
+                "created_at": {
                     "type": "string"
                 },
-                "email": {
+                "error": {
                     "type": "string"
                 },
-                "role": {
+                "id": {
+                    "type": "integer"
+                },
+                "order_id": {
+                    "type": "integer"
+                },
+                "payment_id": {
+                    "type": "integer"
+                },
+                "status": {
                     "type": "string"
                 },
-                "username": {
+                "updated_at": {
                     "type": "string"
+                },
+                "user_id": {
+                    "type": "integer"
                 }
             }
         },
@@ -1103,10 +2993,17 @@ const docTemplate = `{
                 "id": {
                     "type": "integer"
                 },
+                "items": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/models.OrderItem"
+                    }
+                },
                 "order_date": {
                     "type": "string"
                 },
                 "product_ids": {
+                    "description": "ProductIDs is the legacy request shape, one entry per unit ordered.\nIt is folded into Items by NormalizeItems and never returned.",
                     "type": "array",
                     "items": {
                         "type": "integer"
@@ -1116,22 +3013,63 @@ const docTemplate = `{
                     "type": "string"
                 },
                 "total_price": {
-                    "type": "number"
+                    "$ref": "#/definitions/money.Money"
                 },
                 "user_id": {
                     "type": "integer"
                 }
             }
         },
+        "models.OrderItem": {
+            "type": "object",
+            "properties": {
+                "product_id": {
+                    "type": "integer"
+                },
+                "quantity": {
+                    "type": "integer"
+                },
+                "unit_price": {
+                    "$ref": "#/definitions/money.Money"
+                }
+            }
+        },
+        "models.OrderStatusChange": {
+            "type": "object",
+            "properties": {
+                "changed_at": {
+                    "type": "string"
+                },
+                "changed_by": {
+                    "type": "integer"
+                },
+                "from_status": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "integer"
+                },
+                "order_id": {
+                    "type": "integer"
+                },
+                "to_status": {
+                    "type": "string"
+                }
+            }
+        },
         "models.Payment": {
             "type": "object",
             "properties": {
                 "amount": {
-                    "type": "number"
+                    "$ref": "#/definitions/money.Money"
                 },
                 "id": {
                     "type": "integer"
                 },
+                "invoice_id": {
+                    "description": "InvoiceID is our reference for the payment at the gateway and\nTransactionID the gateway's own; both are set by the service.",
+                    "type": "string"
+                },
                 "order_id": {
                     "type": "integer"
                 },
@@ -1141,6 +3079,9 @@ const docTemplate = `{
                 "payment_status": {
                     "type": "string"
                 },
+                "transaction_id": {
+                    "type": "string"
+                },
                 "user_id": {
                     "type": "integer"
                 }
@@ -1165,10 +3106,94 @@ const docTemplate = `{
                     "type": "string"
                 },
                 "price": {
-                    "type": "number"
+                    "$ref": "#/definitions/money.Money"
+                },
+                "quantity": {
+                    "type": "integer"
+                }
+            }
+        },
+        "models.ProductMatch": {
+            "type": "object",
+            "properties": {
+                "category": {
+                    "type": "string"
+                },
+                "date_added": {
+                    "type": "string"
+                },
+                "description": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "integer"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "price": {
+                    "$ref": "#/definitions/money.Money"
                 },
                 "quantity": {
                     "type": "integer"
+                },
+                "rank": {
+                    "type": "number"
+                },
+                "snippet": {
+                    "type": "string"
+                }
+            }
+        },
+        "models.ProductSearchResults": {
+            "type": "object",
+            "properties": {
+                "items": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/models.ProductMatch"
+                    }
+                },
+                "limit": {
+                    "type": "integer"
+                },
+                "next": {
+                    "type": "integer"
+                },
+                "offset": {
+                    "type": "integer"
+                },
+                "suggestions": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "total": {
+                    "type": "integer"
+                }
+            }
+        },
+        "models.Refund": {
+            "type": "object",
+            "properties": {
+                "amount": {
+                    "$ref": "#/definitions/money.Money"
+                },
+                "created_at": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "integer"
+                },
+                "payment_id": {
+                    "type": "integer"
+                },
+                "reason": {
+                    "type": "string"
+                },
+                "status": {
+                    "type": "string"
                 }
             }
         },
@@ -1194,6 +3219,186 @@ const docTemplate = `{
                     "type": "string"
                 }
             }
+        },
+        "money.Money": {
+            "type": "object",
+            "properties": {
+                "amount": {
+                    "type": "integer"
+                },
+                "currency": {
+                    "type": "string"
+                }
+            }
+        },
+        "pagination.Page-models_Order": {
+            "type": "object",
+            "properties": {
+                "items": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/models.Order"
+                    }
+                },
+                "limit": {
+                    "type": "integer"
+                },
+                "next": {
+                    "type": "integer"
+                },
+                "offset": {
+                    "type": "integer"
+                },
+                "total": {
+                    "type": "integer"
+                }
+            }
+        },
+        "pagination.Page-models_Payment": {
+            "type": "object",
+            "properties": {
+                "items": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/models.Payment"
+                    }
+                },
+                "limit": {
+                    "type": "integer"
+                },
+                "next": {
+                    "type": "integer"
+                },
+                "offset": {
+                    "type": "integer"
+                },
+                "total": {
+                    "type": "integer"
+                }
+            }
+        },
+        "pagination.Page-models_Product": {
+            "type": "object",
+            "properties": {
+                "items": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/models.Product"
+                    }
+                },
+                "limit": {
+                    "type": "integer"
+                },
+                "next": {
+                    "type": "integer"
+                },
+                "offset": {
+                    "type": "integer"
+                },
+                "total": {
+                    "type": "integer"
+                }
+            }
+        },
+        "pagination.Page-models_User": {
+            "type": "object",
+            "properties": {
+                "items": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/models.User"
+                    }
+                },
+                "limit": {
+                    "type": "integer"
+                },
+                "next": {
+                    "type": "integer"
+                },
+                "offset": {
+                    "type": "integer"
+                },
+                "total": {
+                    "type": "integer"
+                }
+            }
+        },
+        "proxy.BreakerStatus": {
+            "type": "object",
+            "properties": {
+                "failures": {
+                    "description": "Failures counts consecutive failed requests.",
+                    "type": "integer"
+                },
+                "opened_at": {
+                    "type": "string"
+                },
+                "retry_after": {
+                    "description": "RetryAfter is how many seconds an open breaker keeps failing fast.",
+                    "type": "integer"
+                },
+                "state": {
+                    "type": "string"
+                },
+                "upstream": {
+                    "type": "string"
+                }
+            }
+        },
+        "services.EpayCallback": {
+            "type": "object",
+            "properties": {
+                "accountId": {
+                    "type": "string"
+                },
+                "amount": {
+                    "type": "string"
+                },
+                "cardMask": {
+                    "type": "string"
+                },
+                "code": {
+                    "type": "string"
+                },
+                "currency": {
+                    "type": "string"
+                },
+                "dateTime": {
+                    "type": "string"
+                },
+                "description": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "invoiceId": {
+                    "type": "string"
+                },
+                "reason": {
+                    "type": "string"
+                },
+                "reasonCode": {
+                    "type": "string"
+                },
+                "reference": {
+                    "type": "string"
+                },
+                "secret_hash": {
+                    "type": "string"
+                },
+                "terminal": {
+                    "type": "string"
+                }
+            }
+        }
+    },
+    "securityDefinitions": {
+        "BearerAuth": {
+            "description": "\"Bearer \" followed by the access_token from POST /api/users/login",
+            "type": "apiKey",
+            "name": "Authorization",
+            "in": "header"
         }
     }
 }`
@@ -0,0 +1,158 @@
+// Package idempotency makes create endpoints safe to retry. A client sends an
+// Idempotency-Key header; the first response for that key is stored and
+// replayed for retries, so a request is never carried out twice.
+package idempotency
+
+import (
+	"OnlineStore/apierror"
+	"OnlineStore/auth"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	Header = "Idempotency-Key"
+	// ReplayedHeader is set on responses replayed from the store.
+	ReplayedHeader = "Idempotent-Replayed"
+
+	maxKeyLength = 255
+	// TTL is how long a key is remembered; after that it may be reused.
+	TTL = 24 * time.Hour
+)
+
+var ErrInProgress = apierror.New(apierror.Conflict, "a request with this idempotency key is still in progress")
+
+// Record is what is kept for a key: the hash of the request that claimed it
+// and, once that request completed, its response.
+type Record struct {
+	RequestHash string
+	Completed   bool
+	StatusCode  int
+	ContentType string
+	Body        []byte
+}
+
+type Store interface {
+	// Claim reserves key within scope for a request with hash. It returns
+	// claimed true for the first request, and otherwise the key's record.
+	Claim(ctx context.Context, scope, key, hash string) (record *Record, claimed bool, err error)
+	// Complete stores the response for a claimed key.
+	Complete(ctx context.Context, scope, key string, record Record) error
+	// Release gives up a claim without a response, so the key can be retried.
+	Release(ctx context.Context, scope, key string) error
+}
+
+// Handler wraps a create endpoint. Requests without an Idempotency-Key are
+// passed through unchanged. For the rest the key is scoped to the method and
+// path and the caller, and a retry with the same key gets the stored response if the body is
+// the same, or 409 Conflict if it differs or the first request has not
+// finished.
+func Handler(store Store, next http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		key := request.Header.Get(Header)
+		if key == "" {
+			next(writer, request)
+			return
+		}
+		if len(key) > maxKeyLength {
+			apierror.Write(writer, request, apierror.New(apierror.Validation, "Idempotency-Key must be at most 255 characters"))
+			return
+		}
+
+		body, err := io.ReadAll(request.Body)
+		if err != nil {
+			apierror.Write(writer, request, apierror.Wrap(apierror.Validation, "could not read the request body", err))
+			return
+		}
+		request.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(body)
+		hash := hex.EncodeToString(sum[:])
+		scope := request.Method + " " + request.URL.Path
+		if userID := request.Header.Get(auth.UserIDHeader); userID != "" {
+			// Keys are chosen by clients, so two users may pick the same
+			// one; neither may see the other's response.
+			scope += " user " + userID
+		}
+
+		ctx := request.Context()
+		record, claimed, err := store.Claim(ctx, scope, key, hash)
+		if err != nil {
+			apierror.Write(writer, request, err)
+			return
+		}
+		if !claimed {
+			replay(writer, request, record, hash)
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: writer, statusCode: http.StatusOK}
+		completed := false
+		defer func() {
+			if !completed {
+				// The handler panicked; let the client retry.
+				if err := store.Release(context.WithoutCancel(ctx), scope, key); err != nil {
+					log.Printf("Failed to release idempotency key %q: %v", key, err)
+				}
+			}
+		}()
+		next(recorder, request)
+		completed = true
+
+		err = store.Complete(context.WithoutCancel(ctx), scope, key, Record{
+			RequestHash: hash,
+			Completed:   true,
+			StatusCode:  recorder.statusCode,
+			ContentType: recorder.Header().Get("Content-Type"),
+			Body:        recorder.body.Bytes(),
+		})
+		if err != nil {
+			// The response has been sent; a retry will see the key as in
+			// progress rather than run the request again.
+			log.Printf("Failed to store response for idempotency key %q: %v", key, err)
+		}
+	}
+}
+
+func replay(writer http.ResponseWriter, request *http.Request, record *Record, hash string) {
+	switch {
+	case record.RequestHash != hash:
+		apierror.Write(writer, request, apierror.New(apierror.Conflict, "Idempotency-Key was already used with a different request body"))
+	case !record.Completed:
+		apierror.Write(writer, request, ErrInProgress)
+	default:
+		if record.ContentType != "" {
+			writer.Header().Set("Content-Type", record.ContentType)
+		}
+		writer.Header().Set(ReplayedHeader, "true")
+		writer.WriteHeader(record.StatusCode)
+		writer.Write(record.Body)
+	}
+}
+
+// responseRecorder passes the response through while keeping a copy.
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode  int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(statusCode int) {
+	if !r.wroteHeader {
+		r.statusCode = statusCode
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	r.wroteHeader = true
+	r.body.Write(data)
+	return r.ResponseWriter.Write(data)
+}
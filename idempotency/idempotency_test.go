@@ -0,0 +1,111 @@
+package idempotency
+
+import (
+	"OnlineStore/auth"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandler(t *testing.T) {
+	store := NewMemoryStore()
+	calls := 0
+	handler := Handler(store, func(writer http.ResponseWriter, request *http.Request) {
+		calls++
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusCreated)
+		writer.Write([]byte(`{"id": 1}`))
+	})
+	send := func(key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/payments", strings.NewReader(body))
+		if key != "" {
+			req.Header.Set(Header, key)
+		}
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+
+	rr := send("key-1", `{"amount": 100}`)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.Equal(t, 1, calls)
+
+	// Test retry with the same body
+	rr = send("key-1", `{"amount": 100}`)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.Equal(t, `{"id": 1}`, rr.Body.String())
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	assert.Equal(t, "true", rr.Header().Get(ReplayedHeader))
+	assert.Equal(t, 1, calls)
+
+	// Test same key with a different body
+	rr = send("key-1", `{"amount": 200}`)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Equal(t, 1, calls)
+
+	// Test requests without a key
+	send("", `{"amount": 100}`)
+	send("", `{"amount": 100}`)
+	assert.Equal(t, 3, calls)
+}
+
+func TestHandlerScopesKeysToCaller(t *testing.T) {
+	store := NewMemoryStore()
+	calls := 0
+	handler := Handler(store, func(writer http.ResponseWriter, request *http.Request) {
+		calls++
+		writer.WriteHeader(http.StatusCreated)
+	})
+	send := func(userID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/payments", strings.NewReader(`{"amount": 100}`))
+		req.Header.Set(Header, "key-1")
+		req.Header.Set(auth.UserIDHeader, userID)
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+
+	send("1")
+	rr := send("2")
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.Empty(t, rr.Header().Get(ReplayedHeader))
+	assert.Equal(t, 2, calls)
+}
+
+func TestHandlerInProgress(t *testing.T) {
+	store := NewMemoryStore()
+	sum := sha256.Sum256(nil)
+	_, claimed, err := store.Claim(context.Background(), "POST /orders", "key-1", hex.EncodeToString(sum[:]))
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+
+	handler := Handler(store, func(writer http.ResponseWriter, request *http.Request) {
+		t.Fatal("handler must not run while the key is in progress")
+	})
+	req := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(""))
+	req.Header.Set(Header, "key-1")
+	rr := httptest.NewRecorder()
+	handler(rr, req)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Contains(t, rr.Body.String(), "in progress")
+}
+
+func TestHandlerReleasesKeyOnPanic(t *testing.T) {
+	store := NewMemoryStore()
+	panicking := Handler(store, func(writer http.ResponseWriter, request *http.Request) {
+		panic("boom")
+	})
+	req := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader("{}"))
+	req.Header.Set(Header, "key-1")
+	assert.Panics(t, func() { panicking(httptest.NewRecorder(), req) })
+
+	_, claimed, err := store.Claim(context.Background(), "POST /orders", "key-1", "")
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+}
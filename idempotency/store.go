@@ -0,0 +1,107 @@
+package idempotency
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+)
+
+// PostgresStore keeps records in the idempotency_keys table.
+type PostgresStore struct {
+	DB *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{DB: db}
+}
+
+func (s *PostgresStore) Claim(ctx context.Context, scope, key, hash string) (*Record, bool, error) {
+	_, err := s.DB.ExecContext(ctx, `
+        DELETE FROM idempotency_keys
+        WHERE scope = $1 AND idempotency_key = $2 AND created_at < $3`, scope, key, time.Now().Add(-TTL))
+	if err != nil {
+		return nil, false, err
+	}
+
+	result, err := s.DB.ExecContext(ctx, `
+        INSERT INTO idempotency_keys (scope, idempotency_key, request_hash)
+        VALUES ($1, $2, $3)
+        ON CONFLICT DO NOTHING`, scope, key, hash)
+	if err != nil {
+		return nil, false, err
+	}
+	if inserted, err := result.RowsAffected(); err != nil {
+		return nil, false, err
+	} else if inserted == 1 {
+		return nil, true, nil
+	}
+
+	var record Record
+	var statusCode sql.NullInt64
+	err = s.DB.QueryRowContext(ctx, `
+        SELECT request_hash, status_code, content_type, response_body
+        FROM idempotency_keys WHERE scope = $1 AND idempotency_key = $2`, scope, key).
+		Scan(&record.RequestHash, &statusCode, &record.ContentType, &record.Body)
+	if err == sql.ErrNoRows {
+		// Released between the insert and the select; try again.
+		return s.Claim(ctx, scope, key, hash)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	record.Completed = statusCode.Valid
+	record.StatusCode = int(statusCode.Int64)
+	return &record, false, nil
+}
+
+func (s *PostgresStore) Complete(ctx context.Context, scope, key string, record Record) error {
+	_, err := s.DB.ExecContext(ctx, `
+        UPDATE idempotency_keys SET status_code = $1, content_type = $2, response_body = $3
+        WHERE scope = $4 AND idempotency_key = $5`, record.StatusCode, record.ContentType, record.Body, scope, key)
+	return err
+}
+
+func (s *PostgresStore) Release(ctx context.Context, scope, key string) error {
+	_, err := s.DB.ExecContext(ctx, `
+        DELETE FROM idempotency_keys
+        WHERE scope = $1 AND idempotency_key = $2 AND status_code IS NULL`, scope, key)
+	return err
+}
+
+// MemoryStore keeps records in memory, for tests. Keys never expire.
+type MemoryStore struct {
+	mu      sync.Mutex
+	records map[string]*Record
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{records: make(map[string]*Record)}
+}
+
+func (s *MemoryStore) Claim(ctx context.Context, scope, key, hash string) (*Record, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if record, ok := s.records[scope+"\x00"+key]; ok {
+		copied := *record
+		return &copied, false, nil
+	}
+	s.records[scope+"\x00"+key] = &Record{RequestHash: hash}
+	return nil, true, nil
+}
+
+func (s *MemoryStore) Complete(ctx context.Context, scope, key string, record Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[scope+"\x00"+key] = &record
+	return nil
+}
+
+func (s *MemoryStore) Release(ctx context.Context, scope, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if record, ok := s.records[scope+"\x00"+key]; ok && !record.Completed {
+		delete(s.records, scope+"\x00"+key)
+	}
+	return nil
+}
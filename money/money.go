@@ -0,0 +1,271 @@
+// Package money represents monetary amounts exactly, as an integer number of
+// minor units (tiyn, cents, ...) together with an ISO 4217 currency code.
+package money
+
+import (
+	"OnlineStore/apierror"
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DefaultCurrency is assumed wherever an amount arrives without a currency,
+// e.g. legacy JSON numbers or rows written before currencies were stored.
+const DefaultCurrency = "KZT"
+
+var (
+	ErrCurrencyMismatch = apierror.New(apierror.Validation, "currency mismatch")
+	ErrUnknownCurrency  = apierror.New(apierror.Validation, "unknown currency")
+	ErrInvalidAmount    = apierror.New(apierror.Validation, "invalid amount")
+)
+
+// exponents holds the number of minor-unit digits of each supported currency.
+var exponents = map[string]int{
+	"KZT": 2,
+	"RUB": 2,
+	"USD": 2,
+	"EUR": 2,
+	"GBP": 2,
+	"CNY": 2,
+	"JPY": 0,
+	"KRW": 0,
+}
+
+type Money struct {
+	Amount   int64
+	Currency string
+}
+
+func New(amount int64, currency string) Money {
+	return Money{Amount: amount, Currency: currency}
+}
+
+// Exponent returns the number of minor-unit digits for currency.
+func Exponent(currency string) (int, error) {
+	exp, ok := exponents[currency]
+	if !ok {
+		return 0, fmt.Errorf("%w: %q", ErrUnknownCurrency, currency)
+	}
+	return exp, nil
+}
+
+// Parse reads a decimal amount in major units, such as "19.99", without going
+// through floating point. More fractional digits than the currency has minor
+// units is an error rather than a silent rounding.
+func Parse(s, currency string) (Money, error) {
+	exp, err := Exponent(currency)
+	if err != nil {
+		return Money{}, err
+	}
+
+	digits := strings.TrimSpace(s)
+	negative := strings.HasPrefix(digits, "-")
+	digits = strings.TrimPrefix(strings.TrimPrefix(digits, "-"), "+")
+
+	whole, fraction, _ := strings.Cut(digits, ".")
+	if whole == "" && fraction == "" || !isDigits(whole) || !isDigits(fraction) {
+		return Money{}, fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+	}
+	if len(fraction) > exp {
+		return Money{}, fmt.Errorf("%w: %q has more than %d decimal places for %s", ErrInvalidAmount, s, exp, currency)
+	}
+	fraction += strings.Repeat("0", exp-len(fraction))
+
+	amount, err := strconv.ParseInt(whole+fraction, 10, 64)
+	if err != nil {
+		return Money{}, fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+	}
+	if negative {
+		amount = -amount
+	}
+	return Money{Amount: amount, Currency: currency}, nil
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Decimal formats the amount in major units, e.g. "19.99".
+func (m Money) Decimal() string {
+	exp, ok := exponents[m.Currency]
+	if !ok {
+		exp = exponents[DefaultCurrency]
+	}
+	amount := m.Amount
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	s := strconv.FormatInt(amount, 10)
+	if exp == 0 {
+		return sign + s
+	}
+	if len(s) <= exp {
+		s = strings.Repeat("0", exp-len(s)+1) + s
+	}
+	return sign + s[:len(s)-exp] + "." + s[len(s)-exp:]
+}
+
+// CurrencyOrDefault returns the currency, or DefaultCurrency for a zero value
+// that never had one set.
+func (m Money) CurrencyOrDefault() string {
+	if m.Currency == "" {
+		return DefaultCurrency
+	}
+	return m.Currency
+}
+
+func (m Money) String() string {
+	return m.Decimal() + " " + m.Currency
+}
+
+func (m Money) IsZero() bool {
+	return m.Amount == 0
+}
+
+func (m Money) IsNegative() bool {
+	return m.Amount < 0
+}
+
+func (m Money) Add(other Money) (Money, error) {
+	if m.Currency != other.Currency {
+		return Money{}, fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.Currency, other.Currency)
+	}
+	return Money{Amount: m.Amount + other.Amount, Currency: m.Currency}, nil
+}
+
+func (m Money) Sub(other Money) (Money, error) {
+	return m.Add(Money{Amount: -other.Amount, Currency: other.Currency})
+}
+
+func (m Money) Mul(n int64) Money {
+	return Money{Amount: m.Amount * n, Currency: m.Currency}
+}
+
+// Cmp compares two amounts of the same currency, returning -1, 0 or 1.
+func (m Money) Cmp(other Money) (int, error) {
+	if m.Currency != other.Currency {
+		return 0, fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.Currency, other.Currency)
+	}
+	switch {
+	case m.Amount < other.Amount:
+		return -1, nil
+	case m.Amount > other.Amount:
+		return 1, nil
+	default:
+		return 0, nil
+	}
+}
+
+// Sum adds amounts that must all share currency; the sum of nothing is zero.
+func Sum(currency string, amounts ...Money) (Money, error) {
+	total := Money{Currency: currency}
+	for _, amount := range amounts {
+		var err error
+		if total, err = total.Add(amount); err != nil {
+			return Money{}, err
+		}
+	}
+	return total, nil
+}
+
+type jsonMoney struct {
+	Amount   json.Number `json:"amount"`
+	Currency string      `json:"currency"`
+}
+
+// MarshalJSON writes {"amount": "19.99", "currency": "KZT"}. The amount is a
+// string so clients never see a binary floating point value.
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Amount   string `json:"amount"`
+		Currency string `json:"currency"`
+	}{m.Decimal(), m.Currency})
+}
+
+// UnmarshalJSON accepts the object form written by MarshalJSON, with the
+// amount as a string or number, and also a bare number or string in major
+// units of DefaultCurrency, which is what clients sent before amounts carried
+// a currency.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+
+	var obj jsonMoney
+	if len(data) > 0 && data[0] == '{' {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&obj); err != nil {
+			return err
+		}
+	} else {
+		var raw interface{}
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&raw); err != nil {
+			return err
+		}
+		switch v := raw.(type) {
+		case json.Number:
+			obj.Amount = v
+		case string:
+			obj.Amount = json.Number(v)
+		default:
+			return fmt.Errorf("%w: %s", ErrInvalidAmount, data)
+		}
+	}
+	if obj.Currency == "" {
+		obj.Currency = DefaultCurrency
+	}
+
+	parsed, err := Parse(obj.Amount.String(), obj.Currency)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// Value stores the amount as a BIGINT of minor units. The currency is kept in
+// a column of its own.
+func (m Money) Value() (driver.Value, error) {
+	return m.Amount, nil
+}
+
+// Scan reads a BIGINT of minor units. It leaves Currency alone, defaulting it
+// only when unset, so callers scan the currency column after the amount.
+func (m *Money) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case int64:
+		m.Amount = v
+	case []byte:
+		amount, err := strconv.ParseInt(string(v), 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: %q", ErrInvalidAmount, v)
+		}
+		m.Amount = amount
+	case string:
+		amount, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: %q", ErrInvalidAmount, v)
+		}
+		m.Amount = amount
+	default:
+		return fmt.Errorf("money: cannot scan %T", src)
+	}
+	if m.Currency == "" {
+		m.Currency = DefaultCurrency
+	}
+	return nil
+}
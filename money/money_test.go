@@ -0,0 +1,103 @@
+package money
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		in       string
+		currency string
+		want     int64
+	}{
+		{"19.99", "KZT", 1999},
+		{"0.1", "USD", 10},
+		{"100", "KZT", 10000},
+		{".5", "EUR", 50},
+		{"-3.07", "KZT", -307},
+		{"1500", "JPY", 1500},
+	}
+	for _, c := range cases {
+		m, err := Parse(c.in, c.currency)
+		require.NoError(t, err, c.in)
+		assert.Equal(t, New(c.want, c.currency), m, c.in)
+	}
+
+	for _, in := range []string{"", ".", "1.999", "1e3", "abc", "1.2.3"} {
+		_, err := Parse(in, "KZT")
+		assert.True(t, errors.Is(err, ErrInvalidAmount), in)
+	}
+	_, err := Parse("1", "XXX")
+	assert.True(t, errors.Is(err, ErrUnknownCurrency))
+}
+
+func TestDecimal(t *testing.T) {
+	assert.Equal(t, "19.99", New(1999, "KZT").Decimal())
+	assert.Equal(t, "0.05", New(5, "USD").Decimal())
+	assert.Equal(t, "-1.50", New(-150, "USD").Decimal())
+	assert.Equal(t, "1500", New(1500, "JPY").Decimal())
+	assert.Equal(t, "0.00", New(0, "KZT").Decimal())
+}
+
+func TestArithmetic(t *testing.T) {
+	// 0.1 + 0.2 is exactly 0.3, unlike float64.
+	sum, err := Sum("USD", New(10, "USD"), New(20, "USD"))
+	require.NoError(t, err)
+	assert.Equal(t, New(30, "USD"), sum)
+
+	_, err = New(1, "USD").Add(New(1, "KZT"))
+	assert.True(t, errors.Is(err, ErrCurrencyMismatch))
+
+	diff, err := New(1000, "KZT").Sub(New(250, "KZT"))
+	require.NoError(t, err)
+	assert.Equal(t, New(750, "KZT"), diff)
+	assert.Equal(t, New(2997, "KZT"), New(999, "KZT").Mul(3))
+
+	cmp, err := New(1, "KZT").Cmp(New(2, "KZT"))
+	require.NoError(t, err)
+	assert.Equal(t, -1, cmp)
+}
+
+func TestJSON(t *testing.T) {
+	data, err := json.Marshal(New(1999, "KZT"))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"amount": "19.99", "currency": "KZT"}`, string(data))
+
+	inputs := map[string]Money{
+		`{"amount": "19.99", "currency": "USD"}`: New(1999, "USD"),
+		`{"amount": 19.99, "currency": "USD"}`:   New(1999, "USD"),
+		`{"amount": 5}`:                          New(500, DefaultCurrency),
+		`10.1`:                                   New(1010, DefaultCurrency),
+		`"7.25"`:                                 New(725, DefaultCurrency),
+	}
+	for in, want := range inputs {
+		var m Money
+		require.NoError(t, json.Unmarshal([]byte(in), &m), in)
+		assert.Equal(t, want, m, in)
+	}
+
+	var m Money
+	assert.Error(t, json.Unmarshal([]byte(`true`), &m))
+	assert.Error(t, json.Unmarshal([]byte(`{"amount": "1.001", "currency": "USD"}`), &m))
+}
+
+func TestSQL(t *testing.T) {
+	value, err := New(1999, "KZT").Value()
+	require.NoError(t, err)
+	assert.Equal(t, int64(1999), value)
+
+	var m Money
+	require.NoError(t, m.Scan(int64(250)))
+	assert.Equal(t, New(250, DefaultCurrency), m)
+
+	m = Money{Currency: "USD"}
+	require.NoError(t, m.Scan([]byte("42")))
+	assert.Equal(t, New(42, "USD"), m)
+
+	assert.Error(t, m.Scan(1.5))
+}
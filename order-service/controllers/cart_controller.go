@@ -0,0 +1,148 @@
+package controllers
+
+import (
+	"OnlineStore/apierror"
+	"OnlineStore/auth"
+	"OnlineStore/order-service/models"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+)
+
+// CartController serves the caller's own cart; there is no way to reach
+// another user's.
+type CartController struct {
+	CartModel models.CartModel
+}
+
+func NewCartController(cartModel models.CartModel) *CartController {
+	return &CartController{CartModel: cartModel}
+}
+
+type cartItemInput struct {
+	ProductID int `json:"product_id"`
+	Quantity  int `json:"quantity"`
+}
+
+func (cc *CartController) GetCartController(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := signedInUser(writer, request)
+	if !ok {
+		return
+	}
+	cc.writeCart(writer, request, userID)
+}
+
+// AddCartItemController puts quantity (default 1) more of the product in the
+// cart and returns the cart.
+func (cc *CartController) AddCartItemController(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := signedInUser(writer, request)
+	if !ok {
+		return
+	}
+	input := cartItemInput{Quantity: 1}
+	err := json.NewDecoder(request.Body).Decode(&input)
+	if err != nil {
+		apierror.Write(writer, request, apierror.Wrap(apierror.Validation, "invalid JSON body", err))
+		return
+	}
+	err = cc.CartModel.AddCartItem(userID, input.ProductID, input.Quantity)
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	cc.writeCart(writer, request, userID)
+}
+
+// UpdateCartItemController sets the quantity of a product in the cart, zero
+// removing it, and returns the cart.
+func (cc *CartController) UpdateCartItemController(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := signedInUser(writer, request)
+	if !ok {
+		return
+	}
+	productID, err := strconv.Atoi(mux.Vars(request)["product_id"])
+	if err != nil {
+		apierror.Write(writer, request, apierror.New(apierror.Validation, "product_id must be a number"))
+		return
+	}
+	var input cartItemInput
+	err = json.NewDecoder(request.Body).Decode(&input)
+	if err != nil {
+		apierror.Write(writer, request, apierror.Wrap(apierror.Validation, "invalid JSON body", err))
+		return
+	}
+	err = cc.CartModel.SetCartItemQuantity(userID, productID, input.Quantity)
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	cc.writeCart(writer, request, userID)
+}
+
+func (cc *CartController) RemoveCartItemController(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := signedInUser(writer, request)
+	if !ok {
+		return
+	}
+	productID, err := strconv.Atoi(mux.Vars(request)["product_id"])
+	if err != nil {
+		apierror.Write(writer, request, apierror.New(apierror.Validation, "product_id must be a number"))
+		return
+	}
+	err = cc.CartModel.RemoveCartItem(userID, productID)
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	cc.writeCart(writer, request, userID)
+}
+
+// CheckoutController orders everything in the cart and empties it. If any
+// product is short of stock nothing is ordered and the cart is kept.
+func (cc *CartController) CheckoutController(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := signedInUser(writer, request)
+	if !ok {
+		return
+	}
+	order, err := cc.CartModel.CheckoutCart(userID)
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	jsonOrder, err := json.Marshal(order)
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusCreated)
+	_, err = writer.Write(jsonOrder)
+}
+
+func (cc *CartController) writeCart(writer http.ResponseWriter, request *http.Request, userID int) {
+	cart, err := cc.CartModel.GetCart(userID)
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	jsonCart, err := json.Marshal(cart)
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	_, err = writer.Write(jsonCart)
+}
+
+// signedInUser returns the calling user, whose cart or checkout the request
+// is about. Anonymous callers get 401.
+func signedInUser(writer http.ResponseWriter, request *http.Request) (int, bool) {
+	caller := auth.CallerFromRequest(request)
+	if caller.UserID == 0 {
+		apierror.Write(writer, request, apierror.New(apierror.Unauthorized, "sign in to use a cart"))
+		return 0, false
+	}
+	return caller.UserID, true
+}
@@ -0,0 +1,194 @@
+package controllers
+
+import (
+	"OnlineStore/auth"
+	"OnlineStore/money"
+	"OnlineStore/order-service/models"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+// MockCartModel keeps carts in memory, pricing them from Products.
+type MockCartModel struct {
+	Products map[int]models.CartItem
+	Carts    map[int]map[int]int
+	Orders   []*models.Order
+}
+
+func (m *MockCartModel) GetCart(userID int) (*models.Cart, error) {
+	var items []models.CartItem
+	for productID := 1; productID <= len(m.Products); productID++ {
+		if quantity, ok := m.Carts[userID][productID]; ok {
+			item := m.Products[productID]
+			item.ProductID = productID
+			item.Quantity = quantity
+			items = append(items, item)
+		}
+	}
+	return models.NewCart(userID, items), nil
+}
+
+func (m *MockCartModel) AddCartItem(userID, productID, quantity int) error {
+	if quantity <= 0 {
+		return models.ErrInvalidOrderItems
+	}
+	if _, ok := m.Products[productID]; !ok {
+		return models.ErrProductNotFound
+	}
+	if m.Carts[userID] == nil {
+		m.Carts[userID] = map[int]int{}
+	}
+	m.Carts[userID][productID] += quantity
+	return nil
+}
+
+func (m *MockCartModel) SetCartItemQuantity(userID, productID, quantity int) error {
+	if quantity == 0 {
+		return m.RemoveCartItem(userID, productID)
+	}
+	if _, ok := m.Carts[userID][productID]; !ok {
+		return sql.ErrNoRows
+	}
+	m.Carts[userID][productID] = quantity
+	return nil
+}
+
+func (m *MockCartModel) RemoveCartItem(userID, productID int) error {
+	if _, ok := m.Carts[userID][productID]; !ok {
+		return sql.ErrNoRows
+	}
+	delete(m.Carts[userID], productID)
+	return nil
+}
+
+func (m *MockCartModel) CheckoutCart(userID int) (*models.Order, error) {
+	cart, _ := m.GetCart(userID)
+	if len(cart.Items) == 0 {
+		return nil, models.ErrCartEmpty
+	}
+	order := &models.Order{ID: len(m.Orders) + 1, UserID: userID, Status: models.StatusPending, TotalPrice: *cart.Total}
+	for _, item := range cart.Items {
+		if item.Quantity > item.Available {
+			return nil, models.ErrInsufficientStock
+		}
+		order.Items = append(order.Items, models.OrderItem{ProductID: item.ProductID, Quantity: item.Quantity, UnitPrice: item.UnitPrice})
+	}
+	m.Orders = append(m.Orders, order)
+	delete(m.Carts, userID)
+	return order, nil
+}
+
+func newCartRouter() (*mux.Router, *MockCartModel) {
+	mockModel := &MockCartModel{
+		Products: map[int]models.CartItem{
+			1: {Name: "Mug", UnitPrice: money.New(150000, "KZT"), Available: 10},
+			2: {Name: "Teapot", UnitPrice: money.New(400000, "KZT"), Available: 1},
+		},
+		Carts: map[int]map[int]int{},
+	}
+	controller := NewCartController(mockModel)
+	router := mux.NewRouter()
+	router.HandleFunc("/cart", controller.GetCartController).Methods("GET")
+	router.HandleFunc("/cart/items", controller.AddCartItemController).Methods("POST")
+	router.HandleFunc("/cart/items/{product_id:[0-9]+}", controller.UpdateCartItemController).Methods("PUT")
+	router.HandleFunc("/cart/items/{product_id:[0-9]+}", controller.RemoveCartItemController).Methods("DELETE")
+	router.HandleFunc("/cart/checkout", controller.CheckoutController).Methods("POST")
+	return router, mockModel
+}
+
+func cartRequest(t *testing.T, router *mux.Router, userID int, method, url, body string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userID != 0 {
+		req.Header.Set(auth.UserIDHeader, fmt.Sprint(userID))
+		req.Header.Set(auth.UserRoleHeader, auth.RoleCustomer)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestCartController(t *testing.T) {
+	router, mockModel := newCartRouter()
+
+	rr := cartRequest(t, router, 7, "POST", "/cart/items", `{"product_id": 1}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	rr = cartRequest(t, router, 7, "POST", "/cart/items", `{"product_id": 1, "quantity": 2}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	rr = cartRequest(t, router, 7, "POST", "/cart/items", `{"product_id": 2, "quantity": 3}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var cart models.Cart
+	if err := json.Unmarshal(rr.Body.Bytes(), &cart); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 7, cart.UserID)
+	if assert.Len(t, cart.Items, 2) {
+		assert.Equal(t, 3, cart.Items[0].Quantity)
+		assert.Equal(t, money.New(450000, "KZT"), cart.Items[0].LineTotal)
+		assert.Empty(t, cart.Items[0].Warning)
+		assert.Equal(t, "only 1 left in stock", cart.Items[1].Warning)
+	}
+	assert.Equal(t, money.New(1650000, "KZT"), *cart.Total)
+
+	// Another user's cart is separate
+	rr = cartRequest(t, router, 8, "GET", "/cart", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"items":[]`)
+
+	rr = cartRequest(t, router, 7, "POST", "/cart/items", `{"product_id": 99}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	rr = cartRequest(t, router, 7, "POST", "/cart/items", `{"product_id": 1, "quantity": -1}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	rr = cartRequest(t, router, 8, "PUT", "/cart/items/1", `{"quantity": 2}`)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	rr = cartRequest(t, router, 0, "GET", "/cart", "")
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	// Not enough teapots: nothing is ordered and the cart is kept
+	rr = cartRequest(t, router, 7, "POST", "/cart/checkout", "")
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Len(t, mockModel.Carts[7], 2)
+
+	rr = cartRequest(t, router, 7, "PUT", "/cart/items/2", `{"quantity": 0}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	rr = cartRequest(t, router, 7, "POST", "/cart/checkout", "")
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	var order models.Order
+	if err := json.Unmarshal(rr.Body.Bytes(), &order); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 7, order.UserID)
+	assert.Equal(t, []models.OrderItem{{ProductID: 1, Quantity: 3, UnitPrice: money.New(150000, "KZT")}}, order.Items)
+	assert.Empty(t, mockModel.Carts[7])
+
+	rr = cartRequest(t, router, 7, "POST", "/cart/checkout", "")
+	assert.Equal(t, http.StatusConflict, rr.Code)
+}
+
+func TestNewCart(t *testing.T) {
+	cart := models.NewCart(1, []models.CartItem{
+		{ProductID: 1, Quantity: 2, UnitPrice: money.New(100, "KZT"), Available: 0},
+		{ProductID: 2, Quantity: 1, UnitPrice: money.New(500, "USD"), Available: 5},
+	})
+
+	assert.Equal(t, "out of stock", cart.Items[0].Warning)
+	assert.Equal(t, money.New(200, "KZT"), cart.Items[0].LineTotal)
+	// Mixed currencies have no total
+	assert.Nil(t, cart.Total)
+
+	empty := models.NewCart(1, nil)
+	assert.Equal(t, []models.CartItem{}, empty.Items)
+	assert.Equal(t, money.New(0, "KZT"), *empty.Total)
+}
@@ -0,0 +1,102 @@
+package controllers
+
+import (
+	"OnlineStore/apierror"
+	"OnlineStore/auth"
+	"OnlineStore/order-service/models"
+	"OnlineStore/order-service/services"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+)
+
+type CheckoutController struct {
+	Saga *services.CheckoutSaga
+}
+
+func NewCheckoutController(saga *services.CheckoutSaga) *CheckoutController {
+	return &CheckoutController{Saga: saga}
+}
+
+type checkoutInput struct {
+	Items []models.OrderItem `json:"items"`
+	Card  services.Card      `json:"card"`
+	Email string             `json:"email"`
+	Phone string             `json:"phone"`
+}
+
+// CheckoutController places the order in the body and pays for it. It answers
+// 201 once the order is paid, 402 if the payment failed and the order was
+// cancelled, and 202 while the payment is still being decided.
+func (cc *CheckoutController) CheckoutController(writer http.ResponseWriter, request *http.Request) {
+	userID, ok := signedInUser(writer, request)
+	if !ok {
+		return
+	}
+	var input checkoutInput
+	err := json.NewDecoder(request.Body).Decode(&input)
+	if err != nil {
+		apierror.Write(writer, request, apierror.Wrap(apierror.Validation, "invalid JSON body", err))
+		return
+	}
+	order := models.Order{Items: input.Items}
+	if err := order.NormalizeItems(); err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+
+	checkout, err := cc.Saga.Checkout(request.Context(), services.CheckoutRequest{
+		UserID: userID,
+		Items:  order.Items,
+		Card:   input.Card,
+		Email:  input.Email,
+		Phone:  input.Phone,
+	})
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	status := http.StatusAccepted
+	switch checkout.Status {
+	case models.CheckoutCompleted:
+		status = http.StatusCreated
+	case models.CheckoutFailed:
+		status = http.StatusPaymentRequired
+	}
+	writeCheckout(writer, request, status, checkout)
+}
+
+func (cc *CheckoutController) GetCheckoutController(writer http.ResponseWriter, request *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(request)["id"])
+	if err != nil {
+		apierror.Write(writer, request, apierror.New(apierror.Validation, "id must be a number"))
+		return
+	}
+	checkout, err := cc.Saga.Checkouts.GetCheckout(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = models.ErrCheckoutNotFound
+	}
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	if !auth.CallerFromRequest(request).Owns(checkout.UserID) {
+		apierror.Write(writer, request, models.ErrCheckoutNotFound)
+		return
+	}
+	writeCheckout(writer, request, http.StatusOK, checkout)
+}
+
+func writeCheckout(writer http.ResponseWriter, request *http.Request, status int, checkout *models.Checkout) {
+	jsonCheckout, err := json.Marshal(checkout)
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	_, err = writer.Write(jsonCheckout)
+}
@@ -1,9 +1,16 @@
 package controllers
 
 import (
+	"OnlineStore/apierror"
+	"OnlineStore/auth"
+	"OnlineStore/money"
 	"OnlineStore/order-service/models"
+	"OnlineStore/pagination"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"github.com/gorilla/mux"
+	"io"
 	"net/http"
 	"strconv"
 )
@@ -16,19 +23,40 @@ func NewOrderController(orderModel models.OrderModel) *OrderController {
 	return &OrderController{OrderModel: orderModel}
 }
 
+// GetOrdersController lists a page of orders, optionally filtered by user_id
+// and status. Customers only ever list their own orders.
 func (oc *OrderController) GetOrdersController(writer http.ResponseWriter, request *http.Request) {
-	orders, err := oc.OrderModel.GetOrders()
+	query := request.URL.Query()
+	page, err := pagination.FromQuery(query, models.OrderSorts...)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		apierror.Write(writer, request, err)
 		return
 	}
-	if len(orders) == 0 {
-		writer.WriteHeader(http.StatusNotFound)
+	filter := models.OrderFilter{Status: query.Get("status")}
+	if userID := query.Get("user_id"); userID != "" {
+		filter.UserID, err = strconv.Atoi(userID)
+		if err != nil {
+			apierror.Write(writer, request, apierror.New(apierror.Validation, "user_id must be a number"))
+			return
+		}
+	}
+	caller := auth.CallerFromRequest(request)
+	if !caller.IsAdmin() {
+		if filter.UserID != 0 && filter.UserID != caller.UserID {
+			apierror.Write(writer, request, apierror.New(apierror.NotFound, "user not found"))
+			return
+		}
+		filter.UserID = caller.UserID
+	}
+
+	orders, total, err := oc.OrderModel.ListOrders(filter, page)
+	if err != nil {
+		apierror.Write(writer, request, err)
 		return
 	}
-	jsonOrders, err := json.Marshal(orders)
+	jsonOrders, err := json.Marshal(pagination.NewPage(orders, total, page))
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		apierror.Write(writer, request, err)
 		return
 	}
 	writer.Header().Set("Content-Type", "application/json")
@@ -40,17 +68,16 @@ func (oc *OrderController) GetOrderByIDController(writer http.ResponseWriter, re
 	vars := mux.Vars(request)
 	id, err := strconv.Atoi(vars["id"])
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		apierror.Write(writer, request, apierror.New(apierror.Validation, "id must be a number"))
 		return
 	}
-	order, err := oc.OrderModel.GetOrderByID(id)
-	if err != nil {
-		writer.WriteHeader(http.StatusNotFound)
+	order, ok := oc.ownedOrder(writer, request, id)
+	if !ok {
 		return
 	}
 	jsonOrder, err := json.Marshal(order)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		apierror.Write(writer, request, err)
 		return
 	}
 	writer.Header().Set("Content-Type", "application/json")
@@ -62,12 +89,20 @@ func (oc *OrderController) CreateOrderController(writer http.ResponseWriter, req
 	var order models.Order
 	err := json.NewDecoder(request.Body).Decode(&order)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		apierror.Write(writer, request, apierror.Wrap(apierror.Validation, "invalid JSON body", err))
+		return
+	}
+	if err := order.NormalizeItems(); err != nil {
+		apierror.Write(writer, request, err)
 		return
 	}
+	if caller := auth.CallerFromRequest(request); !caller.IsAdmin() {
+		// Customers can only order for themselves.
+		order.UserID = caller.UserID
+	}
 	err = oc.OrderModel.CreateOrder(order)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		apierror.Write(writer, request, err)
 		return
 	}
 	writer.WriteHeader(http.StatusCreated)
@@ -77,20 +112,32 @@ func (oc *OrderController) UpdateOrderController(writer http.ResponseWriter, req
 	vars := mux.Vars(request)
 	id, err := strconv.Atoi(vars["id"])
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		apierror.Write(writer, request, apierror.New(apierror.Validation, "id must be a number"))
 		return
 
 	}
 	var order models.Order
 	err = json.NewDecoder(request.Body).Decode(&order)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		apierror.Write(writer, request, apierror.Wrap(apierror.Validation, "invalid JSON body", err))
 		return
 	}
 	order.ID = id
+	if err := order.NormalizeItems(); err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	existing, ok := oc.ownedOrder(writer, request, id)
+	if !ok {
+		return
+	}
+	if !auth.CallerFromRequest(request).IsAdmin() {
+		// Only admins may move an order to another user.
+		order.UserID = existing.UserID
+	}
 	err = oc.OrderModel.UpdateOrder(order)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		apierror.Write(writer, request, err)
 		return
 	}
 	writer.WriteHeader(http.StatusOK)
@@ -100,38 +147,48 @@ func (oc *OrderController) DeleteOrderController(writer http.ResponseWriter, req
 	vars := mux.Vars(request)
 	id, err := strconv.Atoi(vars["id"])
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		apierror.Write(writer, request, apierror.New(apierror.Validation, "id must be a number"))
+		return
+	}
+	if _, ok := oc.ownedOrder(writer, request, id); !ok {
 		return
 	}
 	err = oc.OrderModel.DeleteOrder(id)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		apierror.Write(writer, request, err)
 		return
 	}
 	writer.WriteHeader(http.StatusOK)
 }
 
+// SearchOrderController finds orders by user or status. Customers only ever
+// find their own orders.
 func (oc *OrderController) SearchOrderController(writer http.ResponseWriter, request *http.Request) {
+	caller := auth.CallerFromRequest(request)
 	userID := request.URL.Query().Get("user")
 	status := request.URL.Query().Get("status")
 	if userID != "" {
 		userIdInt, err := strconv.Atoi(userID)
 		if err != nil {
-			http.Error(writer, err.Error(), http.StatusBadRequest)
+			apierror.Write(writer, request, apierror.New(apierror.Validation, "user must be a number"))
+			return
+		}
+		if !caller.Owns(userIdInt) {
+			apierror.Write(writer, request, apierror.New(apierror.NotFound, "user not found"))
 			return
 		}
 		orders, err := oc.OrderModel.GetOrderByUserID(userIdInt)
 		if err != nil {
-			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			apierror.Write(writer, request, err)
 			return
 		}
 		if len(orders) == 0 {
-			writer.WriteHeader(http.StatusNotFound)
+			apierror.Write(writer, request, apierror.New(apierror.NotFound, "no orders found"))
 			return
 		}
 		jsonOrders, err := json.Marshal(orders)
 		if err != nil {
-			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			apierror.Write(writer, request, err)
 			return
 		}
 		writer.Header().Set("Content-Type", "application/json")
@@ -140,23 +197,154 @@ func (oc *OrderController) SearchOrderController(writer http.ResponseWriter, req
 	} else if status != "" {
 		orders, err := oc.OrderModel.GetOrderByStatus(status)
 		if err != nil {
-			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			apierror.Write(writer, request, err)
 			return
 		}
+		orders = ownedOrders(caller, orders)
 		if len(orders) == 0 {
-			writer.WriteHeader(http.StatusNotFound)
+			apierror.Write(writer, request, apierror.New(apierror.NotFound, "no orders found"))
 			return
 		}
 		jsonOrders, err := json.Marshal(orders)
 		if err != nil {
-			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			apierror.Write(writer, request, err)
 			return
 		}
 		writer.Header().Set("Content-Type", "application/json")
 		writer.WriteHeader(http.StatusOK)
 		_, err = writer.Write(jsonOrders)
 	} else {
-		http.Error(writer, "Invalid query parameters", http.StatusBadRequest)
+		apierror.Write(writer, request, apierror.New(apierror.Validation, "search by user or status"))
 	}
 
 }
+
+// TransitionOrderController returns a handler that moves the order in the
+// path to the given status, recording the caller from X-User-ID as the author
+// of the change.
+func (oc *OrderController) TransitionOrderController(status string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		vars := mux.Vars(request)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			apierror.Write(writer, request, apierror.New(apierror.Validation, "id must be a number"))
+			return
+		}
+		if _, ok := oc.ownedOrder(writer, request, id); !ok {
+			return
+		}
+		changedBy := auth.CallerFromRequest(request).UserID
+		err = oc.OrderModel.UpdateOrderStatus(id, status, changedBy)
+		if err != nil {
+			apierror.Write(writer, request, err)
+			return
+		}
+		oc.writeOrder(writer, request, id)
+	}
+}
+
+// PayOrderController marks the order in the path paid. The body may give the
+// amount paid, {"amount": ...}, which must then still be the order's total:
+// otherwise the order was changed while it was being paid for, and the answer
+// is 409 with the order left pending.
+func (oc *OrderController) PayOrderController(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		apierror.Write(writer, request, apierror.New(apierror.Validation, "id must be a number"))
+		return
+	}
+	var input struct {
+		Amount *money.Money `json:"amount"`
+	}
+	if request.Body != nil {
+		if err := json.NewDecoder(request.Body).Decode(&input); err != nil && err != io.EOF {
+			apierror.Write(writer, request, apierror.Wrap(apierror.Validation, "invalid JSON body", err))
+			return
+		}
+	}
+	if _, ok := oc.ownedOrder(writer, request, id); !ok {
+		return
+	}
+	changedBy := auth.CallerFromRequest(request).UserID
+	if input.Amount != nil {
+		err = oc.OrderModel.PayOrder(id, *input.Amount, changedBy)
+	} else {
+		err = oc.OrderModel.UpdateOrderStatus(id, models.StatusPaid, changedBy)
+	}
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	oc.writeOrder(writer, request, id)
+}
+
+// writeOrder answers with the order as it is now.
+func (oc *OrderController) writeOrder(writer http.ResponseWriter, request *http.Request, id int) {
+	order, err := oc.OrderModel.GetOrderByID(id)
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	jsonOrder, err := json.Marshal(order)
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	_, err = writer.Write(jsonOrder)
+}
+
+func (oc *OrderController) GetOrderStatusHistoryController(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		apierror.Write(writer, request, apierror.New(apierror.Validation, "id must be a number"))
+		return
+	}
+	if _, ok := oc.ownedOrder(writer, request, id); !ok {
+		return
+	}
+	history, err := oc.OrderModel.GetOrderStatusHistory(id)
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	jsonHistory, err := json.Marshal(history)
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	_, err = writer.Write(jsonHistory)
+}
+
+// ownedOrder loads the order if the caller owns it. Otherwise it answers 404,
+// whether or not the order exists, and returns false.
+func (oc *OrderController) ownedOrder(writer http.ResponseWriter, request *http.Request, id int) (*models.Order, bool) {
+	order, err := oc.OrderModel.GetOrderByID(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = models.ErrOrderNotFound
+	}
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return nil, false
+	}
+	if !auth.CallerFromRequest(request).Owns(order.UserID) {
+		apierror.Write(writer, request, models.ErrOrderNotFound)
+		return nil, false
+	}
+	return order, true
+}
+
+func ownedOrders(caller auth.Caller, orders []*models.Order) []*models.Order {
+	owned := make([]*models.Order, 0, len(orders))
+	for _, order := range orders {
+		if caller.Owns(order.UserID) {
+			owned = append(owned, order)
+		}
+	}
+	return owned
+}
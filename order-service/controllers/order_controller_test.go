@@ -1,8 +1,12 @@
 package controllers
 
 import (
+	"OnlineStore/auth"
+	"OnlineStore/money"
 	"OnlineStore/order-service/models"
+	"OnlineStore/pagination"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -16,13 +20,25 @@ import (
 // MockOrderModel is a mock implementation of the OrderModel interface
 type MockOrderModel struct {
 	Orders []*models.Order
+	Err    error
 }
 
-func (m *MockOrderModel) GetOrders() ([]*models.Order, error) {
-	return m.Orders, nil
+func (m *MockOrderModel) ListOrders(filter models.OrderFilter, page pagination.Params) ([]*models.Order, int, error) {
+	var orders []*models.Order
+	for _, order := range m.Orders {
+		if (filter.UserID == 0 || order.UserID == filter.UserID) && (filter.Status == "" || order.Status == filter.Status) {
+			orders = append(orders, order)
+		}
+	}
+	total := len(orders)
+	orders = orders[min(page.Offset, total):min(page.Offset+page.Limit, total)]
+	return orders, total, nil
 }
 
 func (m *MockOrderModel) CreateOrder(order models.Order) error {
+	if m.Err != nil {
+		return m.Err
+	}
 	m.Orders = append(m.Orders, &order)
 	return nil
 }
@@ -76,11 +92,42 @@ func (m *MockOrderModel) GetOrderByStatus(status string) ([]*models.Order, error
 	return orders, nil
 }
 
+func (m *MockOrderModel) UpdateOrderStatus(id int, status string, changedBy int) error {
+	for _, order := range m.Orders {
+		if order.ID == id {
+			if !models.CanTransition(order.Status, status) {
+				return models.ErrInvalidTransition
+			}
+			order.Status = status
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (m *MockOrderModel) PayOrder(id int, amount money.Money, changedBy int) error {
+	for _, order := range m.Orders {
+		if order.ID == id && order.Status == models.StatusPending && amount != order.TotalPrice {
+			return models.ErrTotalMismatch
+		}
+	}
+	return m.UpdateOrderStatus(id, models.StatusPaid, changedBy)
+}
+
+func (m *MockOrderModel) GetOrderStatusHistory(id int) ([]*models.OrderStatusChange, error) {
+	for _, order := range m.Orders {
+		if order.ID == id {
+			return []*models.OrderStatusChange{{OrderID: id, ToStatus: order.Status}}, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
 func TestGetOrdersController(t *testing.T) {
 	mockModel := &MockOrderModel{
 		Orders: []*models.Order{
-			{ID: 1, UserID: 1, TotalPrice: 100.0, OrderDate: "2023-01-01", Status: "New", ProductIDs: []int{1, 2}},
-			{ID: 2, UserID: 2, TotalPrice: 200.0, OrderDate: "2023-01-02", Status: "Shipped", ProductIDs: []int{3, 4}},
+			{ID: 1, UserID: 1, TotalPrice: money.New(10000, "KZT"), OrderDate: "2023-01-01", Status: "New", ProductIDs: []int{1, 2}},
+			{ID: 2, UserID: 2, TotalPrice: money.New(20000, "KZT"), OrderDate: "2023-01-02", Status: "Shipped", ProductIDs: []int{3, 4}},
 		},
 	}
 	controller := NewOrderController(mockModel)
@@ -89,6 +136,7 @@ func TestGetOrdersController(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
 
 	rr := httptest.NewRecorder()
 	handler := http.HandlerFunc(controller.GetOrdersController)
@@ -96,26 +144,55 @@ func TestGetOrdersController(t *testing.T) {
 
 	assert.Equal(t, http.StatusOK, rr.Code)
 
-	var orders []*models.Order
-	err = json.Unmarshal(rr.Body.Bytes(), &orders)
+	var page pagination.Page[*models.Order]
+	err = json.Unmarshal(rr.Body.Bytes(), &page)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	assert.Equal(t, 2, len(orders))
+	assert.Equal(t, 2, len(page.Items))
+	assert.Equal(t, 2, page.Total)
+	assert.Nil(t, page.Next)
+
+	// Test paging and filtering
+	req = httptest.NewRequest("GET", "/orders?limit=1&sort=order_date&order=desc", nil)
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &page))
+	assert.Equal(t, 1, len(page.Items))
+	assert.Equal(t, 2, page.Total)
+	assert.Equal(t, 1, *page.Next)
+
+	req = httptest.NewRequest("GET", "/orders?status=Shipped", nil)
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &page))
+	assert.Equal(t, 1, page.Total)
+	assert.Equal(t, 2, page.Items[0].ID)
+
+	// Test invalid paging
+	req = httptest.NewRequest("GET", "/orders?sort=user_password", nil)
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
 }
 
 func TestCreateOrderController(t *testing.T) {
 	mockModel := &MockOrderModel{}
 	controller := NewOrderController(mockModel)
 
-	newOrder := models.Order{UserID: 1, TotalPrice: 150.0, OrderDate: "2023-02-01", Status: "New", ProductIDs: []int{1, 2, 3}}
+	newOrder := models.Order{UserID: 1, TotalPrice: money.New(15000, "KZT"), OrderDate: "2023-02-01", Status: "New", ProductIDs: []int{1, 2, 3}}
 	orderJson, _ := json.Marshal(newOrder)
 
 	req, err := http.NewRequest("POST", "/orders", strings.NewReader(string(orderJson)))
 	if err != nil {
 		t.Fatal(err)
 	}
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
 	req.Header.Set("Content-Type", "application/json")
 
 	rr := httptest.NewRecorder()
@@ -127,10 +204,63 @@ func TestCreateOrderController(t *testing.T) {
 	assert.Equal(t, newOrder.UserID, mockModel.Orders[0].UserID)
 }
 
+func TestCreateOrderControllerItems(t *testing.T) {
+	mockModel := &MockOrderModel{}
+	controller := NewOrderController(mockModel)
+
+	body := `{"user_id": 1, "items": [{"product_id": 1, "quantity": 2, "unit_price": 0.01}], "product_ids": [2, 1, 2]}`
+	req, err := http.NewRequest("POST", "/orders", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(controller.CreateOrderController)
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.Equal(t, 1, len(mockModel.Orders))
+	assert.Equal(t, []models.OrderItem{{ProductID: 1, Quantity: 3}, {ProductID: 2, Quantity: 2}}, mockModel.Orders[0].Items)
+	assert.Nil(t, mockModel.Orders[0].ProductIDs)
+
+	// Test invalid quantity
+	req, err = http.NewRequest("POST", "/orders", strings.NewReader(`{"user_id": 1, "items": [{"product_id": 1, "quantity": 0}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, 1, len(mockModel.Orders))
+}
+
+func TestCreateOrderControllerInsufficientStock(t *testing.T) {
+	mockModel := &MockOrderModel{Err: fmt.Errorf("%w for product %d", models.ErrInsufficientStock, 1)}
+	controller := NewOrderController(mockModel)
+
+	req, err := http.NewRequest("POST", "/orders", strings.NewReader(`{"user_id": 1, "product_ids": [1, 1]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(controller.CreateOrderController)
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Equal(t, 0, len(mockModel.Orders))
+}
+
 func TestGetOrderByIDController(t *testing.T) {
 	mockModel := &MockOrderModel{
 		Orders: []*models.Order{
-			{ID: 1, UserID: 1, TotalPrice: 100.0, OrderDate: "2023-01-01", Status: "New", ProductIDs: []int{1, 2}},
+			{ID: 1, UserID: 1, TotalPrice: money.New(10000, "KZT"), OrderDate: "2023-01-01", Status: "New", ProductIDs: []int{1, 2}},
 		},
 	}
 	controller := NewOrderController(mockModel)
@@ -139,6 +269,7 @@ func TestGetOrderByIDController(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
 
 	rr := httptest.NewRecorder()
 	router := mux.NewRouter()
@@ -159,18 +290,19 @@ func TestGetOrderByIDController(t *testing.T) {
 func TestUpdateOrderController(t *testing.T) {
 	mockModel := &MockOrderModel{
 		Orders: []*models.Order{
-			{ID: 1, UserID: 1, TotalPrice: 100.0, OrderDate: "2023-01-01", Status: "New", ProductIDs: []int{1, 2}},
+			{ID: 1, UserID: 1, TotalPrice: money.New(10000, "KZT"), OrderDate: "2023-01-01", Status: "New", ProductIDs: []int{1, 2}},
 		},
 	}
 	controller := NewOrderController(mockModel)
 
-	updatedOrder := models.Order{ID: 1, UserID: 1, TotalPrice: 150.0, OrderDate: "2023-02-01", Status: "Shipped", ProductIDs: []int{1, 2, 3}}
+	updatedOrder := models.Order{ID: 1, UserID: 1, TotalPrice: money.New(15000, "KZT"), OrderDate: "2023-02-01", Status: "Shipped", ProductIDs: []int{1, 2, 3}}
 	orderJson, _ := json.Marshal(updatedOrder)
 
 	req, err := http.NewRequest("PUT", "/orders/1", strings.NewReader(string(orderJson)))
 	if err != nil {
 		t.Fatal(err)
 	}
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
 	req.Header.Set("Content-Type", "application/json")
 
 	rr := httptest.NewRecorder()
@@ -185,7 +317,7 @@ func TestUpdateOrderController(t *testing.T) {
 func TestDeleteOrderController(t *testing.T) {
 	mockModel := &MockOrderModel{
 		Orders: []*models.Order{
-			{ID: 1, UserID: 1, TotalPrice: 100.0, OrderDate: "2023-01-01", Status: "New", ProductIDs: []int{1, 2}},
+			{ID: 1, UserID: 1, TotalPrice: money.New(10000, "KZT"), OrderDate: "2023-01-01", Status: "New", ProductIDs: []int{1, 2}},
 		},
 	}
 	controller := NewOrderController(mockModel)
@@ -194,6 +326,7 @@ func TestDeleteOrderController(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
 
 	rr := httptest.NewRecorder()
 	router := mux.NewRouter()
@@ -207,8 +340,8 @@ func TestDeleteOrderController(t *testing.T) {
 func TestSearchOrderController(t *testing.T) {
 	mockModel := &MockOrderModel{
 		Orders: []*models.Order{
-			{ID: 1, UserID: 1, TotalPrice: 100.0, OrderDate: "2023-01-01", Status: "New", ProductIDs: []int{1, 2}},
-			{ID: 2, UserID: 2, TotalPrice: 200.0, OrderDate: "2023-01-02", Status: "Shipped", ProductIDs: []int{3, 4}},
+			{ID: 1, UserID: 1, TotalPrice: money.New(10000, "KZT"), OrderDate: "2023-01-01", Status: "New", ProductIDs: []int{1, 2}},
+			{ID: 2, UserID: 2, TotalPrice: money.New(20000, "KZT"), OrderDate: "2023-01-02", Status: "Shipped", ProductIDs: []int{3, 4}},
 		},
 	}
 	controller := NewOrderController(mockModel)
@@ -218,6 +351,7 @@ func TestSearchOrderController(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
 
 	rr := httptest.NewRecorder()
 	router := mux.NewRouter()
@@ -240,6 +374,7 @@ func TestSearchOrderController(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
 
 	rr = httptest.NewRecorder()
 	router.ServeHTTP(rr, req)
@@ -254,3 +389,149 @@ func TestSearchOrderController(t *testing.T) {
 	assert.Equal(t, 1, len(orders))
 	assert.Equal(t, "Shipped", orders[0].Status)
 }
+
+func TestTransitionOrderController(t *testing.T) {
+	mockModel := &MockOrderModel{
+		Orders: []*models.Order{
+			{ID: 1, UserID: 1, TotalPrice: money.New(10000, "KZT"), OrderDate: "2023-01-01", Status: models.StatusPending, ProductIDs: []int{1, 2}},
+			{ID: 2, UserID: 2, TotalPrice: money.New(20000, "KZT"), OrderDate: "2023-01-02", Status: models.StatusDelivered, ProductIDs: []int{3, 4}},
+		},
+	}
+	controller := NewOrderController(mockModel)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/orders/{id}/cancel", controller.TransitionOrderController(models.StatusCancelled)).Methods("POST")
+	router.HandleFunc("/orders/{id}/pay", controller.PayOrderController).Methods("POST")
+
+	// Test legal transition
+	req, err := http.NewRequest("POST", "/orders/1/cancel", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, models.StatusCancelled, mockModel.Orders[0].Status)
+
+	// Test illegal transition
+	req, err = http.NewRequest("POST", "/orders/2/pay", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Equal(t, models.StatusDelivered, mockModel.Orders[1].Status)
+
+	// Test missing order
+	req, err = http.NewRequest("POST", "/orders/3/cancel", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestPayOrderController(t *testing.T) {
+	mockModel := &MockOrderModel{
+		Orders: []*models.Order{
+			{ID: 1, UserID: 1, TotalPrice: money.New(10000, "KZT"), Status: models.StatusPending},
+			{ID: 2, UserID: 2, TotalPrice: money.New(20000, "KZT"), Status: models.StatusPending},
+		},
+	}
+	controller := NewOrderController(mockModel)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/orders/{id}/pay", controller.PayOrderController).Methods("POST")
+
+	pay := func(id int, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", fmt.Sprintf("/orders/%d/pay", id), strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// An amount that is no longer the order's total leaves it pending
+	rr := pay(1, `{"amount": {"amount": "50.00", "currency": "KZT"}}`)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Contains(t, rr.Body.String(), "amount-mismatch")
+	assert.Equal(t, models.StatusPending, mockModel.Orders[0].Status)
+
+	// The order's total marks it paid
+	rr = pay(1, `{"amount": {"amount": "100.00", "currency": "KZT"}}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, models.StatusPaid, mockModel.Orders[0].Status)
+
+	// Without an amount the order is marked paid unchecked
+	rr = pay(2, "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, models.StatusPaid, mockModel.Orders[1].Status)
+
+	rr = pay(2, "{")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestOrderOwnership(t *testing.T) {
+	mockModel := &MockOrderModel{
+		Orders: []*models.Order{
+			{ID: 1, UserID: 1, TotalPrice: money.New(10000, "KZT"), Status: models.StatusPending},
+			{ID: 2, UserID: 2, TotalPrice: money.New(20000, "KZT"), Status: models.StatusPending},
+		},
+	}
+	controller := NewOrderController(mockModel)
+	router := mux.NewRouter()
+	router.HandleFunc("/orders", controller.GetOrdersController).Methods("GET")
+	router.HandleFunc("/orders", controller.CreateOrderController).Methods("POST")
+	router.HandleFunc("/orders/search", controller.SearchOrderController).Methods("GET")
+	router.HandleFunc("/orders/{id}", controller.GetOrderByIDController).Methods("GET")
+	router.HandleFunc("/orders/{id}", controller.UpdateOrderController).Methods("PUT")
+	router.HandleFunc("/orders/{id}", controller.DeleteOrderController).Methods("DELETE")
+	router.HandleFunc("/orders/{id}/history", controller.GetOrderStatusHistoryController).Methods("GET")
+	router.HandleFunc("/orders/{id}/cancel", controller.TransitionOrderController(models.StatusCancelled)).Methods("POST")
+	asUser := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set(auth.UserIDHeader, "1")
+		req.Header.Set(auth.UserRoleHeader, auth.RoleCustomer)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Test another user's order looks like a missing one
+	assert.Equal(t, http.StatusOK, asUser("GET", "/orders/1", "").Code)
+	assert.Equal(t, http.StatusNotFound, asUser("GET", "/orders/2", "").Code)
+	assert.Equal(t, http.StatusNotFound, asUser("GET", "/orders/2/history", "").Code)
+	assert.Equal(t, http.StatusNotFound, asUser("PUT", "/orders/2", `{"product_ids": [1]}`).Code)
+	assert.Equal(t, http.StatusNotFound, asUser("POST", "/orders/2/cancel", "").Code)
+	assert.Equal(t, http.StatusNotFound, asUser("DELETE", "/orders/2", "").Code)
+	assert.Equal(t, http.StatusNotFound, asUser("GET", "/orders/search?user=2", "").Code)
+	assert.Equal(t, models.StatusPending, mockModel.Orders[1].Status)
+
+	// Test listing and searching only find the caller's orders
+	var page pagination.Page[*models.Order]
+	assert.NoError(t, json.Unmarshal(asUser("GET", "/orders", "").Body.Bytes(), &page))
+	assert.Equal(t, 1, len(page.Items))
+	assert.Equal(t, 1, page.Items[0].UserID)
+	assert.Equal(t, http.StatusNotFound, asUser("GET", "/orders?user_id=2", "").Code)
+	var orders []*models.Order
+	assert.NoError(t, json.Unmarshal(asUser("GET", "/orders/search?status="+models.StatusPending, "").Body.Bytes(), &orders))
+	assert.Equal(t, 1, len(orders))
+	assert.Equal(t, 1, orders[0].UserID)
+
+	// Test customers cannot order for, or hand an order to, someone else
+	assert.Equal(t, http.StatusCreated, asUser("POST", "/orders", `{"user_id": 2, "product_ids": [1]}`).Code)
+	assert.Equal(t, 1, mockModel.Orders[2].UserID)
+	assert.Equal(t, http.StatusOK, asUser("PUT", "/orders/1", `{"user_id": 2, "product_ids": [1]}`).Code)
+	assert.Equal(t, 1, mockModel.Orders[0].UserID)
+}
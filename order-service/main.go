@@ -2,9 +2,13 @@ package main
 
 import (
 	db "OnlineStore"
+	"OnlineStore/apierror"
+	"OnlineStore/idempotency"
 	"OnlineStore/order-service/controllers"
 	"OnlineStore/order-service/repository"
 	"OnlineStore/order-service/routes"
+	"OnlineStore/order-service/services"
+	"OnlineStore/outbox"
 	"context"
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
@@ -22,28 +26,38 @@ func main() {
 		log.Println("Error loading .env file")
 	}
 
-	database, err := db.InitializeDB()
+	database, err := db.InitializeDB("order")
 	if err != nil {
 		log.Fatalf("Error initializing database: %v", err)
 	}
 
-	// Uncomment to run migrations
-	// if err := db.MigrateUp(database); err != nil {
-	//     log.Fatalf("Error running migrations: %v", err)
-	// }
+	if db.MigrationsEnabled() {
+		if err := db.MigrateUp(database, "order"); err != nil {
+			log.Fatalf("Error running migrations: %v", err)
+		}
+	}
 
-	productModel := repository.NewOrderRepository(database)
+	catalog := services.NewProductClientFromEnv()
+	productModel := repository.NewOrderRepository(database, catalog)
 	productController := controllers.NewOrderController(productModel)
 
+	cartController := controllers.NewCartController(repository.NewCartRepository(database, catalog))
+	checkoutSaga := services.NewCheckoutSaga(repository.NewCheckoutRepository(database, catalog), productModel, services.NewPaymentClientFromEnv())
+	checkoutController := controllers.NewCheckoutController(checkoutSaga)
+	idempotencyKeys := idempotency.NewPostgresStore(database)
+
 	router := mux.NewRouter()
-	routes.Routes(router, productController)
+	apierror.Routes(router)
+	routes.Routes(router, productController, idempotencyKeys)
+	routes.CartRoutes(router, cartController, idempotencyKeys)
+	routes.CheckoutRoutes(router, checkoutController, idempotencyKeys)
 
 	corsHandler := cors.New(cors.Options{
 		AllowedOrigins:   []string{os.Getenv("BASE_URL")},
 		AllowedMethods:   []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete},
-		AllowedHeaders:   []string{"Authorization", "Content-Type"},
+		AllowedHeaders:   []string{"Authorization", "Content-Type", idempotency.Header, apierror.RequestIDHeader},
 		AllowCredentials: true,
-	}).Handler(router)
+	}).Handler(apierror.RequestID(router))
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -54,6 +68,17 @@ func main() {
 		Handler: corsHandler,
 	}
 
+	resumeCtx, stopResuming := context.WithCancel(context.Background())
+	defer stopResuming()
+	go checkoutSaga.ResumeEvery(resumeCtx, services.CheckoutResumeInterval)
+	go productModel.SyncReservationsEvery(resumeCtx, repository.SyncIdle)
+
+	relayCtx, stopRelay := context.WithCancel(context.Background())
+	defer stopRelay()
+	if err := outbox.StartRelay(relayCtx, database); err != nil {
+		log.Fatalf("Error configuring outbox broker: %v", err)
+	}
+
 	go gracefulShutdown(server)
 
 	log.Printf("Server is starting on port %s\n", port)
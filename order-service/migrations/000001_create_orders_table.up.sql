@@ -0,0 +1,38 @@
+-- Amounts are BIGINT minor units in an ISO 4217 currency. user_id,
+-- product_id and changed_by refer to other services' records, so they are
+-- not foreign keys.
+CREATE TABLE IF NOT EXISTS orders
+(
+    id          SERIAL PRIMARY KEY,
+    user_id     INT         NOT NULL,
+    total_price BIGINT      NOT NULL DEFAULT 0,
+    currency    CHAR(3)     NOT NULL DEFAULT 'KZT',
+    order_date  TIMESTAMP   NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    status      VARCHAR(50) NOT NULL DEFAULT 'pending'
+);
+
+CREATE INDEX IF NOT EXISTS idx_orders_user_id ON orders (user_id);
+CREATE INDEX IF NOT EXISTS idx_orders_status ON orders (status);
+
+CREATE TABLE IF NOT EXISTS order_items
+(
+    order_id   INT    NOT NULL REFERENCES orders (id) ON DELETE CASCADE,
+    product_id INT    NOT NULL,
+    quantity   INT    NOT NULL CHECK (quantity > 0),
+    unit_price BIGINT NOT NULL CHECK (unit_price >= 0),
+    PRIMARY KEY (order_id, product_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_order_items_product_id ON order_items (product_id);
+
+CREATE TABLE IF NOT EXISTS order_status_history
+(
+    id          SERIAL PRIMARY KEY,
+    order_id    INT         NOT NULL REFERENCES orders (id) ON DELETE CASCADE,
+    from_status VARCHAR(50),
+    to_status   VARCHAR(50) NOT NULL,
+    changed_by  INT,
+    changed_at  TIMESTAMP   NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_order_status_history_order_id ON order_status_history (order_id);
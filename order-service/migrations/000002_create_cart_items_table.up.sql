@@ -0,0 +1,10 @@
+-- Each user has one cart: the rows with their user_id. Prices are not stored;
+-- the cart is always shown and checked out at the products' current prices.
+CREATE TABLE IF NOT EXISTS cart_items
+(
+    user_id    INT         NOT NULL,
+    product_id INT         NOT NULL,
+    quantity   INT         NOT NULL CHECK (quantity > 0),
+    added_at   TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, product_id)
+);
@@ -0,0 +1,17 @@
+-- One row per checkout, recording how far it got so that a checkout
+-- interrupted by a crash can be finished or undone. Card details are never
+-- stored.
+CREATE TABLE IF NOT EXISTS checkout_sagas
+(
+    id         SERIAL PRIMARY KEY,
+    user_id    INT         NOT NULL,
+    status     VARCHAR(20) NOT NULL,
+    order_id   INT         REFERENCES orders (id) ON DELETE SET NULL,
+    payment_id INT,
+    error      TEXT        NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_checkout_sagas_unfinished ON checkout_sagas (updated_at)
+    WHERE status NOT IN ('completed', 'failed');
@@ -0,0 +1,16 @@
+-- Responses to create requests sent with an Idempotency-Key header, replayed
+-- when the request is retried. status_code is NULL while the first request is
+-- still being processed.
+CREATE TABLE IF NOT EXISTS idempotency_keys
+(
+    scope           VARCHAR(255) NOT NULL,
+    idempotency_key VARCHAR(255) NOT NULL,
+    request_hash    CHAR(64)     NOT NULL,
+    status_code     INT,
+    content_type    VARCHAR(255) NOT NULL DEFAULT '',
+    response_body   BYTEA,
+    created_at      TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (scope, idempotency_key)
+);
+
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_created_at ON idempotency_keys (created_at);
@@ -0,0 +1,9 @@
+-- Databases created while all services shared one schema have foreign keys
+-- into the users and products tables. The order-service no longer sees
+-- those tables, so the keys go.
+ALTER TABLE orders DROP CONSTRAINT IF EXISTS orders_user_id_fkey;
+ALTER TABLE order_items DROP CONSTRAINT IF EXISTS order_items_product_id_fkey;
+ALTER TABLE order_status_history DROP CONSTRAINT IF EXISTS order_status_history_changed_by_fkey;
+ALTER TABLE cart_items DROP CONSTRAINT IF EXISTS cart_items_user_id_fkey;
+ALTER TABLE cart_items DROP CONSTRAINT IF EXISTS cart_items_product_id_fkey;
+ALTER TABLE checkout_sagas DROP CONSTRAINT IF EXISTS checkout_sagas_user_id_fkey;
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS reservation_syncs;
+ALTER TABLE orders DROP COLUMN IF EXISTS stock_released;
@@ -0,0 +1,25 @@
+-- Each order holds its stock as the product-service reservation
+-- "order-<id>". stock_released records that the order has given it back.
+ALTER TABLE orders
+    ADD COLUMN IF NOT EXISTS stock_released BOOLEAN NOT NULL DEFAULT false;
+
+UPDATE orders AS o
+SET stock_released = true
+WHERE o.status = 'cancelled'
+   OR (o.status = 'refunded' AND EXISTS(SELECT 1
+                                         FROM order_status_history AS h
+                                         WHERE h.order_id = o.id
+                                           AND h.from_status = 'paid'
+                                           AND h.to_status = 'refunded'));
+
+-- Orders whose reservation may not match them yet, because a call to the
+-- product-service failed or has not been made. release_if_missing says
+-- whether to release the reservation if the order no longer exists.
+CREATE TABLE IF NOT EXISTS reservation_syncs
+(
+    order_id           INT PRIMARY KEY,
+    release_if_missing BOOLEAN     NOT NULL DEFAULT true,
+    queued_at          TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_reservation_syncs_queued_at ON reservation_syncs (queued_at);
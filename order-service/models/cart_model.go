@@ -0,0 +1,68 @@
+package models
+
+import (
+	"OnlineStore/apierror"
+	"OnlineStore/money"
+	"fmt"
+)
+
+var ErrCartEmpty = apierror.New(apierror.Conflict, "cart is empty")
+
+// Cart is a user's order in progress, priced at the products' current
+// prices. Total is nil when the items are priced in different currencies,
+// which cannot be checked out as one order.
+type Cart struct {
+	UserID int          `json:"user_id"`
+	Items  []CartItem   `json:"items"`
+	Total  *money.Money `json:"total,omitempty"`
+}
+
+// CartItem is one product in a cart. Available is how many are in stock now;
+// Warning says why the item could not be checked out as it is.
+type CartItem struct {
+	ProductID int         `json:"product_id"`
+	Name      string      `json:"name"`
+	Quantity  int         `json:"quantity"`
+	UnitPrice money.Money `json:"unit_price"`
+	LineTotal money.Money `json:"line_total"`
+	Available int         `json:"available"`
+	Warning   string      `json:"warning,omitempty"`
+}
+
+// NewCart fills in the line totals, stock warnings and total of items.
+func NewCart(userID int, items []CartItem) *Cart {
+	cart := &Cart{UserID: userID, Items: make([]CartItem, 0, len(items))}
+	lines := make([]money.Money, 0, len(items))
+	for _, item := range items {
+		item.LineTotal = item.UnitPrice.Mul(int64(item.Quantity))
+		switch {
+		case item.Available == 0:
+			item.Warning = "out of stock"
+		case item.Quantity > item.Available:
+			item.Warning = fmt.Sprintf("only %d left in stock", item.Available)
+		}
+		cart.Items = append(cart.Items, item)
+		lines = append(lines, item.LineTotal)
+	}
+	currency := money.DefaultCurrency
+	if len(items) > 0 {
+		currency = items[0].UnitPrice.CurrencyOrDefault()
+	}
+	if total, err := money.Sum(currency, lines...); err == nil {
+		cart.Total = &total
+	}
+	return cart
+}
+
+type CartModel interface {
+	GetCart(userID int) (*Cart, error)
+	// AddCartItem puts quantity more of the product in the cart.
+	AddCartItem(userID, productID, quantity int) error
+	// SetCartItemQuantity changes the quantity of a product already in the
+	// cart; zero removes it.
+	SetCartItemQuantity(userID, productID, quantity int) error
+	RemoveCartItem(userID, productID int) error
+	// CheckoutCart turns the cart into a pending order and empties it, all
+	// or nothing, and returns the order.
+	CheckoutCart(userID int) (*Order, error)
+}
@@ -0,0 +1,40 @@
+package models
+
+import (
+	"OnlineStore/apierror"
+	"OnlineStore/money"
+	"context"
+	"strconv"
+)
+
+var ErrReservationReleased = apierror.New(apierror.Conflict, "stock reservation was released")
+
+// CatalogProduct is what the order-service knows of a product.
+type CatalogProduct struct {
+	ID       int         `json:"id"`
+	Name     string      `json:"name"`
+	Price    money.Money `json:"price"`
+	Quantity int         `json:"quantity"`
+}
+
+// Catalog is the product-service, which owns products, their prices and
+// their stock. An order holds its stock as the reservation
+// ReservationKey(order ID).
+type Catalog interface {
+	// Products returns the products with the given IDs, leaving out the
+	// ones that do not exist.
+	Products(ctx context.Context, ids []int) ([]CatalogProduct, error)
+	// ReserveStock makes the reservation hold exactly items and returns
+	// them with UnitPrice set to the products' current prices. It is all or
+	// nothing, may be repeated, and fails with ErrProductNotFound,
+	// ErrInsufficientStock, or ErrReservationReleased once the key has been
+	// released.
+	ReserveStock(ctx context.Context, key string, items []OrderItem) ([]OrderItem, error)
+	// ReleaseStock returns everything the reservation holds. Releasing it
+	// again does nothing.
+	ReleaseStock(ctx context.Context, key string) error
+}
+
+func ReservationKey(orderID int) string {
+	return "order-" + strconv.Itoa(orderID)
+}
@@ -0,0 +1,61 @@
+package models
+
+import (
+	"OnlineStore/apierror"
+	"time"
+)
+
+var ErrCheckoutNotFound = apierror.New(apierror.NotFound, "checkout not found")
+
+// A checkout is a saga that reserves stock and creates the order, charges
+// the payment and confirms the order, moving through these statuses:
+//
+//	started -> order_created -> charging -> completed
+//	                 |              |
+//	                 +--------------+-> compensating -> failed
+//
+// A checkout that fails before its order exists goes straight from started
+// to failed. compensating cancels the order, which returns its stock.
+const (
+	CheckoutStarted      = "started"
+	CheckoutOrderCreated = "order_created"
+	CheckoutCharging     = "charging"
+	CheckoutCompleted    = "completed"
+	CheckoutCompensating = "compensating"
+	CheckoutFailed       = "failed"
+)
+
+// Checkout is the persisted state of one checkout saga. Error says why a
+// failed checkout failed.
+type Checkout struct {
+	ID        int    `json:"id"`
+	UserID    int    `json:"user_id"`
+	Status    string `json:"status"`
+	OrderID   int    `json:"order_id,omitempty"`
+	PaymentID int    `json:"payment_id,omitempty"`
+	Error     string `json:"error,omitempty"`
+	CreatedAt string `json:"created_at"`
+	UpdatedAt string `json:"updated_at"`
+}
+
+// Finished reports whether the checkout has nothing left to do.
+func (c *Checkout) Finished() bool {
+	return c.Status == CheckoutCompleted || c.Status == CheckoutFailed
+}
+
+type CheckoutModel interface {
+	StartCheckout(userID int) (*Checkout, error)
+	// CreateCheckoutOrder creates the order, taking its items out of stock,
+	// and moves the started checkout to order_created, all in one
+	// transaction. It returns the order's ID.
+	CreateCheckoutOrder(id int, order Order) (int, error)
+	// AdvanceCheckout moves the checkout from status from to status to,
+	// recording paymentID and reason when they are set. It reports false if
+	// the checkout was no longer in status from, e.g. because a concurrent
+	// resume moved it first.
+	AdvanceCheckout(id int, from, to string, paymentID int, reason string) (bool, error)
+	GetCheckout(id int) (*Checkout, error)
+	// StalledCheckouts returns the unfinished checkouts that have not moved
+	// for at least idle.
+	StalledCheckouts(idle time.Duration) ([]*Checkout, error)
+}
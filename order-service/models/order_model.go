@@ -1,20 +1,110 @@
 package models
 
+import (
+	"OnlineStore/apierror"
+	"OnlineStore/money"
+	"OnlineStore/pagination"
+	"fmt"
+)
+
+var (
+	ErrOrderNotFound     = apierror.New(apierror.NotFound, "order not found")
+	ErrInsufficientStock = apierror.New(apierror.InsufficientStock, "not enough quantity")
+	// ErrProductNotFound is a request for a product that does not exist,
+	// which makes the request itself invalid.
+	ErrProductNotFound   = apierror.New(apierror.Validation, "product not found")
+	ErrInvalidOrderItems = apierror.New(apierror.Validation, "invalid order items")
+	// ErrTotalMismatch is a payment for other than the order's total, e.g.
+	// because the order was edited while it was being paid for.
+	ErrTotalMismatch = apierror.New(apierror.AmountMismatch, "amount paid is not the order's total")
+)
+
+// Events recorded in the outbox when an order changes. Their payload is the
+// Order as it is afterwards; for order.deleted only its ID is set.
+const (
+	EventOrderCreated       = "order.created"
+	EventOrderUpdated       = "order.updated"
+	EventOrderStatusChanged = "order.status_changed"
+	EventOrderDeleted       = "order.deleted"
+)
+
 type Order struct {
-	ID         int     `json:"id"`
-	UserID     int     `json:"user_id"`
-	TotalPrice float64 `json:"total_price"`
-	OrderDate  string  `json:"order_date"`
-	Status     string  `json:"status"`
-	ProductIDs []int   `json:"product_ids"`
+	ID         int         `json:"id"`
+	UserID     int         `json:"user_id"`
+	TotalPrice money.Money `json:"total_price"`
+	OrderDate  string      `json:"order_date"`
+	Status     string      `json:"status"`
+	Items      []OrderItem `json:"items"`
+	// ProductIDs is the legacy request shape, one entry per unit ordered.
+	// It is folded into Items by NormalizeItems and never returned.
+	ProductIDs []int `json:"product_ids,omitempty"`
+}
+
+// OrderItem is one line of an order. UnitPrice is the product's price when
+// it was added to the order and is ignored on input.
+type OrderItem struct {
+	ProductID int         `json:"product_id"`
+	Quantity  int         `json:"quantity"`
+	UnitPrice money.Money `json:"unit_price"`
+}
+
+// NormalizeItems merges the legacy ProductIDs into Items, collapses repeated
+// products into a single line, and rejects empty orders and non-positive
+// quantities.
+func (o *Order) NormalizeItems() error {
+	items := o.Items
+	for _, productID := range o.ProductIDs {
+		items = append(items, OrderItem{ProductID: productID, Quantity: 1})
+	}
+
+	merged := make([]OrderItem, 0, len(items))
+	index := make(map[int]int, len(items))
+	for _, item := range items {
+		if item.ProductID <= 0 {
+			return fmt.Errorf("%w: invalid product id %d", ErrInvalidOrderItems, item.ProductID)
+		}
+		if item.Quantity <= 0 {
+			return fmt.Errorf("%w: quantity for product %d must be positive", ErrInvalidOrderItems, item.ProductID)
+		}
+		if i, ok := index[item.ProductID]; ok {
+			merged[i].Quantity += item.Quantity
+			continue
+		}
+		index[item.ProductID] = len(merged)
+		merged = append(merged, OrderItem{ProductID: item.ProductID, Quantity: item.Quantity})
+	}
+	if len(merged) == 0 {
+		return fmt.Errorf("%w: order has no items", ErrInvalidOrderItems)
+	}
+
+	o.Items = merged
+	o.ProductIDs = nil
+	return nil
+}
+
+// OrderSorts are the keys orders can be listed by; the first is the default.
+var OrderSorts = []string{"id", "order_date", "total_price", "status"}
+
+// OrderFilter narrows a list of orders. Zero fields match every order.
+type OrderFilter struct {
+	UserID int
+	Status string
 }
 
 type OrderModel interface {
-	GetOrders() ([]*Order, error)
+	// ListOrders returns one page of the orders matching filter, and how
+	// many match in total.
+	ListOrders(filter OrderFilter, page pagination.Params) ([]*Order, int, error)
 	CreateOrder(order Order) error
 	GetOrderByID(id int) (*Order, error)
 	UpdateOrder(order Order) error
 	DeleteOrder(id int) error
 	GetOrderByUserID(userID int) ([]*Order, error)
 	GetOrderByStatus(status string) ([]*Order, error)
+	UpdateOrderStatus(id int, status string, changedBy int) error
+	// PayOrder moves a pending order to paid, provided amount is its total,
+	// and otherwise returns ErrTotalMismatch. The order stays locked from
+	// the check to the change, so an edit cannot come in between.
+	PayOrder(id int, amount money.Money, changedBy int) error
+	GetOrderStatusHistory(id int) ([]*OrderStatusChange, error)
 }
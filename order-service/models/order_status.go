@@ -0,0 +1,50 @@
+package models
+
+import "OnlineStore/apierror"
+
+const (
+	StatusPending   = "pending"
+	StatusPaid      = "paid"
+	StatusShipped   = "shipped"
+	StatusDelivered = "delivered"
+	StatusCancelled = "cancelled"
+	StatusRefunded  = "refunded"
+)
+
+var (
+	ErrInvalidTransition = apierror.New(apierror.Conflict, "invalid order status transition")
+	ErrOrderNotEditable  = apierror.New(apierror.Conflict, "order can only be modified while pending")
+)
+
+// transitions lists, for every status, the statuses an order may move to
+// next. Cancelled and refunded orders are final.
+var transitions = map[string][]string{
+	StatusPending:   {StatusPaid, StatusCancelled},
+	StatusPaid:      {StatusShipped, StatusRefunded},
+	StatusShipped:   {StatusDelivered},
+	StatusDelivered: {StatusRefunded},
+}
+
+func CanTransition(from, to string) bool {
+	for _, next := range transitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// ReleasesStock reports whether moving an order from one status to another
+// puts its products back in stock, i.e. the goods never left the warehouse.
+func ReleasesStock(from, to string) bool {
+	return to == StatusCancelled || (to == StatusRefunded && from == StatusPaid)
+}
+
+type OrderStatusChange struct {
+	ID         int     `json:"id"`
+	OrderID    int     `json:"order_id"`
+	FromStatus *string `json:"from_status"`
+	ToStatus   string  `json:"to_status"`
+	ChangedBy  *int    `json:"changed_by"`
+	ChangedAt  string  `json:"changed_at"`
+}
@@ -0,0 +1,170 @@
+package repository
+
+import (
+	"OnlineStore/order-service/models"
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/lib/pq"
+)
+
+type CartRepository struct {
+	DB      *sql.DB
+	Catalog models.Catalog
+}
+
+func NewCartRepository(db *sql.DB, catalog models.Catalog) *CartRepository {
+	return &CartRepository{DB: db, Catalog: catalog}
+}
+
+// GetCart prices the cart with the catalog's current products. Products that
+// no longer exist are left out.
+func (cr *CartRepository) GetCart(userID int) (*models.Cart, error) {
+	rows, err := cr.DB.Query(`
+        SELECT product_id, quantity
+        FROM cart_items
+        WHERE user_id = $1
+        ORDER BY added_at, product_id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		lines      []models.CartItem
+		productIDs []int
+	)
+	for rows.Next() {
+		var line models.CartItem
+		if err := rows.Scan(&line.ProductID, &line.Quantity); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		lines = append(lines, line)
+		productIDs = append(productIDs, line.ProductID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	products, err := cr.Catalog.Products(context.Background(), productIDs)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[int]models.CatalogProduct, len(products))
+	for _, product := range products {
+		byID[product.ID] = product
+	}
+
+	var items []models.CartItem
+	for _, item := range lines {
+		product, ok := byID[item.ProductID]
+		if !ok {
+			continue
+		}
+		item.Name = product.Name
+		item.UnitPrice = product.Price
+		item.Available = product.Quantity
+		items = append(items, item)
+	}
+	return models.NewCart(userID, items), nil
+}
+
+func (cr *CartRepository) AddCartItem(userID, productID, quantity int) error {
+	if quantity <= 0 {
+		return fmt.Errorf("%w: quantity for product %d must be positive", models.ErrInvalidOrderItems, productID)
+	}
+	products, err := cr.Catalog.Products(context.Background(), []int{productID})
+	if err != nil {
+		return err
+	}
+	if len(products) == 0 {
+		return fmt.Errorf("%w: %d", models.ErrProductNotFound, productID)
+	}
+	_, err = cr.DB.Exec(`
+        INSERT INTO cart_items (user_id, product_id, quantity)
+        VALUES ($1, $2, $3)
+        ON CONFLICT (user_id, product_id) DO UPDATE SET quantity = cart_items.quantity + EXCLUDED.quantity`,
+		userID, productID, quantity)
+	return err
+}
+
+func (cr *CartRepository) SetCartItemQuantity(userID, productID, quantity int) error {
+	if quantity < 0 {
+		return fmt.Errorf("%w: quantity for product %d must not be negative", models.ErrInvalidOrderItems, productID)
+	}
+	if quantity == 0 {
+		return cr.RemoveCartItem(userID, productID)
+	}
+	res, err := cr.DB.Exec("UPDATE cart_items SET quantity = $1 WHERE user_id = $2 AND product_id = $3", quantity, userID, productID)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(res)
+}
+
+func (cr *CartRepository) RemoveCartItem(userID, productID int) error {
+	res, err := cr.DB.Exec("DELETE FROM cart_items WHERE user_id = $1 AND product_id = $2", userID, productID)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(res)
+}
+
+// CheckoutCart creates the order exactly like CreateOrder, so stock is
+// reserved and prices are captured the same way. The cart rows stay locked
+// until the order is committed, so a concurrent checkout of the same cart
+// finds it empty instead of ordering it twice. Only the items ordered are
+// removed; one added to the cart meanwhile stays there.
+func (cr *CartRepository) CheckoutCart(userID int) (*models.Order, error) {
+	var productIDs []int
+	prepare := func(tx *sql.Tx) (models.Order, error) {
+		order := models.Order{UserID: userID}
+		rows, err := tx.Query(`
+            SELECT product_id, quantity
+            FROM cart_items
+            WHERE user_id = $1
+            ORDER BY product_id
+            FOR UPDATE`, userID)
+		if err != nil {
+			return order, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var item models.OrderItem
+			if err := rows.Scan(&item.ProductID, &item.Quantity); err != nil {
+				return order, err
+			}
+			order.Items = append(order.Items, item)
+			productIDs = append(productIDs, item.ProductID)
+		}
+		if err := rows.Err(); err != nil {
+			return order, err
+		}
+		if len(order.Items) == 0 {
+			return order, models.ErrCartEmpty
+		}
+		return order, nil
+	}
+	finish := func(tx *sql.Tx, orderID int) error {
+		_, err := tx.Exec("DELETE FROM cart_items WHERE user_id = $1 AND product_id = ANY($2)", userID, pq.Array(productIDs))
+		return err
+	}
+
+	orderID, err := placeOrder(cr.DB, cr.Catalog, prepare, finish)
+	if err != nil {
+		return nil, err
+	}
+	return getOrder(cr.DB, orderID)
+}
+
+// expectOneRow returns sql.ErrNoRows if res did not touch exactly one row.
+func expectOneRow(res sql.Result) error {
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected != 1 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package repository
+
+import (
+	"OnlineStore/order-service/models"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckoutCart(t *testing.T) {
+	database := testDB(t)
+	catalog := newFakeCatalog()
+	carts := NewCartRepository(database, catalog)
+	userID := testUserID(t, database)
+	first := createTestProduct(t, catalog, 5)
+	second := createTestProduct(t, catalog, 1)
+
+	require.NoError(t, carts.AddCartItem(userID, first, 2))
+	require.NoError(t, carts.AddCartItem(userID, first, 1))
+	require.NoError(t, carts.AddCartItem(userID, second, 2))
+	err := carts.AddCartItem(userID, -1, 1)
+	assert.True(t, errors.Is(err, models.ErrProductNotFound))
+
+	cart, err := carts.GetCart(userID)
+	require.NoError(t, err)
+	require.Len(t, cart.Items, 2)
+	assert.Equal(t, 3, cart.Items[0].Quantity)
+	assert.Empty(t, cart.Items[0].Warning)
+	assert.Equal(t, "only 1 left in stock", cart.Items[1].Warning)
+
+	// Short of stock: nothing is ordered and the cart is kept.
+	_, err = carts.CheckoutCart(userID)
+	assert.True(t, errors.Is(err, models.ErrInsufficientStock))
+	assert.Equal(t, 5, productQuantity(t, catalog, first))
+	cart, err = carts.GetCart(userID)
+	require.NoError(t, err)
+	assert.Len(t, cart.Items, 2)
+
+	require.NoError(t, carts.SetCartItemQuantity(userID, second, 1))
+	order, err := carts.CheckoutCart(userID)
+	require.NoError(t, err)
+	assert.Equal(t, userID, order.UserID)
+	assert.Equal(t, models.StatusPending, order.Status)
+	assert.Len(t, order.Items, 2)
+	assert.Equal(t, 2, productQuantity(t, catalog, first))
+	assert.Equal(t, 0, productQuantity(t, catalog, second))
+
+	cart, err = carts.GetCart(userID)
+	require.NoError(t, err)
+	assert.Empty(t, cart.Items)
+	_, err = carts.CheckoutCart(userID)
+	assert.True(t, errors.Is(err, models.ErrCartEmpty))
+}
+
+func TestCheckoutCartConcurrentOrdersOnce(t *testing.T) {
+	database := testDB(t)
+	catalog := newFakeCatalog()
+	carts := NewCartRepository(database, catalog)
+	userID := testUserID(t, database)
+	productID := createTestProduct(t, catalog, 10)
+	require.NoError(t, carts.AddCartItem(userID, productID, 2))
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		ordered int
+	)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := carts.CheckoutCart(userID)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				ordered++
+			case !errors.Is(err, models.ErrCartEmpty):
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, ordered)
+	assert.Equal(t, 8, productQuantity(t, catalog, productID))
+}
+
+func TestCheckoutCartKeepsItemsAddedMeanwhile(t *testing.T) {
+	database := testDB(t)
+	catalog := newFakeCatalog()
+	carts := NewCartRepository(database, catalog)
+	userID := testUserID(t, database)
+	ordered := createTestProduct(t, catalog, 5)
+	added := createTestProduct(t, catalog, 5)
+	require.NoError(t, carts.AddCartItem(userID, ordered, 1))
+
+	// The item is added after the checkout read the cart, before it is
+	// emptied.
+	catalog.reserving = func() {
+		require.NoError(t, carts.AddCartItem(userID, added, 2))
+	}
+	order, err := carts.CheckoutCart(userID)
+	require.NoError(t, err)
+	require.Len(t, order.Items, 1)
+	assert.Equal(t, ordered, order.Items[0].ProductID)
+
+	cart, err := carts.GetCart(userID)
+	require.NoError(t, err)
+	require.Len(t, cart.Items, 1)
+	assert.Equal(t, added, cart.Items[0].ProductID)
+	assert.Equal(t, 2, cart.Items[0].Quantity)
+}
@@ -0,0 +1,138 @@
+package repository
+
+import (
+	"OnlineStore/money"
+	"OnlineStore/order-service/models"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// fakeCatalog is an in-memory product-service that keeps reservations the
+// way the real one does.
+type fakeCatalog struct {
+	mu           sync.Mutex
+	nextID       int
+	products     map[int]*models.CatalogProduct
+	reservations map[string][]models.OrderItem
+	released     map[string]bool
+	// fail, when set, is returned by every reservation call.
+	fail error
+	// reserving, when set, runs once at the start of the next reservation.
+	reserving func()
+}
+
+var errCatalogDown = errors.New("product-service is unavailable")
+
+func newFakeCatalog() *fakeCatalog {
+	return &fakeCatalog{
+		products:     map[int]*models.CatalogProduct{},
+		reservations: map[string][]models.OrderItem{},
+		released:     map[string]bool{},
+	}
+}
+
+func createTestProduct(t *testing.T, catalog *fakeCatalog, quantity int) int {
+	catalog.mu.Lock()
+	defer catalog.mu.Unlock()
+	catalog.nextID++
+	id := catalog.nextID
+	catalog.products[id] = &models.CatalogProduct{ID: id, Name: "stock-test", Price: money.New(1000, "KZT"), Quantity: quantity}
+	return id
+}
+
+func productQuantity(t *testing.T, catalog *fakeCatalog, productID int) int {
+	catalog.mu.Lock()
+	defer catalog.mu.Unlock()
+	return catalog.products[productID].Quantity
+}
+
+func (c *fakeCatalog) setPrice(productID int, amount int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.products[productID].Price = money.New(amount, "KZT")
+}
+
+func (c *fakeCatalog) setFailure(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fail = err
+}
+
+func (c *fakeCatalog) Products(ctx context.Context, ids []int) ([]models.CatalogProduct, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var products []models.CatalogProduct
+	for _, id := range ids {
+		if product, ok := c.products[id]; ok {
+			products = append(products, *product)
+		}
+	}
+	return products, nil
+}
+
+func (c *fakeCatalog) ReserveStock(ctx context.Context, key string, items []models.OrderItem) ([]models.OrderItem, error) {
+	c.mu.Lock()
+	reserving := c.reserving
+	c.reserving = nil
+	c.mu.Unlock()
+	if reserving != nil {
+		reserving()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.fail != nil {
+		return nil, c.fail
+	}
+	if c.released[key] {
+		return nil, models.ErrReservationReleased
+	}
+
+	delta := map[int]int{}
+	for _, item := range items {
+		delta[item.ProductID] += item.Quantity
+	}
+	for _, item := range c.reservations[key] {
+		delta[item.ProductID] -= item.Quantity
+	}
+	for id, count := range delta {
+		product, ok := c.products[id]
+		if !ok {
+			return nil, fmt.Errorf("%w: %d", models.ErrProductNotFound, id)
+		}
+		if product.Quantity < count {
+			return nil, fmt.Errorf("%w for product %d", models.ErrInsufficientStock, id)
+		}
+	}
+	for id, count := range delta {
+		c.products[id].Quantity -= count
+	}
+
+	reserved := make([]models.OrderItem, len(items))
+	for i, item := range items {
+		item.UnitPrice = c.products[item.ProductID].Price
+		reserved[i] = item
+	}
+	c.reservations[key] = reserved
+	return reserved, nil
+}
+
+func (c *fakeCatalog) ReleaseStock(ctx context.Context, key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.fail != nil {
+		return c.fail
+	}
+	if c.released[key] {
+		return nil
+	}
+	for _, item := range c.reservations[key] {
+		c.products[item.ProductID].Quantity += item.Quantity
+	}
+	delete(c.reservations, key)
+	c.released[key] = true
+	return nil
+}
@@ -0,0 +1,96 @@
+package repository
+
+import (
+	"OnlineStore/order-service/models"
+	"database/sql"
+	"time"
+)
+
+type CheckoutRepository struct {
+	DB      *sql.DB
+	Catalog models.Catalog
+}
+
+func NewCheckoutRepository(db *sql.DB, catalog models.Catalog) *CheckoutRepository {
+	return &CheckoutRepository{DB: db, Catalog: catalog}
+}
+
+const checkoutColumns = `id, user_id, status, COALESCE(order_id, 0), COALESCE(payment_id, 0), error, created_at, updated_at`
+
+func scanCheckout(row interface{ Scan(...interface{}) error }) (*models.Checkout, error) {
+	checkout := &models.Checkout{}
+	err := row.Scan(&checkout.ID, &checkout.UserID, &checkout.Status, &checkout.OrderID, &checkout.PaymentID, &checkout.Error, &checkout.CreatedAt, &checkout.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return checkout, nil
+}
+
+func (cr *CheckoutRepository) StartCheckout(userID int) (*models.Checkout, error) {
+	row := cr.DB.QueryRow(`
+        INSERT INTO checkout_sagas (user_id, status)
+        VALUES ($1, $2)
+        RETURNING `+checkoutColumns, userID, models.CheckoutStarted)
+	return scanCheckout(row)
+}
+
+func (cr *CheckoutRepository) CreateCheckoutOrder(id int, order models.Order) (int, error) {
+	prepare := func(tx *sql.Tx) (models.Order, error) { return order, nil }
+	finish := func(tx *sql.Tx, orderID int) error {
+		res, err := tx.Exec(`
+            UPDATE checkout_sagas SET status = $1, order_id = $2, updated_at = CURRENT_TIMESTAMP
+            WHERE id = $3 AND status = $4`, models.CheckoutOrderCreated, orderID, id, models.CheckoutStarted)
+		if err != nil {
+			return err
+		}
+		return expectOneRow(res)
+	}
+	return placeOrder(cr.DB, cr.Catalog, prepare, finish)
+}
+
+func (cr *CheckoutRepository) AdvanceCheckout(id int, from, to string, paymentID int, reason string) (bool, error) {
+	res, err := cr.DB.Exec(`
+        UPDATE checkout_sagas
+        SET status     = $1,
+            payment_id = COALESCE(NULLIF($2, 0), payment_id),
+            error      = COALESCE(NULLIF($3, ''), error),
+            updated_at = CURRENT_TIMESTAMP
+        WHERE id = $4 AND status = $5`, to, paymentID, reason, id, from)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected == 1, nil
+}
+
+func (cr *CheckoutRepository) GetCheckout(id int) (*models.Checkout, error) {
+	return scanCheckout(cr.DB.QueryRow("SELECT "+checkoutColumns+" FROM checkout_sagas WHERE id = $1", id))
+}
+
+func (cr *CheckoutRepository) StalledCheckouts(idle time.Duration) ([]*models.Checkout, error) {
+	rows, err := cr.DB.Query(`
+        SELECT `+checkoutColumns+`
+        FROM checkout_sagas
+        WHERE status NOT IN ($1, $2) AND updated_at <= CURRENT_TIMESTAMP - $3 * INTERVAL '1 second'
+        ORDER BY updated_at, id`, models.CheckoutCompleted, models.CheckoutFailed, idle.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	checkouts := []*models.Checkout{}
+	for rows.Next() {
+		checkout, err := scanCheckout(rows)
+		if err != nil {
+			return nil, err
+		}
+		checkouts = append(checkouts, checkout)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return checkouts, nil
+}
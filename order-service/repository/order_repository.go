@@ -1,300 +1,573 @@
 package repository
 
 import (
+	"OnlineStore/money"
 	"OnlineStore/order-service/models"
+	"OnlineStore/outbox"
+	"OnlineStore/pagination"
+	"context"
 	"database/sql"
 	"fmt"
+	"time"
 )
 
 type OrderRepository struct {
-	DB *sql.DB
+	DB      *sql.DB
+	Catalog models.Catalog
 }
 
-func NewOrderRepository(db *sql.DB) *OrderRepository {
-	return &OrderRepository{DB: db}
+func NewOrderRepository(db *sql.DB, catalog models.Catalog) *OrderRepository {
+	return &OrderRepository{DB: db, Catalog: catalog}
 }
 
-func (or *OrderRepository) GetOrders() ([]*models.Order, error) {
-	rows, err := or.DB.Query("SELECT * FROM orders")
+// querier is satisfied by both *sql.DB and *sql.Tx.
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+var orderSortColumns = map[string]string{
+	"id":          "id",
+	"order_date":  "order_date",
+	"total_price": "total_price",
+	"status":      "status",
+}
+
+func (or *OrderRepository) ListOrders(filter models.OrderFilter, page pagination.Params) ([]*models.Order, int, error) {
+	var where pagination.Where
+	if filter.UserID != 0 {
+		where.Equal("user_id", filter.UserID)
+	}
+	if filter.Status != "" {
+		where.Equal("status", filter.Status)
+	}
+	var total int
+	err := or.DB.QueryRow("SELECT COUNT(*) FROM orders"+where.String(), where.Args...).Scan(&total)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	defer rows.Close()
 
-	orders := []*models.Order{}
-	for rows.Next() {
-		order := &models.Order{}
-		err := rows.Scan(&order.ID, &order.UserID, &order.TotalPrice, &order.OrderDate, &order.Status)
-		if err != nil {
-			return nil, err
-		}
-		orders = append(orders, order)
+	query := "SELECT id, user_id, total_price, currency, order_date, status FROM orders" + where.String()
+	query += page.OrderBy(orderSortColumns, &where)
+	rows, err := or.DB.Query(query, where.Args...)
+	if err != nil {
+		return nil, 0, err
 	}
-	for _, order := range orders {
-		rows, err = or.DB.Query(`SELECT product_id FROM orders_products WHERE order_id = $1`, order.ID)
-		if err != nil {
-			return nil, err
-		}
-		defer rows.Close()
-		for rows.Next() {
-			var productID int
-			if err := rows.Scan(&productID); err != nil {
-				return nil, err
-			}
-			order.ProductIDs = append(order.ProductIDs, productID)
-		}
+	orders, err := or.scanOrders(rows)
+	if err != nil {
+		return nil, 0, err
 	}
-
-	return orders, nil
+	return orders, total, nil
 }
 
 func (or *OrderRepository) GetOrderByID(id int) (*models.Order, error) {
+	return getOrder(or.DB, id)
+}
+
+func getOrder(q querier, id int) (*models.Order, error) {
 	order := &models.Order{}
-	err := or.DB.QueryRow(`
-        SELECT id, user_id, total_price, order_date, status
+	err := q.QueryRow(`
+        SELECT id, user_id, total_price, currency, order_date, status
         FROM orders
-        WHERE id = $1`, id).Scan(&order.ID, &order.UserID, &order.TotalPrice, &order.OrderDate, &order.Status)
+        WHERE id = $1`, id).Scan(&order.ID, &order.UserID, &order.TotalPrice, &order.TotalPrice.Currency, &order.OrderDate, &order.Status)
 	if err != nil {
 		return nil, err
 	}
-	rows, err := or.DB.Query(`
-        SELECT product_id
-        FROM orders_products
-        WHERE order_id = $1`, id)
+	order.Items, err = orderItems(q, id)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var productID int
-		if err := rows.Scan(&productID); err != nil {
-			return nil, err
-		}
-		order.ProductIDs = append(order.ProductIDs, productID)
-	}
-	if err := rows.Err(); err != nil {
-		return nil, err
-	}
 	return order, nil
 }
 
 func (or *OrderRepository) CreateOrder(order models.Order) error {
+	prepare := func(tx *sql.Tx) (models.Order, error) { return order, nil }
+	_, err := placeOrder(or.DB, or.Catalog, prepare, nil)
+	return err
+}
+
+// UpdateOrder replaces the items of a pending order. Products already on the
+// order keep the unit price captured when they were first added; new products
+// are priced at their current price. The order stays locked while its
+// reservation is changed, so the two cannot be changed concurrently.
+func (or *OrderRepository) UpdateOrder(order models.Order) error {
+	if len(order.Items) == 0 {
+		return fmt.Errorf("%w: order has no items", models.ErrInvalidOrderItems)
+	}
+
 	tx, err := or.DB.Begin()
 	if err != nil {
 		return err
 	}
-	productsCount := make(map[int]int)
-	for _, productID := range order.ProductIDs {
-		productsCount[productID]++
+
+	status, err := lockOrder(tx, order.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
 	}
-	for productID, count := range productsCount {
-		var quantity int
-		err := tx.QueryRow("SELECT quantity FROM products WHERE id = $1", productID).Scan(&quantity)
-		if err != nil {
-			tx.Rollback()
-			return err
-		}
-		if quantity < count {
-			tx.Rollback()
-			return fmt.Errorf("not enough quantity for product %d", productID)
-		}
+	if status != models.StatusPending {
+		tx.Rollback()
+		return models.ErrOrderNotEditable
+	}
+	oldItems, err := orderItems(tx, order.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	queuedAt, err := queueSync(or.DB, order.ID, true)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := or.replaceOrderItems(tx, order, oldItems); err != nil {
+		tx.Rollback()
+		settleSync(or.DB, or.Catalog, order.ID, queuedAt)
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		settleSync(or.DB, or.Catalog, order.ID, queuedAt)
+		return err
+	}
+	dequeueSync(or.DB, order.ID, queuedAt)
+	return nil
+}
+
+// replaceOrderItems reserves stock for the order's new items and writes them
+// in place of oldItems.
+func (or *OrderRepository) replaceOrderItems(tx *sql.Tx, order models.Order, oldItems []models.OrderItem) error {
+	reserved, err := or.Catalog.ReserveStock(context.Background(), models.ReservationKey(order.ID), order.Items)
+	if err != nil {
+		return err
+	}
+	items, err := snapshotPrices(order.Items, reserved, oldItems)
+	if err != nil {
+		return err
+	}
+	total, err := totalPrice(items)
+	if err != nil {
+		return err
 	}
 
-	totalPrice := 0.0
+	_, err = tx.Exec("UPDATE orders SET user_id = $1, total_price = $2, currency = $3 WHERE id = $4",
+		order.UserID, total, total.Currency, order.ID)
+	if err != nil {
+		return err
+	}
 
-	for _, productID := range order.ProductIDs {
-		var price float64
-		err := tx.QueryRow("SELECT price FROM products WHERE id = $1", productID).Scan(&price)
-		if err != nil {
-			tx.Rollback()
-			return err
-		}
-		totalPrice += price
+	_, err = tx.Exec("DELETE FROM order_items WHERE order_id = $1", order.ID)
+	if err != nil {
+		return err
 	}
 
-	var orderID int
-	err = tx.QueryRow(`
-        INSERT INTO orders (user_id, total_price, status)
-        VALUES ($1, $2, $3)
-        RETURNING id`, order.UserID, totalPrice, order.Status).Scan(&orderID)
+	if err := insertOrderItems(tx, order.ID, items); err != nil {
+		return err
+	}
+
+	return recordOrderEvent(tx, models.EventOrderUpdated, order.ID)
+}
+
+func (or *OrderRepository) DeleteOrder(id int) error {
+	tx, err := or.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	status, err := lockOrder(tx, id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	// Cancelled and refunded orders already gave their stock back, and
+	// shipped goods are gone.
+	releaseStock := status == models.StatusPending || status == models.StatusPaid
+	queuedAt, err := queueSync(tx, id, releaseStock)
 	if err != nil {
 		tx.Rollback()
 		return err
 	}
 
-	for _, productID := range order.ProductIDs {
-		_, err := tx.Exec(`
-            INSERT INTO orders_products (order_id, product_id)
-            VALUES ($1, $2)`, orderID, productID)
-		if err != nil {
-			tx.Rollback()
-			return err
-		}
+	_, err = tx.Exec("DELETE FROM orders WHERE id = $1", id)
+	if err != nil {
+		tx.Rollback()
+		return err
 	}
 
-	err = tx.Commit()
+	err = outbox.Record(tx, models.EventOrderDeleted, id, models.Order{ID: id})
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
 
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	settleSync(or.DB, or.Catalog, id, queuedAt)
 	return nil
 }
 
-func (or *OrderRepository) UpdateOrder(order models.Order) error {
+func (or *OrderRepository) UpdateOrderStatus(id int, status string, changedBy int) error {
+	return or.updateOrderStatus(id, status, changedBy, nil)
+}
+
+func (or *OrderRepository) PayOrder(id int, amount money.Money, changedBy int) error {
+	return or.updateOrderStatus(id, models.StatusPaid, changedBy, func(tx *sql.Tx) error {
+		var total money.Money
+		err := tx.QueryRow("SELECT total_price, currency FROM orders WHERE id = $1", id).Scan(&total, &total.Currency)
+		if err != nil {
+			return err
+		}
+		if amount.Amount != total.Amount || amount.CurrencyOrDefault() != total.Currency {
+			return fmt.Errorf("%w: order %d totals %s, not %s", models.ErrTotalMismatch, id, total, amount)
+		}
+		return nil
+	})
+}
+
+// updateOrderStatus moves the order to status. check, if set, runs once the
+// order is locked and the transition allowed, and can refuse the change.
+func (or *OrderRepository) updateOrderStatus(id int, status string, changedBy int, check func(tx *sql.Tx) error) error {
 	tx, err := or.DB.Begin()
 	if err != nil {
 		return err
 	}
-	productsCount := make(map[int]int)
-	for _, productID := range order.ProductIDs {
-		productsCount[productID]++
+
+	current, err := lockOrder(tx, id)
+	if err != nil {
+		tx.Rollback()
+		return err
 	}
-	for productID, count := range productsCount {
-		var quantity int
-		err := tx.QueryRow("SELECT quantity FROM products WHERE id = $1", productID).Scan(&quantity)
-		if err != nil {
+	if !models.CanTransition(current, status) {
+		tx.Rollback()
+		return fmt.Errorf("%w: %s -> %s", models.ErrInvalidTransition, current, status)
+	}
+	if check != nil {
+		if err := check(tx); err != nil {
 			tx.Rollback()
 			return err
 		}
-		if quantity < count {
-			tx.Rollback()
-			return fmt.Errorf("not enough quantity for product %d", productID)
-		}
 	}
-	
-	totalPrice := 0.0
 
-	for _, productID := range order.ProductIDs {
-		var price float64
-		err := tx.QueryRow("SELECT price FROM products WHERE id = $1", productID).Scan(&price)
+	var queuedAt time.Time
+	releaseStock := models.ReleasesStock(current, status)
+	if releaseStock {
+		_, err = tx.Exec("UPDATE orders SET stock_released = true WHERE id = $1", id)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		queuedAt, err = queueSync(tx, id, true)
 		if err != nil {
 			tx.Rollback()
 			return err
 		}
-		totalPrice += price
 	}
 
-	_, err = tx.Exec("UPDATE orders SET user_id = $1, total_price = $2, status = $3 WHERE id = $4",
-		order.UserID, totalPrice, order.Status, order.ID)
+	_, err = tx.Exec("UPDATE orders SET status = $1 WHERE id = $2", status, id)
 	if err != nil {
 		tx.Rollback()
 		return err
 	}
 
-	_, err = tx.Exec("DELETE FROM orders_products WHERE order_id = $1", order.ID)
+	err = recordStatusChange(tx, id, current, status, changedBy)
 	if err != nil {
 		tx.Rollback()
 		return err
 	}
 
-	for _, productID := range order.ProductIDs {
-		_, err := tx.Exec("INSERT INTO orders_products (order_id, product_id) VALUES ($1, $2)", order.ID, productID)
-		if err != nil {
-			tx.Rollback()
-			return err
-		}
+	if err := recordOrderEvent(tx, models.EventOrderStatusChanged, id); err != nil {
+		tx.Rollback()
+		return err
 	}
 
-	err = tx.Commit()
-	if err != nil {
+	if err := tx.Commit(); err != nil {
 		return err
 	}
-
+	if releaseStock {
+		settleSync(or.DB, or.Catalog, id, queuedAt)
+	}
 	return nil
 }
 
-func (or *OrderRepository) DeleteOrder(id int) error {
-	_, err := or.DB.Exec("DELETE FROM orders WHERE id = $1", id)
+func (or *OrderRepository) GetOrderStatusHistory(id int) ([]*models.OrderStatusChange, error) {
+	var exists bool
+	err := or.DB.QueryRow("SELECT EXISTS (SELECT 1 FROM orders WHERE id = $1)", id).Scan(&exists)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if !exists {
+		return nil, sql.ErrNoRows
 	}
 
-	return nil
+	rows, err := or.DB.Query(`
+        SELECT id, order_id, from_status, to_status, changed_by, changed_at
+        FROM order_status_history
+        WHERE order_id = $1
+        ORDER BY changed_at, id`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []*models.OrderStatusChange{}
+	for rows.Next() {
+		change := &models.OrderStatusChange{}
+		var (
+			fromStatus sql.NullString
+			changedBy  sql.NullInt64
+		)
+		err := rows.Scan(&change.ID, &change.OrderID, &fromStatus, &change.ToStatus, &changedBy, &change.ChangedAt)
+		if err != nil {
+			return nil, err
+		}
+		if fromStatus.Valid {
+			change.FromStatus = &fromStatus.String
+		}
+		if changedBy.Valid {
+			userID := int(changedBy.Int64)
+			change.ChangedBy = &userID
+		}
+		history = append(history, change)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return history, nil
 }
 
 func (or *OrderRepository) GetOrderByUserID(userID int) ([]*models.Order, error) {
-	query := `
-        SELECT o.id, o.user_id, o.total_price, o.order_date, o.status, op.product_id
-        FROM orders AS o
-        JOIN orders_products AS op ON o.id = op.order_id
-        WHERE o.user_id = $1`
+	rows, err := or.DB.Query(`
+        SELECT id, user_id, total_price, currency, order_date, status
+        FROM orders
+        WHERE user_id = $1
+        ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	return or.scanOrders(rows)
+}
 
-	rows, err := or.DB.Query(query, userID)
+func (or *OrderRepository) GetOrderByStatus(status string) ([]*models.Order, error) {
+	rows, err := or.DB.Query(`
+        SELECT id, user_id, total_price, currency, order_date, status
+        FROM orders
+        WHERE status = $1
+        ORDER BY id`, status)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	return or.scanOrders(rows)
+}
 
-	ordersMap := make(map[int]*models.Order)
+// scanOrders reads orders from rows, closes them, and attaches each order's
+// items.
+func (or *OrderRepository) scanOrders(rows *sql.Rows) ([]*models.Order, error) {
+	defer rows.Close()
 
+	orders := []*models.Order{}
 	for rows.Next() {
-		var (
-			orderID   int
-			productID int
-		)
 		order := &models.Order{}
-		err := rows.Scan(&orderID, &order.UserID, &order.TotalPrice, &order.OrderDate, &order.Status, &productID)
+		err := rows.Scan(&order.ID, &order.UserID, &order.TotalPrice, &order.TotalPrice.Currency, &order.OrderDate, &order.Status)
 		if err != nil {
 			return nil, err
 		}
+		orders = append(orders, order)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
 
-		if existingOrder, found := ordersMap[orderID]; found {
-			existingOrder.ProductIDs = append(existingOrder.ProductIDs, productID)
-		} else {
-			order.ID = orderID
-			order.ProductIDs = []int{productID}
-			ordersMap[orderID] = order
+	for _, order := range orders {
+		items, err := orderItems(or.DB, order.ID)
+		if err != nil {
+			return nil, err
 		}
+		order.Items = items
 	}
+	return orders, nil
+}
 
-	var orders []*models.Order
-	for _, order := range ordersMap {
-		orders = append(orders, order)
+// placeOrder creates a pending order in one transaction: prepare returns the
+// order to place, its stock is reserved under the order's ID and priced at the
+// products' current prices, and finish, if not nil, completes the transaction.
+// If anything fails the reservation is released again.
+func placeOrder(db *sql.DB, catalog models.Catalog, prepare func(tx *sql.Tx) (models.Order, error), finish func(tx *sql.Tx, orderID int) error) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
 	}
 
-	return orders, nil
+	order, err := prepare(tx)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if len(order.Items) == 0 {
+		tx.Rollback()
+		return 0, fmt.Errorf("%w: order has no items", models.ErrInvalidOrderItems)
+	}
+
+	var orderID int
+	err = tx.QueryRow("SELECT nextval(pg_get_serial_sequence('orders', 'id'))").Scan(&orderID)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	queuedAt, err := queueSync(db, orderID, true)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	err = insertOrder(tx, catalog, orderID, order)
+	if err == nil && finish != nil {
+		err = finish(tx, orderID)
+	}
+	if err != nil {
+		tx.Rollback()
+		settleSync(db, catalog, orderID, queuedAt)
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		settleSync(db, catalog, orderID, queuedAt)
+		return 0, err
+	}
+	dequeueSync(db, orderID, queuedAt)
+	return orderID, nil
 }
 
-func (or *OrderRepository) GetOrderByStatus(status string) ([]*models.Order, error) {
-	query := `
-        SELECT o.id, o.user_id, o.total_price, o.order_date, o.status, op.product_id
-        FROM orders AS o
-        JOIN orders_products AS op ON o.id = op.order_id
-        WHERE o.status = $1`
+// insertOrder reserves stock for order's items and inserts it as a pending
+// order with the given ID.
+func insertOrder(tx *sql.Tx, catalog models.Catalog, orderID int, order models.Order) error {
+	reserved, err := catalog.ReserveStock(context.Background(), models.ReservationKey(orderID), order.Items)
+	if err != nil {
+		return err
+	}
+	items, err := snapshotPrices(order.Items, reserved, nil)
+	if err != nil {
+		return err
+	}
+	total, err := totalPrice(items)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+        INSERT INTO orders (id, user_id, total_price, currency, status)
+        VALUES ($1, $2, $3, $4, $5)`, orderID, order.UserID, total, total.Currency, models.StatusPending)
+	if err != nil {
+		return err
+	}
+
+	if err := insertOrderItems(tx, orderID, items); err != nil {
+		return err
+	}
+
+	err = recordStatusChange(tx, orderID, "", models.StatusPending, order.UserID)
+	if err != nil {
+		return err
+	}
+
+	return recordOrderEvent(tx, models.EventOrderCreated, orderID)
+}
 
-	rows, err := or.DB.Query(query, status)
+func orderItems(q querier, orderID int) ([]models.OrderItem, error) {
+	rows, err := q.Query(`
+        SELECT oi.product_id, oi.quantity, oi.unit_price, o.currency
+        FROM order_items AS oi
+        JOIN orders AS o ON o.id = oi.order_id
+        WHERE oi.order_id = $1
+        ORDER BY oi.product_id`, orderID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	ordersMap := make(map[int]*models.Order)
-
+	items := []models.OrderItem{}
 	for rows.Next() {
-		var (
-			orderID   int
-			productID int
-		)
-		order := &models.Order{}
-		err := rows.Scan(&orderID, &order.UserID, &order.TotalPrice, &order.OrderDate, &order.Status, &productID)
-		if err != nil {
+		var item models.OrderItem
+		if err := rows.Scan(&item.ProductID, &item.Quantity, &item.UnitPrice, &item.UnitPrice.Currency); err != nil {
 			return nil, err
 		}
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
 
-		if existingOrder, found := ordersMap[orderID]; found {
-			existingOrder.ProductIDs = append(existingOrder.ProductIDs, productID)
-		} else {
-			order.ID = orderID
-			order.ProductIDs = []int{productID}
-			ordersMap[orderID] = order
+func insertOrderItems(tx *sql.Tx, orderID int, items []models.OrderItem) error {
+	for _, item := range items {
+		_, err := tx.Exec(`
+            INSERT INTO order_items (order_id, product_id, quantity, unit_price)
+            VALUES ($1, $2, $3, $4)`, orderID, item.ProductID, item.Quantity, item.UnitPrice)
+		if err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	var orders []*models.Order
-	for _, order := range ordersMap {
-		orders = append(orders, order)
+// snapshotPrices returns items with UnitPrice filled in: taken from the
+// matching entry in previous when the product was already on the order, and
+// from the price it was reserved at otherwise.
+func snapshotPrices(items, reserved, previous []models.OrderItem) ([]models.OrderItem, error) {
+	current := make(map[int]money.Money, len(reserved))
+	for _, item := range reserved {
+		current[item.ProductID] = item.UnitPrice
+	}
+	known := make(map[int]money.Money, len(previous))
+	for _, item := range previous {
+		known[item.ProductID] = item.UnitPrice
 	}
 
-	return orders, nil
+	priced := make([]models.OrderItem, 0, len(items))
+	for _, item := range items {
+		price, ok := known[item.ProductID]
+		if !ok {
+			if price, ok = current[item.ProductID]; !ok {
+				return nil, fmt.Errorf("product %d was not reserved", item.ProductID)
+			}
+		}
+		item.UnitPrice = price
+		priced = append(priced, item)
+	}
+	return priced, nil
+}
+
+// totalPrice sums the order lines. All lines must share one currency.
+func totalPrice(items []models.OrderItem) (money.Money, error) {
+	lines := make([]money.Money, 0, len(items))
+	for _, item := range items {
+		lines = append(lines, item.UnitPrice.Mul(int64(item.Quantity)))
+	}
+	return money.Sum(items[0].UnitPrice.Currency, lines...)
+}
+
+// lockOrder locks the order row so concurrent changes to the same order
+// serialize, and returns its current status.
+func lockOrder(tx *sql.Tx, orderID int) (string, error) {
+	var status string
+	err := tx.QueryRow("SELECT status FROM orders WHERE id = $1 FOR UPDATE", orderID).Scan(&status)
+	return status, err
+}
+
+// recordStatusChange appends an entry to the order's status history. An empty
+// from status marks the order's creation; changedBy 0 means unknown.
+func recordStatusChange(tx *sql.Tx, orderID int, from, to string, changedBy int) error {
+	_, err := tx.Exec(`
+        INSERT INTO order_status_history (order_id, from_status, to_status, changed_by)
+        VALUES ($1, NULLIF($2, ''), $3, NULLIF($4, 0))`, orderID, from, to, changedBy)
+	return err
+}
+
+// recordOrderEvent records an event whose payload is the order as tx sees it.
+func recordOrderEvent(tx *sql.Tx, eventType string, orderID int) error {
+	order, err := getOrder(tx, orderID)
+	if err != nil {
+		return err
+	}
+	return outbox.Record(tx, eventType, orderID, order)
 }
@@ -0,0 +1,280 @@
+package repository
+
+import (
+	db "OnlineStore"
+	"OnlineStore/money"
+	"OnlineStore/order-service/models"
+	"OnlineStore/pagination"
+	"database/sql"
+	"errors"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testDB connects to TEST_DATABASE_URL and applies the order-service's
+// migrations. Tests that need a real PostgreSQL instance are skipped when it
+// is not set.
+func testDB(t *testing.T) *sql.DB {
+	dbURL := os.Getenv("TEST_DATABASE_URL")
+	if dbURL == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	t.Setenv("ORDER_DATABASE_URL", dbURL)
+	t.Setenv("MIGRATIONS_URL", "file://../migrations")
+
+	database, err := db.InitializeDB("order")
+	require.NoError(t, err)
+	require.NoError(t, db.MigrateUp(database, "order"))
+	t.Cleanup(func() { database.Close() })
+	return database
+}
+
+// testUserID returns a user ID no other test uses, and deletes the user's
+// orders afterwards. Users live in the user-service, so nothing here checks
+// that it exists.
+func testUserID(t *testing.T, database *sql.DB) int {
+	id := 1_000_000 + rand.Intn(1_000_000_000)
+	t.Cleanup(func() { database.Exec("DELETE FROM orders WHERE user_id = $1", id) })
+	return id
+}
+
+func TestCreateOrderConcurrentDoesNotOversell(t *testing.T) {
+	database := testDB(t)
+	catalog := newFakeCatalog()
+	repo := NewOrderRepository(database, catalog)
+	userID := testUserID(t, database)
+	productID := createTestProduct(t, catalog, 5)
+
+	const buyers = 20
+	var (
+		wg           sync.WaitGroup
+		mu           sync.Mutex
+		created      int
+		insufficient int
+	)
+	for i := 0; i < buyers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := repo.CreateOrder(models.Order{UserID: userID, Status: "pending", Items: []models.OrderItem{{ProductID: productID, Quantity: 1}}})
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				created++
+			case errors.Is(err, models.ErrInsufficientStock):
+				insufficient++
+			default:
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 5, created)
+	assert.Equal(t, buyers-5, insufficient)
+	assert.Equal(t, 0, productQuantity(t, catalog, productID))
+}
+
+func TestCreateOrderConcurrentOppositeProductOrder(t *testing.T) {
+	database := testDB(t)
+	catalog := newFakeCatalog()
+	repo := NewOrderRepository(database, catalog)
+	userID := testUserID(t, database)
+	first := createTestProduct(t, catalog, 10)
+	second := createTestProduct(t, catalog, 10)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		items := []models.OrderItem{{ProductID: first, Quantity: 1}, {ProductID: second, Quantity: 1}}
+		if i%2 == 1 {
+			items = []models.OrderItem{{ProductID: second, Quantity: 1}, {ProductID: first, Quantity: 1}}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := repo.CreateOrder(models.Order{UserID: userID, Status: "pending", Items: items})
+			if err != nil && !errors.Is(err, models.ErrInsufficientStock) {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 0, productQuantity(t, catalog, first))
+	assert.Equal(t, 0, productQuantity(t, catalog, second))
+}
+
+func TestUpdateAndDeleteOrderAdjustStock(t *testing.T) {
+	database := testDB(t)
+	catalog := newFakeCatalog()
+	repo := NewOrderRepository(database, catalog)
+	userID := testUserID(t, database)
+	productID := createTestProduct(t, catalog, 5)
+
+	require.NoError(t, repo.CreateOrder(models.Order{UserID: userID, Status: "pending", Items: []models.OrderItem{{ProductID: productID, Quantity: 2}}}))
+	assert.Equal(t, 3, productQuantity(t, catalog, productID))
+
+	var orderID int
+	require.NoError(t, database.QueryRow("SELECT id FROM orders WHERE user_id = $1", userID).Scan(&orderID))
+
+	order := models.Order{ID: orderID, UserID: userID, Status: "pending", Items: []models.OrderItem{{ProductID: productID, Quantity: 1}}}
+	require.NoError(t, repo.UpdateOrder(order))
+	assert.Equal(t, 4, productQuantity(t, catalog, productID))
+
+	order.Items = []models.OrderItem{{ProductID: productID, Quantity: 4}}
+	require.NoError(t, repo.UpdateOrder(order))
+	assert.Equal(t, 1, productQuantity(t, catalog, productID))
+
+	order.Items = []models.OrderItem{{ProductID: productID, Quantity: 6}}
+	err := repo.UpdateOrder(order)
+	assert.True(t, errors.Is(err, models.ErrInsufficientStock))
+	assert.Equal(t, 1, productQuantity(t, catalog, productID))
+
+	require.NoError(t, repo.DeleteOrder(orderID))
+	assert.Equal(t, 5, productQuantity(t, catalog, productID))
+}
+
+func TestCancelOrderReleasesStockOnce(t *testing.T) {
+	database := testDB(t)
+	catalog := newFakeCatalog()
+	repo := NewOrderRepository(database, catalog)
+	userID := testUserID(t, database)
+	productID := createTestProduct(t, catalog, 5)
+
+	require.NoError(t, repo.CreateOrder(models.Order{UserID: userID, Items: []models.OrderItem{{ProductID: productID, Quantity: 2}}}))
+	assert.Equal(t, 3, productQuantity(t, catalog, productID))
+
+	var orderID int
+	require.NoError(t, database.QueryRow("SELECT id FROM orders WHERE user_id = $1", userID).Scan(&orderID))
+
+	require.NoError(t, repo.UpdateOrderStatus(orderID, models.StatusCancelled, userID))
+	assert.Equal(t, 5, productQuantity(t, catalog, productID))
+
+	err := repo.UpdateOrderStatus(orderID, models.StatusPaid, userID)
+	assert.True(t, errors.Is(err, models.ErrInvalidTransition))
+
+	require.NoError(t, repo.DeleteOrder(orderID))
+	assert.Equal(t, 5, productQuantity(t, catalog, productID))
+}
+
+func TestPayOrderChecksTotal(t *testing.T) {
+	database := testDB(t)
+	catalog := newFakeCatalog()
+	repo := NewOrderRepository(database, catalog)
+	userID := testUserID(t, database)
+	productID := createTestProduct(t, catalog, 5)
+
+	require.NoError(t, repo.CreateOrder(models.Order{UserID: userID, Items: []models.OrderItem{{ProductID: productID, Quantity: 1}}}))
+	var orderID int
+	require.NoError(t, database.QueryRow("SELECT id FROM orders WHERE user_id = $1", userID).Scan(&orderID))
+
+	// The order was edited after the payment for one item was made.
+	order := models.Order{ID: orderID, UserID: userID, Items: []models.OrderItem{{ProductID: productID, Quantity: 2}}}
+	require.NoError(t, repo.UpdateOrder(order))
+
+	err := repo.PayOrder(orderID, money.New(1000, "KZT"), userID)
+	assert.True(t, errors.Is(err, models.ErrTotalMismatch))
+	paid, err := repo.GetOrderByID(orderID)
+	require.NoError(t, err)
+	assert.Equal(t, models.StatusPending, paid.Status)
+
+	require.NoError(t, repo.PayOrder(orderID, money.New(2000, "KZT"), userID))
+	paid, err = repo.GetOrderByID(orderID)
+	require.NoError(t, err)
+	assert.Equal(t, models.StatusPaid, paid.Status)
+}
+
+func TestOrderStatusHistory(t *testing.T) {
+	database := testDB(t)
+	catalog := newFakeCatalog()
+	repo := NewOrderRepository(database, catalog)
+	userID := testUserID(t, database)
+	productID := createTestProduct(t, catalog, 5)
+
+	require.NoError(t, repo.CreateOrder(models.Order{UserID: userID, Items: []models.OrderItem{{ProductID: productID, Quantity: 1}}}))
+	var orderID int
+	require.NoError(t, database.QueryRow("SELECT id FROM orders WHERE user_id = $1", userID).Scan(&orderID))
+
+	require.NoError(t, repo.UpdateOrderStatus(orderID, models.StatusPaid, userID))
+	require.NoError(t, repo.UpdateOrderStatus(orderID, models.StatusShipped, 0))
+
+	history, err := repo.GetOrderStatusHistory(orderID)
+	require.NoError(t, err)
+	require.Len(t, history, 3)
+	assert.Nil(t, history[0].FromStatus)
+	assert.Equal(t, models.StatusPending, history[0].ToStatus)
+	assert.Equal(t, models.StatusPending, *history[1].FromStatus)
+	assert.Equal(t, models.StatusPaid, history[1].ToStatus)
+	assert.Equal(t, userID, *history[1].ChangedBy)
+	assert.Nil(t, history[2].ChangedBy)
+}
+
+func TestOrderItemsKeepPriceSnapshot(t *testing.T) {
+	database := testDB(t)
+	catalog := newFakeCatalog()
+	repo := NewOrderRepository(database, catalog)
+	userID := testUserID(t, database)
+	first := createTestProduct(t, catalog, 5)
+	second := createTestProduct(t, catalog, 5)
+
+	require.NoError(t, repo.CreateOrder(models.Order{UserID: userID, Items: []models.OrderItem{{ProductID: first, Quantity: 2}}}))
+	var orderID int
+	require.NoError(t, database.QueryRow("SELECT id FROM orders WHERE user_id = $1", userID).Scan(&orderID))
+
+	catalog.setPrice(first, 2500)
+	catalog.setPrice(second, 2500)
+
+	order, err := repo.GetOrderByID(orderID)
+	require.NoError(t, err)
+	assert.Equal(t, money.New(2000, "KZT"), order.TotalPrice)
+	require.Len(t, order.Items, 1)
+	assert.Equal(t, money.New(1000, "KZT"), order.Items[0].UnitPrice)
+
+	order.Items = []models.OrderItem{{ProductID: first, Quantity: 3}, {ProductID: second, Quantity: 1}}
+	require.NoError(t, repo.UpdateOrder(*order))
+
+	order, err = repo.GetOrderByID(orderID)
+	require.NoError(t, err)
+	assert.Equal(t, money.New(5500, "KZT"), order.TotalPrice)
+	assert.Equal(t, []models.OrderItem{
+		{ProductID: first, Quantity: 3, UnitPrice: money.New(1000, "KZT")},
+		{ProductID: second, Quantity: 1, UnitPrice: money.New(2500, "KZT")},
+	}, order.Items)
+}
+
+func TestListOrders(t *testing.T) {
+	database := testDB(t)
+	catalog := newFakeCatalog()
+	repo := NewOrderRepository(database, catalog)
+	userID := testUserID(t, database)
+	productID := createTestProduct(t, catalog, 10)
+	for quantity := 1; quantity <= 3; quantity++ {
+		require.NoError(t, repo.CreateOrder(models.Order{UserID: userID, Status: "pending", Items: []models.OrderItem{{ProductID: productID, Quantity: quantity}}}))
+	}
+
+	filter := models.OrderFilter{UserID: userID}
+	orders, total, err := repo.ListOrders(filter, pagination.Params{Limit: 2, Sort: "total_price", Desc: true})
+	require.NoError(t, err)
+	assert.Equal(t, 3, total)
+	require.Equal(t, 2, len(orders))
+	assert.Equal(t, int64(3000), orders[0].TotalPrice.Amount)
+	assert.Equal(t, int64(2000), orders[1].TotalPrice.Amount)
+
+	orders, total, err = repo.ListOrders(filter, pagination.Params{Limit: 2, Offset: 2, Sort: "total_price", Desc: true})
+	require.NoError(t, err)
+	assert.Equal(t, 3, total)
+	require.Equal(t, 1, len(orders))
+	assert.Equal(t, int64(1000), orders[0].TotalPrice.Amount)
+
+	filter.Status = "shipped"
+	orders, total, err = repo.ListOrders(filter, pagination.Params{Limit: 2})
+	require.NoError(t, err)
+	assert.Equal(t, 0, total)
+	assert.Empty(t, orders)
+}
@@ -0,0 +1,147 @@
+package repository
+
+import (
+	"OnlineStore/order-service/models"
+	"context"
+	"database/sql"
+	"log"
+	"time"
+)
+
+// The product-service holds each order's stock as the reservation
+// models.ReservationKey(order ID), and the two cannot change in one
+// transaction. So before a change calls the product-service, the order is
+// queued in reservation_syncs; once both sides agree the entry is removed.
+// Entries left behind by a failed call or a crash are synced again later:
+// the reservation is made to hold the order's items, or released if the
+// order gave its stock back or no longer exists.
+
+// SyncIdle is how long a queued order is left alone before the background
+// sync takes it over, well beyond any request still working on it.
+const SyncIdle = time.Minute
+
+// queueSync queues the order for syncing and returns the time it was queued
+// at, which identifies the entry. Queuing an order again replaces its entry.
+func queueSync(q querier, orderID int, releaseIfMissing bool) (time.Time, error) {
+	var queuedAt time.Time
+	err := q.QueryRow(`
+        INSERT INTO reservation_syncs (order_id, release_if_missing)
+        VALUES ($1, $2)
+        ON CONFLICT (order_id) DO UPDATE SET release_if_missing = EXCLUDED.release_if_missing,
+                                             queued_at          = CURRENT_TIMESTAMP
+        RETURNING queued_at`, orderID, releaseIfMissing).Scan(&queuedAt)
+	return queuedAt, err
+}
+
+// dequeueSync removes the entry queued at queuedAt, unless the order has been
+// queued again since.
+func dequeueSync(db *sql.DB, orderID int, queuedAt time.Time) {
+	_, err := db.Exec("DELETE FROM reservation_syncs WHERE order_id = $1 AND queued_at = $2", orderID, queuedAt)
+	if err != nil {
+		log.Printf("Order %d: failed to dequeue reservation sync: %v", orderID, err)
+	}
+}
+
+// settleSync syncs the order's reservation right away, leaving the entry to
+// the background sync if that fails.
+func settleSync(db *sql.DB, catalog models.Catalog, orderID int, queuedAt time.Time) {
+	if err := syncReservation(db, catalog, orderID); err != nil {
+		log.Printf("Order %d: failed to sync stock reservation: %v", orderID, err)
+		return
+	}
+	dequeueSync(db, orderID, queuedAt)
+}
+
+// syncReservation makes the order's reservation match the order. The order
+// stays locked meanwhile, so it cannot change under the call.
+func syncReservation(db *sql.DB, catalog models.Catalog, orderID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var releaseIfMissing bool
+	err = tx.QueryRow("SELECT release_if_missing FROM reservation_syncs WHERE order_id = $1", orderID).Scan(&releaseIfMissing)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	key := models.ReservationKey(orderID)
+	var stockReleased bool
+	err = tx.QueryRow("SELECT stock_released FROM orders WHERE id = $1 FOR UPDATE", orderID).Scan(&stockReleased)
+	switch {
+	case err == sql.ErrNoRows:
+		if releaseIfMissing {
+			return catalog.ReleaseStock(ctx, key)
+		}
+		return nil
+	case err != nil:
+		return err
+	case stockReleased:
+		return catalog.ReleaseStock(ctx, key)
+	}
+
+	items, err := orderItems(tx, orderID)
+	if err != nil {
+		return err
+	}
+	_, err = catalog.ReserveStock(ctx, key, items)
+	return err
+}
+
+// SyncReservations syncs the orders that have been queued for longer than
+// idle.
+func (or *OrderRepository) SyncReservations(idle time.Duration) error {
+	rows, err := or.DB.Query(`
+        SELECT order_id, queued_at
+        FROM reservation_syncs
+        WHERE queued_at <= CURRENT_TIMESTAMP - $1 * INTERVAL '1 second'
+        ORDER BY queued_at, order_id`, idle.Seconds())
+	if err != nil {
+		return err
+	}
+	type entry struct {
+		orderID  int
+		queuedAt time.Time
+	}
+	var entries []entry
+	for rows.Next() {
+		var e entry
+		if err := rows.Scan(&e.orderID, &e.queuedAt); err != nil {
+			rows.Close()
+			return err
+		}
+		entries = append(entries, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		settleSync(or.DB, or.Catalog, e.orderID, e.queuedAt)
+	}
+	return nil
+}
+
+// SyncReservationsEvery syncs stalled orders now and then every interval,
+// until ctx is done.
+func (or *OrderRepository) SyncReservationsEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := or.SyncReservations(SyncIdle); err != nil {
+			log.Printf("Failed to list stalled reservation syncs: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package repository
+
+import (
+	"OnlineStore/order-service/models"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFailedReleaseIsSyncedLater(t *testing.T) {
+	database := testDB(t)
+	catalog := newFakeCatalog()
+	repo := NewOrderRepository(database, catalog)
+	userID := testUserID(t, database)
+	productID := createTestProduct(t, catalog, 5)
+
+	require.NoError(t, repo.CreateOrder(models.Order{UserID: userID, Items: []models.OrderItem{{ProductID: productID, Quantity: 2}}}))
+	var orderID int
+	require.NoError(t, database.QueryRow("SELECT id FROM orders WHERE user_id = $1", userID).Scan(&orderID))
+
+	// The cancellation is kept even though the stock cannot be released yet.
+	catalog.setFailure(errCatalogDown)
+	require.NoError(t, repo.UpdateOrderStatus(orderID, models.StatusCancelled, userID))
+	assert.Equal(t, 3, productQuantity(t, catalog, productID))
+	require.NoError(t, repo.SyncReservations(0))
+	assert.Equal(t, 3, productQuantity(t, catalog, productID))
+
+	catalog.setFailure(nil)
+	require.NoError(t, repo.SyncReservations(0))
+	assert.Equal(t, 5, productQuantity(t, catalog, productID))
+	assert.False(t, syncQueued(t, repo, orderID))
+}
+
+func TestFailedCreateReleasesReservation(t *testing.T) {
+	database := testDB(t)
+	catalog := newFakeCatalog()
+	repo := NewOrderRepository(database, catalog)
+	userID := testUserID(t, database)
+	productID := createTestProduct(t, catalog, 5)
+
+	catalog.setFailure(errCatalogDown)
+	err := repo.CreateOrder(models.Order{UserID: userID, Items: []models.OrderItem{{ProductID: productID, Quantity: 2}}})
+	assert.True(t, errors.Is(err, errCatalogDown))
+
+	var orderID int
+	require.NoError(t, database.QueryRow("SELECT order_id FROM reservation_syncs ORDER BY queued_at DESC LIMIT 1").Scan(&orderID))
+	catalog.setFailure(nil)
+	require.NoError(t, repo.SyncReservations(0))
+	assert.False(t, syncQueued(t, repo, orderID))
+
+	// A reservation that arrives late for the abandoned order is refused.
+	_, err = catalog.ReserveStock(context.Background(), models.ReservationKey(orderID), []models.OrderItem{{ProductID: productID, Quantity: 2}})
+	assert.True(t, errors.Is(err, models.ErrReservationReleased))
+	assert.Equal(t, 5, productQuantity(t, catalog, productID))
+}
+
+func syncQueued(t *testing.T, repo *OrderRepository, orderID int) bool {
+	var queued bool
+	err := repo.DB.QueryRow("SELECT EXISTS (SELECT 1 FROM reservation_syncs WHERE order_id = $1)", orderID).Scan(&queued)
+	require.NoError(t, err)
+	return queued
+}
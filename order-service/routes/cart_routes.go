@@ -0,0 +1,18 @@
+package routes
+
+import (
+	"OnlineStore/idempotency"
+	"OnlineStore/order-service/controllers"
+	"github.com/gorilla/mux"
+	"net/http"
+)
+
+func CartRoutes(router *mux.Router, cartController *controllers.CartController, idempotencyKeys idempotency.Store) {
+	cartRouter := router.PathPrefix("/cart").Subrouter()
+
+	cartRouter.HandleFunc("", cartController.GetCartController).Methods(http.MethodGet)
+	cartRouter.HandleFunc("/items", cartController.AddCartItemController).Methods(http.MethodPost)
+	cartRouter.HandleFunc("/items/{product_id:[0-9]+}", cartController.UpdateCartItemController).Methods(http.MethodPut)
+	cartRouter.HandleFunc("/items/{product_id:[0-9]+}", cartController.RemoveCartItemController).Methods(http.MethodDelete)
+	cartRouter.HandleFunc("/checkout", idempotency.Handler(idempotencyKeys, cartController.CheckoutController)).Methods(http.MethodPost)
+}
@@ -0,0 +1,15 @@
+package routes
+
+import (
+	"OnlineStore/idempotency"
+	"OnlineStore/order-service/controllers"
+	"github.com/gorilla/mux"
+	"net/http"
+)
+
+func CheckoutRoutes(router *mux.Router, checkoutController *controllers.CheckoutController, idempotencyKeys idempotency.Store) {
+	checkoutRouter := router.PathPrefix("/checkout").Subrouter()
+
+	checkoutRouter.HandleFunc("", idempotency.Handler(idempotencyKeys, checkoutController.CheckoutController)).Methods(http.MethodPost)
+	checkoutRouter.HandleFunc("/{id:[0-9]+}", checkoutController.GetCheckoutController).Methods(http.MethodGet)
+}
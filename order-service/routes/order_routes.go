@@ -1,18 +1,26 @@
 package routes
 
 import (
+	"OnlineStore/idempotency"
 	"OnlineStore/order-service/controllers"
+	"OnlineStore/order-service/models"
 	"github.com/gorilla/mux"
 	"net/http"
 )
 
-func Routes(router *mux.Router, orderController *controllers.OrderController) {
+func Routes(router *mux.Router, orderController *controllers.OrderController, idempotencyKeys idempotency.Store) {
 	ordersRouter := router.PathPrefix("/orders").Subrouter()
 
 	ordersRouter.HandleFunc("", orderController.GetOrdersController).Methods(http.MethodGet)
 	ordersRouter.HandleFunc("/{id:[0-9]+}", orderController.GetOrderByIDController).Methods(http.MethodGet)
-	ordersRouter.HandleFunc("", orderController.CreateOrderController).Methods(http.MethodPost)
+	ordersRouter.HandleFunc("", idempotency.Handler(idempotencyKeys, orderController.CreateOrderController)).Methods(http.MethodPost)
 	ordersRouter.HandleFunc("/{id:[0-9]+}", orderController.UpdateOrderController).Methods(http.MethodPut)
 	ordersRouter.HandleFunc("/{id:[0-9]+}", orderController.DeleteOrderController).Methods(http.MethodDelete)
 	ordersRouter.HandleFunc("/search", orderController.SearchOrderController).Methods(http.MethodGet)
+	ordersRouter.HandleFunc("/{id:[0-9]+}/history", orderController.GetOrderStatusHistoryController).Methods(http.MethodGet)
+	ordersRouter.HandleFunc("/{id:[0-9]+}/pay", orderController.PayOrderController).Methods(http.MethodPost)
+	ordersRouter.HandleFunc("/{id:[0-9]+}/ship", orderController.TransitionOrderController(models.StatusShipped)).Methods(http.MethodPost)
+	ordersRouter.HandleFunc("/{id:[0-9]+}/deliver", orderController.TransitionOrderController(models.StatusDelivered)).Methods(http.MethodPost)
+	ordersRouter.HandleFunc("/{id:[0-9]+}/cancel", orderController.TransitionOrderController(models.StatusCancelled)).Methods(http.MethodPost)
+	ordersRouter.HandleFunc("/{id:[0-9]+}/refund", orderController.TransitionOrderController(models.StatusRefunded)).Methods(http.MethodPost)
 }
@@ -0,0 +1,321 @@
+package services
+
+import (
+	"OnlineStore/order-service/models"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+const (
+	// CheckoutIdle is how long a checkout must have stood still before it
+	// is resumed. It is longer than a payment can take, so a checkout still
+	// waiting for its charge is never mistaken for an interrupted one.
+	CheckoutIdle = 5 * time.Minute
+	// CheckoutResumeInterval is how often stalled checkouts are looked for.
+	CheckoutResumeInterval = time.Minute
+)
+
+// Reasons a checkout fails although its payment went through.
+var (
+	// errOrderCancelled is an order cancelled while the card was being
+	// charged.
+	errOrderCancelled = errors.New("order was cancelled during payment")
+	// errOrderChanged is an order edited while the card was being charged,
+	// so that the payment no longer covers its total.
+	errOrderChanged = errors.New("order changed during payment")
+)
+
+// CheckoutRequest is an order to place and the card to pay for it with.
+type CheckoutRequest struct {
+	UserID int
+	Items  []models.OrderItem
+	Card   Card
+	Email  string
+	Phone  string
+}
+
+// CheckoutSaga places and pays for orders as one unit. Every step is recorded
+// in the checkout before the next begins, so an interrupted checkout can be
+// resumed: finished if its payment went through, and otherwise compensated by
+// cancelling the order, which returns its stock. A payment that cannot be
+// kept, because the order was cancelled meanwhile or its capture never
+// finished, is refunded or voided before the checkout fails.
+type CheckoutSaga struct {
+	Checkouts models.CheckoutModel
+	Orders    models.OrderModel
+	Payments  PaymentClient
+}
+
+func NewCheckoutSaga(checkouts models.CheckoutModel, orders models.OrderModel, payments PaymentClient) *CheckoutSaga {
+	return &CheckoutSaga{Checkouts: checkouts, Orders: orders, Payments: payments}
+}
+
+// Checkout reserves the stock and creates the order, charges the card and
+// marks the order paid. It returns the checkout as it ended up: completed,
+// failed with the payment declined or refunded because the order was
+// cancelled meanwhile, or still charging if the payment's outcome is not
+// known yet. An error means the order could not be created,
+// and nothing was reserved, or that the checkout was interrupted and will be
+// resumed.
+func (s *CheckoutSaga) Checkout(ctx context.Context, request CheckoutRequest) (*models.Checkout, error) {
+	checkout, err := s.Checkouts.StartCheckout(request.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	checkout.OrderID, err = s.Checkouts.CreateCheckoutOrder(checkout.ID, models.Order{UserID: request.UserID, Items: request.Items})
+	if err != nil {
+		// The order and its stock were rolled back together.
+		if _, failErr := s.Checkouts.AdvanceCheckout(checkout.ID, models.CheckoutStarted, models.CheckoutFailed, 0, err.Error()); failErr != nil {
+			log.Printf("Checkout %d: failed to record failure: %v", checkout.ID, failErr)
+		}
+		return nil, err
+	}
+	order, err := s.Orders.GetOrderByID(checkout.OrderID)
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := s.Checkouts.AdvanceCheckout(checkout.ID, models.CheckoutOrderCreated, models.CheckoutCharging, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("checkout %d was resumed while running", checkout.ID)
+	}
+	payment, err := s.Payments.Pay(ctx, paymentKey(checkout.ID), PaymentRequest{
+		UserID:  request.UserID,
+		OrderID: order.ID,
+		Amount:  order.TotalPrice,
+		Card:    request.Card,
+		Email:   request.Email,
+		Phone:   request.Phone,
+	})
+	if err != nil {
+		// The charge may or may not have gone through. Resuming the
+		// checkout asks the payment-service which.
+		log.Printf("Checkout %d: payment for order %d failed: %v", checkout.ID, order.ID, err)
+		return s.Checkouts.GetCheckout(checkout.ID)
+	}
+	checkout.Status = models.CheckoutCharging
+	if err := s.settle(ctx, checkout, payment); err != nil {
+		return nil, err
+	}
+	return s.Checkouts.GetCheckout(checkout.ID)
+}
+
+// ResumeEvery resumes stalled checkouts now and then every interval, until
+// ctx is done.
+func (s *CheckoutSaga) ResumeEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.ResumeStalled(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ResumeStalled moves every checkout that has stood still for CheckoutIdle
+// on towards completed or failed. Errors are logged and the checkout is tried
+// again next time.
+func (s *CheckoutSaga) ResumeStalled(ctx context.Context) {
+	checkouts, err := s.Checkouts.StalledCheckouts(CheckoutIdle)
+	if err != nil {
+		log.Printf("Failed to list stalled checkouts: %v", err)
+		return
+	}
+	for _, checkout := range checkouts {
+		if err := s.Resume(ctx, checkout); err != nil {
+			log.Printf("Checkout %d: failed to resume from %s: %v", checkout.ID, checkout.Status, err)
+		}
+	}
+}
+
+// Resume continues an interrupted checkout from where it stopped. Card
+// details are never stored, so a checkout interrupted before it charged the
+// card cannot be charged now and is compensated instead.
+func (s *CheckoutSaga) Resume(ctx context.Context, checkout *models.Checkout) error {
+	switch checkout.Status {
+	case models.CheckoutStarted:
+		// The order was never created, so there is nothing to undo.
+		_, err := s.Checkouts.AdvanceCheckout(checkout.ID, checkout.Status, models.CheckoutFailed, 0, "interrupted before the order was created")
+		return err
+	case models.CheckoutOrderCreated:
+		return s.fail(checkout, 0, "interrupted before payment")
+	case models.CheckoutCharging:
+		payment, err := s.checkoutPayment(ctx, checkout)
+		if err != nil {
+			return err
+		}
+		if payment == nil {
+			return s.fail(checkout, 0, "payment was never made")
+		}
+		if payment.Status == PaymentStatusAuthorized {
+			// The capture did not finish and nothing retries it, so the
+			// hold is released rather than kept forever.
+			payment, err = s.Payments.Void(ctx, payment.ID, checkout.UserID)
+			if err != nil {
+				return err
+			}
+		}
+		return s.settle(ctx, checkout, payment)
+	case models.CheckoutCompensating:
+		return s.compensate(checkout)
+	default:
+		return nil
+	}
+}
+
+// settle completes or fails a charging checkout according to its payment.
+// A payment the gateway has not decided on yet leaves it charging. A captured
+// payment for an order cancelled or changed meanwhile is refunded and fails the
+// checkout; if the refund cannot be made, the checkout stays charging and the
+// refund is retried when it is resumed.
+func (s *CheckoutSaga) settle(ctx context.Context, checkout *models.Checkout, payment *Payment) error {
+	switch payment.Status {
+	case PaymentStatusCaptured:
+		err := s.confirmOrder(checkout, payment)
+		if errors.Is(err, errOrderCancelled) || errors.Is(err, errOrderChanged) {
+			if err := s.refund(ctx, checkout, payment); err != nil {
+				return err
+			}
+			return s.fail(checkout, payment.ID, err.Error())
+		}
+		if err != nil {
+			return err
+		}
+		_, err = s.Checkouts.AdvanceCheckout(checkout.ID, checkout.Status, models.CheckoutCompleted, payment.ID, "")
+		return err
+	case PaymentStatusPending, PaymentStatusAuthorized:
+		_, err := s.Checkouts.AdvanceCheckout(checkout.ID, checkout.Status, checkout.Status, payment.ID, "")
+		return err
+	default:
+		return s.fail(checkout, payment.ID, "payment "+payment.Status)
+	}
+}
+
+// refund gives the checkout's payment back, unless a refund of it is already
+// completed or pending. Each attempt has its own Idempotency-Key, numbered by
+// the failed attempts before it, so that retrying after a rejected refund
+// makes a new attempt instead of replaying the rejection.
+func (s *CheckoutSaga) refund(ctx context.Context, checkout *models.Checkout, payment *Payment) error {
+	refunds, err := s.Payments.Refunds(ctx, payment.ID, checkout.UserID)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, refund := range refunds {
+		if refund.Status != RefundStatusFailed {
+			return nil
+		}
+		failed++
+	}
+	return s.Payments.Refund(ctx, refundKey(checkout.ID, failed), payment.ID, checkout.UserID)
+}
+
+// fail records why the checkout failed and compensates it.
+func (s *CheckoutSaga) fail(checkout *models.Checkout, paymentID int, reason string) error {
+	ok, err := s.Checkouts.AdvanceCheckout(checkout.ID, checkout.Status, models.CheckoutCompensating, paymentID, reason)
+	if err != nil || !ok {
+		// Someone else moved the checkout on and owns compensating it.
+		return err
+	}
+	checkout.Status = models.CheckoutCompensating
+	return s.compensate(checkout)
+}
+
+// compensate cancels the checkout's order, returning its stock, and marks the
+// checkout failed. It can be repeated safely.
+func (s *CheckoutSaga) compensate(checkout *models.Checkout) error {
+	err := s.transitionOrder(checkout, models.StatusPending, models.StatusCancelled)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	_, err = s.Checkouts.AdvanceCheckout(checkout.ID, models.CheckoutCompensating, models.CheckoutFailed, 0, "")
+	return err
+}
+
+// confirmOrder marks the checkout's order paid with the payment. It returns
+// errOrderCancelled if the order was cancelled instead, or errOrderChanged if
+// its total is no longer the amount paid, so the payment must be given back.
+func (s *CheckoutSaga) confirmOrder(checkout *models.Checkout, payment *Payment) error {
+	order, err := s.Orders.GetOrderByID(checkout.OrderID)
+	if err != nil {
+		return err
+	}
+	if order.Status == models.StatusPending {
+		err = s.Orders.PayOrder(order.ID, payment.Amount, checkout.UserID)
+		if errors.Is(err, models.ErrTotalMismatch) {
+			return errOrderChanged
+		}
+		if err != nil && !errors.Is(err, models.ErrInvalidTransition) {
+			return err
+		}
+		// The order may have moved on meanwhile, e.g. been cancelled.
+		if order, err = s.Orders.GetOrderByID(checkout.OrderID); err != nil {
+			return err
+		}
+	}
+	if order.Status == models.StatusCancelled {
+		return errOrderCancelled
+	}
+	return nil
+}
+
+// transitionOrder moves the checkout's order from status from to status to.
+// The order is left alone if it has already moved on, e.g. because the
+// payment-service marked it paid first.
+func (s *CheckoutSaga) transitionOrder(checkout *models.Checkout, from, to string) error {
+	order, err := s.Orders.GetOrderByID(checkout.OrderID)
+	if err != nil {
+		return err
+	}
+	if order.Status != from {
+		return nil
+	}
+	err = s.Orders.UpdateOrderStatus(order.ID, to, checkout.UserID)
+	if errors.Is(err, models.ErrInvalidTransition) {
+		return nil
+	}
+	return err
+}
+
+// checkoutPayment finds the payment made for the checkout's order, or nil if
+// there is none.
+func (s *CheckoutSaga) checkoutPayment(ctx context.Context, checkout *models.Checkout) (*Payment, error) {
+	payments, err := s.Payments.OrderPayments(ctx, checkout.OrderID, checkout.UserID)
+	if err != nil {
+		return nil, err
+	}
+	var latest *Payment
+	for i := range payments {
+		if payments[i].ID == checkout.PaymentID {
+			return &payments[i], nil
+		}
+		if latest == nil || payments[i].ID > latest.ID {
+			latest = &payments[i]
+		}
+	}
+	return latest, nil
+}
+
+// paymentKey is the Idempotency-Key the checkout charges with, so that the
+// payment-service never charges one checkout twice.
+func paymentKey(checkoutID int) string {
+	return "checkout-" + strconv.Itoa(checkoutID)
+}
+
+// refundKey is the Idempotency-Key of the checkout's attempt to refund its
+// payment after failed earlier attempts.
+func refundKey(checkoutID, failed int) string {
+	return paymentKey(checkoutID) + "-refund-" + strconv.Itoa(failed)
+}
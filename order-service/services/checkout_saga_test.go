@@ -0,0 +1,371 @@
+package services
+
+import (
+	"OnlineStore/money"
+	"OnlineStore/order-service/models"
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeCheckouts keeps checkouts in memory and creates their orders in orders.
+type fakeCheckouts struct {
+	checkouts map[int]*models.Checkout
+	orders    *fakeOrders
+}
+
+func (f *fakeCheckouts) StartCheckout(userID int) (*models.Checkout, error) {
+	checkout := &models.Checkout{ID: len(f.checkouts) + 1, UserID: userID, Status: models.CheckoutStarted}
+	f.checkouts[checkout.ID] = checkout
+	copied := *checkout
+	return &copied, nil
+}
+
+func (f *fakeCheckouts) CreateCheckoutOrder(id int, order models.Order) (int, error) {
+	for _, item := range order.Items {
+		if item.Quantity > f.orders.stock {
+			return 0, models.ErrInsufficientStock
+		}
+	}
+	order.ID = len(f.orders.orders) + 1
+	order.Status = models.StatusPending
+	order.TotalPrice = money.New(1000, "KZT")
+	f.orders.orders[order.ID] = &order
+	f.checkouts[id].Status = models.CheckoutOrderCreated
+	f.checkouts[id].OrderID = order.ID
+	return order.ID, nil
+}
+
+func (f *fakeCheckouts) AdvanceCheckout(id int, from, to string, paymentID int, reason string) (bool, error) {
+	checkout := f.checkouts[id]
+	if checkout.Status != from {
+		return false, nil
+	}
+	checkout.Status = to
+	if paymentID != 0 {
+		checkout.PaymentID = paymentID
+	}
+	if reason != "" {
+		checkout.Error = reason
+	}
+	return true, nil
+}
+
+func (f *fakeCheckouts) GetCheckout(id int) (*models.Checkout, error) {
+	checkout, ok := f.checkouts[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	copied := *checkout
+	return &copied, nil
+}
+
+func (f *fakeCheckouts) StalledCheckouts(idle time.Duration) ([]*models.Checkout, error) {
+	var stalled []*models.Checkout
+	for id := 1; id <= len(f.checkouts); id++ {
+		if checkout := f.checkouts[id]; !checkout.Finished() {
+			copied := *checkout
+			stalled = append(stalled, &copied)
+		}
+	}
+	return stalled, nil
+}
+
+// fakeOrders implements the parts of OrderModel the saga uses.
+type fakeOrders struct {
+	models.OrderModel
+	orders map[int]*models.Order
+	stock  int
+}
+
+func (f *fakeOrders) GetOrderByID(id int) (*models.Order, error) {
+	order, ok := f.orders[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	copied := *order
+	return &copied, nil
+}
+
+func (f *fakeOrders) UpdateOrderStatus(id int, status string, changedBy int) error {
+	order := f.orders[id]
+	if !models.CanTransition(order.Status, status) {
+		return models.ErrInvalidTransition
+	}
+	order.Status = status
+	return nil
+}
+
+func (f *fakeOrders) PayOrder(id int, amount money.Money, changedBy int) error {
+	if order := f.orders[id]; order.Status == models.StatusPending && amount != order.TotalPrice {
+		return models.ErrTotalMismatch
+	}
+	return f.UpdateOrderStatus(id, models.StatusPaid, changedBy)
+}
+
+// fakePayments answers Pay with the next outcome, or fails it if err is set.
+// charging runs while the card is being charged. Refunds fail if refundErr is
+// set, and are rejected by the gateway if refundStatus is failed.
+type fakePayments struct {
+	status       string
+	err          error
+	charging     func(payment PaymentRequest)
+	refundErr    error
+	refundStatus string
+	payments     []Payment
+	refunds      map[int][]Refund
+	keys         []string
+	refundKeys   []string
+}
+
+func (f *fakePayments) Pay(ctx context.Context, key string, payment PaymentRequest) (*Payment, error) {
+	f.keys = append(f.keys, key)
+	if f.charging != nil {
+		f.charging(payment)
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	result := Payment{ID: len(f.payments) + 1, OrderID: payment.OrderID, Amount: payment.Amount, Status: f.status}
+	f.payments = append(f.payments, result)
+	return &result, nil
+}
+
+func (f *fakePayments) OrderPayments(ctx context.Context, orderID, userID int) ([]Payment, error) {
+	var payments []Payment
+	for _, payment := range f.payments {
+		if payment.OrderID == orderID {
+			payments = append(payments, payment)
+		}
+	}
+	return payments, nil
+}
+
+func (f *fakePayments) Refund(ctx context.Context, key string, paymentID, userID int) error {
+	if f.refundErr != nil {
+		return f.refundErr
+	}
+	f.refundKeys = append(f.refundKeys, key)
+	refund := Refund{ID: len(f.refundKeys), Status: RefundStatusCompleted}
+	if f.refundStatus != "" {
+		refund.Status = f.refundStatus
+	}
+	f.refunds[paymentID] = append(f.refunds[paymentID], refund)
+	if refund.Status == RefundStatusFailed {
+		return errors.New("refund failed")
+	}
+	f.payments[paymentID-1].Status = "refunded"
+	return nil
+}
+
+func (f *fakePayments) Refunds(ctx context.Context, paymentID, userID int) ([]Refund, error) {
+	return f.refunds[paymentID], nil
+}
+
+func (f *fakePayments) Void(ctx context.Context, paymentID, userID int) (*Payment, error) {
+	payment := &f.payments[paymentID-1]
+	if payment.Status == PaymentStatusAuthorized {
+		payment.Status = PaymentStatusVoided
+	}
+	result := *payment
+	return &result, nil
+}
+
+func newTestSaga() (*CheckoutSaga, *fakeCheckouts, *fakeOrders, *fakePayments) {
+	orders := &fakeOrders{orders: map[int]*models.Order{}, stock: 5}
+	checkouts := &fakeCheckouts{checkouts: map[int]*models.Checkout{}, orders: orders}
+	payments := &fakePayments{status: PaymentStatusCaptured, refunds: map[int][]Refund{}}
+	return NewCheckoutSaga(checkouts, orders, payments), checkouts, orders, payments
+}
+
+var testItems = []models.OrderItem{{ProductID: 1, Quantity: 2}}
+
+func TestCheckoutCompletes(t *testing.T) {
+	saga, _, orders, payments := newTestSaga()
+
+	checkout, err := saga.Checkout(context.Background(), CheckoutRequest{UserID: 7, Items: testItems})
+	require.NoError(t, err)
+
+	assert.Equal(t, models.CheckoutCompleted, checkout.Status)
+	assert.Equal(t, 1, checkout.PaymentID)
+	assert.Equal(t, models.StatusPaid, orders.orders[checkout.OrderID].Status)
+	assert.Equal(t, []string{"checkout-1"}, payments.keys)
+}
+
+func TestCheckoutCompensatesDeclinedPayment(t *testing.T) {
+	saga, _, orders, payments := newTestSaga()
+	payments.status = "declined"
+
+	checkout, err := saga.Checkout(context.Background(), CheckoutRequest{UserID: 7, Items: testItems})
+	require.NoError(t, err)
+
+	assert.Equal(t, models.CheckoutFailed, checkout.Status)
+	assert.Equal(t, "payment declined", checkout.Error)
+	assert.Equal(t, models.StatusCancelled, orders.orders[checkout.OrderID].Status)
+}
+
+func TestCheckoutWithoutStockReservesNothing(t *testing.T) {
+	saga, checkouts, orders, payments := newTestSaga()
+
+	_, err := saga.Checkout(context.Background(), CheckoutRequest{UserID: 7, Items: []models.OrderItem{{ProductID: 1, Quantity: 6}}})
+	assert.True(t, errors.Is(err, models.ErrInsufficientStock))
+
+	assert.Equal(t, models.CheckoutFailed, checkouts.checkouts[1].Status)
+	assert.Empty(t, orders.orders)
+	assert.Empty(t, payments.keys)
+}
+
+func TestCheckoutWaitsForUndecidedPayment(t *testing.T) {
+	saga, checkouts, orders, payments := newTestSaga()
+	payments.status = PaymentStatusPending
+
+	checkout, err := saga.Checkout(context.Background(), CheckoutRequest{UserID: 7, Items: testItems})
+	require.NoError(t, err)
+	assert.Equal(t, models.CheckoutCharging, checkout.Status)
+	assert.Equal(t, 1, checkout.PaymentID)
+	assert.Equal(t, models.StatusPending, orders.orders[checkout.OrderID].Status)
+
+	// Still undecided: the checkout keeps waiting
+	saga.ResumeStalled(context.Background())
+	assert.Equal(t, models.CheckoutCharging, checkouts.checkouts[1].Status)
+
+	// The gateway captures it later
+	payments.payments[0].Status = PaymentStatusCaptured
+	saga.ResumeStalled(context.Background())
+	assert.Equal(t, models.CheckoutCompleted, checkouts.checkouts[1].Status)
+	assert.Equal(t, models.StatusPaid, orders.orders[checkout.OrderID].Status)
+}
+
+func TestResumeInterruptedCheckouts(t *testing.T) {
+	saga, checkouts, orders, payments := newTestSaga()
+
+	// The payment-service charged the card but the answer was lost.
+	payments.err = errors.New("connection reset")
+	lost, err := saga.Checkout(context.Background(), CheckoutRequest{UserID: 7, Items: testItems})
+	require.NoError(t, err)
+	assert.Equal(t, models.CheckoutCharging, lost.Status)
+	payments.payments = append(payments.payments, Payment{ID: 1, OrderID: lost.OrderID, Amount: money.New(1000, "KZT"), Status: PaymentStatusCaptured})
+
+	// The request never reached the payment-service.
+	neverPaid, err := saga.Checkout(context.Background(), CheckoutRequest{UserID: 7, Items: testItems})
+	require.NoError(t, err)
+
+	// Crashed after creating the order, before charging.
+	interrupted, err := checkouts.StartCheckout(8)
+	require.NoError(t, err)
+	_, err = checkouts.CreateCheckoutOrder(interrupted.ID, models.Order{UserID: 8, Items: testItems})
+	require.NoError(t, err)
+
+	// Crashed before creating the order.
+	started, err := checkouts.StartCheckout(9)
+	require.NoError(t, err)
+
+	saga.ResumeStalled(context.Background())
+
+	assert.Equal(t, models.CheckoutCompleted, checkouts.checkouts[lost.ID].Status)
+	assert.Equal(t, models.StatusPaid, orders.orders[lost.OrderID].Status)
+
+	assert.Equal(t, models.CheckoutFailed, checkouts.checkouts[neverPaid.ID].Status)
+	assert.Equal(t, "payment was never made", checkouts.checkouts[neverPaid.ID].Error)
+	assert.Equal(t, models.StatusCancelled, orders.orders[neverPaid.OrderID].Status)
+
+	assert.Equal(t, models.CheckoutFailed, checkouts.checkouts[interrupted.ID].Status)
+	assert.Equal(t, models.StatusCancelled, orders.orders[checkouts.checkouts[interrupted.ID].OrderID].Status)
+
+	assert.Equal(t, models.CheckoutFailed, checkouts.checkouts[started.ID].Status)
+
+	// Resuming again changes nothing
+	saga.ResumeStalled(context.Background())
+	assert.Equal(t, models.CheckoutCompleted, checkouts.checkouts[lost.ID].Status)
+}
+
+func TestCompensateIsRepeatable(t *testing.T) {
+	saga, checkouts, orders, _ := newTestSaga()
+	checkout, err := checkouts.StartCheckout(7)
+	require.NoError(t, err)
+	checkout.OrderID, err = checkouts.CreateCheckoutOrder(checkout.ID, models.Order{UserID: 7, Items: testItems})
+	require.NoError(t, err)
+
+	// Crashed after cancelling the order, before recording it.
+	checkouts.checkouts[checkout.ID].Status = models.CheckoutCompensating
+	orders.orders[checkout.OrderID].Status = models.StatusCancelled
+
+	saga.ResumeStalled(context.Background())
+	assert.Equal(t, models.CheckoutFailed, checkouts.checkouts[checkout.ID].Status)
+	assert.Equal(t, models.StatusCancelled, orders.orders[checkout.OrderID].Status)
+}
+
+func TestCheckoutRefundsCancelledOrder(t *testing.T) {
+	saga, checkouts, orders, payments := newTestSaga()
+	// The customer cancels the order while the card is being charged.
+	payments.charging = func(payment PaymentRequest) {
+		require.NoError(t, orders.UpdateOrderStatus(payment.OrderID, models.StatusCancelled, 7))
+	}
+	payments.refundErr = errors.New("connection reset")
+
+	_, err := saga.Checkout(context.Background(), CheckoutRequest{UserID: 7, Items: testItems})
+	require.Error(t, err)
+	assert.Equal(t, models.CheckoutCharging, checkouts.checkouts[1].Status, "the refund is retried")
+
+	// The gateway rejects the refund: the checkout keeps the order's money
+	// until a new attempt succeeds.
+	payments.refundErr = nil
+	payments.refundStatus = RefundStatusFailed
+	saga.ResumeStalled(context.Background())
+	assert.Equal(t, models.CheckoutCharging, checkouts.checkouts[1].Status)
+	assert.Equal(t, PaymentStatusCaptured, payments.payments[0].Status)
+
+	payments.refundStatus = ""
+	saga.ResumeStalled(context.Background())
+
+	checkout := checkouts.checkouts[1]
+	assert.Equal(t, models.CheckoutFailed, checkout.Status)
+	assert.Equal(t, "order was cancelled during payment", checkout.Error)
+	assert.Equal(t, models.StatusCancelled, orders.orders[checkout.OrderID].Status)
+	assert.Equal(t, "refunded", payments.payments[0].Status)
+	assert.Equal(t, []string{"checkout-1-refund-0", "checkout-1-refund-1"}, payments.refundKeys)
+
+	// A completed refund is not repeated.
+	require.NoError(t, saga.refund(context.Background(), checkout, &payments.payments[0]))
+	assert.Len(t, payments.refundKeys, 2)
+}
+
+func TestCheckoutRefundsChangedOrder(t *testing.T) {
+	saga, _, orders, payments := newTestSaga()
+	// The customer adds to the order while the card is being charged.
+	payments.charging = func(payment PaymentRequest) {
+		orders.orders[payment.OrderID].TotalPrice = money.New(3000, "KZT")
+	}
+
+	checkout, err := saga.Checkout(context.Background(), CheckoutRequest{UserID: 7, Items: testItems})
+	require.NoError(t, err)
+
+	assert.Equal(t, models.CheckoutFailed, checkout.Status)
+	assert.Equal(t, "order changed during payment", checkout.Error)
+	assert.Equal(t, models.StatusCancelled, orders.orders[checkout.OrderID].Status)
+	assert.Equal(t, "refunded", payments.payments[0].Status)
+	assert.Equal(t, []string{"checkout-1-refund-0"}, payments.refundKeys)
+}
+
+func TestResumeVoidsAuthorizedPayment(t *testing.T) {
+	saga, checkouts, orders, payments := newTestSaga()
+	// The capture timed out, leaving the card's hold in place.
+	payments.status = PaymentStatusAuthorized
+
+	checkout, err := saga.Checkout(context.Background(), CheckoutRequest{UserID: 7, Items: testItems})
+	require.NoError(t, err)
+	assert.Equal(t, models.CheckoutCharging, checkout.Status)
+
+	saga.ResumeStalled(context.Background())
+
+	assert.Equal(t, PaymentStatusVoided, payments.payments[0].Status)
+	assert.Equal(t, models.CheckoutFailed, checkouts.checkouts[1].Status)
+	assert.Equal(t, "payment voided", checkouts.checkouts[1].Error)
+	assert.Equal(t, models.StatusCancelled, orders.orders[checkout.OrderID].Status)
+	assert.Empty(t, payments.refundKeys)
+}
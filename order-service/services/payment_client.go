@@ -0,0 +1,201 @@
+package services
+
+import (
+	"OnlineStore/apierror"
+	"OnlineStore/auth"
+	"OnlineStore/idempotency"
+	"OnlineStore/money"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Payment statuses the checkout acts on, as reported by the payment-service.
+const (
+	PaymentStatusPending    = "pending"
+	PaymentStatusAuthorized = "authorized"
+	PaymentStatusCaptured   = "captured"
+	PaymentStatusVoided     = "voided"
+)
+
+// Refund statuses, as reported by the payment-service.
+const (
+	RefundStatusPending   = "pending"
+	RefundStatusCompleted = "completed"
+	RefundStatusFailed    = "failed"
+)
+
+// paymentTimeout covers the payment-service authorizing and capturing at the
+// gateway, each of which may take up to its own timeout.
+const paymentTimeout = 90 * time.Second
+
+type Card struct {
+	Number     string `json:"number"`
+	ExpDate    string `json:"exp_date"`
+	CVC        string `json:"cvc"`
+	HolderName string `json:"holder_name"`
+}
+
+// PaymentRequest is the body of POST /payments in the payment-service.
+type PaymentRequest struct {
+	UserID  int         `json:"user_id"`
+	OrderID int         `json:"order_id"`
+	Amount  money.Money `json:"amount"`
+	Card    Card        `json:"card"`
+	Email   string      `json:"email"`
+	Phone   string      `json:"phone"`
+}
+
+type Payment struct {
+	ID      int         `json:"id"`
+	OrderID int         `json:"order_id"`
+	Amount  money.Money `json:"amount"`
+	Status  string      `json:"payment_status"`
+}
+
+type Refund struct {
+	ID     int    `json:"id"`
+	Status string `json:"status"`
+}
+
+// PaymentClient charges orders through the payment-service.
+type PaymentClient interface {
+	// Pay charges the order. Retries with the same key are answered with
+	// the first outcome instead of charging again.
+	Pay(ctx context.Context, key string, payment PaymentRequest) (*Payment, error)
+	// OrderPayments lists the payments made for the order.
+	OrderPayments(ctx context.Context, orderID, userID int) ([]Payment, error)
+	// Refund returns whatever has not been refunded yet of the captured
+	// payment. Retries with the same key are answered with the first
+	// outcome instead of refunding again. It fails unless the refund is
+	// completed, or pending until the payment-service reconciles it.
+	Refund(ctx context.Context, key string, paymentID, userID int) error
+	// Refunds lists the refunds of the payment.
+	Refunds(ctx context.Context, paymentID, userID int) ([]Refund, error)
+	// Void releases the hold of an authorized payment and returns the
+	// payment as it ended up: voided, or captured if the gateway had
+	// already taken the money.
+	Void(ctx context.Context, paymentID, userID int) (*Payment, error)
+}
+
+type HTTPPaymentClient struct {
+	baseURL string
+	client  *http.Client
+}
+
+func NewHTTPPaymentClient(baseURL string) *HTTPPaymentClient {
+	return &HTTPPaymentClient{
+		baseURL: baseURL + "/payments",
+		client:  &http.Client{Timeout: paymentTimeout},
+	}
+}
+
+// NewPaymentClientFromEnv talks to the payment-service at PAYMENT_SERVICE_URL.
+func NewPaymentClientFromEnv() *HTTPPaymentClient {
+	return NewHTTPPaymentClient(os.Getenv("PAYMENT_SERVICE_URL"))
+}
+
+func (c *HTTPPaymentClient) Pay(ctx context.Context, key string, payment PaymentRequest) (*Payment, error) {
+	body, err := json.Marshal(payment)
+	if err != nil {
+		return nil, err
+	}
+	req, err := c.newRequest(ctx, http.MethodPost, c.baseURL, payment.UserID, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(idempotency.Header, key)
+
+	var result Payment
+	if err := c.do(req, &result); err != nil {
+		return nil, fmt.Errorf("failed to pay for order %d: %w", payment.OrderID, err)
+	}
+	return &result, nil
+}
+
+func (c *HTTPPaymentClient) OrderPayments(ctx context.Context, orderID, userID int) ([]Payment, error) {
+	url := c.baseURL + "?order_id=" + strconv.Itoa(orderID) + "&limit=100"
+	req, err := c.newRequest(ctx, http.MethodGet, url, userID, nil)
+	if err != nil {
+		return nil, err
+	}
+	var page struct {
+		Items []Payment `json:"items"`
+	}
+	if err := c.do(req, &page); err != nil {
+		return nil, fmt.Errorf("failed to get payments for order %d: %w", orderID, err)
+	}
+	return page.Items, nil
+}
+
+func (c *HTTPPaymentClient) Refund(ctx context.Context, key string, paymentID, userID int) error {
+	req, err := c.newRequest(ctx, http.MethodPost, c.baseURL+"/"+strconv.Itoa(paymentID)+"/refunds", userID, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(idempotency.Header, key)
+	var refund Refund
+	if err := c.do(req, &refund); err != nil {
+		return fmt.Errorf("failed to refund payment %d: %w", paymentID, err)
+	}
+	if refund.Status != RefundStatusCompleted && refund.Status != RefundStatusPending {
+		return fmt.Errorf("refund %d of payment %d is %s", refund.ID, paymentID, refund.Status)
+	}
+	return nil
+}
+
+func (c *HTTPPaymentClient) Refunds(ctx context.Context, paymentID, userID int) ([]Refund, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, c.baseURL+"/"+strconv.Itoa(paymentID)+"/refunds", userID, nil)
+	if err != nil {
+		return nil, err
+	}
+	var refunds []Refund
+	if err := c.do(req, &refunds); err != nil {
+		return nil, fmt.Errorf("failed to get refunds of payment %d: %w", paymentID, err)
+	}
+	return refunds, nil
+}
+
+func (c *HTTPPaymentClient) Void(ctx context.Context, paymentID, userID int) (*Payment, error) {
+	req, err := c.newRequest(ctx, http.MethodPost, c.baseURL+"/"+strconv.Itoa(paymentID)+"/void", userID, nil)
+	if err != nil {
+		return nil, err
+	}
+	var result Payment
+	if err := c.do(req, &result); err != nil {
+		return nil, fmt.Errorf("failed to void payment %d: %w", paymentID, err)
+	}
+	return &result, nil
+}
+
+// newRequest builds a request made on behalf of the customer userID, so the
+// payment-service applies the same ownership checks as for the customer.
+func (c *HTTPPaymentClient) newRequest(ctx context.Context, method, url string, userID int, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(auth.UserIDHeader, strconv.Itoa(userID))
+	req.Header.Set(auth.UserRoleHeader, auth.RoleCustomer)
+	return req, nil
+}
+
+func (c *HTTPPaymentClient) do(req *http.Request, result interface{}) error {
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusAccepted {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("status: %s, detail: %s", resp.Status, apierror.ParseProblem(resp.StatusCode, body).Detail)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
@@ -0,0 +1,36 @@
+package services
+
+import (
+	"OnlineStore/idempotency"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPaymentClientRefundChecksStatus(t *testing.T) {
+	for status, ok := range map[string]bool{
+		RefundStatusCompleted: true,
+		RefundStatusPending:   true,
+		RefundStatusFailed:    false,
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/payments/4/refunds", r.URL.Path)
+			assert.Equal(t, "checkout-1-refund-0", r.Header.Get(idempotency.Header))
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"id":9,"status":"` + status + `"}`))
+		}))
+
+		err := NewHTTPPaymentClient(server.URL).Refund(context.Background(), "checkout-1-refund-0", 4, 7)
+		assert.Equal(t, ok, err == nil, status)
+		server.Close()
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+	assert.Error(t, NewHTTPPaymentClient(server.URL).Refund(context.Background(), "checkout-1-refund-0", 4, 7))
+}
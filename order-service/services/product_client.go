@@ -0,0 +1,158 @@
+package services
+
+import (
+	"OnlineStore/apierror"
+	"OnlineStore/auth"
+	"OnlineStore/order-service/models"
+	"OnlineStore/pagination"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const productTimeout = 10 * time.Second
+
+// HTTPProductClient is the models.Catalog of the product-service's API.
+type HTTPProductClient struct {
+	baseURL string
+	client  *http.Client
+}
+
+func NewHTTPProductClient(baseURL string) *HTTPProductClient {
+	return &HTTPProductClient{
+		baseURL: baseURL + "/products",
+		client:  &http.Client{Timeout: productTimeout},
+	}
+}
+
+// NewProductClientFromEnv talks to the product-service at PRODUCT_SERVICE_URL.
+func NewProductClientFromEnv() *HTTPProductClient {
+	return NewHTTPProductClient(os.Getenv("PRODUCT_SERVICE_URL"))
+}
+
+func (c *HTTPProductClient) Products(ctx context.Context, ids []int) ([]models.CatalogProduct, error) {
+	products := make([]models.CatalogProduct, 0, len(ids))
+	for start := 0; start < len(ids); start += pagination.MaxLimit {
+		batch := ids[start:min(start+pagination.MaxLimit, len(ids))]
+		params := make([]string, len(batch))
+		for i, id := range batch {
+			params[i] = strconv.Itoa(id)
+		}
+		query := url.Values{"ids": {strings.Join(params, ",")}, "limit": {strconv.Itoa(len(batch))}}
+
+		req, err := c.newRequest(ctx, http.MethodGet, c.baseURL+"?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Items []models.CatalogProduct `json:"items"`
+		}
+		if err := c.do(req, &page); err != nil {
+			return nil, fmt.Errorf("failed to get products: %w", err)
+		}
+		products = append(products, page.Items...)
+	}
+	return products, nil
+}
+
+type reservationItem struct {
+	ProductID int `json:"product_id"`
+	Quantity  int `json:"quantity"`
+}
+
+func (c *HTTPProductClient) ReserveStock(ctx context.Context, key string, items []models.OrderItem) ([]models.OrderItem, error) {
+	input := struct {
+		Items []reservationItem `json:"items"`
+	}{Items: make([]reservationItem, len(items))}
+	for i, item := range items {
+		input.Items[i] = reservationItem{ProductID: item.ProductID, Quantity: item.Quantity}
+	}
+	body, err := json.Marshal(input)
+	if err != nil {
+		return nil, err
+	}
+	req, err := c.newRequest(ctx, http.MethodPut, c.reservationURL(key), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	var reservation struct {
+		Items []models.OrderItem `json:"items"`
+	}
+	if err := c.do(req, &reservation); err != nil {
+		return nil, err
+	}
+	return reservation.Items, nil
+}
+
+func (c *HTTPProductClient) ReleaseStock(ctx context.Context, key string) error {
+	req, err := c.newRequest(ctx, http.MethodDelete, c.reservationURL(key), nil)
+	if err != nil {
+		return err
+	}
+	return c.do(req, nil)
+}
+
+func (c *HTTPProductClient) reservationURL(key string) string {
+	return c.baseURL + "/reservations/" + url.PathEscape(key)
+}
+
+// newRequest builds a request made by the order-service itself, which the
+// product-service trusts as an admin.
+func (c *HTTPProductClient) newRequest(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
+	return req, nil
+}
+
+// catalogError is a failure reported by the product-service, matching the
+// order-service error it corresponds to with errors.Is.
+type catalogError struct {
+	kind    error
+	message string
+}
+
+func (e *catalogError) Error() string { return e.message }
+
+func (e *catalogError) Unwrap() error { return e.kind }
+
+// catalogErrors are the product-service's answers that mean the request
+// cannot succeed as it is.
+var catalogErrors = map[int]error{
+	http.StatusNotFound: models.ErrProductNotFound,
+	http.StatusConflict: models.ErrInsufficientStock,
+	http.StatusGone:     models.ErrReservationReleased,
+}
+
+// do sends req and decodes the response into result, if it is not nil.
+func (c *HTTPProductClient) do(req *http.Request, result interface{}) error {
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		problem := apierror.ParseProblem(resp.StatusCode, body)
+		if kind, ok := catalogErrors[resp.StatusCode]; ok {
+			return &catalogError{kind: kind, message: problem.Detail}
+		}
+		return fmt.Errorf("status: %s, detail: %s", resp.Status, problem.Detail)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
@@ -0,0 +1,86 @@
+package services
+
+import (
+	"OnlineStore/apierror"
+	"OnlineStore/auth"
+	"OnlineStore/money"
+	"OnlineStore/order-service/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProductClientReservesAsAdmin(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPut, r.Method)
+		assert.Equal(t, "/products/reservations/order-7", r.URL.Path)
+		assert.Equal(t, auth.RoleAdmin, r.Header.Get(auth.UserRoleHeader))
+		w.Write([]byte(`{"key":"order-7","items":[{"product_id":3,"quantity":2,"unit_price":{"amount":"15.00","currency":"KZT"}}]}`))
+	}))
+	defer server.Close()
+
+	items, err := NewHTTPProductClient(server.URL).ReserveStock(context.Background(), models.ReservationKey(7), []models.OrderItem{{ProductID: 3, Quantity: 2}})
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+	assert.Equal(t, int64(1500), items[0].UnitPrice.Amount)
+}
+
+func TestProductClientMapsErrors(t *testing.T) {
+	statuses := map[int]error{
+		http.StatusNotFound: models.ErrProductNotFound,
+		http.StatusConflict: models.ErrInsufficientStock,
+		http.StatusGone:     models.ErrReservationReleased,
+	}
+	for status, want := range statuses {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "refused", status)
+		}))
+		err := NewHTTPProductClient(server.URL).ReleaseStock(context.Background(), "order-1")
+		server.Close()
+		assert.True(t, errors.Is(err, want), "status %d: %v", status, err)
+		assert.Equal(t, "refused", err.Error())
+	}
+}
+
+func TestProductClientReadsProblems(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apierror.Write(w, r, fmt.Errorf("%w: product 3", models.ErrInsufficientStock))
+	}))
+	defer server.Close()
+
+	_, err := NewHTTPProductClient(server.URL).ReserveStock(context.Background(), "order-1", []models.OrderItem{{ProductID: 3, Quantity: 2}})
+	assert.ErrorIs(t, err, models.ErrInsufficientStock)
+	assert.Equal(t, "not enough quantity: product 3", err.Error())
+}
+
+func TestProductClientListsProductsInBatches(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		var page struct {
+			Items []models.CatalogProduct `json:"items"`
+		}
+		page.Items = append(page.Items, models.CatalogProduct{ID: requests, Name: r.URL.Query().Get("limit"), Price: money.New(1000, "KZT")})
+		json.NewEncoder(w).Encode(page)
+	}))
+	defer server.Close()
+
+	ids := make([]int, 150)
+	for i := range ids {
+		ids[i] = i + 1
+	}
+	products, err := NewHTTPProductClient(server.URL).Products(context.Background(), ids)
+	require.NoError(t, err)
+	assert.Equal(t, 2, requests)
+	assert.Equal(t, []models.CatalogProduct{
+		{ID: 1, Name: "100", Price: money.New(1000, "KZT")},
+		{ID: 2, Name: "50", Price: money.New(1000, "KZT")},
+	}, products)
+}
@@ -0,0 +1,116 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Channel is the PostgreSQL notification channel PostgresBroker publishes
+// on.
+const Channel = "outbox_events"
+
+// Broker delivers events to whoever is interested in them.
+type Broker interface {
+	Publish(ctx context.Context, event Event) error
+}
+
+// BrokerFromEnv builds the broker selected by OUTBOX_BROKER: "memory" (the
+// default) or "postgres".
+func BrokerFromEnv(db *sql.DB) (Broker, error) {
+	switch name := os.Getenv("OUTBOX_BROKER"); name {
+	case "", "memory":
+		return NewMemoryBroker(), nil
+	case "postgres":
+		return NewPostgresBroker(db), nil
+	default:
+		return nil, fmt.Errorf("unknown OUTBOX_BROKER %q", name)
+	}
+}
+
+// MemoryBroker hands events to handlers in the same process, in the order
+// they are published. It suits tests and running a service on its own.
+type MemoryBroker struct {
+	mu       sync.RWMutex
+	handlers []func(Event)
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{}
+}
+
+// Subscribe calls handler with every event published from now on.
+func (b *MemoryBroker) Subscribe(handler func(Event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, handler)
+}
+
+func (b *MemoryBroker) Publish(ctx context.Context, event Event) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, handler := range b.handlers {
+		handler(event)
+	}
+	return nil
+}
+
+// PostgresBroker publishes events with NOTIFY on Channel, so any process
+// connected to the same database can LISTEN for them; see Listen. PostgreSQL
+// limits a notification to 8000 bytes, which bounds the payload size.
+type PostgresBroker struct {
+	DB *sql.DB
+}
+
+func NewPostgresBroker(db *sql.DB) *PostgresBroker {
+	return &PostgresBroker{DB: db}
+}
+
+func (b *PostgresBroker) Publish(ctx context.Context, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = b.DB.ExecContext(ctx, "SELECT pg_notify($1, $2)", Channel, string(data))
+	return err
+}
+
+// Listen calls handler with every event a PostgresBroker publishes to the
+// database at dbURL, until ctx is done. Notifications sent while the
+// connection is down are lost; the outbox table still has every event.
+func Listen(ctx context.Context, dbURL string, handler func(Event)) error {
+	listener := pq.NewListener(dbURL, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Outbox listener: %v", err)
+		}
+	})
+	defer listener.Close()
+	if err := listener.Listen(Channel); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case notification := <-listener.Notify:
+			if notification == nil {
+				// The connection was re-established.
+				continue
+			}
+			var event Event
+			if err := json.Unmarshal([]byte(notification.Extra), &event); err != nil {
+				log.Printf("Outbox listener: bad event: %v", err)
+				continue
+			}
+			handler(event)
+		}
+	}
+}
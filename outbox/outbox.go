@@ -0,0 +1,48 @@
+// Package outbox publishes domain events reliably. Repositories record an
+// event in the same transaction as the change it describes, so an event is
+// stored if and only if the change is committed; a Relay then delivers the
+// stored events to a Broker.
+//
+// Delivery is at least once: an event may be delivered again if the relay
+// stops between publishing it and marking it published, so consumers should
+// ignore event IDs they have already seen.
+package outbox
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// Event is something that happened to one aggregate, such as an order. Type
+// is "<aggregate>.<what happened>", like "order.created".
+type Event struct {
+	ID          int64           `json:"id"`
+	Type        string          `json:"type"`
+	AggregateID int             `json:"aggregate_id"`
+	Payload     json.RawMessage `json:"payload"`
+	CreatedAt   time.Time       `json:"created_at"`
+}
+
+// Aggregate returns the kind of thing the event is about, like "order".
+func (e Event) Aggregate() string {
+	aggregate, _, _ := strings.Cut(e.Type, ".")
+	return aggregate
+}
+
+// Execer runs a statement; *sql.Tx satisfies it.
+type Execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// Record stores an event with payload marshalled to JSON. tx should be the
+// transaction making the change the event describes.
+func Record(tx Execer, eventType string, aggregateID int, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO outbox_events (type, aggregate_id, payload) VALUES ($1, $2, $3)", eventType, aggregateID, data)
+	return err
+}
@@ -0,0 +1,129 @@
+package outbox
+
+import (
+	db "OnlineStore"
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryBroker(t *testing.T) {
+	broker := NewMemoryBroker()
+	require.NoError(t, broker.Publish(context.Background(), Event{ID: 1, Type: "order.created"}))
+
+	var first, second []int64
+	broker.Subscribe(func(event Event) { first = append(first, event.ID) })
+	broker.Subscribe(func(event Event) { second = append(second, event.ID) })
+	require.NoError(t, broker.Publish(context.Background(), Event{ID: 2, Type: "order.created"}))
+	require.NoError(t, broker.Publish(context.Background(), Event{ID: 3, Type: "order.deleted"}))
+
+	// Subscribers only see events published after they subscribed
+	assert.Equal(t, []int64{2, 3}, first)
+	assert.Equal(t, []int64{2, 3}, second)
+}
+
+func TestEventAggregate(t *testing.T) {
+	assert.Equal(t, "order", Event{Type: "order.status_changed"}.Aggregate())
+	assert.Equal(t, "refund", Event{Type: "refund.created"}.Aggregate())
+}
+
+func TestBrokerFromEnv(t *testing.T) {
+	t.Setenv("OUTBOX_BROKER", "")
+	broker, err := BrokerFromEnv(nil)
+	require.NoError(t, err)
+	assert.IsType(t, &MemoryBroker{}, broker)
+
+	t.Setenv("OUTBOX_BROKER", "postgres")
+	broker, err = BrokerFromEnv(nil)
+	require.NoError(t, err)
+	assert.IsType(t, &PostgresBroker{}, broker)
+
+	t.Setenv("OUTBOX_BROKER", "kafka")
+	_, err = BrokerFromEnv(nil)
+	assert.Error(t, err)
+}
+
+func testDB(t *testing.T) *sql.DB {
+	dbURL := os.Getenv("TEST_DATABASE_URL")
+	if dbURL == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	t.Setenv("ORDER_DATABASE_URL", dbURL)
+	t.Setenv("MIGRATIONS_URL", "file://../order-service/migrations")
+
+	database, err := db.InitializeDB("order")
+	require.NoError(t, err)
+	require.NoError(t, db.MigrateUp(database, "order"))
+	t.Cleanup(func() { database.Close() })
+	return database
+}
+
+// recordTestEvent commits an event of a type no service uses, so the test
+// can tell it apart from events recorded by other tests.
+func recordTestEvent(t *testing.T, database *sql.DB, committed bool) {
+	tx, err := database.Begin()
+	require.NoError(t, err)
+	require.NoError(t, Record(tx, "test.relayed", 42, map[string]string{"name": "test"}))
+	if committed {
+		require.NoError(t, tx.Commit())
+	} else {
+		require.NoError(t, tx.Rollback())
+	}
+	t.Cleanup(func() { database.Exec("DELETE FROM outbox_events WHERE type = 'test.relayed'") })
+}
+
+func TestRelayPublishesCommittedEvents(t *testing.T) {
+	database := testDB(t)
+	recordTestEvent(t, database, false)
+	recordTestEvent(t, database, true)
+
+	broker := NewMemoryBroker()
+	var relayed []Event
+	broker.Subscribe(func(event Event) {
+		if event.Type == "test.relayed" {
+			relayed = append(relayed, event)
+		}
+	})
+	relay := NewRelay(database, broker)
+	for {
+		published, err := relay.RelayOnce(context.Background())
+		require.NoError(t, err)
+		if published == 0 {
+			break
+		}
+	}
+
+	// Only the committed event is relayed, once
+	require.Len(t, relayed, 1)
+	assert.Equal(t, 42, relayed[0].AggregateID)
+	assert.JSONEq(t, `{"name": "test"}`, string(relayed[0].Payload))
+
+	var unpublished int
+	err := database.QueryRow("SELECT COUNT(*) FROM outbox_events WHERE type = 'test.relayed' AND published_at IS NULL").Scan(&unpublished)
+	require.NoError(t, err)
+	assert.Equal(t, 0, unpublished)
+}
+
+type failingBroker struct{}
+
+func (failingBroker) Publish(ctx context.Context, event Event) error {
+	return errors.New("broker is down")
+}
+
+func TestRelayKeepsEventsTheBrokerRejects(t *testing.T) {
+	database := testDB(t)
+	recordTestEvent(t, database, true)
+
+	_, err := NewRelay(database, failingBroker{}).RelayOnce(context.Background())
+	assert.Error(t, err)
+
+	var unpublished int
+	err = database.QueryRow("SELECT COUNT(*) FROM outbox_events WHERE type = 'test.relayed' AND published_at IS NULL").Scan(&unpublished)
+	require.NoError(t, err)
+	assert.Equal(t, 1, unpublished)
+}
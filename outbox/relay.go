@@ -0,0 +1,119 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	defaultBatchSize = 100
+	// RelayInterval is how long the relay waits when the outbox is empty.
+	RelayInterval = time.Second
+)
+
+// Relay delivers recorded events to a broker, oldest first, and marks them
+// published. Several relays may share an outbox: each batch is locked, so
+// they do not publish the same events at once.
+type Relay struct {
+	DB        *sql.DB
+	Broker    Broker
+	BatchSize int
+}
+
+func NewRelay(db *sql.DB, broker Broker) *Relay {
+	return &Relay{DB: db, Broker: broker, BatchSize: defaultBatchSize}
+}
+
+// Run relays events until ctx is done, waiting interval whenever it has
+// caught up. Errors are logged and retried.
+func (r *Relay) Run(ctx context.Context, interval time.Duration) {
+	for {
+		published, err := r.RelayOnce(ctx)
+		if err != nil {
+			log.Printf("Outbox relay: %v", err)
+		}
+		if err == nil && published == r.BatchSize {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// RelayOnce publishes up to BatchSize unpublished events and returns how many
+// it published. It stops at the first event the broker rejects, so events
+// are never published out of order by one relay.
+func (r *Relay) RelayOnce(ctx context.Context) (int, error) {
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+        SELECT id, type, aggregate_id, payload, created_at
+        FROM outbox_events
+        WHERE published_at IS NULL
+        ORDER BY id
+        LIMIT $1
+        FOR UPDATE SKIP LOCKED`, r.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+	var events []Event
+	for rows.Next() {
+		var event Event
+		if err := rows.Scan(&event.ID, &event.Type, &event.AggregateID, &event.Payload, &event.CreatedAt); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		events = append(events, event)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var published []int64
+	var publishErr error
+	for _, event := range events {
+		if publishErr = r.Broker.Publish(ctx, event); publishErr != nil {
+			break
+		}
+		published = append(published, event.ID)
+	}
+	if len(published) > 0 {
+		_, err = tx.ExecContext(ctx, "UPDATE outbox_events SET published_at = CURRENT_TIMESTAMP WHERE id = ANY($1)", pq.Array(published))
+		if err != nil {
+			return 0, err
+		}
+		if err := tx.Commit(); err != nil {
+			return 0, err
+		}
+	}
+	return len(published), publishErr
+}
+
+// StartRelay relays the events in db to the broker chosen by BrokerFromEnv in
+// the background until ctx is done. The in-memory broker logs each event, as
+// nothing else in the process subscribes to it.
+func StartRelay(ctx context.Context, db *sql.DB) error {
+	broker, err := BrokerFromEnv(db)
+	if err != nil {
+		return err
+	}
+	if memory, ok := broker.(*MemoryBroker); ok {
+		memory.Subscribe(func(event Event) {
+			log.Printf("Event %d: %s %d", event.ID, event.Type, event.AggregateID)
+		})
+	}
+	go NewRelay(db, broker).Run(ctx, RelayInterval)
+	return nil
+}
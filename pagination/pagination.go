@@ -0,0 +1,136 @@
+// Package pagination reads paging and sorting parameters from list requests
+// and builds the matching SQL.
+package pagination
+
+import (
+	"OnlineStore/apierror"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	DefaultLimit = 20
+	MaxLimit     = 100
+)
+
+var ErrInvalidParams = apierror.New(apierror.Validation, "invalid pagination parameters")
+
+// Params selects one page of a sorted list.
+type Params struct {
+	Limit  int
+	Offset int
+	// Sort is one of the sort keys the list offers; Desc reverses it.
+	Sort string
+	Desc bool
+}
+
+// FromQuery reads limit, offset, sort and order (asc or desc) from query.
+// sorts are the keys the list can be sorted by; the first is the default.
+func FromQuery(query url.Values, sorts ...string) (Params, error) {
+	params := Params{Limit: DefaultLimit}
+	if len(sorts) > 0 {
+		params.Sort = sorts[0]
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > MaxLimit {
+			return Params{}, fmt.Errorf("%w: limit must be between 1 and %d", ErrInvalidParams, MaxLimit)
+		}
+		params.Limit = n
+	}
+	if offset := query.Get("offset"); offset != "" {
+		n, err := strconv.Atoi(offset)
+		if err != nil || n < 0 {
+			return Params{}, fmt.Errorf("%w: offset must not be negative", ErrInvalidParams)
+		}
+		params.Offset = n
+	}
+	if sort := query.Get("sort"); sort != "" {
+		if !slices.Contains(sorts, sort) {
+			return Params{}, fmt.Errorf("%w: sort must be one of %s", ErrInvalidParams, strings.Join(sorts, ", "))
+		}
+		params.Sort = sort
+	}
+	switch order := query.Get("order"); order {
+	case "", "asc":
+	case "desc":
+		params.Desc = true
+	default:
+		return Params{}, fmt.Errorf("%w: order must be asc or desc", ErrInvalidParams)
+	}
+	return params, nil
+}
+
+// OrderBy returns the ORDER BY, LIMIT and OFFSET clauses for the page, with
+// its arguments appended to where's, so count the matching rows first.
+// columns maps sort keys to SQL; rows that tie are ordered by id, so pages
+// never overlap.
+func (p Params) OrderBy(columns map[string]string, where *Where) string {
+	direction := "ASC"
+	if p.Desc {
+		direction = "DESC"
+	}
+	orderBy := "id " + direction
+	if column, ok := columns[p.Sort]; ok && column != "id" {
+		orderBy = column + " " + direction + ", " + orderBy
+	}
+	limit := where.Arg(p.Limit)
+	offset := where.Arg(p.Offset)
+	return fmt.Sprintf(" ORDER BY %s LIMIT %s OFFSET %s", orderBy, limit, offset)
+}
+
+// Where collects the filters of a list query and their arguments.
+type Where struct {
+	conditions []string
+	Args       []any
+}
+
+// Add adds a condition on value, written with %s where its placeholder goes,
+// such as "price >= %s".
+func (w *Where) Add(condition string, value any) {
+	w.conditions = append(w.conditions, fmt.Sprintf(condition, w.Arg(value)))
+}
+
+// Equal adds column = value.
+func (w *Where) Equal(column string, value any) {
+	w.Add(column+" = %s", value)
+}
+
+// String returns the WHERE clause, or nothing if there are no conditions.
+func (w *Where) String() string {
+	if len(w.conditions) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(w.conditions, " AND ")
+}
+
+// Arg adds value to the arguments and returns its placeholder, for values the
+// query uses outside a condition.
+func (w *Where) Arg(value any) string {
+	w.Args = append(w.Args, value)
+	return "$" + strconv.Itoa(len(w.Args))
+}
+
+// Page is one page of a list. Next is the offset of the following page, or
+// null on the last one.
+type Page[T any] struct {
+	Items  []T  `json:"items"`
+	Total  int  `json:"total"`
+	Limit  int  `json:"limit"`
+	Offset int  `json:"offset"`
+	Next   *int `json:"next"`
+}
+
+func NewPage[T any](items []T, total int, params Params) Page[T] {
+	if items == nil {
+		items = []T{}
+	}
+	page := Page[T]{Items: items, Total: total, Limit: params.Limit, Offset: params.Offset}
+	if next := params.Offset + len(items); len(items) > 0 && next < total {
+		page.Next = &next
+	}
+	return page
+}
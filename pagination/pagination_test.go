@@ -0,0 +1,61 @@
+package pagination
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFromQuery(t *testing.T) {
+	params, err := FromQuery(url.Values{}, "id", "price")
+	require.NoError(t, err)
+	assert.Equal(t, Params{Limit: DefaultLimit, Sort: "id"}, params)
+
+	query := url.Values{"limit": {"5"}, "offset": {"10"}, "sort": {"price"}, "order": {"desc"}}
+	params, err = FromQuery(query, "id", "price")
+	require.NoError(t, err)
+	assert.Equal(t, Params{Limit: 5, Offset: 10, Sort: "price", Desc: true}, params)
+
+	for _, query := range []url.Values{
+		{"limit": {"0"}},
+		{"limit": {"101"}},
+		{"offset": {"-1"}},
+		{"sort": {"password_hash"}},
+		{"order": {"sideways"}},
+	} {
+		_, err := FromQuery(query, "id", "price")
+		assert.True(t, errors.Is(err, ErrInvalidParams), "%v", query)
+	}
+}
+
+func TestOrderBy(t *testing.T) {
+	var where Where
+	where.Equal("status", "paid")
+	where.Add("price >= %s", 100)
+	assert.Equal(t, " WHERE status = $1 AND price >= $2", where.String())
+
+	params := Params{Limit: 5, Offset: 10, Sort: "price", Desc: true}
+	orderBy := params.OrderBy(map[string]string{"id": "id", "price": "price"}, &where)
+	assert.Equal(t, " ORDER BY price DESC, id DESC LIMIT $3 OFFSET $4", orderBy)
+	assert.Equal(t, []any{"paid", 100, 5, 10}, where.Args)
+
+	var empty Where
+	assert.Equal(t, "", empty.String())
+	assert.Equal(t, " ORDER BY id ASC LIMIT $1 OFFSET $2", Params{Limit: 5, Sort: "id"}.OrderBy(map[string]string{"id": "id"}, &empty))
+}
+
+func TestNewPage(t *testing.T) {
+	page := NewPage([]int{1, 2}, 5, Params{Limit: 2, Offset: 2})
+	require.NotNil(t, page.Next)
+	assert.Equal(t, 4, *page.Next)
+
+	page = NewPage([]int{5}, 5, Params{Limit: 2, Offset: 4})
+	assert.Nil(t, page.Next)
+
+	page = NewPage[int](nil, 5, Params{Limit: 2, Offset: 10})
+	assert.Equal(t, []int{}, page.Items)
+	assert.Nil(t, page.Next)
+}
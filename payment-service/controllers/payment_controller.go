@@ -1,9 +1,16 @@
 package controllers
 
 import (
+	"OnlineStore/apierror"
+	"OnlineStore/auth"
+	"OnlineStore/money"
+	"OnlineStore/pagination"
 	"OnlineStore/payment-service/models"
 	"OnlineStore/payment-service/services"
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
 	"log"
@@ -13,25 +20,52 @@ import (
 
 type PaymentController struct {
 	PaymentModel models.PaymentModel
+	Gateway      services.PaymentGateway
+	Orders       services.OrderClient
+	// WebhookSecret authenticates epay callbacks; see services.EpaySecretHash.
+	WebhookSecret string
 }
 
-func NewPaymentController(paymentModel models.PaymentModel) *PaymentController {
-	return &PaymentController{PaymentModel: paymentModel}
+func NewPaymentController(paymentModel models.PaymentModel, gateway services.PaymentGateway, orders services.OrderClient, webhookSecret string) *PaymentController {
+	return &PaymentController{PaymentModel: paymentModel, Gateway: gateway, Orders: orders, WebhookSecret: webhookSecret}
 }
 
+// GetPaymentsController lists a page of payments, optionally filtered by
+// user_id, order_id and status. Customers only ever list their own payments.
 func (pc *PaymentController) GetPaymentsController(writer http.ResponseWriter, request *http.Request) {
-	payments, err := pc.PaymentModel.GetPayments()
+	query := request.URL.Query()
+	page, err := pagination.FromQuery(query, models.PaymentSorts...)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		apierror.Write(writer, request, err)
 		return
 	}
-	if len(payments) == 0 {
-		writer.WriteHeader(http.StatusNotFound)
+	filter := models.PaymentFilter{Status: query.Get("status")}
+	for param, id := range map[string]*int{"user_id": &filter.UserID, "order_id": &filter.OrderID} {
+		if value := query.Get(param); value != "" {
+			*id, err = strconv.Atoi(value)
+			if err != nil {
+				apierror.Write(writer, request, apierror.New(apierror.Validation, param+" must be a number"))
+				return
+			}
+		}
+	}
+	caller := auth.CallerFromRequest(request)
+	if !caller.IsAdmin() {
+		if filter.UserID != 0 && filter.UserID != caller.UserID {
+			apierror.Write(writer, request, apierror.New(apierror.NotFound, "user not found"))
+			return
+		}
+		filter.UserID = caller.UserID
+	}
+
+	payments, total, err := pc.PaymentModel.ListPayments(filter, page)
+	if err != nil {
+		apierror.Write(writer, request, err)
 		return
 	}
-	jsonPayments, err := json.Marshal(payments)
+	jsonPayments, err := json.Marshal(pagination.NewPage(payments, total, page))
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		apierror.Write(writer, request, err)
 		return
 	}
 	writer.Header().Set("Content-Type", "application/json")
@@ -44,21 +78,16 @@ func (pc *PaymentController) GetPaymentByIDController(writer http.ResponseWriter
 	vars := mux.Vars(request)
 	id, err := strconv.Atoi(vars["id"])
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		apierror.Write(writer, request, apierror.New(apierror.Validation, "id must be a number"))
 		return
 	}
-	payment, err := pc.PaymentModel.GetPaymentByID(id)
-	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	if payment == nil {
-		writer.WriteHeader(http.StatusNotFound)
+	payment, ok := pc.ownedPayment(writer, request, id)
+	if !ok {
 		return
 	}
 	jsonPayment, err := json.Marshal(payment)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		apierror.Write(writer, request, err)
 		return
 	}
 	writer.Header().Set("Content-Type", "application/json")
@@ -67,47 +96,302 @@ func (pc *PaymentController) GetPaymentByIDController(writer http.ResponseWriter
 	return
 }
 
+// createPaymentRequest is the body of POST /payments: the payment plus the
+// card and contact details that are passed to the gateway but never stored.
+type createPaymentRequest struct {
+	models.Payment
+	Card  services.Card `json:"card"`
+	Email string        `json:"email"`
+	Phone string        `json:"phone"`
+}
+
 func (pc *PaymentController) CreatePaymentController(writer http.ResponseWriter, request *http.Request) {
-	var payment models.Payment
-	err := json.NewDecoder(request.Body).Decode(&payment)
+	var input createPaymentRequest
+	err := json.NewDecoder(request.Body).Decode(&input)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		apierror.Write(writer, request, apierror.Wrap(apierror.Validation, "invalid JSON body", err))
+		return
+	}
+	payment := input.Payment
+	if caller := auth.CallerFromRequest(request); !caller.IsAdmin() {
+		// Customers can only pay as themselves.
+		payment.UserID = caller.UserID
+	}
+	if payment.Amount.Amount <= 0 {
+		apierror.Write(writer, request, apierror.New(apierror.Validation, "amount must be positive"))
 		return
 	}
-	paymentResponse, err := services.MakePayment()
+	if err := input.Card.Validate(); err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	order, err := pc.Orders.GetOrder(request.Context(), payment.OrderID, payment.UserID)
+	if err == nil && order.UserID != payment.UserID {
+		err = services.ErrOrderNotFound
+	}
+	if err == nil {
+		err = order.CheckPayable()
+	}
+	if err == nil {
+		err = order.CheckAmount(payment.Amount)
+	}
+	if err == nil {
+		err = pc.checkNoOpenPayment(payment.OrderID)
+	}
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	payment.InvoiceID, err = services.NewInvoiceID()
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+
+	// The payment is recorded before the card is charged, so no charge is
+	// ever left without a payment, and the gateway's callback finds it even
+	// if it arrives before the charge returns.
+	payment.PaymentStatus = models.PaymentStatusPending
+	payment.TransactionID = ""
+	payment.ID, err = pc.PaymentModel.CreatePayment(payment)
 	if err != nil {
-		payment.PaymentStatus = "failed"
-		fmt.Printf("Payment failed: %v", err)
+		apierror.Write(writer, request, err)
+		return
+	}
+	pc.charge(request.Context(), &payment, input)
+	pc.recordOutcome(&payment, models.PaymentStatusPending)
+	if payment.PaymentStatus == models.PaymentStatusCaptured {
+		pc.markOrderPaid(request.Context(), &payment)
+	}
+	jsonPayment, err := json.Marshal(payment)
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	if payment.PaymentStatus == models.PaymentStatusPending {
+		// The gateway did not answer in time; the outcome is unknown until
+		// it is reconciled.
+		writer.WriteHeader(http.StatusAccepted)
 	} else {
-		log.Println("Payment is successful")
-		payment.PaymentStatus = paymentResponse.Status
+		writer.WriteHeader(http.StatusCreated)
+	}
+	_, err = writer.Write(jsonPayment)
+	return
+}
+
+// checkNoOpenPayment returns ErrOrderNotPending if the order already has a
+// payment that went through or may still go through, so a second one would
+// charge the card twice.
+func (pc *PaymentController) checkNoOpenPayment(orderID int) error {
+	payments, err := pc.PaymentModel.GetPaymentByOrderID(orderID)
+	if err != nil {
+		return err
+	}
+	for _, payment := range payments {
+		switch payment.PaymentStatus {
+		case models.PaymentStatusDeclined, models.PaymentStatusFailed, models.PaymentStatusVoided:
+		default:
+			return fmt.Errorf("%w: order %d already has payment %d, which is %s", services.ErrOrderNotPending, orderID, payment.ID, payment.PaymentStatus)
+		}
+	}
+	return nil
+}
+
+// charge authorizes the payment at the gateway and captures it, recording the
+// outcome in payment.PaymentStatus. A hold that cannot be captured is voided.
+func (pc *PaymentController) charge(ctx context.Context, payment *models.Payment, input createPaymentRequest) {
+	result, err := pc.Gateway.Authorize(ctx, services.Charge{
+		InvoiceID:   payment.InvoiceID,
+		OrderID:     payment.OrderID,
+		UserID:      payment.UserID,
+		Amount:      payment.Amount,
+		Description: fmt.Sprintf("Order #%d", payment.OrderID),
+		Email:       input.Email,
+		Phone:       input.Phone,
+		Card:        input.Card,
+	})
+	if err != nil {
+		log.Printf("Payment %s authorization failed: %v", payment.InvoiceID, err)
+		payment.PaymentStatus = failedPaymentStatus(err)
+		return
+	}
+	payment.TransactionID = result.TransactionID
+	if result.Status != services.GatewayStatusAuthorized {
+		payment.PaymentStatus = result.Status
+		return
+	}
+	pc.capture(ctx, payment)
+}
+
+// capture charges an authorized payment, recording the outcome in
+// payment.PaymentStatus.
+func (pc *PaymentController) capture(ctx context.Context, payment *models.Payment) {
+	result, err := pc.Gateway.Capture(ctx, payment.TransactionID, payment.Amount)
+	if err != nil {
+		log.Printf("Payment %s capture failed: %v", payment.InvoiceID, err)
+		if errors.Is(err, services.ErrGatewayTimeout) {
+			payment.PaymentStatus = models.PaymentStatusAuthorized
+			return
+		}
+		if _, voidErr := pc.Gateway.Void(ctx, payment.TransactionID); voidErr != nil {
+			log.Printf("Payment %s void failed: %v", payment.InvoiceID, voidErr)
+		}
+		payment.PaymentStatus = models.PaymentStatusFailed
+		return
+	}
+	log.Println("Payment is successful")
+	payment.PaymentStatus = result.Status
+}
+
+// recordOutcome stores the outcome of moving the payment on from status from,
+// such as charging a pending payment. If the gateway's callback recorded an
+// outcome first, payment is reloaded with it. If the outcome cannot be stored
+// the payment stays in status from, as it is in the database, until the
+// callback settles it.
+func (pc *PaymentController) recordOutcome(payment *models.Payment, from string) {
+	if payment.PaymentStatus == from {
+		return
 	}
-	err = pc.PaymentModel.CreatePayment(payment)
+	updated, err := pc.PaymentModel.UpdatePaymentStatus(payment.ID, from, payment.PaymentStatus, payment.TransactionID)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		log.Printf("Payment %s: failed to record status %s: %v", payment.InvoiceID, payment.PaymentStatus, err)
+		payment.PaymentStatus = from
 		return
 	}
-	writer.WriteHeader(http.StatusCreated)
+	if updated {
+		return
+	}
+	current, err := pc.PaymentModel.GetPaymentByID(payment.ID)
+	if err != nil {
+		log.Printf("Payment %s: failed to reload: %v", payment.InvoiceID, err)
+		return
+	}
+	*payment = *current
+}
+
+// markOrderPaid advances the payment's order. If the amount captured is not
+// the order's total, e.g. because the order was changed while it was being
+// paid for, the payment is refunded in full and the order left pending. Other
+// failures are only logged: the payment stands, and the next callback for it
+// retries the order.
+func (pc *PaymentController) markOrderPaid(ctx context.Context, payment *models.Payment) {
+	err := pc.Orders.MarkOrderPaid(ctx, payment.OrderID, payment.UserID, payment.Amount)
+	if err == nil {
+		return
+	}
+	log.Printf("Payment %s: failed to mark order %d paid: %v", payment.InvoiceID, payment.OrderID, err)
+	if !errors.Is(err, services.ErrAmountMismatch) {
+		return
+	}
+	_, refunded, err := pc.refundPayment(ctx, payment.ID, money.Money{}, "amount paid is not the order's total")
+	if err != nil {
+		log.Printf("Payment %s: failed to refund: %v", payment.InvoiceID, err)
+		return
+	}
+	*payment = *refunded
+}
+
+// VoidPaymentController releases the hold of an authorized payment, e.g. one
+// whose capture timed out. If the gateway turns out to have captured it after
+// all, the payment is recorded as captured instead, to be refunded. Voiding a
+// voided payment returns it unchanged.
+func (pc *PaymentController) VoidPaymentController(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		apierror.Write(writer, request, apierror.New(apierror.Validation, "id must be a number"))
+		return
+	}
+	payment, ok := pc.ownedPayment(writer, request, id)
+	if !ok {
+		return
+	}
+	switch payment.PaymentStatus {
+	case models.PaymentStatusAuthorized:
+		pc.void(request.Context(), payment)
+		pc.recordOutcome(payment, models.PaymentStatusAuthorized)
+	case models.PaymentStatusVoided:
+	default:
+		apierror.Write(writer, request, fmt.Errorf("%w: payment is %s", models.ErrPaymentNotVoidable, payment.PaymentStatus))
+		return
+	}
+	switch payment.PaymentStatus {
+	case models.PaymentStatusAuthorized:
+		apierror.Write(writer, request, apierror.New(apierror.Unavailable, "the gateway did not void the payment, try again later"))
+		return
+	case models.PaymentStatusCaptured:
+		pc.markOrderPaid(request.Context(), payment)
+	}
+
+	jsonPayment, err := json.Marshal(payment)
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	_, err = writer.Write(jsonPayment)
 	return
 }
 
+// void releases the authorized payment's hold at the gateway, recording the
+// outcome in payment.PaymentStatus. When the void fails, the gateway is asked
+// whether the hold was captured or voided meanwhile; otherwise the payment
+// stays authorized.
+func (pc *PaymentController) void(ctx context.Context, payment *models.Payment) {
+	_, err := pc.Gateway.Void(ctx, payment.TransactionID)
+	if err == nil {
+		payment.PaymentStatus = models.PaymentStatusVoided
+		return
+	}
+	log.Printf("Payment %s void failed: %v", payment.InvoiceID, err)
+	result, err := pc.Gateway.Status(ctx, payment.InvoiceID)
+	if err != nil {
+		log.Printf("Payment %s: failed to get status: %v", payment.InvoiceID, err)
+		return
+	}
+	switch result.Status {
+	case services.GatewayStatusCaptured, services.GatewayStatusVoided:
+		payment.PaymentStatus = result.Status
+	}
+}
+
+func failedPaymentStatus(err error) string {
+	switch {
+	case errors.Is(err, services.ErrGatewayTimeout):
+		return models.PaymentStatusPending
+	case errors.Is(err, services.ErrDeclined):
+		return models.PaymentStatusDeclined
+	default:
+		return models.PaymentStatusFailed
+	}
+}
+
 func (pc *PaymentController) UpdatePaymentController(writer http.ResponseWriter, request *http.Request) {
 	vars := mux.Vars(request)
 	id, err := strconv.Atoi(vars["id"])
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		apierror.Write(writer, request, apierror.New(apierror.Validation, "id must be a number"))
 		return
 	}
 	var payment models.Payment
 	err = json.NewDecoder(request.Body).Decode(&payment)
 	payment.ID = id
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		apierror.Write(writer, request, apierror.Wrap(apierror.Validation, "invalid JSON body", err))
+		return
+	}
+	existing, ok := pc.ownedPayment(writer, request, id)
+	if !ok {
 		return
 	}
+	if !auth.CallerFromRequest(request).IsAdmin() {
+		payment.UserID = existing.UserID
+	}
 	err = pc.PaymentModel.UpdatePayment(payment)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		apierror.Write(writer, request, err)
 		return
 	}
 	writer.WriteHeader(http.StatusOK)
@@ -118,27 +402,33 @@ func (pc *PaymentController) DeletePaymentController(writer http.ResponseWriter,
 	vars := mux.Vars(request)
 	id, err := strconv.Atoi(vars["id"])
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		apierror.Write(writer, request, apierror.New(apierror.Validation, "id must be a number"))
+		return
+	}
+	if _, ok := pc.ownedPayment(writer, request, id); !ok {
 		return
 	}
 	err = pc.PaymentModel.DeletePayment(id)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		apierror.Write(writer, request, err)
 		return
 	}
 	writer.WriteHeader(http.StatusNoContent)
 	return
 }
 
+// SearchPaymentController finds payments by order, user or status. Customers
+// only ever find their own payments.
 func (pc *PaymentController) SearchPaymentController(writer http.ResponseWriter, request *http.Request) {
+	caller := auth.CallerFromRequest(request)
 	orderID, err := strconv.Atoi(request.URL.Query().Get("order_id"))
 	if err != nil && orderID != 0 {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		apierror.Write(writer, request, apierror.New(apierror.Validation, "order_id must be a number"))
 		return
 	}
 	userID, err := strconv.Atoi(request.URL.Query().Get("user_id"))
 	if err != nil && userID != 0 {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		apierror.Write(writer, request, apierror.New(apierror.Validation, "user_id must be a number"))
 		return
 	}
 	status := request.URL.Query().Get("status")
@@ -146,16 +436,17 @@ func (pc *PaymentController) SearchPaymentController(writer http.ResponseWriter,
 	if orderID != 0 {
 		payments, err := pc.PaymentModel.GetPaymentByOrderID(orderID)
 		if err != nil {
-			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			apierror.Write(writer, request, err)
 			return
 		}
+		payments = ownedPayments(caller, payments)
 		if len(payments) == 0 {
-			writer.WriteHeader(http.StatusNotFound)
+			apierror.Write(writer, request, apierror.New(apierror.NotFound, "no payments found"))
 			return
 		}
 		jsonPayments, err := json.Marshal(payments)
 		if err != nil {
-			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			apierror.Write(writer, request, err)
 			return
 		}
 		writer.Header().Set("Content-Type", "application/json")
@@ -164,18 +455,22 @@ func (pc *PaymentController) SearchPaymentController(writer http.ResponseWriter,
 		return
 	}
 	if userID != 0 {
+		if !caller.Owns(userID) {
+			apierror.Write(writer, request, apierror.New(apierror.NotFound, "user not found"))
+			return
+		}
 		payments, err := pc.PaymentModel.GetPaymentByUserID(userID)
 		if err != nil {
-			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			apierror.Write(writer, request, err)
 			return
 		}
 		if len(payments) == 0 {
-			writer.WriteHeader(http.StatusNotFound)
+			apierror.Write(writer, request, apierror.New(apierror.NotFound, "no payments found"))
 			return
 		}
 		jsonPayments, err := json.Marshal(payments)
 		if err != nil {
-			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			apierror.Write(writer, request, err)
 			return
 		}
 		writer.Header().Set("Content-Type", "application/json")
@@ -187,16 +482,17 @@ func (pc *PaymentController) SearchPaymentController(writer http.ResponseWriter,
 	if status != "" {
 		payments, err := pc.PaymentModel.GetPaymentByStatus(status)
 		if err != nil {
-			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			apierror.Write(writer, request, err)
 			return
 		}
+		payments = ownedPayments(caller, payments)
 		if len(payments) == 0 {
-			writer.WriteHeader(http.StatusNotFound)
+			apierror.Write(writer, request, apierror.New(apierror.NotFound, "no payments found"))
 			return
 		}
 		jsonPayments, err := json.Marshal(payments)
 		if err != nil {
-			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			apierror.Write(writer, request, err)
 			return
 		}
 		writer.Header().Set("Content-Type", "application/json")
@@ -205,4 +501,33 @@ func (pc *PaymentController) SearchPaymentController(writer http.ResponseWriter,
 		return
 
 	}
+	apierror.Write(writer, request, apierror.New(apierror.Validation, "search by order_id, user_id or status"))
+}
+
+// ownedPayment loads the payment if the caller owns it. Otherwise it answers
+// 404, whether or not the payment exists, and returns false.
+func (pc *PaymentController) ownedPayment(writer http.ResponseWriter, request *http.Request, id int) (*models.Payment, bool) {
+	payment, err := pc.PaymentModel.GetPaymentByID(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = models.ErrPaymentNotFound
+	}
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return nil, false
+	}
+	if payment == nil || !auth.CallerFromRequest(request).Owns(payment.UserID) {
+		apierror.Write(writer, request, models.ErrPaymentNotFound)
+		return nil, false
+	}
+	return payment, true
+}
+
+func ownedPayments(caller auth.Caller, payments []*models.Payment) []*models.Payment {
+	owned := make([]*models.Payment, 0, len(payments))
+	for _, payment := range payments {
+		if caller.Owns(payment.UserID) {
+			owned = append(owned, payment)
+		}
+	}
+	return owned
 }
@@ -1,30 +1,49 @@
 package controllers
 
 import (
+	"OnlineStore/auth"
+	"OnlineStore/money"
+	"OnlineStore/pagination"
 	"OnlineStore/payment-service/models"
+	"OnlineStore/payment-service/services"
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"database/sql"
 	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // MockPaymentModel is a mock implementation of the PaymentModel interface
 type MockPaymentModel struct {
 	Payments []*models.Payment
+	Refunds  []*models.Refund
 }
 
-func (m *MockPaymentModel) GetPayments() ([]*models.Payment, error) {
-	return m.Payments, nil
+func (m *MockPaymentModel) ListPayments(filter models.PaymentFilter, page pagination.Params) ([]*models.Payment, int, error) {
+	var payments []*models.Payment
+	for _, payment := range m.Payments {
+		if (filter.UserID == 0 || payment.UserID == filter.UserID) &&
+			(filter.OrderID == 0 || payment.OrderID == filter.OrderID) &&
+			(filter.Status == "" || payment.PaymentStatus == filter.Status) {
+			payments = append(payments, payment)
+		}
+	}
+	total := len(payments)
+	payments = payments[min(page.Offset, total):min(page.Offset+page.Limit, total)]
+	return payments, total, nil
 }
 
-func (m *MockPaymentModel) CreatePayment(payment models.Payment) error {
+func (m *MockPaymentModel) CreatePayment(payment models.Payment) (int, error) {
+	payment.ID = len(m.Payments) + 1
 	m.Payments = append(m.Payments, &payment)
-	return nil
+	return payment.ID, nil
 }
 
 func (m *MockPaymentModel) GetPaymentByID(id int) (*models.Payment, error) {
@@ -86,19 +105,156 @@ func (m *MockPaymentModel) GetPaymentByStatus(status string) ([]*models.Payment,
 	return payments, nil
 }
 
+func (m *MockPaymentModel) GetPaymentByInvoiceID(invoiceID string) (*models.Payment, error) {
+	for _, payment := range m.Payments {
+		if payment.InvoiceID == invoiceID {
+			return payment, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *MockPaymentModel) UpdatePaymentStatus(id int, from, to, transactionID string) (bool, error) {
+	for _, payment := range m.Payments {
+		if payment.ID == id {
+			if payment.PaymentStatus != from {
+				return false, nil
+			}
+			payment.PaymentStatus = to
+			if transactionID != "" {
+				payment.TransactionID = transactionID
+			}
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *MockPaymentModel) CreateRefund(refund models.Refund) (*models.Refund, error) {
+	payment, err := m.GetPaymentByID(refund.PaymentID)
+	if err != nil {
+		return nil, err
+	}
+	if payment.PaymentStatus != models.PaymentStatusCaptured && payment.PaymentStatus != models.PaymentStatusPartiallyRefunded {
+		return nil, models.ErrPaymentNotRefundable
+	}
+	remaining := payment.Amount
+	for _, r := range m.Refunds {
+		if r.PaymentID == refund.PaymentID && r.Status != models.RefundStatusFailed {
+			remaining.Amount -= r.Amount.Amount
+		}
+	}
+	if refund.Amount.IsZero() {
+		refund.Amount = remaining
+	}
+	if refund.Amount.IsZero() || refund.Amount.Amount > remaining.Amount {
+		return nil, models.ErrRefundExceedsPayment
+	}
+	refund.ID = len(m.Refunds) + 1
+	refund.Status = models.RefundStatusPending
+	m.Refunds = append(m.Refunds, &refund)
+	return &refund, nil
+}
+
+func (m *MockPaymentModel) CompleteRefund(id int, status string) (*models.Payment, error) {
+	refund := m.Refunds[id-1]
+	refund.Status = status
+	payment, err := m.GetPaymentByID(refund.PaymentID)
+	if err != nil || status != models.RefundStatusCompleted {
+		return payment, err
+	}
+	var refunded int64
+	for _, r := range m.Refunds {
+		if r.PaymentID == payment.ID && r.Status == models.RefundStatusCompleted {
+			refunded += r.Amount.Amount
+		}
+	}
+	payment.PaymentStatus = models.PaymentStatusPartiallyRefunded
+	if refunded >= payment.Amount.Amount {
+		payment.PaymentStatus = models.PaymentStatusRefunded
+	}
+	return payment, nil
+}
+
+func (m *MockPaymentModel) GetRefundsByPaymentID(paymentID int) ([]*models.Refund, error) {
+	var refunds []*models.Refund
+	for _, refund := range m.Refunds {
+		if refund.PaymentID == paymentID {
+			refunds = append(refunds, refund)
+		}
+	}
+	return refunds, nil
+}
+
+func (m *MockPaymentModel) GetPendingRefunds(olderThan time.Duration) ([]*models.Refund, error) {
+	var refunds []*models.Refund
+	for _, refund := range m.Refunds {
+		if refund.Status == models.RefundStatusPending {
+			refunds = append(refunds, refund)
+		}
+	}
+	return refunds, nil
+}
+
+const testWebhookSecret = "test-secret"
+
+var testCard = services.Card{Number: "4405645000006150", ExpDate: "0930", CVC: "123"}
+
+const testCardJSON = `{"number": "4405645000006150", "exp_date": "0930", "cvc": "123"}`
+
+// MockOrderClient records the orders marked paid and refunded. Orders are
+// the orders that exist, and are marked paid when paid for; those not listed
+// are only recorded.
+type MockOrderClient struct {
+	Orders   []*services.Order
+	Paid     []int
+	Refunded []int
+}
+
+func (m *MockOrderClient) GetOrder(ctx context.Context, orderID, userID int) (*services.Order, error) {
+	for _, order := range m.Orders {
+		if order.ID == orderID {
+			return order, nil
+		}
+	}
+	return nil, services.ErrOrderNotFound
+}
+
+func (m *MockOrderClient) MarkOrderPaid(ctx context.Context, orderID, userID int, amount money.Money) error {
+	if order, err := m.GetOrder(ctx, orderID, userID); err == nil {
+		if err := order.CheckAmount(amount); err != nil {
+			return err
+		}
+		order.Status = "paid"
+	}
+	m.Paid = append(m.Paid, orderID)
+	return nil
+}
+
+// testOrder is order 1 of user 1, awaiting a payment of 150.00 KZT.
+func testOrder() *MockOrderClient {
+	return &MockOrderClient{Orders: []*services.Order{{ID: 1, UserID: 1, TotalPrice: money.New(15000, "KZT"), Status: "pending"}}}
+}
+
+func (m *MockOrderClient) MarkOrderRefunded(ctx context.Context, orderID, userID int) error {
+	m.Refunded = append(m.Refunded, orderID)
+	return nil
+}
+
 func TestGetPaymentsController(t *testing.T) {
 	mockModel := &MockPaymentModel{
 		Payments: []*models.Payment{
-			{ID: 1, UserID: 1, OrderID: 1, Amount: 100.0, PaymentDate: "2023-01-01", PaymentStatus: "Completed"},
-			{ID: 2, UserID: 2, OrderID: 2, Amount: 200.0, PaymentDate: "2023-01-02", PaymentStatus: "Pending"},
+			{ID: 1, UserID: 1, OrderID: 1, Amount: money.New(10000, "KZT"), PaymentDate: "2023-01-01", PaymentStatus: "Completed"},
+			{ID: 2, UserID: 2, OrderID: 2, Amount: money.New(20000, "KZT"), PaymentDate: "2023-01-02", PaymentStatus: "Pending"},
 		},
 	}
-	controller := NewPaymentController(mockModel)
+	controller := NewPaymentController(mockModel, services.NewFakeGateway(), &MockOrderClient{}, testWebhookSecret)
 
 	req, err := http.NewRequest("GET", "/payments", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
 
 	rr := httptest.NewRecorder()
 	handler := http.HandlerFunc(controller.GetPaymentsController)
@@ -106,26 +262,47 @@ func TestGetPaymentsController(t *testing.T) {
 
 	assert.Equal(t, http.StatusOK, rr.Code)
 
-	var payments []*models.Payment
-	err = json.Unmarshal(rr.Body.Bytes(), &payments)
+	var page pagination.Page[*models.Payment]
+	err = json.Unmarshal(rr.Body.Bytes(), &page)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	assert.Equal(t, 2, len(payments))
+	assert.Equal(t, 2, len(page.Items))
+	assert.Equal(t, 2, page.Total)
+
+	// Test paging and filtering
+	req = httptest.NewRequest("GET", "/payments?limit=1&offset=1", nil)
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &page))
+	assert.Equal(t, 1, len(page.Items))
+	assert.Equal(t, 2, page.Items[0].ID)
+	assert.Nil(t, page.Next)
+
+	req = httptest.NewRequest("GET", "/payments?order_id=1", nil)
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &page))
+	assert.Equal(t, 1, page.Total)
+	assert.Equal(t, 1, page.Items[0].ID)
 }
 
 func TestCreatePaymentController(t *testing.T) {
 	mockModel := &MockPaymentModel{}
-	controller := NewPaymentController(mockModel)
+	orders := testOrder()
+	controller := NewPaymentController(mockModel, services.NewFakeGateway(), orders, testWebhookSecret)
 
-	newPayment := models.Payment{UserID: 1, OrderID: 1, Amount: 150.0, PaymentDate: "2023-02-01", PaymentStatus: "Pending"}
-	paymentJson, _ := json.Marshal(newPayment)
+	newPayment := models.Payment{UserID: 1, OrderID: 1, Amount: money.New(15000, "KZT"), PaymentDate: "2023-02-01", PaymentStatus: "Pending"}
+	paymentJson, _ := json.Marshal(createPaymentRequest{Payment: newPayment, Card: testCard})
 
 	req, err := http.NewRequest("POST", "/payments", strings.NewReader(string(paymentJson)))
 	if err != nil {
 		t.Fatal(err)
 	}
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
 	req.Header.Set("Content-Type", "application/json")
 
 	rr := httptest.NewRecorder()
@@ -135,20 +312,117 @@ func TestCreatePaymentController(t *testing.T) {
 	assert.Equal(t, http.StatusCreated, rr.Code)
 	assert.Equal(t, 1, len(mockModel.Payments))
 	assert.Equal(t, newPayment.UserID, mockModel.Payments[0].UserID)
+	assert.Equal(t, models.PaymentStatusCaptured, mockModel.Payments[0].PaymentStatus)
+	assert.NotEmpty(t, mockModel.Payments[0].InvoiceID)
+	assert.NotEmpty(t, mockModel.Payments[0].TransactionID)
+	assert.Equal(t, []int{1}, orders.Paid)
+}
+
+func TestCreatePaymentControllerGatewayOutcomes(t *testing.T) {
+	mockModel := &MockPaymentModel{}
+	gateway := services.NewFakeGateway()
+	gateway.Script(services.OutcomeDecline, services.OutcomeTimeout)
+	controller := NewPaymentController(mockModel, gateway, testOrder(), testWebhookSecret)
+	handler := http.HandlerFunc(controller.CreatePaymentController)
+
+	body := `{"user_id": 1, "order_id": 1, "amount": {"amount": "150.00", "currency": "KZT"}, "card": ` + testCardJSON + `}`
+
+	// Test declined card
+	req, err := http.NewRequest("POST", "/payments", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.Equal(t, models.PaymentStatusDeclined, mockModel.Payments[0].PaymentStatus)
+
+	// Test gateway timeout
+	req, err = http.NewRequest("POST", "/payments", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	assert.Equal(t, models.PaymentStatusPending, mockModel.Payments[1].PaymentStatus)
+
+	// Test invalid amount
+	req, err = http.NewRequest("POST", "/payments", strings.NewReader(`{"user_id": 1, "order_id": 1, "amount": 0}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, 2, len(mockModel.Payments))
+}
+
+func TestCreatePaymentControllerRequiresCard(t *testing.T) {
+	mockModel := &MockPaymentModel{}
+	controller := NewPaymentController(mockModel, services.NewFakeGateway(), &MockOrderClient{}, testWebhookSecret)
+
+	req := httptest.NewRequest("POST", "/payments", strings.NewReader(
+		`{"user_id": 1, "order_id": 1, "amount": {"amount": "150.00", "currency": "KZT"}, "card": {"number": "4405645000006150"}}`))
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
+	rr := httptest.NewRecorder()
+	controller.CreatePaymentController(rr, req)
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "card number, expiry date and CVC are required")
+	assert.Empty(t, mockModel.Payments)
+}
+
+// recordingGateway notes whether the payment was stored before each call.
+type recordingGateway struct {
+	*services.FakeGateway
+	model  *MockPaymentModel
+	stored []bool
+}
+
+func (g *recordingGateway) Authorize(ctx context.Context, charge services.Charge) (*services.GatewayResult, error) {
+	_, err := g.model.GetPaymentByInvoiceID(charge.InvoiceID)
+	g.stored = append(g.stored, err == nil)
+	return g.FakeGateway.Authorize(ctx, charge)
+}
+
+func TestCreatePaymentControllerStoresBeforeCharging(t *testing.T) {
+	mockModel := &MockPaymentModel{}
+	gateway := &recordingGateway{FakeGateway: services.NewFakeGateway(), model: mockModel}
+	controller := NewPaymentController(mockModel, gateway, testOrder(), testWebhookSecret)
+
+	req := httptest.NewRequest("POST", "/payments", strings.NewReader(
+		`{"user_id": 1, "order_id": 1, "amount": {"amount": "150.00", "currency": "KZT"}, "card": `+testCardJSON+`}`))
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
+	rr := httptest.NewRecorder()
+	controller.CreatePaymentController(rr, req)
+
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.Equal(t, []bool{true}, gateway.stored, "the payment is stored before the card is charged")
+	require.Len(t, mockModel.Payments, 1)
+	assert.Equal(t, models.PaymentStatusCaptured, mockModel.Payments[0].PaymentStatus)
+	assert.NotEmpty(t, mockModel.Payments[0].TransactionID)
 }
 
 func TestGetPaymentByIDController(t *testing.T) {
 	mockModel := &MockPaymentModel{
 		Payments: []*models.Payment{
-			{ID: 1, UserID: 1, OrderID: 1, Amount: 100.0, PaymentDate: "2023-01-01", PaymentStatus: "Completed"},
+			{ID: 1, UserID: 1, OrderID: 1, Amount: money.New(10000, "KZT"), PaymentDate: "2023-01-01", PaymentStatus: "Completed"},
 		},
 	}
-	controller := NewPaymentController(mockModel)
+	controller := NewPaymentController(mockModel, services.NewFakeGateway(), &MockOrderClient{}, testWebhookSecret)
 
 	req, err := http.NewRequest("GET", "/payments/1", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
 
 	rr := httptest.NewRecorder()
 	router := mux.NewRouter()
@@ -169,18 +443,19 @@ func TestGetPaymentByIDController(t *testing.T) {
 func TestUpdatePaymentController(t *testing.T) {
 	mockModel := &MockPaymentModel{
 		Payments: []*models.Payment{
-			{ID: 1, UserID: 1, OrderID: 1, Amount: 100.0, PaymentDate: "2023-01-01", PaymentStatus: "Completed"},
+			{ID: 1, UserID: 1, OrderID: 1, Amount: money.New(10000, "KZT"), PaymentDate: "2023-01-01", PaymentStatus: "Completed"},
 		},
 	}
-	controller := NewPaymentController(mockModel)
+	controller := NewPaymentController(mockModel, services.NewFakeGateway(), &MockOrderClient{}, testWebhookSecret)
 
-	updatedPayment := models.Payment{ID: 1, UserID: 1, OrderID: 1, Amount: 150.0, PaymentDate: "2023-02-01", PaymentStatus: "Pending"}
+	updatedPayment := models.Payment{ID: 1, UserID: 1, OrderID: 1, Amount: money.New(15000, "KZT"), PaymentDate: "2023-02-01", PaymentStatus: "Pending"}
 	paymentJson, _ := json.Marshal(updatedPayment)
 
 	req, err := http.NewRequest("PUT", "/payments/1", strings.NewReader(string(paymentJson)))
 	if err != nil {
 		t.Fatal(err)
 	}
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
 	req.Header.Set("Content-Type", "application/json")
 
 	rr := httptest.NewRecorder()
@@ -195,15 +470,16 @@ func TestUpdatePaymentController(t *testing.T) {
 func TestDeletePaymentController(t *testing.T) {
 	mockModel := &MockPaymentModel{
 		Payments: []*models.Payment{
-			{ID: 1, UserID: 1, OrderID: 1, Amount: 100.0, PaymentDate: "2023-01-01", PaymentStatus: "Completed"},
+			{ID: 1, UserID: 1, OrderID: 1, Amount: money.New(10000, "KZT"), PaymentDate: "2023-01-01", PaymentStatus: "Completed"},
 		},
 	}
-	controller := NewPaymentController(mockModel)
+	controller := NewPaymentController(mockModel, services.NewFakeGateway(), &MockOrderClient{}, testWebhookSecret)
 
 	req, err := http.NewRequest("DELETE", "/payments/1", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
 
 	rr := httptest.NewRecorder()
 	router := mux.NewRouter()
@@ -217,17 +493,18 @@ func TestDeletePaymentController(t *testing.T) {
 func TestSearchPaymentController(t *testing.T) {
 	mockModel := &MockPaymentModel{
 		Payments: []*models.Payment{
-			{ID: 1, UserID: 1, OrderID: 1, Amount: 100.0, PaymentDate: "2023-01-01", PaymentStatus: "Completed"},
-			{ID: 2, UserID: 2, OrderID: 2, Amount: 200.0, PaymentDate: "2023-01-02", PaymentStatus: "Pending"},
+			{ID: 1, UserID: 1, OrderID: 1, Amount: money.New(10000, "KZT"), PaymentDate: "2023-01-01", PaymentStatus: "Completed"},
+			{ID: 2, UserID: 2, OrderID: 2, Amount: money.New(20000, "KZT"), PaymentDate: "2023-01-02", PaymentStatus: "Pending"},
 		},
 	}
-	controller := NewPaymentController(mockModel)
+	controller := NewPaymentController(mockModel, services.NewFakeGateway(), &MockOrderClient{}, testWebhookSecret)
 
 	// Test search by order ID
 	req, err := http.NewRequest("GET", "/payments/search?order_id=1", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
 
 	rr := httptest.NewRecorder()
 	router := mux.NewRouter()
@@ -250,6 +527,7 @@ func TestSearchPaymentController(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
 
 	rr = httptest.NewRecorder()
 	router.ServeHTTP(rr, req)
@@ -269,6 +547,7 @@ func TestSearchPaymentController(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
 
 	rr = httptest.NewRecorder()
 	router.ServeHTTP(rr, req)
@@ -283,3 +562,206 @@ func TestSearchPaymentController(t *testing.T) {
 	assert.Equal(t, 1, len(payments))
 	assert.Equal(t, "Pending", payments[0].PaymentStatus)
 }
+
+func TestPaymentOwnership(t *testing.T) {
+	mockModel := &MockPaymentModel{
+		Payments: []*models.Payment{
+			{ID: 1, UserID: 1, OrderID: 3, Amount: money.New(10000, "KZT"), PaymentStatus: models.PaymentStatusCaptured},
+			{ID: 2, UserID: 2, OrderID: 2, Amount: money.New(20000, "KZT"), PaymentStatus: models.PaymentStatusCaptured},
+		},
+	}
+	orders := testOrder()
+	orders.Orders = append(orders.Orders, &services.Order{ID: 2, UserID: 2, TotalPrice: money.New(1000, "KZT"), Status: "pending"})
+	controller := NewPaymentController(mockModel, services.NewFakeGateway(), orders, testWebhookSecret)
+	router := mux.NewRouter()
+	router.HandleFunc("/payments", controller.GetPaymentsController).Methods("GET")
+	router.HandleFunc("/payments", controller.CreatePaymentController).Methods("POST")
+	router.HandleFunc("/payments/search", controller.SearchPaymentController).Methods("GET")
+	router.HandleFunc("/payments/{id}", controller.GetPaymentByIDController).Methods("GET")
+	router.HandleFunc("/payments/{id}", controller.DeletePaymentController).Methods("DELETE")
+	router.HandleFunc("/payments/{id}/refunds", controller.GetRefundsController).Methods("GET")
+	router.HandleFunc("/payments/{id}/refunds", controller.CreateRefundController).Methods("POST")
+	asUser := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set(auth.UserIDHeader, "1")
+		req.Header.Set(auth.UserRoleHeader, auth.RoleCustomer)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Test another user's payment looks like a missing one
+	assert.Equal(t, http.StatusOK, asUser("GET", "/payments/1", "").Code)
+	assert.Equal(t, http.StatusNotFound, asUser("GET", "/payments/2", "").Code)
+	assert.Equal(t, http.StatusNotFound, asUser("GET", "/payments/2/refunds", "").Code)
+	assert.Equal(t, http.StatusNotFound, asUser("POST", "/payments/2/refunds", "").Code)
+	assert.Equal(t, http.StatusNotFound, asUser("DELETE", "/payments/2", "").Code)
+	assert.Equal(t, http.StatusNotFound, asUser("GET", "/payments/search?user_id=2", "").Code)
+	assert.Equal(t, http.StatusNotFound, asUser("GET", "/payments/search?order_id=2", "").Code)
+	assert.Equal(t, 2, len(mockModel.Payments))
+	assert.Equal(t, models.PaymentStatusCaptured, mockModel.Payments[1].PaymentStatus)
+
+	// Test listing and searching only find the caller's payments
+	var page pagination.Page[*models.Payment]
+	require.NoError(t, json.Unmarshal(asUser("GET", "/payments", "").Body.Bytes(), &page))
+	assert.Equal(t, 1, len(page.Items))
+	assert.Equal(t, 1, page.Items[0].UserID)
+	assert.Equal(t, http.StatusNotFound, asUser("GET", "/payments?user_id=2", "").Code)
+	var payments []*models.Payment
+	require.NoError(t, json.Unmarshal(asUser("GET", "/payments/search?status="+models.PaymentStatusCaptured, "").Body.Bytes(), &payments))
+	assert.Equal(t, 1, len(payments))
+	assert.Equal(t, 1, payments[0].UserID)
+
+	// Test customers cannot pay as someone else
+	rr := asUser("POST", "/payments", `{"user_id": 2, "order_id": 1, "amount": {"amount": "150.00", "currency": "KZT"}, "card": `+testCardJSON+`}`)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.Equal(t, 1, mockModel.Payments[2].UserID)
+
+	// Test customers cannot pay for someone else's order
+	rr = asUser("POST", "/payments", `{"order_id": 2, "amount": {"amount": "10.00", "currency": "KZT"}, "card": `+testCardJSON+`}`)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Equal(t, 3, len(mockModel.Payments))
+}
+
+func TestCreatePaymentControllerChecksOrderTotal(t *testing.T) {
+	mockModel := &MockPaymentModel{}
+	orders := testOrder()
+	controller := NewPaymentController(mockModel, services.NewFakeGateway(), orders, testWebhookSecret)
+	pay := func(amount string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/payments", strings.NewReader(
+			`{"user_id": 1, "order_id": 1, "amount": {"amount": "`+amount+`", "currency": "KZT"}, "card": `+testCardJSON+`}`))
+		req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
+		rr := httptest.NewRecorder()
+		controller.CreatePaymentController(rr, req)
+		return rr
+	}
+
+	rr := pay("0.01")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "amount must equal the order's total")
+	rr = pay("200.00")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Empty(t, mockModel.Payments, "no payment is stored or charged")
+	assert.Empty(t, orders.Paid)
+
+	assert.Equal(t, http.StatusCreated, pay("150.00").Code)
+	assert.Equal(t, []int{1}, orders.Paid)
+}
+
+func TestCreatePaymentControllerRequiresPendingOrder(t *testing.T) {
+	mockModel := &MockPaymentModel{}
+	gateway := services.NewFakeGateway()
+	orders := testOrder()
+	orders.Orders = append(orders.Orders,
+		&services.Order{ID: 2, UserID: 1, TotalPrice: money.New(15000, "KZT"), Status: "paid"},
+		&services.Order{ID: 3, UserID: 1, TotalPrice: money.New(15000, "KZT"), Status: "cancelled"})
+	controller := NewPaymentController(mockModel, gateway, orders, testWebhookSecret)
+	pay := func(orderID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/payments", strings.NewReader(
+			`{"order_id": `+orderID+`, "amount": {"amount": "150.00", "currency": "KZT"}, "card": `+testCardJSON+`}`))
+		req.Header.Set(auth.UserIDHeader, "1")
+		req.Header.Set(auth.UserRoleHeader, auth.RoleCustomer)
+		rr := httptest.NewRecorder()
+		controller.CreatePaymentController(rr, req)
+		return rr
+	}
+
+	for _, orderID := range []string{"2", "3"} {
+		rr := pay(orderID)
+		assert.Equal(t, http.StatusConflict, rr.Code, orderID)
+		assert.Contains(t, rr.Body.String(), "only a pending order can be paid for")
+	}
+	assert.Empty(t, mockModel.Payments, "nothing is stored or charged")
+
+	// A payment whose outcome is not known yet keeps the order from being
+	// charged again, as does one that went through.
+	gateway.Script(services.OutcomeTimeout)
+	assert.Equal(t, http.StatusAccepted, pay("1").Code)
+	assert.Equal(t, http.StatusConflict, pay("1").Code)
+	mockModel.Payments[0].PaymentStatus = models.PaymentStatusCaptured
+	assert.Equal(t, http.StatusConflict, pay("1").Code)
+	assert.Len(t, mockModel.Payments, 1)
+
+	// A declined payment does not.
+	mockModel.Payments[0].PaymentStatus = models.PaymentStatusDeclined
+	assert.Equal(t, http.StatusCreated, pay("1").Code)
+	assert.Equal(t, []int{1}, orders.Paid)
+}
+
+func TestMarkOrderPaidChecksOrderTotal(t *testing.T) {
+	gateway := services.NewFakeGateway()
+	payment := capturedPayment(t, gateway)
+	mockModel := &MockPaymentModel{Payments: []*models.Payment{payment}}
+	orders := testOrder()
+	controller := NewPaymentController(mockModel, gateway, orders, testWebhookSecret)
+
+	// The order was changed while it was being paid for: it is left unpaid
+	// and the payment given back.
+	orders.Orders[0].TotalPrice = money.New(20000, "KZT")
+	controller.markOrderPaid(context.Background(), payment)
+	assert.Empty(t, orders.Paid)
+	assert.Equal(t, models.PaymentStatusRefunded, payment.PaymentStatus)
+	require.Len(t, mockModel.Refunds, 1)
+	assert.Equal(t, money.New(15000, "KZT"), mockModel.Refunds[0].Amount)
+	assert.Equal(t, models.RefundStatusCompleted, mockModel.Refunds[0].Status)
+
+	controller.markOrderPaid(context.Background(), &models.Payment{OrderID: 1, UserID: 1, Amount: money.New(20000, "KZT")})
+	assert.Equal(t, []int{1}, orders.Paid)
+}
+
+func TestVoidPaymentController(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		captured bool
+		status   string
+		paid     []int
+	}{
+		{"hold released", false, models.PaymentStatusVoided, nil},
+		{"capture went through", true, models.PaymentStatusCaptured, []int{1}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			gateway := services.NewFakeGateway()
+			amount := money.New(15000, "KZT")
+			result, err := gateway.Authorize(context.Background(), services.Charge{InvoiceID: fixtureInvoiceID, Amount: amount})
+			require.NoError(t, err)
+			if tt.captured {
+				// The capture timed out after the gateway had taken it.
+				_, err = gateway.Capture(context.Background(), result.TransactionID, amount)
+				require.NoError(t, err)
+			}
+			mockModel := &MockPaymentModel{Payments: []*models.Payment{{ID: 1, UserID: 1, OrderID: 1, Amount: amount,
+				PaymentStatus: models.PaymentStatusAuthorized, InvoiceID: fixtureInvoiceID, TransactionID: result.TransactionID}}}
+			orders := &MockOrderClient{}
+			controller := NewPaymentController(mockModel, gateway, orders, testWebhookSecret)
+			router := mux.NewRouter()
+			router.HandleFunc("/payments/{id}/void", controller.VoidPaymentController).Methods("POST")
+
+			void := func() *httptest.ResponseRecorder {
+				req := httptest.NewRequest("POST", "/payments/1/void", nil)
+				req.Header.Set(auth.UserIDHeader, "1")
+				req.Header.Set(auth.UserRoleHeader, auth.RoleCustomer)
+				rr := httptest.NewRecorder()
+				router.ServeHTTP(rr, req)
+				return rr
+			}
+			rr := void()
+			require.Equal(t, http.StatusOK, rr.Code)
+			var payment models.Payment
+			require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &payment))
+			assert.Equal(t, tt.status, payment.PaymentStatus)
+			assert.Equal(t, tt.status, mockModel.Payments[0].PaymentStatus)
+			assert.Equal(t, tt.paid, orders.Paid)
+
+			status, err := gateway.Status(context.Background(), fixtureInvoiceID)
+			require.NoError(t, err)
+			assert.Equal(t, tt.status, status.Status)
+
+			// Voiding again returns a voided payment and refuses a captured one.
+			if tt.captured {
+				assert.Equal(t, http.StatusConflict, void().Code)
+			} else {
+				assert.Equal(t, http.StatusOK, void().Code)
+			}
+		})
+	}
+}
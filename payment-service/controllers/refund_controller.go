@@ -0,0 +1,255 @@
+package controllers
+
+import (
+	"OnlineStore/apierror"
+	"OnlineStore/money"
+	"OnlineStore/payment-service/models"
+	"OnlineStore/payment-service/services"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// createRefundRequest is the body of POST /payments/{id}/refunds. Leaving out
+// the amount refunds whatever has not been refunded yet.
+type createRefundRequest struct {
+	Amount money.Money `json:"amount"`
+	Reason string      `json:"reason"`
+}
+
+// CreateRefundController reserves the refund, asks the gateway to return the
+// money and records the outcome. A fully refunded payment also refunds its
+// order. A refund the gateway rejects is recorded as failed, freeing its
+// amount, and answered with 502 Bad Gateway.
+func (pc *PaymentController) CreateRefundController(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	paymentID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		apierror.Write(writer, request, apierror.New(apierror.Validation, "id must be a number"))
+		return
+	}
+	var input createRefundRequest
+	if err := json.NewDecoder(request.Body).Decode(&input); err != nil && err != io.EOF {
+		apierror.Write(writer, request, apierror.Wrap(apierror.Validation, "invalid JSON body", err))
+		return
+	}
+	if _, ok := pc.ownedPayment(writer, request, paymentID); !ok {
+		return
+	}
+
+	refund, payment, err := pc.refundPayment(request.Context(), paymentID, input.Amount, input.Reason)
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	pc.markOrderRefunded(request.Context(), payment)
+
+	jsonRefund, err := json.Marshal(refund)
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	if refund.Status == models.RefundStatusPending {
+		writer.WriteHeader(http.StatusAccepted)
+	} else {
+		writer.WriteHeader(http.StatusCreated)
+	}
+	_, err = writer.Write(jsonRefund)
+	return
+}
+
+// refundPayment reserves a refund of amount, or of whatever has not been
+// refunded yet if amount is zero, asks the gateway to return the money and
+// records the outcome. It returns the refund and the payment as they are now.
+// A refund the gateway rejects is recorded as failed, freeing its amount, and
+// returned as a BadGateway error.
+func (pc *PaymentController) refundPayment(ctx context.Context, paymentID int, amount money.Money, reason string) (*models.Refund, *models.Payment, error) {
+	refund, err := pc.PaymentModel.CreateRefund(models.Refund{PaymentID: paymentID, Amount: amount, Reason: reason})
+	if err != nil {
+		return nil, nil, err
+	}
+	payment, err := pc.PaymentModel.GetPaymentByID(paymentID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var rejected error
+	_, err = pc.Gateway.Refund(ctx, payment.TransactionID, refund.Amount)
+	switch {
+	case errors.Is(err, services.ErrGatewayTimeout):
+		// The outcome is unknown, so the refund stays pending and keeps
+		// its amount reserved until ReconcileRefunds settles it.
+		log.Printf("Refund %d of payment %s timed out: %v", refund.ID, payment.InvoiceID, err)
+	case err != nil:
+		log.Printf("Refund %d of payment %s failed: %v", refund.ID, payment.InvoiceID, err)
+		refund.Status = models.RefundStatusFailed
+		rejected = apierror.Wrap(apierror.BadGateway, "the gateway rejected the refund", err)
+	default:
+		refund.Status = models.RefundStatusCompleted
+	}
+
+	if refund.Status != models.RefundStatusPending {
+		payment, err = pc.PaymentModel.CompleteRefund(refund.ID, refund.Status)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return refund, payment, rejected
+}
+
+// markOrderRefunded refunds the payment's order once the payment is fully
+// refunded. A failure is only logged: the refund stands either way.
+func (pc *PaymentController) markOrderRefunded(ctx context.Context, payment *models.Payment) {
+	if payment.PaymentStatus != models.PaymentStatusRefunded {
+		return
+	}
+	if err := pc.Orders.MarkOrderRefunded(ctx, payment.OrderID, payment.UserID); err != nil {
+		log.Printf("Payment %s: failed to mark order %d refunded: %v", payment.InvoiceID, payment.OrderID, err)
+	}
+}
+
+// RefundReconcileAge is how long a refund stays pending before
+// ReconcileRefunds asks the gateway about it, well beyond any request still
+// waiting for the gateway to answer.
+const RefundReconcileAge = 10 * time.Minute
+
+// ReconcileRefunds settles the refunds left pending for at least olderThan,
+// which is what a gateway timeout leaves behind, from the gateway's record
+// of the transaction. Refunds the gateway cannot answer for yet stay pending
+// until the next pass.
+func (pc *PaymentController) ReconcileRefunds(ctx context.Context, olderThan time.Duration) error {
+	refunds, err := pc.PaymentModel.GetPendingRefunds(olderThan)
+	if err != nil {
+		return err
+	}
+	for _, refund := range refunds {
+		if err := pc.reconcileRefund(ctx, refund); err != nil {
+			log.Printf("Refund %d: failed to reconcile: %v", refund.ID, err)
+		}
+	}
+	return nil
+}
+
+// ReconcileRefundsEvery reconciles pending refunds now and then every
+// interval, until ctx is done.
+func (pc *PaymentController) ReconcileRefundsEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := pc.ReconcileRefunds(ctx, RefundReconcileAge); err != nil {
+			log.Printf("Failed to list pending refunds: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (pc *PaymentController) reconcileRefund(ctx context.Context, refund *models.Refund) error {
+	payment, err := pc.PaymentModel.GetPaymentByID(refund.PaymentID)
+	if err != nil {
+		return err
+	}
+	result, err := pc.Gateway.Status(ctx, payment.InvoiceID)
+	if err != nil {
+		return err
+	}
+	refunds, err := pc.PaymentModel.GetRefundsByPaymentID(payment.ID)
+	if err != nil {
+		return err
+	}
+	var completed []money.Money
+	for _, r := range refunds {
+		if r.Status == models.RefundStatusCompleted {
+			completed = append(completed, r.Amount)
+		}
+	}
+	settled, err := money.Sum(payment.Amount.Currency, completed...)
+	if err != nil {
+		return err
+	}
+
+	status, err := refundOutcome(result, settled, refund.Amount)
+	if err != nil {
+		return err
+	}
+	log.Printf("Refund %d of payment %s reconciled as %s", refund.ID, payment.InvoiceID, status)
+	payment, err = pc.PaymentModel.CompleteRefund(refund.ID, status)
+	if err != nil {
+		return err
+	}
+	pc.markOrderRefunded(ctx, payment)
+	return nil
+}
+
+// refundOutcome decides a pending refund of amount from the gateway's record
+// of its transaction, given the refunds of it already completed. A refund is
+// completed only when the gateway has refunded enough to cover it too.
+func refundOutcome(result *services.GatewayResult, completed, amount money.Money) (string, error) {
+	switch result.Status {
+	case services.GatewayStatusCaptured:
+		return models.RefundStatusFailed, nil
+	case services.GatewayStatusRefunded:
+	default:
+		return "", fmt.Errorf("transaction is %s", result.Status)
+	}
+	if result.Refunded.IsZero() {
+		// The gateway does not say how much it refunded. That settles a
+		// first refund, but not one following others.
+		if completed.IsZero() {
+			return models.RefundStatusCompleted, nil
+		}
+		return "", errors.New("gateway does not report the amount refunded")
+	}
+	expected, err := completed.Add(amount)
+	if err != nil {
+		return "", err
+	}
+	cmp, err := expected.Cmp(result.Refunded)
+	if err != nil {
+		return "", err
+	}
+	if cmp > 0 {
+		return models.RefundStatusFailed, nil
+	}
+	return models.RefundStatusCompleted, nil
+}
+
+func (pc *PaymentController) GetRefundsController(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	paymentID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		apierror.Write(writer, request, apierror.New(apierror.Validation, "id must be a number"))
+		return
+	}
+	if _, ok := pc.ownedPayment(writer, request, paymentID); !ok {
+		return
+	}
+	refunds, err := pc.PaymentModel.GetRefundsByPaymentID(paymentID)
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	if refunds == nil {
+		refunds = []*models.Refund{}
+	}
+	jsonRefunds, err := json.Marshal(refunds)
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	_, err = writer.Write(jsonRefunds)
+	return
+}
@@ -0,0 +1,209 @@
+package controllers
+
+import (
+	"OnlineStore/apierror"
+	"OnlineStore/auth"
+	"OnlineStore/money"
+	"OnlineStore/payment-service/models"
+	"OnlineStore/payment-service/services"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// capturedPayment charges 150.00 KZT through the fake gateway.
+func capturedPayment(t *testing.T, gateway *services.FakeGateway) *models.Payment {
+	amount := money.New(15000, "KZT")
+	result, err := gateway.Authorize(context.Background(), services.Charge{InvoiceID: fixtureInvoiceID, Amount: amount})
+	require.NoError(t, err)
+	_, err = gateway.Capture(context.Background(), result.TransactionID, amount)
+	require.NoError(t, err)
+	return &models.Payment{ID: 1, UserID: 1, OrderID: 1, Amount: amount, PaymentStatus: models.PaymentStatusCaptured,
+		InvoiceID: fixtureInvoiceID, TransactionID: result.TransactionID}
+}
+
+func TestCreateRefundController(t *testing.T) {
+	gateway := services.NewFakeGateway()
+	mockModel := &MockPaymentModel{Payments: []*models.Payment{capturedPayment(t, gateway)}}
+	orders := &MockOrderClient{}
+	controller := NewPaymentController(mockModel, gateway, orders, testWebhookSecret)
+	router := mux.NewRouter()
+	router.HandleFunc("/payments/{id}/refunds", controller.CreateRefundController).Methods("POST")
+	router.HandleFunc("/payments/{id}/refunds", controller.GetRefundsController).Methods("GET")
+
+	refund := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/payments/1/refunds", strings.NewReader(body))
+		req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Test partial refund
+	rr := refund(`{"amount": {"amount": "50.00", "currency": "KZT"}, "reason": "damaged item"}`)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	var created models.Refund
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &created))
+	assert.Equal(t, models.RefundStatusCompleted, created.Status)
+	assert.Equal(t, money.New(5000, "KZT"), created.Amount)
+	assert.Equal(t, models.PaymentStatusPartiallyRefunded, mockModel.Payments[0].PaymentStatus)
+	assert.Empty(t, orders.Refunded)
+
+	// Test refund exceeding what is left
+	rr = refund(`{"amount": {"amount": "100.01", "currency": "KZT"}}`)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	// Test refund of the rest
+	rr = refund("")
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &created))
+	assert.Equal(t, money.New(10000, "KZT"), created.Amount)
+	assert.Equal(t, models.PaymentStatusRefunded, mockModel.Payments[0].PaymentStatus)
+	assert.Equal(t, []int{1}, orders.Refunded)
+
+	// Test refunding a fully refunded payment
+	rr = refund("")
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	req := httptest.NewRequest("GET", "/payments/1/refunds", nil)
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var refunds []*models.Refund
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &refunds))
+	assert.Equal(t, 2, len(refunds))
+}
+
+func TestCreateRefundControllerNotCaptured(t *testing.T) {
+	mockModel := &MockPaymentModel{Payments: []*models.Payment{pendingPayment()}}
+	controller := NewPaymentController(mockModel, services.NewFakeGateway(), &MockOrderClient{}, testWebhookSecret)
+	router := mux.NewRouter()
+	router.HandleFunc("/payments/{id}/refunds", controller.CreateRefundController).Methods("POST")
+
+	req := httptest.NewRequest("POST", "/payments/1/refunds", nil)
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	req = httptest.NewRequest("POST", "/payments/2/refunds", nil)
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+// rejectingRefundGateway declines every refund.
+type rejectingRefundGateway struct {
+	*services.FakeGateway
+}
+
+func (g *rejectingRefundGateway) Refund(ctx context.Context, transactionID string, amount money.Money) (*services.GatewayResult, error) {
+	return nil, fmt.Errorf("%w: card account closed", services.ErrDeclined)
+}
+
+func TestCreateRefundControllerRejected(t *testing.T) {
+	gateway := &rejectingRefundGateway{FakeGateway: services.NewFakeGateway()}
+	mockModel := &MockPaymentModel{Payments: []*models.Payment{capturedPayment(t, gateway.FakeGateway)}}
+	orders := &MockOrderClient{}
+	controller := NewPaymentController(mockModel, gateway, orders, testWebhookSecret)
+	router := mux.NewRouter()
+	router.HandleFunc("/payments/{id}/refunds", controller.CreateRefundController).Methods("POST")
+
+	req := httptest.NewRequest("POST", "/payments/1/refunds", nil)
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusBadGateway, rr.Code)
+	assert.Equal(t, apierror.ContentType, rr.Header().Get("Content-Type"))
+	assert.Contains(t, rr.Body.String(), "card account closed")
+	assert.Equal(t, models.RefundStatusFailed, mockModel.Refunds[0].Status)
+	assert.Equal(t, models.PaymentStatusCaptured, mockModel.Payments[0].PaymentStatus)
+	assert.Empty(t, orders.Refunded)
+}
+
+// lostRefundGateway times out on refunds, after carrying them out if
+// refunds is set.
+type lostRefundGateway struct {
+	*services.FakeGateway
+	refunds bool
+}
+
+func (g *lostRefundGateway) Refund(ctx context.Context, transactionID string, amount money.Money) (*services.GatewayResult, error) {
+	if g.refunds {
+		if _, err := g.FakeGateway.Refund(ctx, transactionID, amount); err != nil {
+			return nil, err
+		}
+	}
+	return nil, services.ErrGatewayTimeout
+}
+
+func TestReconcileRefunds(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		refunds bool
+		status  string
+		payment string
+		orders  []int
+	}{
+		{"gateway refunded", true, models.RefundStatusCompleted, models.PaymentStatusRefunded, []int{1}},
+		{"gateway did not refund", false, models.RefundStatusFailed, models.PaymentStatusCaptured, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			gateway := &lostRefundGateway{FakeGateway: services.NewFakeGateway(), refunds: tt.refunds}
+			mockModel := &MockPaymentModel{Payments: []*models.Payment{capturedPayment(t, gateway.FakeGateway)}}
+			orders := &MockOrderClient{}
+			controller := NewPaymentController(mockModel, gateway, orders, testWebhookSecret)
+			router := mux.NewRouter()
+			router.HandleFunc("/payments/{id}/refunds", controller.CreateRefundController).Methods("POST")
+
+			req := httptest.NewRequest("POST", "/payments/1/refunds", nil)
+			req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			require.Equal(t, http.StatusAccepted, rr.Code)
+			require.Equal(t, models.RefundStatusPending, mockModel.Refunds[0].Status)
+
+			require.NoError(t, controller.ReconcileRefunds(context.Background(), RefundReconcileAge))
+			assert.Equal(t, tt.status, mockModel.Refunds[0].Status)
+			assert.Equal(t, tt.payment, mockModel.Payments[0].PaymentStatus)
+			assert.Equal(t, tt.orders, orders.Refunded)
+
+			require.NoError(t, controller.ReconcileRefunds(context.Background(), RefundReconcileAge))
+			assert.Equal(t, tt.orders, orders.Refunded, "a settled refund is left alone")
+		})
+	}
+}
+
+func TestRefundOutcome(t *testing.T) {
+	refunded := func(amount int64) *services.GatewayResult {
+		return &services.GatewayResult{Status: services.GatewayStatusRefunded, Refunded: money.New(amount, "KZT")}
+	}
+	for _, tt := range []struct {
+		name      string
+		result    *services.GatewayResult
+		completed int64
+		status    string
+	}{
+		{"nothing refunded", &services.GatewayResult{Status: services.GatewayStatusCaptured}, 0, models.RefundStatusFailed},
+		{"refund covered", refunded(8000), 3000, models.RefundStatusCompleted},
+		{"only earlier refunds covered", refunded(3000), 3000, models.RefundStatusFailed},
+		{"amount not reported", refunded(0), 0, models.RefundStatusCompleted},
+		{"amount not reported after others", refunded(0), 3000, ""},
+		{"transaction still authorized", &services.GatewayResult{Status: services.GatewayStatusAuthorized}, 0, ""},
+	} {
+		status, err := refundOutcome(tt.result, money.New(tt.completed, "KZT"), money.New(5000, "KZT"))
+		assert.Equal(t, tt.status, status, tt.name)
+		assert.Equal(t, tt.status == "", err != nil, tt.name)
+	}
+}
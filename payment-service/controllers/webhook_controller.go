@@ -0,0 +1,136 @@
+package controllers
+
+import (
+	"OnlineStore/apierror"
+	"OnlineStore/payment-service/models"
+	"OnlineStore/payment-service/services"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+)
+
+// EpayPostLinkController receives epay's postLink callback, sent after a
+// successful payment.
+func (pc *PaymentController) EpayPostLinkController(writer http.ResponseWriter, request *http.Request) {
+	pc.handleEpayCallback(writer, request, false)
+}
+
+// EpayFailurePostLinkController receives epay's failurePostLink callback, sent
+// after a failed payment.
+func (pc *PaymentController) EpayFailurePostLinkController(writer http.ResponseWriter, request *http.Request) {
+	pc.handleEpayCallback(writer, request, true)
+}
+
+// handleEpayCallback settles a payment from an epay callback. The callback is
+// only trusted to say which invoice changed: after checking its secret_hash
+// and amount, the status is read back from the gateway itself. Callbacks may
+// arrive more than once and in any order, so stale and repeated ones leave
+// the payment as it is and still answer 200, which stops epay resending.
+func (pc *PaymentController) handleEpayCallback(writer http.ResponseWriter, request *http.Request, failure bool) {
+	var callback services.EpayCallback
+	err := json.NewDecoder(request.Body).Decode(&callback)
+	if err != nil {
+		apierror.Write(writer, request, apierror.Wrap(apierror.Validation, "invalid JSON body", err))
+		return
+	}
+	if err := services.VerifyEpayCallback(pc.WebhookSecret, &callback); err != nil {
+		log.Printf("Rejected epay callback for invoice %q: %v", callback.InvoiceID, err)
+		apierror.Write(writer, request, apierror.New(apierror.Unauthorized, "invalid callback signature"))
+		return
+	}
+
+	payment, err := pc.PaymentModel.GetPaymentByInvoiceID(callback.InvoiceID)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = apierror.New(apierror.NotFound, "unknown invoice")
+	}
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	amount, err := callback.Money()
+	if err != nil || amount != payment.Amount {
+		log.Printf("Rejected epay callback for invoice %s: amount %s %s does not match payment", callback.InvoiceID, callback.Amount, callback.Currency)
+		apierror.Write(writer, request, apierror.New(apierror.Validation, "callback amount does not match payment"))
+		return
+	}
+
+	updated := *payment
+	if err := pc.settle(request.Context(), &updated, failure || !callback.Succeeded()); err != nil {
+		// The gateway could not be asked; epay retries the callback later.
+		log.Printf("Epay callback for invoice %s: %v", callback.InvoiceID, err)
+		apierror.Write(writer, request, apierror.New(apierror.Unavailable, "payment gateway could not be reached"))
+		return
+	}
+
+	if updated.PaymentStatus != payment.PaymentStatus {
+		changed, err := pc.PaymentModel.UpdatePaymentStatus(payment.ID, payment.PaymentStatus, updated.PaymentStatus, updated.TransactionID)
+		if err != nil {
+			apierror.Write(writer, request, err)
+			return
+		}
+		if !changed {
+			// Another delivery of this callback settled it first.
+			if payment, err = pc.PaymentModel.GetPaymentByInvoiceID(callback.InvoiceID); err != nil {
+				apierror.Write(writer, request, err)
+				return
+			}
+			updated = *payment
+		}
+	}
+	if updated.PaymentStatus == models.PaymentStatusCaptured {
+		pc.markOrderPaid(request.Context(), &updated)
+	}
+
+	jsonPayment, err := json.Marshal(updated)
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	_, err = writer.Write(jsonPayment)
+	return
+}
+
+// settle works out the payment's status from the gateway, capturing it if the
+// gateway holds an authorization we never captured, e.g. because the original
+// request timed out. Statuses the payment cannot move to are ignored.
+func (pc *PaymentController) settle(ctx context.Context, payment *models.Payment, failed bool) error {
+	result, err := pc.Gateway.Status(ctx, payment.InvoiceID)
+	var status string
+	switch {
+	case errors.Is(err, services.ErrUnknownPayment) && failed:
+		// Declined before the gateway kept any record of it.
+		status = models.PaymentStatusDeclined
+	case err != nil:
+		return err
+	default:
+		status = result.Status
+		if result.TransactionID != "" {
+			payment.TransactionID = result.TransactionID
+		}
+	}
+
+	if status == services.GatewayStatusAuthorized &&
+		(payment.PaymentStatus == models.PaymentStatusPending || payment.PaymentStatus == models.PaymentStatusAuthorized) {
+		previous := payment.PaymentStatus
+		pc.capture(ctx, payment)
+		if payment.PaymentStatus != models.PaymentStatusFailed {
+			return nil
+		}
+		// A concurrent delivery of the callback may have captured it
+		// first; trust the gateway over our failed attempt.
+		if result, err = pc.Gateway.Status(ctx, payment.InvoiceID); err != nil {
+			return err
+		}
+		status = result.Status
+		payment.PaymentStatus = previous
+	}
+	if models.CanTransitionPayment(payment.PaymentStatus, status) {
+		payment.PaymentStatus = status
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package controllers
+
+import (
+	"OnlineStore/money"
+	"OnlineStore/payment-service/models"
+	"OnlineStore/payment-service/services"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const fixtureInvoiceID = "000000000042"
+
+// loadCallback reads a recorded epay callback and signs it like epay would.
+func loadCallback(t *testing.T, name string, edit func(map[string]interface{})) []byte {
+	data, err := os.ReadFile("testdata/" + name)
+	require.NoError(t, err)
+	var callback map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &callback))
+	callback["secret_hash"] = services.EpaySecretHash(testWebhookSecret, callback["invoiceId"].(string))
+	if edit != nil {
+		edit(callback)
+	}
+	data, err = json.Marshal(callback)
+	require.NoError(t, err)
+	return data
+}
+
+func postCallback(handler http.HandlerFunc, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/payments/webhooks/epay", bytes.NewReader(body))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func pendingPayment() *models.Payment {
+	return &models.Payment{ID: 1, UserID: 1, OrderID: 1, Amount: money.New(15000, "KZT"),
+		PaymentStatus: models.PaymentStatusPending, InvoiceID: fixtureInvoiceID}
+}
+
+func TestEpayPostLinkController(t *testing.T) {
+	mockModel := &MockPaymentModel{Payments: []*models.Payment{pendingPayment()}}
+	gateway := services.NewFakeGateway()
+	orders := &MockOrderClient{}
+	controller := NewPaymentController(mockModel, gateway, orders, testWebhookSecret)
+	handler := http.HandlerFunc(controller.EpayPostLinkController)
+
+	// The authorization went through but its response was lost.
+	_, err := gateway.Authorize(context.Background(), services.Charge{InvoiceID: fixtureInvoiceID, Amount: money.New(15000, "KZT")})
+	require.NoError(t, err)
+
+	rr := postCallback(handler, loadCallback(t, "epay_postlink.json", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, models.PaymentStatusCaptured, mockModel.Payments[0].PaymentStatus)
+	assert.NotEmpty(t, mockModel.Payments[0].TransactionID)
+	assert.Equal(t, []int{1}, orders.Paid)
+
+	// Test replayed callback
+	rr = postCallback(handler, loadCallback(t, "epay_postlink.json", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, models.PaymentStatusCaptured, mockModel.Payments[0].PaymentStatus)
+
+	// Test a late failure callback does not undo the capture
+	rr = postCallback(http.HandlerFunc(controller.EpayFailurePostLinkController), loadCallback(t, "epay_failure_postlink.json", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, models.PaymentStatusCaptured, mockModel.Payments[0].PaymentStatus)
+}
+
+func TestEpayPostLinkControllerRejectsForgedCallbacks(t *testing.T) {
+	mockModel := &MockPaymentModel{Payments: []*models.Payment{pendingPayment()}}
+	orders := &MockOrderClient{}
+	controller := NewPaymentController(mockModel, services.NewFakeGateway(), orders, testWebhookSecret)
+	handler := http.HandlerFunc(controller.EpayPostLinkController)
+
+	// Test wrong secret hash
+	rr := postCallback(handler, loadCallback(t, "epay_postlink.json", func(callback map[string]interface{}) {
+		callback["secret_hash"] = services.EpaySecretHash("other-secret", fixtureInvoiceID)
+	}))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	// Test amount that does not match the payment
+	rr = postCallback(handler, loadCallback(t, "epay_postlink.json", func(callback map[string]interface{}) {
+		callback["amount"] = 1
+	}))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// Test unknown invoice
+	rr = postCallback(handler, loadCallback(t, "epay_postlink.json", func(callback map[string]interface{}) {
+		callback["invoiceId"] = "000000000043"
+		callback["secret_hash"] = services.EpaySecretHash(testWebhookSecret, "000000000043")
+	}))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	assert.Equal(t, models.PaymentStatusPending, mockModel.Payments[0].PaymentStatus)
+	assert.Empty(t, orders.Paid)
+}
+
+func TestEpayFailurePostLinkController(t *testing.T) {
+	mockModel := &MockPaymentModel{Payments: []*models.Payment{pendingPayment()}}
+	orders := &MockOrderClient{}
+	controller := NewPaymentController(mockModel, services.NewFakeGateway(), orders, testWebhookSecret)
+	handler := http.HandlerFunc(controller.EpayFailurePostLinkController)
+
+	rr := postCallback(handler, loadCallback(t, "epay_failure_postlink.json", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, models.PaymentStatusDeclined, mockModel.Payments[0].PaymentStatus)
+	assert.Empty(t, orders.Paid)
+}
@@ -2,9 +2,13 @@ package main
 
 import (
 	db "OnlineStore"
+	"OnlineStore/apierror"
+	"OnlineStore/idempotency"
+	"OnlineStore/outbox"
 	"OnlineStore/payment-service/controllers"
 	"OnlineStore/payment-service/repository"
 	"OnlineStore/payment-service/routes"
+	"OnlineStore/payment-service/services"
 	"context"
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
@@ -22,28 +26,36 @@ func main() {
 		log.Println("Error loading .env file")
 	}
 
-	database, err := db.InitializeDB()
+	database, err := db.InitializeDB("payment")
 	if err != nil {
 		log.Fatalf("Error initializing database: %v", err)
 	}
 
-	// Uncomment to run migrations
-	// if err := db.MigrateUp(database); err != nil {
-	//     log.Fatalf("Error running migrations: %v", err)
-	// }
+	if db.MigrationsEnabled() {
+		if err := db.MigrateUp(database, "payment"); err != nil {
+			log.Fatalf("Error running migrations: %v", err)
+		}
+	}
+
+	gateway, err := services.NewGatewayFromEnv()
+	if err != nil {
+		log.Fatalf("Error configuring payment gateway: %v", err)
+	}
 
 	productModel := repository.NewPaymentRepository(database)
-	productController := controllers.NewPaymentController(productModel)
+	orders := services.NewOrderClientFromEnv()
+	productController := controllers.NewPaymentController(productModel, gateway, orders, os.Getenv("EPAY_WEBHOOK_SECRET"))
 
 	router := mux.NewRouter()
-	routes.Routes(router, productController)
+	apierror.Routes(router)
+	routes.Routes(router, productController, idempotency.NewPostgresStore(database))
 
 	corsHandler := cors.New(cors.Options{
 		AllowedOrigins:   []string{os.Getenv("BASE_URL")},
 		AllowedMethods:   []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete},
-		AllowedHeaders:   []string{"Authorization", "Content-Type"},
+		AllowedHeaders:   []string{"Authorization", "Content-Type", idempotency.Header, apierror.RequestIDHeader},
 		AllowCredentials: true,
-	}).Handler(router)
+	}).Handler(apierror.RequestID(router))
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -54,6 +66,16 @@ func main() {
 		Handler: corsHandler,
 	}
 
+	relayCtx, stopRelay := context.WithCancel(context.Background())
+	defer stopRelay()
+	if err := outbox.StartRelay(relayCtx, database); err != nil {
+		log.Fatalf("Error configuring outbox broker: %v", err)
+	}
+
+	reconcileCtx, stopReconcile := context.WithCancel(context.Background())
+	defer stopReconcile()
+	go productController.ReconcileRefundsEvery(reconcileCtx, time.Minute)
+
 	go gracefulShutdown(server)
 
 	log.Printf("Server is starting on port %s\n", port)
@@ -0,0 +1,21 @@
+-- Amounts are BIGINT minor units in an ISO 4217 currency. invoice_id is our
+-- reference for the payment at the gateway and transaction_id the gateway's
+-- own. user_id and order_id refer to other services' records, so they are not
+-- foreign keys.
+CREATE TABLE IF NOT EXISTS payments
+(
+    id             SERIAL PRIMARY KEY,
+    user_id        INT         NOT NULL,
+    order_id       INT         NOT NULL,
+    amount         BIGINT      NOT NULL CHECK (amount >= 0),
+    currency       CHAR(3)     NOT NULL DEFAULT 'KZT',
+    payment_date   TIMESTAMP   NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    payment_status VARCHAR(50) NOT NULL DEFAULT 'pending',
+    invoice_id     VARCHAR(15),
+    transaction_id VARCHAR(64)
+);
+
+CREATE INDEX IF NOT EXISTS idx_payments_user_id ON payments (user_id);
+CREATE INDEX IF NOT EXISTS idx_payments_order_id ON payments (order_id);
+CREATE INDEX IF NOT EXISTS idx_payments_payment_status ON payments (payment_status);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_payments_invoice_id ON payments (invoice_id);
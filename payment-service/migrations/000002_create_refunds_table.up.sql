@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS refunds
+(
+    id             SERIAL PRIMARY KEY,
+    payment_id     INT         NOT NULL REFERENCES payments (id) ON DELETE CASCADE,
+    amount         BIGINT      NOT NULL CHECK (amount > 0),
+    currency       CHAR(3)     NOT NULL DEFAULT 'KZT',
+    status         VARCHAR(20) NOT NULL DEFAULT 'pending',
+    reason         TEXT        NOT NULL DEFAULT '',
+    created_at     TIMESTAMP   NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_refunds_payment_id ON refunds (payment_id);
@@ -0,0 +1 @@
+-- The dropped foreign keys are not restored: the tables they refer to belong to other services.
@@ -0,0 +1,5 @@
+-- Databases created while all services shared one schema have foreign keys
+-- into the users and orders tables. The payment-service no longer sees
+-- those tables, so the keys go.
+ALTER TABLE payments DROP CONSTRAINT IF EXISTS payments_user_id_fkey;
+ALTER TABLE payments DROP CONSTRAINT IF EXISTS payments_order_id_fkey;
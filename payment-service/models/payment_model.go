@@ -1,21 +1,105 @@
 package models
 
+import (
+	"OnlineStore/apierror"
+	"OnlineStore/money"
+	"OnlineStore/pagination"
+	"time"
+)
+
+var (
+	ErrPaymentNotFound    = apierror.New(apierror.NotFound, "payment not found")
+	ErrPaymentNotVoidable = apierror.New(apierror.Conflict, "only an authorized payment can be voided")
+)
+
+const (
+	PaymentStatusPending    = "pending"
+	PaymentStatusAuthorized = "authorized"
+	PaymentStatusCaptured   = "captured"
+	PaymentStatusDeclined   = "declined"
+	PaymentStatusFailed     = "failed"
+	PaymentStatusRefunded   = "refunded"
+	// PaymentStatusPartiallyRefunded is a captured payment with some, but
+	// not all, of its amount refunded.
+	PaymentStatusPartiallyRefunded = "partially_refunded"
+	PaymentStatusVoided            = "voided"
+)
+
+// paymentTransitions lists the statuses a payment may move to as the gateway
+// reports on it. Anything else, including a repeat of the current status, is
+// a stale or replayed report and is ignored.
+var paymentTransitions = map[string][]string{
+	PaymentStatusPending:           {PaymentStatusAuthorized, PaymentStatusCaptured, PaymentStatusDeclined, PaymentStatusFailed},
+	PaymentStatusAuthorized:        {PaymentStatusCaptured, PaymentStatusVoided, PaymentStatusDeclined, PaymentStatusFailed},
+	PaymentStatusCaptured:          {PaymentStatusPartiallyRefunded, PaymentStatusRefunded},
+	PaymentStatusPartiallyRefunded: {PaymentStatusRefunded},
+}
+
+func CanTransitionPayment(from, to string) bool {
+	for _, status := range paymentTransitions[from] {
+		if status == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Events recorded in the outbox when a payment changes. Their payload is the
+// Payment as it is afterwards; for payment.deleted only its ID is set.
+const (
+	EventPaymentCreated       = "payment.created"
+	EventPaymentUpdated       = "payment.updated"
+	EventPaymentStatusChanged = "payment.status_changed"
+	EventPaymentDeleted       = "payment.deleted"
+)
+
 type Payment struct {
-	ID            int     `json:"id"`
-	UserID        int     `json:"user_id"`
-	OrderID       int     `json:"order_id"`
-	Amount        float64 `json:"amount"`
-	PaymentDate   string  `json:"payment_date"`
-	PaymentStatus string  `json:"payment_status"`
+	ID            int         `json:"id"`
+	UserID        int         `json:"user_id"`
+	OrderID       int         `json:"order_id"`
+	Amount        money.Money `json:"amount"`
+	PaymentDate   string      `json:"payment_date"`
+	PaymentStatus string      `json:"payment_status"`
+	// InvoiceID is our reference for the payment at the gateway and
+	// TransactionID the gateway's own; both are set by the service.
+	InvoiceID     string `json:"invoice_id"`
+	TransactionID string `json:"transaction_id"`
+}
+
+// PaymentSorts are the keys payments can be listed by; the first is the
+// default.
+var PaymentSorts = []string{"id", "payment_date", "amount", "payment_status"}
+
+// PaymentFilter narrows a list of payments. Zero fields match every payment.
+type PaymentFilter struct {
+	UserID  int
+	OrderID int
+	Status  string
 }
 
 type PaymentModel interface {
-	GetPayments() ([]*Payment, error)
-	CreatePayment(payment Payment) error
+	// ListPayments returns one page of the payments matching filter, and
+	// how many match in total.
+	ListPayments(filter PaymentFilter, page pagination.Params) ([]*Payment, int, error)
+	CreatePayment(payment Payment) (int, error)
 	GetPaymentByID(id int) (*Payment, error)
 	UpdatePayment(payment Payment) error
 	DeletePayment(id int) error
 	GetPaymentByOrderID(orderID int) ([]*Payment, error)
 	GetPaymentByUserID(userID int) ([]*Payment, error)
 	GetPaymentByStatus(status string) ([]*Payment, error)
+	GetPaymentByInvoiceID(invoiceID string) (*Payment, error)
+	// UpdatePaymentStatus moves a payment from status from to status to,
+	// reporting false if it was no longer in status from.
+	UpdatePaymentStatus(id int, from, to, transactionID string) (bool, error)
+	// CreateRefund records a pending refund of a captured payment, taking
+	// the rest of the refundable amount when refund.Amount is zero.
+	CreateRefund(refund Refund) (*Refund, error)
+	// CompleteRefund settles a pending refund with status and returns the
+	// payment, whose status reflects all completed refunds.
+	CompleteRefund(id int, status string) (*Payment, error)
+	GetRefundsByPaymentID(paymentID int) ([]*Refund, error)
+	// GetPendingRefunds returns the refunds that have been pending for at
+	// least olderThan, oldest first.
+	GetPendingRefunds(olderThan time.Duration) ([]*Refund, error)
 }
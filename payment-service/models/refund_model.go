@@ -0,0 +1,35 @@
+package models
+
+import (
+	"OnlineStore/apierror"
+	"OnlineStore/money"
+)
+
+const (
+	RefundStatusPending   = "pending"
+	RefundStatusCompleted = "completed"
+	RefundStatusFailed    = "failed"
+)
+
+// Events recorded in the outbox when a refund is requested and when it
+// completes or fails. Their payload is the Refund.
+const (
+	EventRefundCreated = "refund.created"
+	EventRefundSettled = "refund.settled"
+)
+
+var (
+	ErrPaymentNotRefundable = apierror.New(apierror.Conflict, "payment cannot be refunded")
+	ErrRefundExceedsPayment = apierror.New(apierror.Conflict, "refund exceeds the captured amount")
+)
+
+// Refund returns all or part of a captured payment. Pending and completed
+// refunds together never exceed the payment's amount.
+type Refund struct {
+	ID        int         `json:"id"`
+	PaymentID int         `json:"payment_id"`
+	Amount    money.Money `json:"amount"`
+	Status    string      `json:"status"`
+	Reason    string      `json:"reason"`
+	CreatedAt string      `json:"created_at"`
+}
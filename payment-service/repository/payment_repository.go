@@ -1,10 +1,15 @@
 package repository
 
 import (
+	"OnlineStore/outbox"
+	"OnlineStore/pagination"
 	"OnlineStore/payment-service/models"
 	"database/sql"
 )
 
+const paymentColumns = `id, user_id, order_id, amount, currency, payment_date, payment_status,
+        COALESCE(invoice_id, ''), COALESCE(transaction_id, '')`
+
 type PaymentRepository struct {
 	DB *sql.DB
 }
@@ -13,59 +18,180 @@ func NewPaymentRepository(db *sql.DB) *PaymentRepository {
 	return &PaymentRepository{DB: db}
 }
 
-func (pr *PaymentRepository) GetPayments() ([]*models.Payment, error) {
-	rows, err := pr.DB.Query("SELECT * FROM payments")
+var paymentSortColumns = map[string]string{
+	"id":             "id",
+	"payment_date":   "payment_date",
+	"amount":         "amount",
+	"payment_status": "payment_status",
+}
+
+func (pr *PaymentRepository) ListPayments(filter models.PaymentFilter, page pagination.Params) ([]*models.Payment, int, error) {
+	var where pagination.Where
+	if filter.UserID != 0 {
+		where.Equal("user_id", filter.UserID)
+	}
+	if filter.OrderID != 0 {
+		where.Equal("order_id", filter.OrderID)
+	}
+	if filter.Status != "" {
+		where.Equal("payment_status", filter.Status)
+	}
+	var total int
+	err := pr.DB.QueryRow("SELECT COUNT(*) FROM payments"+where.String(), where.Args...).Scan(&total)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+
+	query := "SELECT " + paymentColumns + " FROM payments" + where.String()
+	query += page.OrderBy(paymentSortColumns, &where)
+	rows, err := pr.DB.Query(query, where.Args...)
+	if err != nil {
+		return nil, 0, err
 	}
 	defer rows.Close()
 	var payments []*models.Payment
 	for rows.Next() {
 		var payment models.Payment
-		err := rows.Scan(&payment.ID, &payment.UserID, &payment.OrderID, &payment.Amount, &payment.PaymentDate, &payment.PaymentStatus)
+		err := rows.Scan(&payment.ID, &payment.UserID, &payment.OrderID, &payment.Amount, &payment.Amount.Currency, &payment.PaymentDate, &payment.PaymentStatus, &payment.InvoiceID, &payment.TransactionID)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 		payments = append(payments, &payment)
 	}
-	return payments, nil
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	return payments, total, nil
 }
 
-func (pr *PaymentRepository) CreatePayment(payment models.Payment) error {
-	_, err := pr.DB.Exec("INSERT INTO payments (user_id, order_id, amount, payment_status) VALUES ($1, $2, $3, $4)", payment.UserID, payment.OrderID, payment.Amount, payment.PaymentStatus)
+func (pr *PaymentRepository) CreatePayment(payment models.Payment) (int, error) {
+	tx, err := pr.DB.Begin()
 	if err != nil {
-		return err
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var id int
+	err = tx.QueryRow(`
+        INSERT INTO payments (user_id, order_id, amount, currency, payment_status, invoice_id, transaction_id)
+        VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), NULLIF($7, ''))
+        RETURNING id`, payment.UserID, payment.OrderID, payment.Amount, payment.Amount.CurrencyOrDefault(),
+		payment.PaymentStatus, payment.InvoiceID, payment.TransactionID).Scan(&id)
+	if err != nil {
+		return 0, err
 	}
-	return nil
+	if err := recordPaymentEvent(tx, models.EventPaymentCreated, id); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
 }
 
-func (pr *PaymentRepository) GetPaymentByID(id int) (*models.Payment, error) {
+func scanPayment(row *sql.Row) (*models.Payment, error) {
 	var payment models.Payment
-	err := pr.DB.QueryRow("SELECT * FROM payments WHERE id = $1", id).Scan(&payment.ID, &payment.UserID, &payment.OrderID, &payment.Amount, &payment.PaymentDate, &payment.PaymentStatus)
+	err := row.Scan(&payment.ID, &payment.UserID, &payment.OrderID, &payment.Amount, &payment.Amount.Currency, &payment.PaymentDate, &payment.PaymentStatus, &payment.InvoiceID, &payment.TransactionID)
 	if err != nil {
 		return nil, err
 	}
 	return &payment, nil
 }
 
+func (pr *PaymentRepository) GetPaymentByID(id int) (*models.Payment, error) {
+	return scanPayment(pr.DB.QueryRow("SELECT "+paymentColumns+" FROM payments WHERE id = $1", id))
+}
+
+func (pr *PaymentRepository) GetPaymentByInvoiceID(invoiceID string) (*models.Payment, error) {
+	return scanPayment(pr.DB.QueryRow("SELECT "+paymentColumns+" FROM payments WHERE invoice_id = $1", invoiceID))
+}
+
+// UpdatePaymentStatus only updates the row while it still has status from, so
+// of two concurrent deliveries of the same callback exactly one wins.
+func (pr *PaymentRepository) UpdatePaymentStatus(id int, from, to, transactionID string) (bool, error) {
+	tx, err := pr.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+        UPDATE payments
+        SET payment_status = $1, transaction_id = COALESCE(NULLIF($2, ''), transaction_id)
+        WHERE id = $3 AND payment_status = $4`, to, transactionID, id, from)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if affected != 1 {
+		return false, nil
+	}
+	if err := recordPaymentEvent(tx, models.EventPaymentStatusChanged, id); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
 func (pr *PaymentRepository) UpdatePayment(payment models.Payment) error {
-	_, err := pr.DB.Exec("UPDATE payments SET user_id = $1, order_id = $2, amount = $3 WHERE id = $4", payment.UserID, payment.OrderID, payment.Amount, payment.ID)
+	tx, err := pr.DB.Begin()
 	if err != nil {
 		return err
 	}
-	return nil
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE payments SET user_id = $1, order_id = $2, amount = $3, currency = $4 WHERE id = $5", payment.UserID, payment.OrderID, payment.Amount, payment.Amount.CurrencyOrDefault(), payment.ID)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return nil
+	}
+	if err := recordPaymentEvent(tx, models.EventPaymentUpdated, payment.ID); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 func (pr *PaymentRepository) DeletePayment(id int) error {
-	_, err := pr.DB.Exec("DELETE FROM payments WHERE id = $1", id)
+	tx, err := pr.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM payments WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return nil
+	}
+	if err := outbox.Record(tx, models.EventPaymentDeleted, id, models.Payment{ID: id}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// recordPaymentEvent records an event whose payload is the payment as tx sees
+// it.
+func recordPaymentEvent(tx *sql.Tx, eventType string, id int) error {
+	payment, err := scanPayment(tx.QueryRow("SELECT "+paymentColumns+" FROM payments WHERE id = $1", id))
 	if err != nil {
 		return err
 	}
-	return nil
+	return outbox.Record(tx, eventType, id, payment)
 }
 
 func (pr *PaymentRepository) GetPaymentByOrderID(orderID int) ([]*models.Payment, error) {
-	rows, err := pr.DB.Query("SELECT * FROM payments WHERE order_id = $1", orderID)
+	rows, err := pr.DB.Query("SELECT "+paymentColumns+" FROM payments WHERE order_id = $1", orderID)
 	if err != nil {
 		return nil, err
 	}
@@ -73,7 +199,7 @@ func (pr *PaymentRepository) GetPaymentByOrderID(orderID int) ([]*models.Payment
 	var payments []*models.Payment
 	for rows.Next() {
 		var payment models.Payment
-		err := rows.Scan(&payment.ID, &payment.UserID, &payment.OrderID, &payment.Amount, &payment.PaymentDate, &payment.PaymentStatus)
+		err := rows.Scan(&payment.ID, &payment.UserID, &payment.OrderID, &payment.Amount, &payment.Amount.Currency, &payment.PaymentDate, &payment.PaymentStatus, &payment.InvoiceID, &payment.TransactionID)
 		if err != nil {
 			return nil, err
 		}
@@ -83,7 +209,7 @@ func (pr *PaymentRepository) GetPaymentByOrderID(orderID int) ([]*models.Payment
 }
 
 func (pr *PaymentRepository) GetPaymentByUserID(userID int) ([]*models.Payment, error) {
-	rows, err := pr.DB.Query("SELECT * FROM payments WHERE user_id = $1", userID)
+	rows, err := pr.DB.Query("SELECT "+paymentColumns+" FROM payments WHERE user_id = $1", userID)
 	if err != nil {
 		return nil, err
 	}
@@ -91,7 +217,7 @@ func (pr *PaymentRepository) GetPaymentByUserID(userID int) ([]*models.Payment,
 	var payments []*models.Payment
 	for rows.Next() {
 		var payment models.Payment
-		err := rows.Scan(&payment.ID, &payment.UserID, &payment.OrderID, &payment.Amount, &payment.PaymentDate, &payment.PaymentStatus)
+		err := rows.Scan(&payment.ID, &payment.UserID, &payment.OrderID, &payment.Amount, &payment.Amount.Currency, &payment.PaymentDate, &payment.PaymentStatus, &payment.InvoiceID, &payment.TransactionID)
 		if err != nil {
 			return nil, err
 		}
@@ -101,7 +227,7 @@ func (pr *PaymentRepository) GetPaymentByUserID(userID int) ([]*models.Payment,
 }
 
 func (pr *PaymentRepository) GetPaymentByStatus(status string) ([]*models.Payment, error) {
-	rows, err := pr.DB.Query("SELECT * FROM payments WHERE payment_status = $1", status)
+	rows, err := pr.DB.Query("SELECT "+paymentColumns+" FROM payments WHERE payment_status = $1", status)
 	if err != nil {
 		return nil, err
 	}
@@ -109,7 +235,7 @@ func (pr *PaymentRepository) GetPaymentByStatus(status string) ([]*models.Paymen
 	var payments []*models.Payment
 	for rows.Next() {
 		var payment models.Payment
-		err := rows.Scan(&payment.ID, &payment.UserID, &payment.OrderID, &payment.Amount, &payment.PaymentDate, &payment.PaymentStatus)
+		err := rows.Scan(&payment.ID, &payment.UserID, &payment.OrderID, &payment.Amount, &payment.Amount.Currency, &payment.PaymentDate, &payment.PaymentStatus, &payment.InvoiceID, &payment.TransactionID)
 		if err != nil {
 			return nil, err
 		}
@@ -0,0 +1,175 @@
+package repository
+
+import (
+	"OnlineStore/money"
+	"OnlineStore/outbox"
+	"OnlineStore/payment-service/models"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// CreateRefund locks the payment while it checks the refundable amount, so
+// concurrent refunds of one payment cannot together exceed it.
+func (pr *PaymentRepository) CreateRefund(refund models.Refund) (*models.Refund, error) {
+	tx, err := pr.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var status string
+	var amount money.Money
+	err = tx.QueryRow("SELECT payment_status, amount, currency FROM payments WHERE id = $1 FOR UPDATE", refund.PaymentID).
+		Scan(&status, &amount, &amount.Currency)
+	if err != nil {
+		return nil, err
+	}
+	if status != models.PaymentStatusCaptured && status != models.PaymentStatusPartiallyRefunded {
+		return nil, fmt.Errorf("%w: payment is %s", models.ErrPaymentNotRefundable, status)
+	}
+
+	reserved := money.Money{Currency: amount.Currency}
+	err = tx.QueryRow(`
+        SELECT COALESCE(SUM(amount), 0) FROM refunds
+        WHERE payment_id = $1 AND status IN ($2, $3)`,
+		refund.PaymentID, models.RefundStatusPending, models.RefundStatusCompleted).Scan(&reserved)
+	if err != nil {
+		return nil, err
+	}
+	remaining, err := amount.Sub(reserved)
+	if err != nil {
+		return nil, err
+	}
+
+	if refund.Amount.IsNegative() {
+		return nil, fmt.Errorf("%w: refund amount must be positive", money.ErrInvalidAmount)
+	}
+	if refund.Amount.IsZero() {
+		refund.Amount = remaining
+	}
+	cmp, err := refund.Amount.Cmp(remaining)
+	if err != nil {
+		return nil, err
+	}
+	if refund.Amount.IsZero() || cmp > 0 {
+		return nil, fmt.Errorf("%w: %s refundable", models.ErrRefundExceedsPayment, remaining)
+	}
+
+	refund.Status = models.RefundStatusPending
+	err = tx.QueryRow(`
+        INSERT INTO refunds (payment_id, amount, currency, status, reason)
+        VALUES ($1, $2, $3, $4, $5)
+        RETURNING id, created_at`, refund.PaymentID, refund.Amount, refund.Amount.Currency, refund.Status, refund.Reason).
+		Scan(&refund.ID, &refund.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := outbox.Record(tx, models.EventRefundCreated, refund.ID, refund); err != nil {
+		return nil, err
+	}
+	return &refund, tx.Commit()
+}
+
+// CompleteRefund settles a pending refund; settling one that is no longer
+// pending changes nothing. Once completed refunds add up to the payment's
+// amount the payment becomes refunded.
+func (pr *PaymentRepository) CompleteRefund(id int, status string) (*models.Payment, error) {
+	tx, err := pr.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var paymentID int
+	var current string
+	err = tx.QueryRow("SELECT payment_id, status FROM refunds WHERE id = $1 FOR UPDATE", id).Scan(&paymentID, &current)
+	if err != nil {
+		return nil, err
+	}
+	if current == models.RefundStatusPending {
+		if err := settleRefund(tx, id, paymentID, status); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return pr.GetPaymentByID(paymentID)
+}
+
+func settleRefund(tx *sql.Tx, id, paymentID int, status string) error {
+	var refund models.Refund
+	err := tx.QueryRow(`
+        UPDATE refunds SET status = $1 WHERE id = $2
+        RETURNING id, payment_id, amount, currency, status, reason, created_at`, status, id).
+		Scan(&refund.ID, &refund.PaymentID, &refund.Amount, &refund.Amount.Currency, &refund.Status, &refund.Reason, &refund.CreatedAt)
+	if err != nil {
+		return err
+	}
+	if err := outbox.Record(tx, models.EventRefundSettled, id, refund); err != nil {
+		return err
+	}
+	if status != models.RefundStatusCompleted {
+		return nil
+	}
+
+	var amount, refunded money.Money
+	err = tx.QueryRow("SELECT amount, currency FROM payments WHERE id = $1 FOR UPDATE", paymentID).
+		Scan(&amount, &amount.Currency)
+	if err != nil {
+		return err
+	}
+	refunded.Currency = amount.Currency
+	err = tx.QueryRow("SELECT COALESCE(SUM(amount), 0) FROM refunds WHERE payment_id = $1 AND status = $2",
+		paymentID, models.RefundStatusCompleted).Scan(&refunded)
+	if err != nil {
+		return err
+	}
+
+	paymentStatus := models.PaymentStatusPartiallyRefunded
+	if refunded.Amount >= amount.Amount {
+		paymentStatus = models.PaymentStatusRefunded
+	}
+	_, err = tx.Exec("UPDATE payments SET payment_status = $1 WHERE id = $2", paymentStatus, paymentID)
+	if err != nil {
+		return err
+	}
+	return recordPaymentEvent(tx, models.EventPaymentStatusChanged, paymentID)
+}
+
+func (pr *PaymentRepository) GetRefundsByPaymentID(paymentID int) ([]*models.Refund, error) {
+	rows, err := pr.DB.Query(`
+        SELECT id, payment_id, amount, currency, status, reason, created_at
+        FROM refunds WHERE payment_id = $1 ORDER BY id`, paymentID)
+	if err != nil {
+		return nil, err
+	}
+	return scanRefunds(rows)
+}
+
+func (pr *PaymentRepository) GetPendingRefunds(olderThan time.Duration) ([]*models.Refund, error) {
+	rows, err := pr.DB.Query(`
+        SELECT id, payment_id, amount, currency, status, reason, created_at
+        FROM refunds
+        WHERE status = $1 AND created_at <= CURRENT_TIMESTAMP - $2 * INTERVAL '1 second'
+        ORDER BY id`, models.RefundStatusPending, olderThan.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	return scanRefunds(rows)
+}
+
+func scanRefunds(rows *sql.Rows) ([]*models.Refund, error) {
+	defer rows.Close()
+	var refunds []*models.Refund
+	for rows.Next() {
+		var refund models.Refund
+		err := rows.Scan(&refund.ID, &refund.PaymentID, &refund.Amount, &refund.Amount.Currency, &refund.Status, &refund.Reason, &refund.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		refunds = append(refunds, &refund)
+	}
+	return refunds, rows.Err()
+}
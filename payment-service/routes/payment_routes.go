@@ -1,18 +1,24 @@
 package routes
 
 import (
+	"OnlineStore/idempotency"
 	"OnlineStore/payment-service/controllers"
 	"github.com/gorilla/mux"
 	"net/http"
 )
 
-func Routes(router *mux.Router, paymentController *controllers.PaymentController) {
+func Routes(router *mux.Router, paymentController *controllers.PaymentController, idempotencyKeys idempotency.Store) {
 	paymentsRouter := router.PathPrefix("/payments").Subrouter()
 
 	paymentsRouter.HandleFunc("", paymentController.GetPaymentsController).Methods(http.MethodGet)
 	paymentsRouter.HandleFunc("/{id:[0-9]+}", paymentController.GetPaymentByIDController).Methods(http.MethodGet)
-	paymentsRouter.HandleFunc("", paymentController.CreatePaymentController).Methods(http.MethodPost)
+	paymentsRouter.HandleFunc("", idempotency.Handler(idempotencyKeys, paymentController.CreatePaymentController)).Methods(http.MethodPost)
 	paymentsRouter.HandleFunc("/{id:[0-9]+}", paymentController.UpdatePaymentController).Methods(http.MethodPut)
 	paymentsRouter.HandleFunc("/{id:[0-9]+}", paymentController.DeletePaymentController).Methods(http.MethodDelete)
+	paymentsRouter.HandleFunc("/{id:[0-9]+}/void", paymentController.VoidPaymentController).Methods(http.MethodPost)
 	paymentsRouter.HandleFunc("/search", paymentController.SearchPaymentController).Methods(http.MethodGet)
+	paymentsRouter.HandleFunc("/{id:[0-9]+}/refunds", paymentController.GetRefundsController).Methods(http.MethodGet)
+	paymentsRouter.HandleFunc("/{id:[0-9]+}/refunds", idempotency.Handler(idempotencyKeys, paymentController.CreateRefundController)).Methods(http.MethodPost)
+	paymentsRouter.HandleFunc("/webhooks/epay", paymentController.EpayPostLinkController).Methods(http.MethodPost)
+	paymentsRouter.HandleFunc("/webhooks/epay/failure", paymentController.EpayFailurePostLinkController).Methods(http.MethodPost)
 }
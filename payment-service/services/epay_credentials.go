@@ -0,0 +1,97 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// cached holds a value fetched from epay, such as the access token or the
+// public key, and refreshes it on demand. Callers that need a refresh at the
+// same time share a single in-flight fetch.
+type cached[T any] struct {
+	mu sync.Mutex
+	// value is usable until expiresAt, or indefinitely if expiresAt is
+	// zero; a refresh is started once refreshAt has passed.
+	value     T
+	valid     bool
+	refreshAt time.Time
+	expiresAt time.Time
+	inflight  *fetchCall[T]
+}
+
+type fetchCall[T any] struct {
+	done  chan struct{}
+	value T
+	err   error
+}
+
+// fetchFunc fetches a fresh value. It is given the current value, if any, so
+// it can refresh rather than start over, and reports when the new value
+// should be refreshed and when it stops being usable.
+type fetchFunc[T any] func(ctx context.Context, current T, valid bool) (value T, refreshAt, expiresAt time.Time, err error)
+
+// get returns the cached value, fetching a new one once it is due for a
+// refresh. While the current value has not expired it is returned if the
+// refresh fails, so an early refresh never turns into an outage.
+func (c *cached[T]) get(ctx context.Context, now time.Time, fetch fetchFunc[T]) (T, error) {
+	c.mu.Lock()
+	if c.valid && now.Before(c.refreshAt) {
+		value := c.value
+		c.mu.Unlock()
+		return value, nil
+	}
+	call := c.inflight
+	if call == nil {
+		call = &fetchCall[T]{done: make(chan struct{})}
+		c.inflight = call
+		current, valid := c.value, c.valid
+		// The fetch is shared, so one caller giving up must not cancel it
+		// for the others; the HTTP client timeout still bounds it.
+		go c.fetch(context.WithoutCancel(ctx), call, current, valid, fetch)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		return c.fallback(now, ctx.Err())
+	}
+	if call.err != nil {
+		return c.fallback(now, call.err)
+	}
+	return call.value, nil
+}
+
+func (c *cached[T]) fetch(ctx context.Context, call *fetchCall[T], current T, valid bool, fetch fetchFunc[T]) {
+	value, refreshAt, expiresAt, err := fetch(ctx, current, valid)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil {
+		c.value, c.valid = value, true
+		c.refreshAt, c.expiresAt = refreshAt, expiresAt
+	}
+	c.inflight = nil
+	call.value, call.err = value, err
+	close(call.done)
+}
+
+// fallback returns the current value if it is still usable, and err otherwise.
+func (c *cached[T]) fallback(now time.Time, err error) (T, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.valid && (c.expiresAt.IsZero() || now.Before(c.expiresAt)) {
+		return c.value, nil
+	}
+	var zero T
+	return zero, err
+}
+
+// invalidate drops the cached value, e.g. after epay rejected the token.
+func (c *cached[T]) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var zero T
+	c.value, c.valid = zero, false
+}
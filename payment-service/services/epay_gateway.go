@@ -0,0 +1,514 @@
+package services
+
+import (
+	"OnlineStore/money"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+const epayScope = "webapi usermanagement email_send verification statement statistics payment"
+
+const (
+	defaultTokenRefreshMargin = time.Minute
+	defaultPublicKeyTTL       = 24 * time.Hour
+	// defaultTokenLifetime is assumed when epay does not say how long a
+	// token lives.
+	defaultTokenLifetime = 20 * time.Minute
+)
+
+// EpayConfig configures the Halyk Bank (homebank.kz) epay client.
+type EpayConfig struct {
+	TokenURL        string
+	PublicKeyURL    string
+	APIURL          string
+	ClientID        string
+	ClientSecret    string
+	TerminalID      string
+	PostLink        string
+	FailurePostLink string
+	// WebhookSecret derives the secret_hash that authenticates callbacks.
+	WebhookSecret string
+	Timeout       time.Duration
+	// TokenRefreshMargin is how long before expiry the access token is
+	// refreshed.
+	TokenRefreshMargin time.Duration
+	// PublicKeyTTL is how often the public key is fetched again, so a key
+	// rotated by epay is picked up.
+	PublicKeyTTL time.Duration
+}
+
+// EpayConfigFromEnv reads the EPAY_* variables. Credentials are required;
+// the endpoints default to the epay test environment.
+func EpayConfigFromEnv() (EpayConfig, error) {
+	config := EpayConfig{
+		TokenURL:        envOr("EPAY_TOKEN_URL", "https://testoauth.homebank.kz/epay2/oauth2/token"),
+		PublicKeyURL:    envOr("EPAY_PUBLIC_KEY_URL", "https://testepay.homebank.kz/api/public.rsa"),
+		APIURL:          envOr("EPAY_API_URL", "https://testepay.homebank.kz/api"),
+		ClientID:        os.Getenv("EPAY_CLIENT_ID"),
+		ClientSecret:    os.Getenv("EPAY_CLIENT_SECRET"),
+		TerminalID:      os.Getenv("EPAY_TERMINAL_ID"),
+		PostLink:        os.Getenv("EPAY_POST_LINK"),
+		FailurePostLink: os.Getenv("EPAY_FAILURE_POST_LINK"),
+		WebhookSecret:   os.Getenv("EPAY_WEBHOOK_SECRET"),
+		Timeout:         GatewayTimeout(),
+	}
+	if seconds, err := strconv.Atoi(os.Getenv("EPAY_TOKEN_REFRESH_MARGIN")); err == nil && seconds > 0 {
+		config.TokenRefreshMargin = time.Duration(seconds) * time.Second
+	}
+	if seconds, err := strconv.Atoi(os.Getenv("EPAY_PUBLIC_KEY_TTL")); err == nil && seconds > 0 {
+		config.PublicKeyTTL = time.Duration(seconds) * time.Second
+	}
+	if config.ClientID == "" || config.ClientSecret == "" || config.TerminalID == "" {
+		return EpayConfig{}, fmt.Errorf("EPAY_CLIENT_ID, EPAY_CLIENT_SECRET and EPAY_TERMINAL_ID must be set")
+	}
+	return config, nil
+}
+
+func envOr(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// EpayGateway is safe for concurrent use. The access token and public key are
+// cached and shared by all payments.
+type EpayGateway struct {
+	config EpayConfig
+	client *http.Client
+	now    func() time.Time
+	tokens cached[epayToken]
+	keys   cached[*rsa.PublicKey]
+}
+
+func NewEpayGateway(config EpayConfig) *EpayGateway {
+	if config.TokenRefreshMargin <= 0 {
+		config.TokenRefreshMargin = defaultTokenRefreshMargin
+	}
+	if config.PublicKeyTTL <= 0 {
+		config.PublicKeyTTL = defaultPublicKeyTTL
+	}
+	return &EpayGateway{
+		config: config,
+		client: &http.Client{Timeout: config.Timeout},
+		now:    time.Now,
+	}
+}
+
+type TokenResponse struct {
+	AccessToken  string      `json:"access_token"`
+	ExpiresIn    json.Number `json:"expires_in"`
+	RefreshToken string      `json:"refresh_token"`
+	Scope        string      `json:"scope"`
+	TokenType    string      `json:"token_type"`
+}
+
+type CryptogramResponse struct {
+	Hpan       string `json:"hpan"`
+	ExpDate    string `json:"expDate"`
+	Cvc        string `json:"cvc"`
+	TerminalId string `json:"terminalId"`
+}
+
+// epayOperation is the part of an epay operation response the gateway uses.
+type epayOperation struct {
+	ID        string `json:"id"`
+	InvoiceID string `json:"invoiceID"`
+	Status    string `json:"status"`
+	Code      int    `json:"code"`
+	Message   string `json:"message"`
+}
+
+func (g *EpayGateway) Authorize(ctx context.Context, charge Charge) (*GatewayResult, error) {
+	cryptogram, err := g.encryptCard(ctx, charge.Card)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt card: %w", err)
+	}
+
+	body := map[string]interface{}{
+		"amount":          json.Number(charge.Amount.Decimal()),
+		"currency":        charge.Amount.Currency,
+		"name":            charge.Card.HolderName,
+		"cryptogram":      cryptogram,
+		"invoiceId":       charge.InvoiceID,
+		"description":     charge.Description,
+		"accountId":       strconv.Itoa(charge.UserID),
+		"email":           charge.Email,
+		"phone":           charge.Phone,
+		"cardSave":        false,
+		"data":            fmt.Sprintf(`{"order_id":%d}`, charge.OrderID),
+		"postLink":        g.config.PostLink,
+		"failurePostLink": g.config.FailurePostLink,
+	}
+	if g.config.WebhookSecret != "" {
+		body["secret_hash"] = EpaySecretHash(g.config.WebhookSecret, charge.InvoiceID)
+	}
+	operation, err := g.do(ctx, http.MethodPost, "/payment/cryptopay", body)
+	if err != nil {
+		return nil, err
+	}
+	result := operation.result()
+	if result.InvoiceID == "" {
+		result.InvoiceID = charge.InvoiceID
+	}
+	return result, nil
+}
+
+func (g *EpayGateway) Capture(ctx context.Context, transactionID string, amount money.Money) (*GatewayResult, error) {
+	path := "/operation/" + url.PathEscape(transactionID) + "/charge?amount=" + url.QueryEscape(amount.Decimal())
+	return g.operation(ctx, http.MethodPost, path, transactionID, GatewayStatusCaptured)
+}
+
+func (g *EpayGateway) Refund(ctx context.Context, transactionID string, amount money.Money) (*GatewayResult, error) {
+	path := "/operation/" + url.PathEscape(transactionID) + "/refund?amount=" + url.QueryEscape(amount.Decimal())
+	return g.operation(ctx, http.MethodPost, path, transactionID, GatewayStatusRefunded)
+}
+
+func (g *EpayGateway) Void(ctx context.Context, transactionID string) (*GatewayResult, error) {
+	path := "/operation/" + url.PathEscape(transactionID) + "/cancel"
+	return g.operation(ctx, http.MethodPost, path, transactionID, GatewayStatusVoided)
+}
+
+func (g *EpayGateway) Status(ctx context.Context, invoiceID string) (*GatewayResult, error) {
+	operation, err := g.do(ctx, http.MethodGet, "/check-status/payment/transaction/"+url.PathEscape(invoiceID), nil)
+	if err != nil {
+		return nil, err
+	}
+	result := operation.result()
+	result.InvoiceID = invoiceID
+	return result, nil
+}
+
+// operation runs one of the follow-up calls on an existing transaction. These
+// answer with an empty body on success, so the status is implied by the call.
+func (g *EpayGateway) operation(ctx context.Context, method, path, transactionID, status string) (*GatewayResult, error) {
+	operation, err := g.do(ctx, method, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	result := operation.result()
+	result.TransactionID = transactionID
+	if operation.Status == "" {
+		result.Status = status
+	}
+	return result, nil
+}
+
+func (g *EpayGateway) do(ctx context.Context, method, path string, body interface{}) (*epayOperation, error) {
+	var jsonBody []byte
+	if body != nil {
+		var err error
+		jsonBody, err = json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal body: %w", err)
+		}
+	}
+
+	resp, err := g.send(ctx, method, path, jsonBody)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		// The cached token was revoked or expired early; epay did not
+		// process the request, so it is safe to send again once.
+		resp.Body.Close()
+		g.tokens.invalidate()
+		resp, err = g.send(ctx, method, path, jsonBody)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, classifyTransportError(err)
+	}
+	operation := &epayOperation{}
+	if len(bytes.TrimSpace(respBody)) > 0 {
+		if err := json.Unmarshal(respBody, operation); err != nil {
+			return nil, fmt.Errorf("failed to decode JSON response: %w", err)
+		}
+	}
+	switch {
+	case resp.StatusCode >= 500:
+		return nil, fmt.Errorf("status: %s, body: %s", resp.Status, respBody)
+	case resp.StatusCode >= 400:
+		return nil, fmt.Errorf("%w: %s", ErrDeclined, operation.describe(resp.Status))
+	}
+	return operation, nil
+}
+
+func (g *EpayGateway) send(ctx context.Context, method, path string, jsonBody []byte) (*http.Response, error) {
+	token, err := g.token(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get token: %w", err)
+	}
+
+	var reader io.Reader
+	if jsonBody != nil {
+		reader = bytes.NewReader(jsonBody)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, g.config.APIURL+path, reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, classifyTransportError(err)
+	}
+	return resp, nil
+}
+
+func (o *epayOperation) result() *GatewayResult {
+	return &GatewayResult{
+		TransactionID: o.ID,
+		InvoiceID:     o.InvoiceID,
+		Status:        epayStatus(o.Status),
+		Message:       o.Message,
+	}
+}
+
+func (o *epayOperation) describe(fallback string) string {
+	if o.Message != "" {
+		return o.Message
+	}
+	return fallback
+}
+
+// epayStatus maps epay operation statuses to gateway statuses.
+func epayStatus(status string) string {
+	switch status {
+	case "AUTH":
+		return GatewayStatusAuthorized
+	case "CHARGE":
+		return GatewayStatusCaptured
+	case "CANCEL", "CANCEL_OLD":
+		return GatewayStatusVoided
+	case "REFUND":
+		return GatewayStatusRefunded
+	case "REJECT", "FAILED":
+		return GatewayStatusDeclined
+	case "NEW", "":
+		return GatewayStatusPending
+	default:
+		return status
+	}
+}
+
+func classifyTransportError(err error) error {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return fmt.Errorf("%w: %v", ErrGatewayTimeout, err)
+	}
+	return fmt.Errorf("failed to perform request: %w", err)
+}
+
+// epayToken is a cached OAuth access token.
+type epayToken struct {
+	accessToken  string
+	refreshToken string
+}
+
+// token returns the cached access token, refreshing it shortly before it
+// expires.
+func (g *EpayGateway) token(ctx context.Context) (string, error) {
+	token, err := g.tokens.get(ctx, g.now(), g.fetchToken)
+	if err != nil {
+		return "", err
+	}
+	return token.accessToken, nil
+}
+
+// fetchToken exchanges the refresh token for a new access token, falling back
+// to the client credentials when there is none or epay no longer accepts it.
+func (g *EpayGateway) fetchToken(ctx context.Context, current epayToken, valid bool) (epayToken, time.Time, time.Time, error) {
+	requested := g.now()
+	var response *TokenResponse
+	var err error
+	if valid && current.refreshToken != "" {
+		response, err = g.requestToken(ctx, map[string]string{
+			"grant_type":    "refresh_token",
+			"refresh_token": current.refreshToken,
+		})
+	}
+	if response == nil || err != nil {
+		response, err = g.requestToken(ctx, map[string]string{
+			"grant_type": "client_credentials",
+		})
+	}
+	if err != nil {
+		return epayToken{}, time.Time{}, time.Time{}, err
+	}
+
+	lifetime := defaultTokenLifetime
+	if seconds, err := response.ExpiresIn.Int64(); err == nil && seconds > 0 {
+		lifetime = time.Duration(seconds) * time.Second
+	}
+	margin := g.config.TokenRefreshMargin
+	if margin > lifetime/2 {
+		margin = lifetime / 2
+	}
+	// Measured from when the request was sent, so time spent waiting for
+	// the response only makes the refresh earlier.
+	expiresAt := requested.Add(lifetime)
+	token := epayToken{accessToken: response.AccessToken, refreshToken: response.RefreshToken}
+	return token, expiresAt.Add(-margin), expiresAt, nil
+}
+
+func (g *EpayGateway) requestToken(ctx context.Context, grant map[string]string) (*TokenResponse, error) {
+	// Создаем буфер для тела запроса и writer для multipart формы
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	// Добавляем поля формы
+	for key, value := range grant {
+		writer.WriteField(key, value)
+	}
+	writer.WriteField("scope", epayScope)
+	writer.WriteField("client_id", g.config.ClientID)
+	writer.WriteField("client_secret", g.config.ClientSecret)
+	writer.WriteField("terminalId", g.config.TerminalID)
+
+	// Закрываем writer чтобы отправить все данные
+	err := writer.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.config.TokenURL, body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Устанавливаем заголовок Content-Type включая boundary
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, classifyTransportError(err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status: %s, body: %s ", resp.Status, respBody)
+	}
+
+	var token TokenResponse
+	err = json.Unmarshal(respBody, &token)
+	if err != nil {
+		return nil, err
+	}
+	if token.AccessToken == "" {
+		return nil, fmt.Errorf("token response has no access_token")
+	}
+
+	return &token, nil
+}
+
+// publicKey returns the cached epay public key, fetched again every
+// PublicKeyTTL. If epay cannot be reached the previous key keeps being used.
+func (g *EpayGateway) publicKey(ctx context.Context) (*rsa.PublicKey, error) {
+	return g.keys.get(ctx, g.now(), g.fetchPublicKey)
+}
+
+func (g *EpayGateway) fetchPublicKey(ctx context.Context, _ *rsa.PublicKey, _ bool) (*rsa.PublicKey, time.Time, time.Time, error) {
+	key, err := g.requestPublicKey(ctx)
+	if err != nil {
+		return nil, time.Time{}, time.Time{}, err
+	}
+	// A rotated key is only noticed on the next refresh, so the old key
+	// never expires outright; it is kept for as long as refreshes fail.
+	now := g.now()
+	return key, now.Add(g.config.PublicKeyTTL), time.Time{}, nil
+}
+
+func (g *EpayGateway) requestPublicKey(ctx context.Context) (*rsa.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, g.config.PublicKeyURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, classifyTransportError(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status: %s, body: %s ", resp.Status, body)
+	}
+	return parsePublicKey(body)
+}
+
+func parsePublicKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode PEM block containing public key")
+	}
+
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaPublicKey, ok := publicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("failed to parse RSA public key")
+	}
+
+	return rsaPublicKey, nil
+}
+
+// encryptCard builds the card cryptogram epay expects: the card details as
+// JSON, encrypted with epay's RSA public key.
+func (g *EpayGateway) encryptCard(ctx context.Context, card Card) (string, error) {
+	if err := card.Validate(); err != nil {
+		return "", err
+	}
+	publicKey, err := g.publicKey(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	jsonData, err := json.Marshal(CryptogramResponse{
+		Hpan:       card.Number,
+		ExpDate:    card.ExpDate,
+		Cvc:        card.CVC,
+		TerminalId: g.config.TerminalID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	encryptedData, err := rsa.EncryptPKCS1v15(rand.Reader, publicKey, jsonData)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(encryptedData), nil
+}
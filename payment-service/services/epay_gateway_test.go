@@ -0,0 +1,235 @@
+package services
+
+import (
+	"OnlineStore/money"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// epayCalls counts the requests made to the emulated epay endpoints.
+type epayCalls struct {
+	tokens        atomic.Int32
+	refreshes     atomic.Int32
+	keys          atomic.Int32
+	unauthorized  atomic.Int32
+	rejectedToken atomic.Value
+}
+
+// newEpayServer emulates the token, public key and payment endpoints of epay
+// and records the cryptopay request it receives.
+func newEpayServer(t *testing.T, cryptopay *map[string]interface{}) *httptest.Server {
+	server, _ := newCountingEpayServer(t, cryptopay)
+	return server
+}
+
+func newCountingEpayServer(t *testing.T, cryptopay *map[string]interface{}) (*httptest.Server, *epayCalls) {
+	calls := &epayCalls{}
+	calls.rejectedToken.Store("")
+	var mu sync.Mutex
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth2/token", func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseMultipartForm(1<<20))
+		assert.Equal(t, "client", r.FormValue("client_id"))
+		var token string
+		if r.FormValue("grant_type") == "refresh_token" {
+			assert.Equal(t, "refresh", r.FormValue("refresh_token"))
+			token = fmt.Sprintf("refreshed-%d", calls.refreshes.Add(1))
+		} else {
+			token = fmt.Sprintf("token-%d", calls.tokens.Add(1))
+		}
+		// Slow enough that concurrent payments overlap on the first fetch.
+		time.Sleep(20 * time.Millisecond)
+		json.NewEncoder(w).Encode(TokenResponse{AccessToken: token, ExpiresIn: "7200", RefreshToken: "refresh"})
+	})
+	mux.HandleFunc("/public.rsa", func(w http.ResponseWriter, r *http.Request) {
+		calls.keys.Add(1)
+		time.Sleep(20 * time.Millisecond)
+		w.Write(publicPEM)
+	})
+	mux.HandleFunc("/payment/cryptopay", func(w http.ResponseWriter, r *http.Request) {
+		if auth := r.Header.Get("Authorization"); auth == "Bearer "+calls.rejectedToken.Load().(string) {
+			calls.unauthorized.Add(1)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		require.NoError(t, json.NewDecoder(r.Body).Decode(cryptopay))
+
+		encrypted, err := base64.StdEncoding.DecodeString((*cryptopay)["cryptogram"].(string))
+		require.NoError(t, err)
+		plain, err := rsa.DecryptPKCS1v15(rand.Reader, key, encrypted)
+		require.NoError(t, err)
+		var card CryptogramResponse
+		require.NoError(t, json.Unmarshal(plain, &card))
+		if card.Hpan == FakeCardDecline {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"code": 455, "message": "card declined"}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": "op-1", "invoiceID": (*cryptopay)["invoiceId"], "status": "AUTH"})
+	})
+	mux.HandleFunc("/operation/op-1/charge", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "150.25", r.URL.Query().Get("amount"))
+	})
+	mux.HandleFunc("/operation/op-2/refund", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server, calls
+}
+
+func testEpayConfig(server *httptest.Server) EpayConfig {
+	return EpayConfig{
+		TokenURL:     server.URL + "/oauth2/token",
+		PublicKeyURL: server.URL + "/public.rsa",
+		APIURL:       server.URL,
+		ClientID:     "client",
+		ClientSecret: "secret",
+		TerminalID:   "terminal",
+		Timeout:      time.Second,
+	}
+}
+
+func TestEpayGatewayAuthorizeAndCapture(t *testing.T) {
+	var cryptopay map[string]interface{}
+	server := newEpayServer(t, &cryptopay)
+	gateway := NewEpayGateway(testEpayConfig(server))
+	amount := money.New(15025, "KZT")
+
+	result, err := gateway.Authorize(context.Background(), Charge{
+		InvoiceID: "000000000042",
+		OrderID:   7,
+		UserID:    3,
+		Amount:    amount,
+		Card:      Card{Number: "4405639704015096", ExpDate: "0125", CVC: "815"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, GatewayStatusAuthorized, result.Status)
+	assert.Equal(t, "op-1", result.TransactionID)
+	assert.Equal(t, 150.25, cryptopay["amount"])
+	assert.Equal(t, "KZT", cryptopay["currency"])
+	assert.Equal(t, "000000000042", cryptopay["invoiceId"])
+	assert.Equal(t, "3", cryptopay["accountId"])
+
+	result, err = gateway.Capture(context.Background(), "op-1", amount)
+	require.NoError(t, err)
+	assert.Equal(t, GatewayStatusCaptured, result.Status)
+}
+
+func TestEpayGatewayErrors(t *testing.T) {
+	var cryptopay map[string]interface{}
+	server := newEpayServer(t, &cryptopay)
+	config := testEpayConfig(server)
+	gateway := NewEpayGateway(config)
+
+	_, err := gateway.Authorize(context.Background(), Charge{
+		Amount: money.New(100, "KZT"),
+		Card:   Card{Number: FakeCardDecline, ExpDate: "0125", CVC: "000"},
+	})
+	assert.True(t, errors.Is(err, ErrDeclined))
+
+	_, err = gateway.Authorize(context.Background(), Charge{Amount: money.New(100, "KZT"), Card: Card{Number: "4405639704015096"}})
+	assert.True(t, errors.Is(err, ErrIncompleteCard))
+	assert.False(t, errors.Is(err, ErrDeclined))
+
+	config.Timeout = 20 * time.Millisecond
+	gateway = NewEpayGateway(config)
+	_, err = gateway.Refund(context.Background(), "op-2", money.New(100, "KZT"))
+	assert.True(t, errors.Is(err, ErrGatewayTimeout))
+}
+
+func testCharge() Charge {
+	return Charge{
+		Amount: money.New(100, "KZT"),
+		Card:   Card{Number: "4405639704015096", ExpDate: "0125", CVC: "815"},
+	}
+}
+
+func TestEpayGatewaySharesCredentials(t *testing.T) {
+	var cryptopay map[string]interface{}
+	server, calls := newCountingEpayServer(t, &cryptopay)
+	gateway := NewEpayGateway(testEpayConfig(server))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := gateway.Authorize(context.Background(), testCharge())
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), calls.tokens.Load())
+	assert.Equal(t, int32(1), calls.keys.Load())
+}
+
+func TestEpayGatewayRefreshesCredentials(t *testing.T) {
+	var cryptopay map[string]interface{}
+	server, calls := newCountingEpayServer(t, &cryptopay)
+	config := testEpayConfig(server)
+	config.TokenRefreshMargin = 5 * time.Minute
+	config.PublicKeyTTL = 3 * time.Hour
+	gateway := NewEpayGateway(config)
+	now := time.Now()
+	gateway.now = func() time.Time { return now }
+
+	_, err := gateway.Authorize(context.Background(), testCharge())
+	require.NoError(t, err)
+
+	// Within the refresh margin the refresh token is used and the key,
+	// not yet due, is reused.
+	now = now.Add(7200*time.Second - 4*time.Minute)
+	_, err = gateway.Authorize(context.Background(), testCharge())
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), calls.tokens.Load())
+	assert.Equal(t, int32(1), calls.refreshes.Load())
+	assert.Equal(t, int32(1), calls.keys.Load())
+
+	// Past its TTL the key is fetched again to pick up rotations.
+	now = now.Add(2 * time.Hour)
+	_, err = gateway.Authorize(context.Background(), testCharge())
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), calls.keys.Load())
+}
+
+func TestEpayGatewayRetriesRejectedToken(t *testing.T) {
+	var cryptopay map[string]interface{}
+	server, calls := newCountingEpayServer(t, &cryptopay)
+	gateway := NewEpayGateway(testEpayConfig(server))
+
+	_, err := gateway.Authorize(context.Background(), testCharge())
+	require.NoError(t, err)
+
+	calls.rejectedToken.Store("token-1")
+	_, err = gateway.Authorize(context.Background(), testCharge())
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), calls.unauthorized.Load())
+	assert.Equal(t, int32(2), calls.tokens.Load())
+}
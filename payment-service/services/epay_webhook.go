@@ -0,0 +1,69 @@
+package services
+
+import (
+	"OnlineStore/money"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+)
+
+var ErrInvalidCallback = errors.New("invalid payment callback")
+
+// EpayCallback is the body epay posts to postLink after a successful payment
+// and to failurePostLink after a failed one.
+type EpayCallback struct {
+	ID          string      `json:"id"`
+	DateTime    string      `json:"dateTime"`
+	InvoiceID   string      `json:"invoiceId"`
+	Amount      json.Number `json:"amount"`
+	Currency    string      `json:"currency"`
+	Terminal    string      `json:"terminal"`
+	AccountID   string      `json:"accountId"`
+	Description string      `json:"description"`
+	CardMask    string      `json:"cardMask"`
+	Reference   string      `json:"reference"`
+	Code        string      `json:"code"`
+	Reason      string      `json:"reason"`
+	ReasonCode  json.Number `json:"reasonCode"`
+	SecretHash  string      `json:"secret_hash"`
+}
+
+// EpaySecretHash is the secret_hash sent with a payment and echoed back in its
+// callbacks. It is derived per invoice, so a leaked callback cannot be
+// replayed against another payment.
+func EpaySecretHash(secret, invoiceID string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(invoiceID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyEpayCallback checks that the callback carries the secret_hash issued
+// for its invoice.
+func VerifyEpayCallback(secret string, callback *EpayCallback) error {
+	if secret == "" {
+		return errors.New("EPAY_WEBHOOK_SECRET is not set")
+	}
+	if callback.InvoiceID == "" {
+		return ErrInvalidCallback
+	}
+	expected := EpaySecretHash(secret, callback.InvoiceID)
+	if !hmac.Equal([]byte(expected), []byte(callback.SecretHash)) {
+		return ErrInvalidCallback
+	}
+	return nil
+}
+
+// Succeeded reports whether epay considers the payment successful.
+func (c *EpayCallback) Succeeded() bool {
+	return c.Code == "ok"
+}
+
+func (c *EpayCallback) Money() (money.Money, error) {
+	currency := c.Currency
+	if currency == "" {
+		currency = money.DefaultCurrency
+	}
+	return money.Parse(c.Amount.String(), currency)
+}
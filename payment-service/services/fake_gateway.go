@@ -0,0 +1,186 @@
+package services
+
+import (
+	"OnlineStore/money"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Outcome is what the fake gateway does with the next authorization.
+type Outcome string
+
+const (
+	OutcomeSuccess Outcome = "success"
+	OutcomeDecline Outcome = "decline"
+	OutcomeTimeout Outcome = "timeout"
+)
+
+// Card numbers that make the fake gateway decline or time out regardless of
+// its script, so outcomes can be chosen per request in local environments.
+const (
+	FakeCardDecline = "4000000000000002"
+	FakeCardTimeout = "4000000000000119"
+)
+
+// FakeGateway is an in-process PaymentGateway for tests and local
+// development. Authorizations follow the scripted outcomes in order, then
+// the magic card numbers, then DefaultOutcome. A timeout models a lost
+// response: the authorization is made but the caller never hears of it, as
+// when the real gateway only reports back through its callback.
+type FakeGateway struct {
+	DefaultOutcome Outcome
+	// TimeoutDelay is how long a timeout outcome blocks before failing,
+	// unless the context ends first.
+	TimeoutDelay time.Duration
+
+	mu           sync.Mutex
+	script       []Outcome
+	nextID       int
+	transactions map[string]*fakeTransaction
+}
+
+type fakeTransaction struct {
+	invoiceID  string
+	status     string
+	authorized money.Money
+	captured   money.Money
+	refunded   money.Money
+}
+
+func NewFakeGateway() *FakeGateway {
+	return &FakeGateway{
+		DefaultOutcome: OutcomeSuccess,
+		transactions:   make(map[string]*fakeTransaction),
+	}
+}
+
+// Script queues outcomes for the next authorizations.
+func (f *FakeGateway) Script(outcomes ...Outcome) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.script = append(f.script, outcomes...)
+}
+
+func (f *FakeGateway) nextOutcome(card Card) Outcome {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.script) > 0 {
+		outcome := f.script[0]
+		f.script = f.script[1:]
+		return outcome
+	}
+	switch card.Number {
+	case FakeCardDecline:
+		return OutcomeDecline
+	case FakeCardTimeout:
+		return OutcomeTimeout
+	}
+	return f.DefaultOutcome
+}
+
+func (f *FakeGateway) Authorize(ctx context.Context, charge Charge) (*GatewayResult, error) {
+	switch f.nextOutcome(charge.Card) {
+	case OutcomeDecline:
+		return nil, fmt.Errorf("%w: card declined by fake gateway", ErrDeclined)
+	case OutcomeTimeout:
+		f.authorize(charge)
+		select {
+		case <-ctx.Done():
+		case <-time.After(f.TimeoutDelay):
+		}
+		return nil, fmt.Errorf("%w: fake gateway timeout", ErrGatewayTimeout)
+	}
+	return f.authorize(charge), nil
+}
+
+func (f *FakeGateway) authorize(charge Charge) *GatewayResult {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextID++
+	id := fmt.Sprintf("fake-%d", f.nextID)
+	f.transactions[id] = &fakeTransaction{
+		invoiceID:  charge.InvoiceID,
+		status:     GatewayStatusAuthorized,
+		authorized: charge.Amount,
+		captured:   money.New(0, charge.Amount.Currency),
+		refunded:   money.New(0, charge.Amount.Currency),
+	}
+	return f.result(id)
+}
+
+func (f *FakeGateway) Capture(ctx context.Context, transactionID string, amount money.Money) (*GatewayResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	tx, ok := f.transactions[transactionID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownPayment, transactionID)
+	}
+	if tx.status != GatewayStatusAuthorized {
+		return nil, fmt.Errorf("%w: cannot capture a %s transaction", ErrDeclined, tx.status)
+	}
+	if cmp, err := amount.Cmp(tx.authorized); err != nil || cmp > 0 {
+		return nil, fmt.Errorf("%w: capture exceeds authorized amount", ErrDeclined)
+	}
+	tx.captured = amount
+	tx.status = GatewayStatusCaptured
+	return f.result(transactionID), nil
+}
+
+func (f *FakeGateway) Refund(ctx context.Context, transactionID string, amount money.Money) (*GatewayResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	tx, ok := f.transactions[transactionID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownPayment, transactionID)
+	}
+	if tx.status != GatewayStatusCaptured && tx.status != GatewayStatusRefunded {
+		return nil, fmt.Errorf("%w: cannot refund a %s transaction", ErrDeclined, tx.status)
+	}
+	refunded, err := tx.refunded.Add(amount)
+	if err != nil {
+		return nil, err
+	}
+	if cmp, err := refunded.Cmp(tx.captured); err != nil || cmp > 0 {
+		return nil, fmt.Errorf("%w: refund exceeds captured amount", ErrDeclined)
+	}
+	tx.refunded = refunded
+	tx.status = GatewayStatusRefunded
+	return f.result(transactionID), nil
+}
+
+func (f *FakeGateway) Void(ctx context.Context, transactionID string) (*GatewayResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	tx, ok := f.transactions[transactionID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownPayment, transactionID)
+	}
+	if tx.status != GatewayStatusAuthorized {
+		return nil, fmt.Errorf("%w: cannot void a %s transaction", ErrDeclined, tx.status)
+	}
+	tx.status = GatewayStatusVoided
+	return f.result(transactionID), nil
+}
+
+func (f *FakeGateway) Status(ctx context.Context, invoiceID string) (*GatewayResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for id, tx := range f.transactions {
+		if tx.invoiceID == invoiceID {
+			return f.result(id), nil
+		}
+	}
+	return nil, fmt.Errorf("%w: invoice %s", ErrUnknownPayment, invoiceID)
+}
+
+func (f *FakeGateway) result(transactionID string) *GatewayResult {
+	tx := f.transactions[transactionID]
+	return &GatewayResult{
+		TransactionID: transactionID,
+		InvoiceID:     tx.invoiceID,
+		Status:        tx.status,
+		Refunded:      tx.refunded,
+	}
+}
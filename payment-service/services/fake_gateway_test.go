@@ -0,0 +1,74 @@
+package services
+
+import (
+	"OnlineStore/money"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFakeGatewayLifecycle(t *testing.T) {
+	gateway := NewFakeGateway()
+	ctx := context.Background()
+	amount := money.New(10000, "KZT")
+
+	result, err := gateway.Authorize(ctx, Charge{InvoiceID: "000000000001", Amount: amount})
+	require.NoError(t, err)
+	assert.Equal(t, GatewayStatusAuthorized, result.Status)
+
+	result, err = gateway.Capture(ctx, result.TransactionID, amount)
+	require.NoError(t, err)
+	assert.Equal(t, GatewayStatusCaptured, result.Status)
+
+	_, err = gateway.Refund(ctx, result.TransactionID, money.New(4000, "KZT"))
+	require.NoError(t, err)
+	_, err = gateway.Refund(ctx, result.TransactionID, money.New(6001, "KZT"))
+	assert.True(t, errors.Is(err, ErrDeclined))
+
+	status, err := gateway.Status(ctx, "000000000001")
+	require.NoError(t, err)
+	assert.Equal(t, GatewayStatusRefunded, status.Status)
+
+	_, err = gateway.Void(ctx, result.TransactionID)
+	assert.True(t, errors.Is(err, ErrDeclined))
+}
+
+func TestFakeGatewayOutcomes(t *testing.T) {
+	gateway := NewFakeGateway()
+	gateway.Script(OutcomeDecline)
+	ctx := context.Background()
+	amount := money.New(100, "KZT")
+
+	_, err := gateway.Authorize(ctx, Charge{Amount: amount})
+	assert.True(t, errors.Is(err, ErrDeclined))
+
+	_, err = gateway.Authorize(ctx, Charge{Amount: amount, Card: Card{Number: FakeCardDecline}})
+	assert.True(t, errors.Is(err, ErrDeclined))
+
+	gateway.TimeoutDelay = time.Hour
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = gateway.Authorize(timeoutCtx, Charge{Amount: amount, Card: Card{Number: FakeCardTimeout}})
+	assert.True(t, errors.Is(err, ErrGatewayTimeout))
+
+	result, err := gateway.Authorize(ctx, Charge{Amount: amount})
+	require.NoError(t, err)
+	_, err = gateway.Void(ctx, result.TransactionID)
+	require.NoError(t, err)
+}
+
+func TestNewGatewayFromEnvFakeOutcome(t *testing.T) {
+	t.Setenv("PAYMENT_GATEWAY", "fake")
+	t.Setenv("FAKE_GATEWAY_OUTCOME", "decline")
+	gateway, err := NewGatewayFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, OutcomeDecline, gateway.(*FakeGateway).DefaultOutcome)
+
+	t.Setenv("FAKE_GATEWAY_OUTCOME", "declined")
+	_, err = NewGatewayFromEnv()
+	assert.Error(t, err)
+}
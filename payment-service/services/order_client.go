@@ -0,0 +1,194 @@
+package services
+
+import (
+	"OnlineStore/apierror"
+	"OnlineStore/auth"
+	"OnlineStore/money"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+var (
+	ErrOrderTransition = errors.New("order cannot change status")
+	ErrOrderNotFound   = apierror.New(apierror.NotFound, "order not found")
+	// ErrAmountMismatch is a payment that does not cover exactly the
+	// order's total.
+	ErrAmountMismatch = apierror.New(apierror.Validation, "amount must equal the order's total")
+	// ErrOrderNotPending is a payment for an order that is already paid,
+	// or cancelled or otherwise past being paid for.
+	ErrOrderNotPending = apierror.New(apierror.Conflict, "only a pending order can be paid for")
+)
+
+// Order is what the payment-service needs to know of an order.
+type Order struct {
+	ID         int         `json:"id"`
+	UserID     int         `json:"user_id"`
+	TotalPrice money.Money `json:"total_price"`
+	Status     string      `json:"status"`
+}
+
+// CheckPayable returns ErrOrderNotPending unless the order is waiting to be
+// paid for.
+func (o *Order) CheckPayable() error {
+	if o.Status != "pending" {
+		return fmt.Errorf("%w: order %d is %s", ErrOrderNotPending, o.ID, o.Status)
+	}
+	return nil
+}
+
+// CheckAmount returns ErrAmountMismatch unless amount is the order's total.
+func (o *Order) CheckAmount(amount money.Money) error {
+	if amount.Amount != o.TotalPrice.Amount || amount.CurrencyOrDefault() != o.TotalPrice.CurrencyOrDefault() {
+		return fmt.Errorf("%w: order %d totals %s, not %s", ErrAmountMismatch, o.ID, o.TotalPrice, amount)
+	}
+	return nil
+}
+
+// OrderClient reads orders from the order-service and advances them as
+// their payments settle. The Mark calls succeed without doing anything if the
+// order is already there.
+type OrderClient interface {
+	// GetOrder returns the order, or ErrOrderNotFound.
+	GetOrder(ctx context.Context, orderID, userID int) (*Order, error)
+	// MarkOrderPaid moves a pending order to paid, provided amount, the
+	// amount captured, is the order's total.
+	MarkOrderPaid(ctx context.Context, orderID, userID int, amount money.Money) error
+	// MarkOrderRefunded moves a paid or delivered order to refunded.
+	MarkOrderRefunded(ctx context.Context, orderID, userID int) error
+}
+
+type HTTPOrderClient struct {
+	baseURL string
+	client  *http.Client
+}
+
+func NewHTTPOrderClient(baseURL string) *HTTPOrderClient {
+	return &HTTPOrderClient{
+		baseURL: baseURL + "/orders",
+		client:  &http.Client{Timeout: GatewayTimeout()},
+	}
+}
+
+// NewOrderClientFromEnv talks to the order-service at ORDER_SERVICE_URL.
+func NewOrderClientFromEnv() *HTTPOrderClient {
+	return NewHTTPOrderClient(os.Getenv("ORDER_SERVICE_URL"))
+}
+
+func (c *HTTPOrderClient) MarkOrderPaid(ctx context.Context, orderID, userID int, amount money.Money) error {
+	order, err := c.GetOrder(ctx, orderID, userID)
+	if err != nil {
+		return err
+	}
+	if contains([]string{"paid", "shipped", "delivered"}, order.Status) {
+		return nil
+	}
+	if err := order.CheckAmount(amount); err != nil {
+		return err
+	}
+	// The order-service checks the amount again as it marks the order
+	// paid, in case the order was changed since.
+	body, err := json.Marshal(map[string]money.Money{"amount": amount})
+	if err != nil {
+		return err
+	}
+	return c.transition(ctx, order, userID, "pay", []string{"pending"}, body)
+}
+
+func (c *HTTPOrderClient) MarkOrderRefunded(ctx context.Context, orderID, userID int) error {
+	order, err := c.GetOrder(ctx, orderID, userID)
+	if err != nil {
+		return err
+	}
+	if order.Status == "refunded" {
+		return nil
+	}
+	return c.transition(ctx, order, userID, "refund", []string{"paid", "delivered"}, nil)
+}
+
+// transition runs action on the order if it is in one of the from statuses,
+// sending body with it if not nil.
+func (c *HTTPOrderClient) transition(ctx context.Context, order *Order, userID int, action string, from []string, body []byte) error {
+	if !contains(from, order.Status) {
+		return fmt.Errorf("%w: cannot %s order %d, it is %s", ErrOrderTransition, action, order.ID, order.Status)
+	}
+
+	url := c.baseURL + "/" + strconv.Itoa(order.ID) + "/" + action
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := c.newRequest(ctx, http.MethodPost, url, userID, reqBody)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		problem := apierror.ParseProblem(resp.StatusCode, body)
+		if problem.Type == apierror.TypePrefix+string(apierror.AmountMismatch) {
+			return fmt.Errorf("%w: %s", ErrAmountMismatch, problem.Detail)
+		}
+		return fmt.Errorf("failed to %s order %d: status: %s, detail: %s", action, order.ID, resp.Status, problem.Detail)
+	}
+	return nil
+}
+
+func (c *HTTPOrderClient) GetOrder(ctx context.Context, orderID, userID int) (*Order, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, c.baseURL+"/"+strconv.Itoa(orderID), userID, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrOrderNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("failed to get order %d: status: %s, detail: %s", orderID, resp.Status, apierror.ParseProblem(resp.StatusCode, body).Detail)
+	}
+	var order Order
+	if err := json.NewDecoder(resp.Body).Decode(&order); err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// newRequest makes a request as the payment-service itself, which the
+// order-service trusts like an admin, on behalf of userID, who is recorded
+// as the author of status changes. A body is sent as JSON.
+func (c *HTTPOrderClient) newRequest(ctx context.Context, method, url string, userID int, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set(auth.UserIDHeader, strconv.Itoa(userID))
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
+	return req, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+package services
+
+import (
+	"OnlineStore/idempotency"
+	"OnlineStore/money"
+	"OnlineStore/order-service/controllers"
+	"OnlineStore/order-service/models"
+	"OnlineStore/order-service/routes"
+	"context"
+	"database/sql"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// orders is the order-service's storage for one order. The methods the
+// client does not reach are left to the embedded nil interface. beforePay,
+// if set, runs as the order is being paid for, e.g. to change it.
+type orders struct {
+	models.OrderModel
+	order     models.Order
+	changedBy int
+	beforePay func(order *models.Order)
+}
+
+func (o *orders) GetOrderByID(id int) (*models.Order, error) {
+	if id != o.order.ID {
+		return nil, sql.ErrNoRows
+	}
+	order := o.order
+	return &order, nil
+}
+
+func (o *orders) UpdateOrderStatus(id int, status string, changedBy int) error {
+	if id != o.order.ID {
+		return sql.ErrNoRows
+	}
+	if !models.CanTransition(o.order.Status, status) {
+		return models.ErrInvalidTransition
+	}
+	o.order.Status = status
+	o.changedBy = changedBy
+	return nil
+}
+
+func (o *orders) PayOrder(id int, amount money.Money, changedBy int) error {
+	if o.beforePay != nil {
+		o.beforePay(&o.order)
+	}
+	if id == o.order.ID && o.order.Status == models.StatusPending && amount != o.order.TotalPrice {
+		return models.ErrTotalMismatch
+	}
+	return o.UpdateOrderStatus(id, models.StatusPaid, changedBy)
+}
+
+// orderService serves the order-service's routes, with its ownership checks,
+// over the given orders.
+func orderService(t *testing.T, store *orders) *HTTPOrderClient {
+	router := mux.NewRouter()
+	routes.Routes(router, controllers.NewOrderController(store), idempotency.NewMemoryStore())
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return NewHTTPOrderClient(server.URL)
+}
+
+func TestOrderClientPassesOwnershipCheck(t *testing.T) {
+	store := &orders{order: models.Order{ID: 7, UserID: 3, TotalPrice: money.New(5000, "KZT"), Status: models.StatusPending}}
+	client := orderService(t, store)
+	ctx := context.Background()
+
+	order, err := client.GetOrder(ctx, 7, 3)
+	require.NoError(t, err)
+	assert.Equal(t, Order{ID: 7, UserID: 3, TotalPrice: money.New(5000, "KZT"), Status: models.StatusPending}, *order)
+	_, err = client.GetOrder(ctx, 8, 3)
+	assert.ErrorIs(t, err, ErrOrderNotFound)
+
+	require.NoError(t, client.MarkOrderPaid(ctx, 7, 3, money.New(5000, "KZT")))
+	assert.Equal(t, models.StatusPaid, store.order.Status)
+	assert.Equal(t, 3, store.changedBy, "the payer is recorded as the author")
+	require.NoError(t, client.MarkOrderPaid(ctx, 7, 3, money.New(5000, "KZT")), "paying a paid order does nothing")
+
+	require.NoError(t, client.MarkOrderRefunded(ctx, 7, 3))
+	assert.Equal(t, models.StatusRefunded, store.order.Status)
+}
+
+func TestOrderClientRejectsInvalidTransition(t *testing.T) {
+	store := &orders{order: models.Order{ID: 7, UserID: 3, TotalPrice: money.New(5000, "KZT"), Status: models.StatusCancelled}}
+	client := orderService(t, store)
+
+	err := client.MarkOrderPaid(context.Background(), 7, 3, money.New(5000, "KZT"))
+	assert.ErrorIs(t, err, ErrOrderTransition)
+	assert.Equal(t, models.StatusCancelled, store.order.Status)
+}
+
+func TestOrderClientRejectsPartialPayment(t *testing.T) {
+	store := &orders{order: models.Order{ID: 7, UserID: 3, TotalPrice: money.New(5000, "KZT"), Status: models.StatusPending}}
+	client := orderService(t, store)
+
+	err := client.MarkOrderPaid(context.Background(), 7, 3, money.New(100, "KZT"))
+	assert.ErrorIs(t, err, ErrAmountMismatch)
+	err = client.MarkOrderPaid(context.Background(), 7, 3, money.New(5000, "USD"))
+	assert.ErrorIs(t, err, ErrAmountMismatch)
+	assert.Equal(t, models.StatusPending, store.order.Status)
+}
+
+func TestOrderClientRejectsChangedOrder(t *testing.T) {
+	store := &orders{order: models.Order{ID: 7, UserID: 3, TotalPrice: money.New(5000, "KZT"), Status: models.StatusPending}}
+	// The customer adds to the order after the client has read its total.
+	store.beforePay = func(order *models.Order) { order.TotalPrice = money.New(8000, "KZT") }
+	client := orderService(t, store)
+
+	err := client.MarkOrderPaid(context.Background(), 7, 3, money.New(5000, "KZT"))
+	assert.ErrorIs(t, err, ErrAmountMismatch)
+	assert.Equal(t, models.StatusPending, store.order.Status)
+}
@@ -1,201 +1,125 @@
 package services
 
 import (
-	"bytes"
+	"OnlineStore/apierror"
+	"OnlineStore/money"
+	"context"
 	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
-	"encoding/base64"
-	"encoding/json"
-	"encoding/pem"
+	"errors"
 	"fmt"
-	"io/ioutil"
-	"mime/multipart"
-	"net/http"
+	"math/big"
+	"os"
+	"strconv"
+	"time"
 )
 
-type TokenResponse struct {
-	AccessToken  string `json:"access_token"`
-	ExpiresIn    string `json:"expires_in"`
-	RefreshToken string `json:"refresh_token"`
-	Scope        string `json:"scope"`
-	TokenType    string `json:"token_type"`
-}
-
-type CryptogramResponse struct {
-	Hpan       string `json:"hpan"`
-	ExpDate    string `json:"expDate"`
-	Cvc        string `json:"cvc"`
-	TerminalId string `json:"terminalId"`
-}
-
-func GetToken() (string, error) {
-	tokenURL := "https://testoauth.homebank.kz/epay2/oauth2/token"
-
-	// Создаем буфер для тела запроса и writer для multipart формы
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-
-	// Добавляем поля формы
-	writer.WriteField("grant_type", "client_credentials")
-	writer.WriteField("scope", "webapi usermanagement email_send verification statement statistics payment")
-	writer.WriteField("client_id", "test")
-	writer.WriteField("client_secret", "yF587AV9Ms94qN2QShFzVR3vFnWkhjbAK3sG")
-	writer.WriteField("invoiceId", "000000001")
-	writer.WriteField("amount", "100")
-	writer.WriteField("currency", "KZT")
-	writer.WriteField("terminalId", "67e34d63-102f-4bd1-898e-370781d0074d")
-
-	// Закрываем writer чтобы отправить все данные
-	err := writer.Close()
-	if err != nil {
-		return "", err
-	}
-
-	req, err := http.NewRequest("POST", tokenURL, body)
-	if err != nil {
-		return "", err
-	}
-
-	// Устанавливаем заголовок Content-Type включая boundary
-	req.Header.Set("Content-Type", writer.FormDataContentType())
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
+const (
+	GatewayStatusAuthorized = "authorized"
+	GatewayStatusCaptured   = "captured"
+	GatewayStatusDeclined   = "declined"
+	GatewayStatusRefunded   = "refunded"
+	GatewayStatusVoided     = "voided"
+	GatewayStatusPending    = "pending"
+)
 
-	respBody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
-	}
+var (
+	ErrDeclined       = errors.New("payment declined")
+	ErrGatewayTimeout = errors.New("payment gateway timed out")
+	ErrUnknownPayment = errors.New("unknown payment")
+)
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("status: %s, body: %s ", resp.Status, respBody)
-	}
+// PaymentGateway is a card payment provider. Authorize holds the amount on
+// the card; Capture charges a held amount and Void releases it; Refund returns
+// all or part of a captured amount.
+type PaymentGateway interface {
+	Authorize(ctx context.Context, charge Charge) (*GatewayResult, error)
+	Capture(ctx context.Context, transactionID string, amount money.Money) (*GatewayResult, error)
+	Refund(ctx context.Context, transactionID string, amount money.Money) (*GatewayResult, error)
+	Void(ctx context.Context, transactionID string) (*GatewayResult, error)
+	Status(ctx context.Context, invoiceID string) (*GatewayResult, error)
+}
 
-	var token TokenResponse
-	err = json.Unmarshal(respBody, &token)
-	if err != nil {
-		return "", err
-	}
-	return token.AccessToken, nil
+type Card struct {
+	Number     string `json:"number"`
+	ExpDate    string `json:"exp_date"`
+	CVC        string `json:"cvc"`
+	HolderName string `json:"holder_name"`
 }
 
-func GetPublicKey() (*rsa.PublicKey, error) {
-	publicKeyURL := "https://testepay.homebank.kz/api/public.rsa"
-	resp, err := http.Get(publicKeyURL)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
+var ErrIncompleteCard = apierror.New(apierror.Validation, "card number, expiry date and CVC are required")
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-	block, _ := pem.Decode(body)
-	if block == nil {
-		return nil, fmt.Errorf("failed to decode PEM block containing public key")
-	}
-	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
-	if err != nil {
-		return nil, err
+// Validate checks that the card can be charged at all, before the gateway is
+// asked to.
+func (c Card) Validate() error {
+	if c.Number == "" || c.ExpDate == "" || c.CVC == "" {
+		return ErrIncompleteCard
 	}
-	rsaPublicKey, ok := publicKey.(*rsa.PublicKey)
-	if !ok {
-		return nil, fmt.Errorf("failed to parse RSA public key")
-	}
-	return rsaPublicKey, nil
+	return nil
 }
 
-func encryptData() (string, error) {
-	publicKey, err := GetPublicKey()
-	if err != nil {
-		return "", err
-	}
-	data := map[string]string{
-		"hpan":       "4405639704015096",
-		"expDate":    "0125",
-		"cvc":        "815",
-		"terminalId": "67e34d63-102f-4bd1-898e-370781d0074d",
-	}
-	jsonData, err := json.Marshal(data)
-	if err != nil {
-		return "", err
-	}
-	encryptedData, err := rsa.EncryptPKCS1v15(rand.Reader, publicKey, jsonData)
-	if err != nil {
-		return "", err
-	}
-	return base64.StdEncoding.EncodeToString(encryptedData), nil
+// Charge describes the payment the gateway is asked to authorize.
+type Charge struct {
+	InvoiceID   string
+	OrderID     int
+	UserID      int
+	Amount      money.Money
+	Description string
+	Email       string
+	Phone       string
+	Card        Card
 }
 
-type PaymentResponse struct {
-	Status    string  `json:"status"`
-	Message   string  `json:"message"`
-	PaymentID string  `json:"payment_id"`
-	Amount    float64 `json:"amount"`
-	Currency  string  `json:"currency"`
-	InvoiceID string  `json:"invoice_id"`
+type GatewayResult struct {
+	TransactionID string
+	InvoiceID     string
+	Status        string
+	Message       string
+	// Refunded is the total refunded so far, or zero when the gateway does
+	// not report it.
+	Refunded money.Money
 }
 
-func MakePayment() (*PaymentResponse, error) {
-	paymentUrl := "https://testepay.homebank.kz/api/payment/cryptopay"
-	token, err := GetToken()
+// NewInvoiceID returns a random 12-digit invoice number, the format epay
+// expects for invoiceId.
+func NewInvoiceID() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1e12))
 	if err != nil {
-		return nil, fmt.Errorf("failed to get token: %v", err)
-	}
-
-	encryptedData, err := encryptData()
-	if err != nil {
-		return nil, fmt.Errorf("failed to encrypt data: %v", err)
-	}
-
-	body := map[string]interface{}{
-		"amount":          100,
-		"currency":        "KZT",
-		"name":            "JON JONSON",
-		"cryptogram":      encryptedData,
-		"invoiceId":       "000000001",
-		"invoiceIdAlt":    "8564546",
-		"description":     "test payment",
-		"accountId":       "uuid000001",
-		"email":           "jj@example.com",
-		"phone":           "77777777777",
-		"cardSave":        true,
-		"data":            `{\"statement\":{\"name\":\"Arman     Ali\",\"invoiceID\":\"80000016\"}}`,
-		"postLink":        "https://testmerchant/order/1123",
-		"failurePostLink": "https://testmerchant/order/1123/fail",
-	}
-	jsonBody, err := json.Marshal(body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal body: %v", err)
-	}
-
-	req, err := http.NewRequest("POST", paymentUrl, bytes.NewBuffer(jsonBody))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %v", err)
+		return "", err
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+token)
+	return fmt.Sprintf("%012d", n.Int64()), nil
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to perform request: %v", err)
+// NewGatewayFromEnv builds the gateway selected by PAYMENT_GATEWAY: "epay"
+// (the default) or "fake" for tests and local development.
+func NewGatewayFromEnv() (PaymentGateway, error) {
+	switch name := os.Getenv("PAYMENT_GATEWAY"); name {
+	case "", "epay":
+		config, err := EpayConfigFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		return NewEpayGateway(config), nil
+	case "fake":
+		gateway := NewFakeGateway()
+		switch outcome := Outcome(os.Getenv("FAKE_GATEWAY_OUTCOME")); outcome {
+		case "":
+		case OutcomeSuccess, OutcomeDecline, OutcomeTimeout:
+			gateway.DefaultOutcome = outcome
+		default:
+			return nil, fmt.Errorf("unknown FAKE_GATEWAY_OUTCOME %q, want success, decline or timeout", outcome)
+		}
+		return gateway, nil
+	default:
+		return nil, fmt.Errorf("unknown PAYMENT_GATEWAY %q", name)
 	}
-	defer resp.Body.Close()
-	var paymentResponse PaymentResponse
+}
 
-	if err = json.NewDecoder(resp.Body).Decode(&paymentResponse); err != nil {
-		return nil, fmt.Errorf("failed to decode JSON response: %v", err)
-	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("status: %s, body: %s", resp.Status, paymentResponse)
+// GatewayTimeout is the deadline for a single call to the payment gateway,
+// read from PAYMENT_GATEWAY_TIMEOUT in seconds.
+func GatewayTimeout() time.Duration {
+	seconds, err := strconv.Atoi(os.Getenv("PAYMENT_GATEWAY_TIMEOUT"))
+	if err != nil || seconds <= 0 {
+		return 30 * time.Second
 	}
-	fmt.Println(paymentResponse)
-	return &paymentResponse, nil
+	return time.Duration(seconds) * time.Second
 }
@@ -1,12 +1,19 @@
 package controllers
 
 import (
+	"OnlineStore/apierror"
+	"OnlineStore/money"
+	"OnlineStore/pagination"
 	"OnlineStore/product-service/models"
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"github.com/gorilla/mux"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type ProductController struct {
@@ -17,19 +24,29 @@ func NewProductController(userModel models.ProductModel) *ProductController {
 	return &ProductController{ProductModel: userModel}
 }
 
+// GetProductsController lists a page of the products matching the search
+// filters in the query.
 func (pc *ProductController) GetProductsController(writer http.ResponseWriter, request *http.Request) {
-	products, err := pc.ProductModel.GetProducts()
+	query := request.URL.Query()
+	page, err := pagination.FromQuery(query, models.ProductSorts...)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		apierror.Write(writer, request, err)
 		return
 	}
-	if len(products) == 0 {
-		writer.WriteHeader(http.StatusNotFound)
+	filter, err := productFilterFromQuery(query)
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+
+	products, total, err := pc.ProductModel.ListProducts(filter, page)
+	if err != nil {
+		apierror.Write(writer, request, err)
 		return
 	}
-	jsonProducts, err := json.Marshal(products)
+	jsonProducts, err := json.Marshal(pagination.NewPage(products, total, page))
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		apierror.Write(writer, request, err)
 		return
 	}
 	writer.Header().Set("Content-Type", "application/json")
@@ -37,27 +54,103 @@ func (pc *ProductController) GetProductsController(writer http.ResponseWriter, r
 	_, err = writer.Write(jsonProducts)
 }
 
+// productFilterFromQuery reads the product search filters: ids (comma
+// separated), name (partial, case-insensitive), category, min_price and max_price in currency (default
+// KZT), in_stock, and added_from and added_to as inclusive dates.
+func productFilterFromQuery(query url.Values) (models.ProductFilter, error) {
+	filter := models.ProductFilter{
+		Name:     strings.TrimSpace(query.Get("name")),
+		Category: query.Get("category"),
+	}
+
+	if ids := query.Get("ids"); ids != "" {
+		for _, id := range strings.Split(ids, ",") {
+			n, err := strconv.Atoi(strings.TrimSpace(id))
+			if err != nil {
+				return filter, apierror.New(apierror.Validation, "ids must be a comma-separated list of product IDs")
+			}
+			filter.IDs = append(filter.IDs, n)
+		}
+	}
+
+	currency := query.Get("currency")
+	if currency == "" {
+		currency = money.DefaultCurrency
+	}
+	var err error
+	if filter.MinPrice, err = priceFromQuery(query, "min_price", currency); err != nil {
+		return filter, err
+	}
+	if filter.MaxPrice, err = priceFromQuery(query, "max_price", currency); err != nil {
+		return filter, err
+	}
+	if filter.MinPrice != nil && filter.MaxPrice != nil && filter.MinPrice.Amount > filter.MaxPrice.Amount {
+		return filter, apierror.New(apierror.Validation, "min_price must not exceed max_price")
+	}
+
+	if inStock := query.Get("in_stock"); inStock != "" {
+		if filter.InStock, err = strconv.ParseBool(inStock); err != nil {
+			return filter, apierror.New(apierror.Validation, "in_stock must be true or false")
+		}
+	}
+
+	if from := query.Get("added_from"); from != "" {
+		date, err := time.Parse(time.DateOnly, from)
+		if err != nil {
+			return filter, apierror.New(apierror.Validation, "added_from must be a date like 2024-01-31")
+		}
+		filter.AddedFrom = date
+	}
+	if to := query.Get("added_to"); to != "" {
+		date, err := time.Parse(time.DateOnly, to)
+		if err != nil {
+			return filter, apierror.New(apierror.Validation, "added_to must be a date like 2024-01-31")
+		}
+		filter.AddedBefore = date.AddDate(0, 0, 1)
+	}
+	if !filter.AddedFrom.IsZero() && !filter.AddedBefore.IsZero() && !filter.AddedFrom.Before(filter.AddedBefore) {
+		return filter, apierror.New(apierror.Validation, "added_from must not be after added_to")
+	}
+	return filter, nil
+}
+
+// priceFromQuery reads the non-negative price in param, or nil if it is not
+// given.
+func priceFromQuery(query url.Values, param, currency string) (*money.Money, error) {
+	value := query.Get(param)
+	if value == "" {
+		return nil, nil
+	}
+	price, err := money.Parse(value, currency)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", param, err)
+	}
+	if price.IsNegative() {
+		return nil, apierror.New(apierror.Validation, param+" must not be negative")
+	}
+	return &price, nil
+}
+
 func (pc *ProductController) GetProductByIDController(writer http.ResponseWriter, request *http.Request) {
 	vars := mux.Vars(request)
 	id, err := strconv.Atoi(vars["id"])
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		apierror.Write(writer, request, apierror.New(apierror.Validation, "id must be a number"))
 		return
 	}
 
 	product, err := pc.ProductModel.GetProductByID(id)
+	if err == sql.ErrNoRows {
+		err = models.ErrProductNotFound
+	}
 	if err != nil {
-		if err == sql.ErrNoRows {
-			writer.WriteHeader(http.StatusNotFound)
-			return
-		}
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		apierror.Write(writer, request, err)
 		return
 	}
 
 	jsonProduct, err := json.Marshal(product)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		apierror.Write(writer, request, err)
 		return
 	}
 	writer.Header().Set("Content-Type", "application/json")
@@ -69,13 +162,13 @@ func (pc *ProductController) CreateProductController(writer http.ResponseWriter,
 	var product models.Product
 	err := json.NewDecoder(request.Body).Decode(&product)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		apierror.Write(writer, request, apierror.Wrap(apierror.Validation, "invalid JSON body", err))
 		return
 	}
 
 	err = pc.ProductModel.CreateProduct(product)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		apierror.Write(writer, request, err)
 		return
 	}
 	writer.WriteHeader(http.StatusCreated)
@@ -85,20 +178,20 @@ func (pc *ProductController) UpdateProductController(writer http.ResponseWriter,
 	vars := mux.Vars(request)
 	id, err := strconv.Atoi(vars["id"])
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		apierror.Write(writer, request, apierror.New(apierror.Validation, "id must be a number"))
 		return
 	}
 	var product models.Product
 	err = json.NewDecoder(request.Body).Decode(&product)
 	product.ID = id
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		apierror.Write(writer, request, apierror.Wrap(apierror.Validation, "invalid JSON body", err))
 		return
 	}
 
 	err = pc.ProductModel.UpdateProduct(product)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		apierror.Write(writer, request, err)
 		return
 	}
 	writer.WriteHeader(http.StatusOK)
@@ -108,59 +201,98 @@ func (pc *ProductController) DeleteProductController(writer http.ResponseWriter,
 	vars := mux.Vars(request)
 	id, err := strconv.Atoi(vars["id"])
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		apierror.Write(writer, request, apierror.New(apierror.Validation, "id must be a number"))
 		return
 	}
 
 	err = pc.ProductModel.DeleteProduct(id)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		apierror.Write(writer, request, err)
 		return
 	}
 	writer.WriteHeader(http.StatusOK)
 }
 
+// SearchProductController ranks the products matching the full-text search
+// terms in q, narrowed by the same filters as GetProductsController. If
+// nothing matches it suggests similarly spelled product names. Without q it
+// lists products like GetProductsController.
 func (pc *ProductController) SearchProductController(writer http.ResponseWriter, request *http.Request) {
-	name := request.URL.Query().Get("name")
-	category := request.URL.Query().Get("category")
-	if name != "" {
-		products, err := pc.ProductModel.GetProductByName(name)
-		if err != nil {
-			http.Error(writer, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		if len(products) == 0 {
-			writer.WriteHeader(http.StatusNotFound)
-			return
-		}
-		jsonProducts, err := json.Marshal(products)
-		if err != nil {
-			http.Error(writer, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		writer.Header().Set("Content-Type", "application/json")
-		writer.WriteHeader(http.StatusOK)
-		_, err = writer.Write(jsonProducts)
-	} else if category != "" {
-		products, err := pc.ProductModel.GetProductByCategory(category)
+	query := request.URL.Query()
+	terms := strings.TrimSpace(query.Get("q"))
+	if terms == "" {
+		pc.GetProductsController(writer, request)
+		return
+	}
+	page, err := pagination.FromQuery(query, models.ProductSearchSorts...)
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	filter, err := productFilterFromQuery(query)
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+
+	matches, total, err := pc.ProductModel.SearchProducts(terms, filter, page)
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	results := models.ProductSearchResults{Page: pagination.NewPage(matches, total, page)}
+	if total == 0 {
+		results.Suggestions, err = pc.ProductModel.SuggestProductNames(terms, defaultSuggestions)
 		if err != nil {
-			http.Error(writer, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		if len(products) == 0 {
-			writer.WriteHeader(http.StatusNotFound)
+			apierror.Write(writer, request, err)
 			return
 		}
-		jsonProducts, err := json.Marshal(products)
-		if err != nil {
-			http.Error(writer, err.Error(), http.StatusInternalServerError)
+	}
+	jsonResults, err := json.Marshal(results)
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	_, err = writer.Write(jsonResults)
+}
+
+const (
+	defaultSuggestions = 5
+	maxSuggestions     = 20
+)
+
+// SuggestProductsController returns up to limit product names similar to q,
+// tolerating typos, for search boxes to complete or correct.
+func (pc *ProductController) SuggestProductsController(writer http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+	term := strings.TrimSpace(query.Get("q"))
+	if term == "" {
+		apierror.Write(writer, request, apierror.New(apierror.Validation, "q is required"))
+		return
+	}
+	limit := defaultSuggestions
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxSuggestions {
+			apierror.Write(writer, request, apierror.New(apierror.Validation, fmt.Sprintf("limit must be between 1 and %d", maxSuggestions)))
 			return
 		}
-		writer.Header().Set("Content-Type", "application/json")
-		writer.WriteHeader(http.StatusOK)
-		_, err = writer.Write(jsonProducts)
-	} else {
-		http.Error(writer, "Bad request", http.StatusBadRequest)
+		limit = n
+	}
+
+	names, err := pc.ProductModel.SuggestProductNames(term, limit)
+	if err != nil {
+		apierror.Write(writer, request, err)
 		return
 	}
+	jsonNames, err := json.Marshal(names)
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	_, err = writer.Write(jsonNames)
 }
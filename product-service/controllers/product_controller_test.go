@@ -1,12 +1,16 @@
 package controllers
 
 import (
+	"OnlineStore/money"
+	"OnlineStore/pagination"
 	"OnlineStore/product-service/models"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
+	"time"
 
 	"database/sql"
 	"github.com/gorilla/mux"
@@ -15,11 +19,47 @@ import (
 
 // MockProductModel is a mock implementation of the ProductModel interface
 type MockProductModel struct {
-	Products []*models.Product
+	Products    []*models.Product
+	Suggestions []string
 }
 
-func (m *MockProductModel) GetProducts() ([]*models.Product, error) {
-	return m.Products, nil
+func (m *MockProductModel) ListProducts(filter models.ProductFilter, page pagination.Params) ([]*models.Product, int, error) {
+	var products []*models.Product
+	for _, product := range m.Products {
+		if filter.Name != "" && !strings.Contains(strings.ToLower(product.Name), strings.ToLower(filter.Name)) ||
+			filter.Category != "" && product.Category != filter.Category ||
+			filter.MinPrice != nil && product.Price.Amount < filter.MinPrice.Amount ||
+			filter.MaxPrice != nil && product.Price.Amount > filter.MaxPrice.Amount ||
+			filter.InStock && product.Quantity <= 0 {
+			continue
+		}
+		products = append(products, product)
+	}
+	total := len(products)
+	products = products[min(page.Offset, total):min(page.Offset+page.Limit, total)]
+	return products, total, nil
+}
+
+// SearchProducts matches products whose name or description contains terms.
+func (m *MockProductModel) SearchProducts(terms string, filter models.ProductFilter, page pagination.Params) ([]*models.ProductMatch, int, error) {
+	products, _, err := m.ListProducts(filter, pagination.Params{Limit: len(m.Products)})
+	if err != nil {
+		return nil, 0, err
+	}
+	var matches []*models.ProductMatch
+	for _, product := range products {
+		text := strings.ToLower(product.Name + " " + product.Description)
+		if strings.Contains(text, strings.ToLower(terms)) {
+			matches = append(matches, &models.ProductMatch{Product: *product, Rank: 1, Snippet: product.Name})
+		}
+	}
+	total := len(matches)
+	matches = matches[min(page.Offset, total):min(page.Offset+page.Limit, total)]
+	return matches, total, nil
+}
+
+func (m *MockProductModel) SuggestProductNames(term string, limit int) ([]string, error) {
+	return m.Suggestions[:min(limit, len(m.Suggestions))], nil
 }
 
 func (m *MockProductModel) CreateProduct(product models.Product) error {
@@ -56,31 +96,11 @@ func (m *MockProductModel) DeleteProduct(id int) error {
 	return sql.ErrNoRows
 }
 
-func (m *MockProductModel) GetProductByName(name string) ([]*models.Product, error) {
-	var products []*models.Product
-	for _, product := range m.Products {
-		if product.Name == name {
-			products = append(products, product)
-		}
-	}
-	return products, nil
-}
-
-func (m *MockProductModel) GetProductByCategory(category string) ([]*models.Product, error) {
-	var products []*models.Product
-	for _, product := range m.Products {
-		if product.Category == category {
-			products = append(products, product)
-		}
-	}
-	return products, nil
-}
-
 func TestGetProductsController(t *testing.T) {
 	mockModel := &MockProductModel{
 		Products: []*models.Product{
-			{ID: 1, Name: "Product1", Description: "Description1", Price: 10.0, Category: "Category1", Quantity: 100},
-			{ID: 2, Name: "Product2", Description: "Description2", Price: 20.0, Category: "Category2", Quantity: 200},
+			{ID: 1, Name: "Product1", Description: "Description1", Price: money.New(1000, "KZT"), Category: "Category1", Quantity: 100},
+			{ID: 2, Name: "Product2", Description: "Description2", Price: money.New(2000, "KZT"), Category: "Category2", Quantity: 200},
 		},
 	}
 	controller := NewProductController(mockModel)
@@ -96,20 +116,38 @@ func TestGetProductsController(t *testing.T) {
 
 	assert.Equal(t, http.StatusOK, rr.Code)
 
-	var products []*models.Product
-	err = json.Unmarshal(rr.Body.Bytes(), &products)
+	var page pagination.Page[*models.Product]
+	err = json.Unmarshal(rr.Body.Bytes(), &page)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	assert.Equal(t, 2, len(products))
+	assert.Equal(t, 2, len(page.Items))
+	assert.Equal(t, 2, page.Total)
+
+	// Test filtering and paging past the end
+	req, err = http.NewRequest("GET", "/products?category=Category2&offset=5", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	err = json.Unmarshal(rr.Body.Bytes(), &page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 0, len(page.Items))
+	assert.Equal(t, 1, page.Total)
+	assert.Nil(t, page.Next)
 }
 
 func TestCreateProductController(t *testing.T) {
 	mockModel := &MockProductModel{}
 	controller := NewProductController(mockModel)
 
-	newProduct := models.Product{Name: "NewProduct", Description: "NewDescription", Price: 30.0, Category: "NewCategory", Quantity: 300}
+	newProduct := models.Product{Name: "NewProduct", Description: "NewDescription", Price: money.New(3000, "KZT"), Category: "NewCategory", Quantity: 300}
 	productJson, _ := json.Marshal(newProduct)
 
 	req, err := http.NewRequest("POST", "/products", strings.NewReader(string(productJson)))
@@ -130,7 +168,7 @@ func TestCreateProductController(t *testing.T) {
 func TestGetProductByIDController(t *testing.T) {
 	mockModel := &MockProductModel{
 		Products: []*models.Product{
-			{ID: 1, Name: "Product1", Description: "Description1", Price: 10.0, Category: "Category1", Quantity: 100},
+			{ID: 1, Name: "Product1", Description: "Description1", Price: money.New(1000, "KZT"), Category: "Category1", Quantity: 100},
 		},
 	}
 	controller := NewProductController(mockModel)
@@ -159,12 +197,12 @@ func TestGetProductByIDController(t *testing.T) {
 func TestUpdateProductController(t *testing.T) {
 	mockModel := &MockProductModel{
 		Products: []*models.Product{
-			{ID: 1, Name: "Product1", Description: "Description1", Price: 10.0, Category: "Category1", Quantity: 100},
+			{ID: 1, Name: "Product1", Description: "Description1", Price: money.New(1000, "KZT"), Category: "Category1", Quantity: 100},
 		},
 	}
 	controller := NewProductController(mockModel)
 
-	updatedProduct := models.Product{ID: 1, Name: "UpdatedProduct", Description: "UpdatedDescription", Price: 15.0, Category: "UpdatedCategory", Quantity: 150}
+	updatedProduct := models.Product{ID: 1, Name: "UpdatedProduct", Description: "UpdatedDescription", Price: money.New(1500, "KZT"), Category: "UpdatedCategory", Quantity: 150}
 	productJson, _ := json.Marshal(updatedProduct)
 
 	req, err := http.NewRequest("PUT", "/products/1", strings.NewReader(string(productJson)))
@@ -185,7 +223,7 @@ func TestUpdateProductController(t *testing.T) {
 func TestDeleteProductController(t *testing.T) {
 	mockModel := &MockProductModel{
 		Products: []*models.Product{
-			{ID: 1, Name: "Product1", Description: "Description1", Price: 10.0, Category: "Category1", Quantity: 100},
+			{ID: 1, Name: "Product1", Description: "Description1", Price: money.New(1000, "KZT"), Category: "Category1", Quantity: 100},
 		},
 	}
 	controller := NewProductController(mockModel)
@@ -207,50 +245,169 @@ func TestDeleteProductController(t *testing.T) {
 func TestSearchProductController(t *testing.T) {
 	mockModel := &MockProductModel{
 		Products: []*models.Product{
-			{ID: 1, Name: "Product1", Description: "Description1", Price: 10.0, Category: "Category1", Quantity: 100},
-			{ID: 2, Name: "Product2", Description: "Description2", Price: 20.0, Category: "Category2", Quantity: 200},
+			{ID: 1, Name: "Red Mug", Price: money.New(150000, "KZT"), Category: "Kitchen", Quantity: 10},
+			{ID: 2, Name: "Blue mug", Price: money.New(250000, "KZT"), Category: "Kitchen", Quantity: 0},
+			{ID: 3, Name: "Mug rack", Price: money.New(900000, "KZT"), Category: "Furniture", Quantity: 3},
+			{ID: 4, Name: "Teapot", Price: money.New(400000, "KZT"), Category: "Kitchen", Quantity: 5},
 		},
 	}
 	controller := NewProductController(mockModel)
+	router := mux.NewRouter()
+	router.HandleFunc("/products/search", controller.SearchProductController).Methods("GET")
 
-	// Test search by name
-	req, err := http.NewRequest("GET", "/products/search?name=Product1", nil)
+	search := func(query string) (int, []int) {
+		req, err := http.NewRequest("GET", "/products/search?"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			return rr.Code, nil
+		}
+		var page pagination.Page[*models.Product]
+		if err := json.Unmarshal(rr.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+		var ids []int
+		for _, product := range page.Items {
+			ids = append(ids, product.ID)
+		}
+		return rr.Code, ids
+	}
+
+	tests := []struct {
+		query string
+		code  int
+		ids   []int
+	}{
+		{"name=mug", http.StatusOK, []int{1, 2, 3}},
+		{"name=MUG&category=Kitchen", http.StatusOK, []int{1, 2}},
+		{"name=mug&category=Kitchen&in_stock=true", http.StatusOK, []int{1}},
+		{"min_price=2000&max_price=4000", http.StatusOK, []int{2, 4}},
+		{"category=Kitchen&max_price=1500.00", http.StatusOK, []int{1}},
+		{"name=mug&limit=2", http.StatusOK, []int{1, 2}},
+		{"name=nothing", http.StatusOK, nil},
+		{"min_price=abc", http.StatusBadRequest, nil},
+		{"min_price=-1", http.StatusBadRequest, nil},
+		{"min_price=5000&max_price=1000", http.StatusBadRequest, nil},
+		{"in_stock=maybe", http.StatusBadRequest, nil},
+		{"added_from=31-01-2024", http.StatusBadRequest, nil},
+		{"added_from=2024-02-01&added_to=2024-01-31", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		code, ids := search(tt.query)
+		assert.Equal(t, tt.code, code, tt.query)
+		assert.Equal(t, tt.ids, ids, tt.query)
+	}
+}
+
+func TestProductFilterFromQuery(t *testing.T) {
+	query, err := url.ParseQuery("name=+mug+&min_price=10.5&currency=USD&added_from=2024-01-01&added_to=2024-01-31")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter, err := productFilterFromQuery(query)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	rr := httptest.NewRecorder()
+	assert.Equal(t, "mug", filter.Name)
+	assert.Equal(t, money.New(1050, "USD"), *filter.MinPrice)
+	assert.Nil(t, filter.MaxPrice)
+	assert.Equal(t, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), filter.AddedFrom)
+	// added_to is inclusive, so the bound is the start of the next day.
+	assert.Equal(t, time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), filter.AddedBefore)
+}
+
+func TestSearchProductControllerFullText(t *testing.T) {
+	mockModel := &MockProductModel{
+		Products: []*models.Product{
+			{ID: 1, Name: "Red Mug", Description: "Ceramic, 300 ml", Price: money.New(150000, "KZT"), Category: "Kitchen", Quantity: 10},
+			{ID: 2, Name: "Teapot", Description: "Ceramic, 1 l", Price: money.New(400000, "KZT"), Category: "Kitchen", Quantity: 0},
+		},
+		Suggestions: []string{"Red Mug", "Teapot"},
+	}
+	controller := NewProductController(mockModel)
 	router := mux.NewRouter()
 	router.HandleFunc("/products/search", controller.SearchProductController).Methods("GET")
-	router.ServeHTTP(rr, req)
-
-	assert.Equal(t, http.StatusOK, rr.Code)
 
-	var products []*models.Product
-	err = json.Unmarshal(rr.Body.Bytes(), &products)
-	if err != nil {
-		t.Fatal(err)
+	search := func(query string) (*httptest.ResponseRecorder, models.ProductSearchResults) {
+		req, err := http.NewRequest("GET", "/products/search?"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		var results models.ProductSearchResults
+		if rr.Code == http.StatusOK {
+			if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rr, results
 	}
 
-	assert.Equal(t, 1, len(products))
-	assert.Equal(t, "Product1", products[0].Name)
+	rr, results := search("q=ceramic")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, 2, results.Total)
+	assert.Equal(t, "Red Mug", results.Items[0].Name)
+	assert.Equal(t, "Red Mug", results.Items[0].Snippet)
+	assert.Empty(t, results.Suggestions)
 
-	// Test search by category
-	req, err = http.NewRequest("GET", "/products/search?category=Category2", nil)
-	if err != nil {
-		t.Fatal(err)
-	}
+	// Filters narrow full-text matches too
+	rr, results = search("q=ceramic&in_stock=true")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, 1, results.Total)
+	assert.Equal(t, 1, results.Items[0].ID)
 
-	rr = httptest.NewRecorder()
-	router.ServeHTTP(rr, req)
+	// Nothing matched, so similar names are suggested
+	rr, results = search("q=teapott")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, 0, results.Total)
+	assert.Empty(t, results.Items)
+	assert.Equal(t, []string{"Red Mug", "Teapot"}, results.Suggestions)
 
+	rr, _ = search("q=ceramic&sort=relevance&order=desc")
 	assert.Equal(t, http.StatusOK, rr.Code)
 
-	err = json.Unmarshal(rr.Body.Bytes(), &products)
-	if err != nil {
-		t.Fatal(err)
-	}
+	// relevance is only a sort key for full-text search
+	rr, _ = search("name=mug&sort=relevance")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
 
-	assert.Equal(t, 1, len(products))
-	assert.Equal(t, "Product2", products[0].Name)
+func TestSuggestProductsController(t *testing.T) {
+	mockModel := &MockProductModel{Suggestions: []string{"Red Mug", "Mug rack", "Teapot"}}
+	controller := NewProductController(mockModel)
+	router := mux.NewRouter()
+	router.HandleFunc("/products/suggest", controller.SuggestProductsController).Methods("GET")
+
+	tests := []struct {
+		query string
+		code  int
+		names []string
+	}{
+		{"q=mgu", http.StatusOK, []string{"Red Mug", "Mug rack", "Teapot"}},
+		{"q=mgu&limit=2", http.StatusOK, []string{"Red Mug", "Mug rack"}},
+		{"q=+", http.StatusBadRequest, nil},
+		{"q=mgu&limit=0", http.StatusBadRequest, nil},
+		{"q=mgu&limit=21", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/products/suggest?"+tt.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		assert.Equal(t, tt.code, rr.Code, tt.query)
+		if tt.code == http.StatusOK {
+			var names []string
+			if err := json.Unmarshal(rr.Body.Bytes(), &names); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.names, names, tt.query)
+		}
+	}
 }
@@ -0,0 +1,65 @@
+package controllers
+
+import (
+	"OnlineStore/apierror"
+	"OnlineStore/auth"
+	"OnlineStore/product-service/models"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+)
+
+// ReservationController lets other services hold stock. The api-gateway
+// does not route to it, and it only answers callers acting as admin.
+type ReservationController struct {
+	ReservationModel models.ReservationModel
+}
+
+func NewReservationController(reservationModel models.ReservationModel) *ReservationController {
+	return &ReservationController{ReservationModel: reservationModel}
+}
+
+type reservationInput struct {
+	Items []models.ReservedItem `json:"items"`
+}
+
+// ReserveStockController makes the reservation hold exactly the items in the
+// body and returns them with the products' current prices.
+func (rc *ReservationController) ReserveStockController(writer http.ResponseWriter, request *http.Request) {
+	if !auth.CallerFromRequest(request).IsAdmin() {
+		apierror.Write(writer, request, apierror.New(apierror.Forbidden, "only services may reserve stock"))
+		return
+	}
+	var input reservationInput
+	err := json.NewDecoder(request.Body).Decode(&input)
+	if err != nil {
+		apierror.Write(writer, request, apierror.Wrap(apierror.Validation, "invalid JSON body", err))
+		return
+	}
+	reservation, err := rc.ReservationModel.ReserveStock(mux.Vars(request)["key"], input.Items)
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	jsonReservation, err := json.Marshal(reservation)
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	_, err = writer.Write(jsonReservation)
+}
+
+func (rc *ReservationController) ReleaseStockController(writer http.ResponseWriter, request *http.Request) {
+	if !auth.CallerFromRequest(request).IsAdmin() {
+		apierror.Write(writer, request, apierror.New(apierror.Forbidden, "only services may reserve stock"))
+		return
+	}
+	err := rc.ReservationModel.ReleaseStock(mux.Vars(request)["key"])
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	writer.WriteHeader(http.StatusOK)
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	db "OnlineStore"
+	"OnlineStore/apierror"
+	"OnlineStore/outbox"
 	"OnlineStore/product-service/controllers"
 	"OnlineStore/product-service/repository"
 	"OnlineStore/product-service/routes"
@@ -22,28 +24,32 @@ func main() {
 		log.Println("Error loading .env file")
 	}
 
-	database, err := db.InitializeDB()
+	database, err := db.InitializeDB("product")
 	if err != nil {
 		log.Fatalf("Error initializing database: %v", err)
 	}
 
-	// Uncomment to run migrations
-	// if err := db.MigrateUp(database); err != nil {
-	//     log.Fatalf("Error running migrations: %v", err)
-	// }
+	if db.MigrationsEnabled() {
+		if err := db.MigrateUp(database, "product"); err != nil {
+			log.Fatalf("Error running migrations: %v", err)
+		}
+	}
 
 	productModel := repository.NewProductRepository(database)
 	productController := controllers.NewProductController(productModel)
+	reservationController := controllers.NewReservationController(repository.NewReservationRepository(database))
 
 	router := mux.NewRouter()
+	apierror.Routes(router)
 	routes.Routes(router, productController)
+	routes.ReservationRoutes(router, reservationController)
 
 	corsHandler := cors.New(cors.Options{
 		AllowedOrigins:   []string{os.Getenv("BASE_URL")},
 		AllowedMethods:   []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete},
-		AllowedHeaders:   []string{"Authorization", "Content-Type"},
+		AllowedHeaders:   []string{"Authorization", "Content-Type", apierror.RequestIDHeader},
 		AllowCredentials: true,
-	}).Handler(router)
+	}).Handler(apierror.RequestID(router))
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -54,6 +60,12 @@ func main() {
 		Handler: corsHandler,
 	}
 
+	relayCtx, stopRelay := context.WithCancel(context.Background())
+	defer stopRelay()
+	if err := outbox.StartRelay(relayCtx, database); err != nil {
+		log.Fatalf("Error configuring outbox broker: %v", err)
+	}
+
 	go gracefulShutdown(server)
 
 	log.Printf("Server is starting on port %s\n", port)
@@ -0,0 +1,25 @@
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+-- Prices are BIGINT minor units in an ISO 4217 currency. Names weigh more
+-- than descriptions when ranking search matches.
+CREATE TABLE IF NOT EXISTS products
+(
+    id          SERIAL PRIMARY KEY,
+    name        VARCHAR(50) NOT NULL,
+    description TEXT        NOT NULL DEFAULT '',
+    price       BIGINT      NOT NULL CHECK (price >= 0),
+    currency    CHAR(3)     NOT NULL DEFAULT 'KZT',
+    category    VARCHAR(50) NOT NULL DEFAULT '',
+    quantity    INT         NOT NULL DEFAULT 0 CHECK (quantity >= 0),
+    date_added  TIMESTAMP   NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    search      TSVECTOR GENERATED ALWAYS AS (
+        setweight(to_tsvector('english', name), 'A') ||
+        setweight(to_tsvector('english', description), 'B')
+        ) STORED
+);
+
+CREATE INDEX IF NOT EXISTS idx_products_name ON products (name);
+CREATE INDEX IF NOT EXISTS idx_products_category ON products (category);
+CREATE INDEX IF NOT EXISTS idx_products_search ON products USING GIN (search);
+-- Serves typo-tolerant suggestions and partial name matches.
+CREATE INDEX IF NOT EXISTS idx_products_name_trgm ON products USING GIN (name gin_trgm_ops);
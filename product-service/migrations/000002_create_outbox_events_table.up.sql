@@ -0,0 +1,15 @@
+-- Domain events waiting to be relayed to the broker. Each is written in the
+-- same transaction as the change it describes; published_at is set once the
+-- relay has delivered it.
+CREATE TABLE IF NOT EXISTS outbox_events
+(
+    id           BIGSERIAL PRIMARY KEY,
+    type         VARCHAR(50) NOT NULL,
+    aggregate_id INT         NOT NULL,
+    payload      JSONB       NOT NULL,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    published_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_outbox_events_unpublished ON outbox_events (id)
+    WHERE published_at IS NULL;
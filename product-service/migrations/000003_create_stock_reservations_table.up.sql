@@ -0,0 +1,52 @@
+-- Stock held for another service, such as the order-service's orders, under
+-- a key the holder chooses. A released reservation keeps its row, without
+-- items, so a late or repeated request cannot take the stock again.
+CREATE TABLE IF NOT EXISTS stock_reservations
+(
+    key         VARCHAR(64) PRIMARY KEY,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at  TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    released_at TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS stock_reservation_items
+(
+    reservation_key VARCHAR(64) NOT NULL REFERENCES stock_reservations (key) ON DELETE CASCADE,
+    product_id      INT         NOT NULL REFERENCES products (id) ON DELETE RESTRICT,
+    quantity        INT         NOT NULL CHECK (quantity > 0),
+    PRIMARY KEY (reservation_key, product_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_stock_reservation_items_product_id ON stock_reservation_items (product_id);
+
+-- Orders placed while all services shared one database took their stock
+-- directly. Run against such a database, this gives each order still holding
+-- stock the reservation the order-service expects, so that cancelling it
+-- returns the stock.
+DO
+$$
+    BEGIN
+        IF to_regclass('order_items') IS NOT NULL THEN
+            CREATE TEMPORARY TABLE holding_orders ON COMMIT DROP AS
+            SELECT o.id
+            FROM orders AS o
+            WHERE o.status <> 'cancelled'
+              AND NOT (o.status = 'refunded' AND EXISTS(SELECT 1
+                                                        FROM order_status_history AS h
+                                                        WHERE h.order_id = o.id
+                                                          AND h.from_status = 'paid'
+                                                          AND h.to_status = 'refunded'));
+
+            INSERT INTO stock_reservations (key)
+            SELECT 'order-' || id
+            FROM holding_orders
+            ON CONFLICT DO NOTHING;
+
+            INSERT INTO stock_reservation_items (reservation_key, product_id, quantity)
+            SELECT 'order-' || oi.order_id, oi.product_id, oi.quantity
+            FROM order_items AS oi
+                     JOIN holding_orders AS h ON h.id = oi.order_id
+            ON CONFLICT DO NOTHING;
+        END IF;
+    END
+$$;
@@ -1,21 +1,82 @@
 package models
 
+import (
+	"OnlineStore/money"
+	"OnlineStore/pagination"
+	"time"
+)
+
+// Events recorded in the outbox when a product changes. Their payload is the
+// Product as it is afterwards; for product.deleted only its ID is set.
+const (
+	EventProductCreated = "product.created"
+	EventProductUpdated = "product.updated"
+	EventProductDeleted = "product.deleted"
+)
+
 type Product struct {
-	ID          int     `json:"id"`
-	Name        string  `json:"name"`
-	Description string  `json:"description"`
-	Price       float64 `json:"price"`
-	Category    string  `json:"category"`
-	Quantity    int     `json:"quantity"`
-	DateAdded   string  `json:"date_added"`
+	ID          int         `json:"id"`
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Price       money.Money `json:"price"`
+	Category    string      `json:"category"`
+	Quantity    int         `json:"quantity"`
+	DateAdded   string      `json:"date_added"`
+}
+
+// ProductSorts are the keys products can be listed by; the first is the
+// default.
+var ProductSorts = []string{"id", "name", "price", "quantity", "date_added"}
+
+// ProductFilter narrows a list of products. Zero fields match every product.
+type ProductFilter struct {
+	// IDs, if set, only matches the products with these IDs.
+	IDs []int
+	// Name matches products whose name contains it, ignoring case.
+	Name     string
+	Category string
+	// MinPrice and MaxPrice bound the price, inclusive. Setting either only
+	// matches products priced in its currency.
+	MinPrice *money.Money
+	MaxPrice *money.Money
+	InStock  bool
+	// AddedFrom and AddedBefore bound date_added; AddedBefore is exclusive.
+	AddedFrom   time.Time
+	AddedBefore time.Time
 }
 
+// ProductMatch is a product found by full-text search. Snippet is the part of
+// its name and description that matched, as HTML with the matching words
+// wrapped in <mark> tags.
+type ProductMatch struct {
+	Product
+	Rank    float64 `json:"rank"`
+	Snippet string  `json:"snippet"`
+}
+
+// ProductSearchResults is a page of search results. When nothing matched,
+// Suggestions holds product names close to the search terms.
+type ProductSearchResults struct {
+	pagination.Page[*ProductMatch]
+	Suggestions []string `json:"suggestions,omitempty"`
+}
+
+// ProductSearchSorts are the keys search results can be sorted by; the
+// default, relevance, puts the best matches first.
+var ProductSearchSorts = append([]string{"relevance"}, ProductSorts...)
+
 type ProductModel interface {
-	GetProducts() ([]*Product, error)
+	// ListProducts returns one page of the products matching filter, and
+	// how many match in total.
+	ListProducts(filter ProductFilter, page pagination.Params) ([]*Product, int, error)
+	// SearchProducts returns one page of the products matching both the
+	// full-text search terms and filter, and how many match in total.
+	SearchProducts(terms string, filter ProductFilter, page pagination.Params) ([]*ProductMatch, int, error)
+	// SuggestProductNames returns up to limit product names similar to term,
+	// most similar first, to correct typos.
+	SuggestProductNames(term string, limit int) ([]string, error)
 	CreateProduct(product Product) error
 	GetProductByID(id int) (*Product, error)
 	UpdateProduct(product Product) error
 	DeleteProduct(id int) error
-	GetProductByName(name string) ([]*Product, error)
-	GetProductByCategory(category string) ([]*Product, error)
 }
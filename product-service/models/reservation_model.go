@@ -0,0 +1,42 @@
+package models
+
+import (
+	"OnlineStore/apierror"
+	"OnlineStore/money"
+)
+
+// The order-service's product client tells these apart by status: 404
+// unknown product, 409 short of stock, 410 released.
+var (
+	ErrInsufficientStock   = apierror.New(apierror.InsufficientStock, "not enough quantity")
+	ErrProductNotFound     = apierror.New(apierror.NotFound, "product not found")
+	ErrInvalidReservation  = apierror.New(apierror.Validation, "invalid stock reservation")
+	ErrReservationReleased = apierror.New(apierror.Gone, "stock reservation was released")
+)
+
+// ReservedItem is one product held by a reservation. UnitPrice is the
+// product's current price, returned for the holder to charge.
+type ReservedItem struct {
+	ProductID int         `json:"product_id"`
+	Quantity  int         `json:"quantity"`
+	UnitPrice money.Money `json:"unit_price"`
+}
+
+// Reservation is stock held for another service under a key it chooses,
+// such as the order-service's "order-42".
+type Reservation struct {
+	Key   string         `json:"key"`
+	Items []ReservedItem `json:"items"`
+}
+
+type ReservationModel interface {
+	// ReserveStock makes the reservation hold exactly items, taking stock
+	// for what it did not hold yet and returning what it no longer holds.
+	// It is all or nothing, and repeating it changes nothing. It returns
+	// ErrReservationReleased once the key has been released.
+	ReserveStock(key string, items []ReservedItem) (*Reservation, error)
+	// ReleaseStock returns all the reservation's stock. Releasing it again,
+	// or releasing a key never reserved, changes nothing but still stops
+	// the key from being reserved later.
+	ReleaseStock(key string) error
+}
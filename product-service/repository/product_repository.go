@@ -1,10 +1,16 @@
 package repository
 
 import (
+	"OnlineStore/outbox"
+	"OnlineStore/pagination"
 	"OnlineStore/product-service/models"
 	"database/sql"
+	"github.com/lib/pq"
+	"strings"
 )
 
+const productColumns = "id, name, description, price, currency, category, quantity, date_added"
+
 type ProductRepository struct {
 	DB *sql.DB
 }
@@ -13,98 +19,245 @@ func NewProductRepository(db *sql.DB) *ProductRepository {
 	return &ProductRepository{DB: db}
 }
 
-func (pr *ProductRepository) GetProducts() ([]*models.Product, error) {
-	rows, err := pr.DB.Query("SELECT * FROM products")
+var productSortColumns = map[string]string{
+	"id":         "id",
+	"name":       "name",
+	"price":      "price",
+	"quantity":   "quantity",
+	"date_added": "date_added",
+}
+
+// likeEscaper escapes the LIKE wildcards in a search term, so it matches
+// literally.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// filterProducts adds the conditions of filter to where.
+func filterProducts(where *pagination.Where, filter models.ProductFilter) {
+	if filter.IDs != nil {
+		where.Add("id = ANY(%s)", pq.Array(filter.IDs))
+	}
+	if filter.Name != "" {
+		where.Add("name ILIKE %s", "%"+likeEscaper.Replace(filter.Name)+"%")
+	}
+	if filter.Category != "" {
+		where.Equal("category", filter.Category)
+	}
+	if filter.MinPrice != nil {
+		where.Equal("currency", filter.MinPrice.CurrencyOrDefault())
+		where.Add("price >= %s", filter.MinPrice.Amount)
+	}
+	if filter.MaxPrice != nil {
+		where.Equal("currency", filter.MaxPrice.CurrencyOrDefault())
+		where.Add("price <= %s", filter.MaxPrice.Amount)
+	}
+	if filter.InStock {
+		where.Add("quantity > %s", 0)
+	}
+	if !filter.AddedFrom.IsZero() {
+		where.Add("date_added >= %s", filter.AddedFrom)
+	}
+	if !filter.AddedBefore.IsZero() {
+		where.Add("date_added < %s", filter.AddedBefore)
+	}
+}
+
+func (pr *ProductRepository) ListProducts(filter models.ProductFilter, page pagination.Params) ([]*models.Product, int, error) {
+	var where pagination.Where
+	filterProducts(&where, filter)
+	var total int
+	err := pr.DB.QueryRow("SELECT COUNT(*) FROM products"+where.String(), where.Args...).Scan(&total)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+
+	query := "SELECT " + productColumns + " FROM products" + where.String()
+	query += page.OrderBy(productSortColumns, &where)
+	rows, err := pr.DB.Query(query, where.Args...)
+	if err != nil {
+		return nil, 0, err
 	}
 	defer rows.Close()
 
 	products := []*models.Product{}
 	for rows.Next() {
 		product := &models.Product{}
-		err := rows.Scan(&product.ID, &product.Name, &product.Description, &product.Price, &product.Category, &product.Quantity, &product.DateAdded)
+		err := rows.Scan(&product.ID, &product.Name, &product.Description, &product.Price, &product.Price.Currency, &product.Category, &product.Quantity, &product.DateAdded)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 		products = append(products, product)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
 
-	return products, nil
+	return products, total, nil
 }
 
-func (pr *ProductRepository) GetProductByID(id int) (*models.Product, error) {
-	product := &models.Product{}
-	err := pr.DB.QueryRow("SELECT * FROM products WHERE id = $1", id).Scan(&product.ID, &product.Name, &product.Description, &product.Price, &product.Category, &product.Quantity, &product.DateAdded)
-	if err != nil {
-		return nil, err
-	}
-
-	return product, nil
+// productSearchColumns adds relevance to the sort keys. Ranks sort
+// descending, so the best matches come first in ascending order.
+var productSearchColumns = map[string]string{
+	"relevance":  "-rank",
+	"id":         "id",
+	"name":       "name",
+	"price":      "price",
+	"quantity":   "quantity",
+	"date_added": "date_added",
 }
 
-func (pr *ProductRepository) CreateProduct(product models.Product) error {
-	_, err := pr.DB.Exec("INSERT INTO products (name, description, price, category, quantity) VALUES ($1, $2, $3, $4, $5)", product.Name, product.Description, product.Price, product.Category, product.Quantity)
+// productMatches are the products matching the full-text query in $1, with
+// their rank and the parsed query, for filtering like the products table.
+const productMatches = `(
+        SELECT products.*, query, ts_rank_cd(search, query) AS rank
+        FROM products, websearch_to_tsquery('english', $1) AS query
+        WHERE search @@ query
+    ) AS matches`
+
+// productSnippet highlights the matched words of the name and description in
+// <mark> tags. The text is HTML-escaped first, so the tags are the only markup
+// in the snippet. The default parser reads each entity as one token, so no
+// fragment ends inside one.
+const productSnippet = `ts_headline('english',
+            replace(replace(replace(replace(replace(name || ' ' || description,
+                '&', '&amp;'), '<', '&lt;'), '>', '&gt;'), '"', '&quot;'), '''', '&#39;'),
+            query, 'StartSel=<mark>, StopSel=</mark>, MaxFragments=2')`
+
+func (pr *ProductRepository) SearchProducts(terms string, filter models.ProductFilter, page pagination.Params) ([]*models.ProductMatch, int, error) {
+	var where pagination.Where
+	where.Arg(terms) // $1 in productMatches
+	filterProducts(&where, filter)
+	var total int
+	err := pr.DB.QueryRow("SELECT COUNT(*) FROM "+productMatches+where.String(), where.Args...).Scan(&total)
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
-	return nil
-}
 
-func (pr *ProductRepository) UpdateProduct(product models.Product) error {
-	_, err := pr.DB.Exec("UPDATE products SET name = $1, description = $2, price = $3, category = $4, quantity = $5 WHERE id = $6", product.Name, product.Description, product.Price, product.Category, product.Quantity, product.ID)
+	query := `SELECT id, name, description, price, currency, category, quantity, date_added, rank, ` + productSnippet + `
+        FROM ` + productMatches + where.String()
+	query += page.OrderBy(productSearchColumns, &where)
+	rows, err := pr.DB.Query(query, where.Args...)
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
+	defer rows.Close()
 
-	return nil
-}
-
-func (pr *ProductRepository) DeleteProduct(id int) error {
-	_, err := pr.DB.Exec("DELETE FROM products WHERE id = $1", id)
-	if err != nil {
-		return err
+	matches := []*models.ProductMatch{}
+	for rows.Next() {
+		match := &models.ProductMatch{}
+		err := rows.Scan(&match.ID, &match.Name, &match.Description, &match.Price, &match.Price.Currency, &match.Category, &match.Quantity, &match.DateAdded, &match.Rank, &match.Snippet)
+		if err != nil {
+			return nil, 0, err
+		}
+		matches = append(matches, match)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
 	}
 
-	return nil
+	return matches, total, nil
 }
 
-func (pr *ProductRepository) GetProductByName(name string) ([]*models.Product, error) {
-	var products []*models.Product
-	rows, err := pr.DB.Query("SELECT * FROM products WHERE name = $1", name)
+func (pr *ProductRepository) SuggestProductNames(term string, limit int) ([]string, error) {
+	rows, err := pr.DB.Query(`
+        SELECT name
+        FROM products
+        WHERE name % $1
+        GROUP BY name
+        ORDER BY max(similarity(name, $1)) DESC, name
+        LIMIT $2`, term, limit)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
+	names := []string{}
 	for rows.Next() {
-		product := &models.Product{}
-		err := rows.Scan(&product.ID, &product.Name, &product.Description, &product.Price, &product.Category, &product.Quantity, &product.DateAdded)
-		if err != nil {
+		var name string
+		if err := rows.Scan(&name); err != nil {
 			return nil, err
 		}
-		products = append(products, product)
+		names = append(names, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
 
-	return products, nil
+	return names, nil
 }
 
-func (pr *ProductRepository) GetProductByCategory(category string) ([]*models.Product, error) {
-	var products []*models.Product
-	rows, err := pr.DB.Query("SELECT * FROM products WHERE category = $1", category)
+func scanProduct(row *sql.Row) (*models.Product, error) {
+	product := &models.Product{}
+	err := row.Scan(&product.ID, &product.Name, &product.Description, &product.Price, &product.Price.Currency, &product.Category, &product.Quantity, &product.DateAdded)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	return product, nil
+}
 
-	for rows.Next() {
-		product := &models.Product{}
-		err := rows.Scan(&product.ID, &product.Name, &product.Description, &product.Price, &product.Category, &product.Quantity, &product.DateAdded)
-		if err != nil {
-			return nil, err
-		}
-		products = append(products, product)
+func (pr *ProductRepository) GetProductByID(id int) (*models.Product, error) {
+	return scanProduct(pr.DB.QueryRow("SELECT "+productColumns+" FROM products WHERE id = $1", id))
+}
+
+func (pr *ProductRepository) CreateProduct(product models.Product) error {
+	tx, err := pr.DB.Begin()
+	if err != nil {
+		return err
 	}
+	defer tx.Rollback()
 
-	return products, nil
+	created, err := scanProduct(tx.QueryRow("INSERT INTO products (name, description, price, currency, category, quantity) VALUES ($1, $2, $3, $4, $5, $6) RETURNING "+productColumns, product.Name, product.Description, product.Price, product.Price.CurrencyOrDefault(), product.Category, product.Quantity))
+	if err != nil {
+		return err
+	}
+	err = outbox.Record(tx, models.EventProductCreated, created.ID, created)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (pr *ProductRepository) UpdateProduct(product models.Product) error {
+	tx, err := pr.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	updated, err := scanProduct(tx.QueryRow("UPDATE products SET name = $1, description = $2, price = $3, currency = $4, category = $5, quantity = $6 WHERE id = $7 RETURNING "+productColumns, product.Name, product.Description, product.Price, product.Price.CurrencyOrDefault(), product.Category, product.Quantity, product.ID))
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = outbox.Record(tx, models.EventProductUpdated, updated.ID, updated)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (pr *ProductRepository) DeleteProduct(id int) error {
+	tx, err := pr.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM products WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return nil
+	}
+	err = outbox.Record(tx, models.EventProductDeleted, id, models.Product{ID: id})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
 }
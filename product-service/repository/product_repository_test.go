@@ -0,0 +1,37 @@
+package repository
+
+import (
+	"OnlineStore/pagination"
+	"OnlineStore/product-service/models"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSearchProductsEscapesSnippet(t *testing.T) {
+	database := testDB(t)
+	word := fmt.Sprintf("escapetest%d", rand.Int63())
+	var id int
+	err := database.QueryRow(`
+        INSERT INTO products (name, description, price, quantity)
+        VALUES ($1, $2, 1000, 1)
+        RETURNING id`, word+` <img src=x onerror="alert(1)">`, `Tom's & Jerry's `+word).Scan(&id)
+	require.NoError(t, err)
+	t.Cleanup(func() { database.Exec("DELETE FROM products WHERE id = $1", id) })
+
+	matches, total, err := NewProductRepository(database).SearchProducts(word, models.ProductFilter{}, pagination.Params{Limit: 10, Sort: "relevance"})
+	require.NoError(t, err)
+	require.Equal(t, 1, total)
+	snippet := matches[0].Snippet
+
+	assert.Contains(t, snippet, "<mark>"+word+"</mark>")
+	assert.Contains(t, snippet, "&lt;img src=x onerror=&quot;alert(1)&quot;&gt;")
+	assert.Contains(t, snippet, "Tom&#39;s &amp; Jerry&#39;s")
+	withoutMarks := strings.NewReplacer("<mark>", "", "</mark>", "").Replace(snippet)
+	assert.NotContains(t, withoutMarks, "<")
+	assert.NotContains(t, withoutMarks, ">")
+}
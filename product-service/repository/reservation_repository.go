@@ -0,0 +1,218 @@
+package repository
+
+import (
+	"OnlineStore/product-service/models"
+	"database/sql"
+	"fmt"
+	"sort"
+)
+
+type ReservationRepository struct {
+	DB *sql.DB
+}
+
+func NewReservationRepository(db *sql.DB) *ReservationRepository {
+	return &ReservationRepository{DB: db}
+}
+
+// ReserveStock locks the reservation row first, so concurrent requests for
+// the same key serialize and each sees what the previous one left.
+func (rr *ReservationRepository) ReserveStock(key string, items []models.ReservedItem) (*models.Reservation, error) {
+	if err := validateReservation(key, items); err != nil {
+		return nil, err
+	}
+
+	tx, err := rr.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	released, err := lockReservation(tx, key)
+	if err != nil {
+		return nil, err
+	}
+	if released {
+		return nil, fmt.Errorf("%w: %s", models.ErrReservationReleased, key)
+	}
+	held, err := reservedQuantities(tx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	delta := make(map[int]int, len(items)+len(held))
+	for _, item := range items {
+		delta[item.ProductID] += item.Quantity
+	}
+	for productID, quantity := range held {
+		delta[productID] -= quantity
+	}
+	if err := adjustStock(tx, delta); err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec("DELETE FROM stock_reservation_items WHERE reservation_key = $1", key)
+	if err != nil {
+		return nil, err
+	}
+	reservation := &models.Reservation{Key: key, Items: []models.ReservedItem{}}
+	for _, item := range items {
+		// The price is read under the row lock, so it is the price the
+		// stock was taken at.
+		err := tx.QueryRow("SELECT price, currency FROM products WHERE id = $1 FOR UPDATE", item.ProductID).
+			Scan(&item.UnitPrice, &item.UnitPrice.Currency)
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("%w: %d", models.ErrProductNotFound, item.ProductID)
+		}
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.Exec(`
+            INSERT INTO stock_reservation_items (reservation_key, product_id, quantity)
+            VALUES ($1, $2, $3)`, key, item.ProductID, item.Quantity)
+		if err != nil {
+			return nil, err
+		}
+		reservation.Items = append(reservation.Items, item)
+	}
+	_, err = tx.Exec("UPDATE stock_reservations SET updated_at = CURRENT_TIMESTAMP WHERE key = $1", key)
+	if err != nil {
+		return nil, err
+	}
+	return reservation, tx.Commit()
+}
+
+func (rr *ReservationRepository) ReleaseStock(key string) error {
+	if err := validateReservation(key, nil); err != nil {
+		return err
+	}
+
+	tx, err := rr.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	released, err := lockReservation(tx, key)
+	if err != nil {
+		return err
+	}
+	if released {
+		return nil
+	}
+	held, err := reservedQuantities(tx, key)
+	if err != nil {
+		return err
+	}
+	delta := make(map[int]int, len(held))
+	for productID, quantity := range held {
+		delta[productID] = -quantity
+	}
+	if err := adjustStock(tx, delta); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM stock_reservation_items WHERE reservation_key = $1", key)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE stock_reservations SET released_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP WHERE key = $1", key)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func validateReservation(key string, items []models.ReservedItem) error {
+	if key == "" || len(key) > 64 {
+		return fmt.Errorf("%w: key must be 1 to 64 characters", models.ErrInvalidReservation)
+	}
+	seen := make(map[int]bool, len(items))
+	for _, item := range items {
+		if item.Quantity <= 0 {
+			return fmt.Errorf("%w: quantity for product %d must be positive", models.ErrInvalidReservation, item.ProductID)
+		}
+		if seen[item.ProductID] {
+			return fmt.Errorf("%w: product %d is listed twice", models.ErrInvalidReservation, item.ProductID)
+		}
+		seen[item.ProductID] = true
+	}
+	return nil
+}
+
+// lockReservation creates the reservation if it is new, locks it, and
+// reports whether it has been released.
+func lockReservation(tx *sql.Tx, key string) (bool, error) {
+	_, err := tx.Exec("INSERT INTO stock_reservations (key) VALUES ($1) ON CONFLICT (key) DO NOTHING", key)
+	if err != nil {
+		return false, err
+	}
+	var releasedAt sql.NullTime
+	err = tx.QueryRow("SELECT released_at FROM stock_reservations WHERE key = $1 FOR UPDATE", key).Scan(&releasedAt)
+	if err != nil {
+		return false, err
+	}
+	return releasedAt.Valid, nil
+}
+
+// reservedQuantities returns how many of each product the reservation holds.
+func reservedQuantities(tx *sql.Tx, key string) (map[int]int, error) {
+	rows, err := tx.Query("SELECT product_id, quantity FROM stock_reservation_items WHERE reservation_key = $1", key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	held := map[int]int{}
+	for rows.Next() {
+		var productID, quantity int
+		if err := rows.Scan(&productID, &quantity); err != nil {
+			return nil, err
+		}
+		held[productID] = quantity
+	}
+	return held, rows.Err()
+}
+
+// adjustStock takes delta[id] units of each product out of stock, or returns
+// them when delta is negative. Each decrement is a conditional UPDATE, so the
+// row lock and the stock check happen atomically; products are visited in ID
+// order so concurrent reservations over the same products cannot deadlock.
+func adjustStock(tx *sql.Tx, delta map[int]int) error {
+	productIDs := make([]int, 0, len(delta))
+	for productID := range delta {
+		productIDs = append(productIDs, productID)
+	}
+	sort.Ints(productIDs)
+
+	for _, productID := range productIDs {
+		count := delta[productID]
+		if count == 0 {
+			continue
+		}
+		res, err := tx.Exec(`
+            UPDATE products SET quantity = quantity - $1
+            WHERE id = $2 AND quantity >= $1`, count, productID)
+		if err != nil {
+			return err
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected == 1 {
+			continue
+		}
+
+		var exists bool
+		err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM products WHERE id = $1)", productID).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("%w: %d", models.ErrProductNotFound, productID)
+		}
+		return fmt.Errorf("%w for product %d", models.ErrInsufficientStock, productID)
+	}
+	return nil
+}
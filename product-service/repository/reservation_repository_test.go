@@ -0,0 +1,148 @@
+package repository
+
+import (
+	db "OnlineStore"
+	"OnlineStore/money"
+	"OnlineStore/product-service/models"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testDB connects to TEST_DATABASE_URL and applies the product-service's
+// migrations. Tests that need a real PostgreSQL instance are skipped when it
+// is not set.
+func testDB(t *testing.T) *sql.DB {
+	dbURL := os.Getenv("TEST_DATABASE_URL")
+	if dbURL == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	t.Setenv("PRODUCT_DATABASE_URL", dbURL)
+	t.Setenv("MIGRATIONS_URL", "file://../migrations")
+
+	database, err := db.InitializeDB("product")
+	require.NoError(t, err)
+	require.NoError(t, db.MigrateUp(database, "product"))
+	t.Cleanup(func() { database.Close() })
+	return database
+}
+
+func createTestProduct(t *testing.T, database *sql.DB, quantity int) int {
+	var id int
+	err := database.QueryRow(`
+        INSERT INTO products (name, price, quantity)
+        VALUES ('stock-test', 1000, $1)
+        RETURNING id`, quantity).Scan(&id)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		database.Exec("DELETE FROM stock_reservation_items WHERE product_id = $1", id)
+		database.Exec("DELETE FROM products WHERE id = $1", id)
+	})
+	return id
+}
+
+func productQuantity(t *testing.T, database *sql.DB, productID int) int {
+	var quantity int
+	err := database.QueryRow("SELECT quantity FROM products WHERE id = $1", productID).Scan(&quantity)
+	require.NoError(t, err)
+	return quantity
+}
+
+// testKey returns a reservation key no other test run uses.
+func testKey(name string) string {
+	return fmt.Sprintf("test-%s-%d", name, rand.Int63())
+}
+
+func TestReserveStockConcurrentDoesNotOversell(t *testing.T) {
+	database := testDB(t)
+	repo := NewReservationRepository(database)
+	productID := createTestProduct(t, database, 5)
+
+	const buyers = 20
+	var (
+		wg           sync.WaitGroup
+		mu           sync.Mutex
+		reserved     int
+		insufficient int
+	)
+	for i := 0; i < buyers; i++ {
+		key := testKey("oversell")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := repo.ReserveStock(key, []models.ReservedItem{{ProductID: productID, Quantity: 1}})
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				reserved++
+			case errors.Is(err, models.ErrInsufficientStock):
+				insufficient++
+			default:
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 5, reserved)
+	assert.Equal(t, buyers-5, insufficient)
+	assert.Equal(t, 0, productQuantity(t, database, productID))
+}
+
+func TestReserveStockHoldsExactlyTheItems(t *testing.T) {
+	database := testDB(t)
+	repo := NewReservationRepository(database)
+	productID := createTestProduct(t, database, 5)
+	key := testKey("exact")
+
+	reservation, err := repo.ReserveStock(key, []models.ReservedItem{{ProductID: productID, Quantity: 2}})
+	require.NoError(t, err)
+	require.Len(t, reservation.Items, 1)
+	assert.Equal(t, money.New(1000, "KZT"), reservation.Items[0].UnitPrice)
+	assert.Equal(t, 3, productQuantity(t, database, productID))
+
+	// Repeating a reservation changes nothing; changing it moves the difference.
+	_, err = repo.ReserveStock(key, []models.ReservedItem{{ProductID: productID, Quantity: 2}})
+	require.NoError(t, err)
+	assert.Equal(t, 3, productQuantity(t, database, productID))
+	_, err = repo.ReserveStock(key, []models.ReservedItem{{ProductID: productID, Quantity: 4}})
+	require.NoError(t, err)
+	assert.Equal(t, 1, productQuantity(t, database, productID))
+
+	_, err = repo.ReserveStock(key, []models.ReservedItem{{ProductID: productID, Quantity: 6}})
+	assert.True(t, errors.Is(err, models.ErrInsufficientStock))
+	_, err = repo.ReserveStock(key, []models.ReservedItem{{ProductID: -1, Quantity: 1}})
+	assert.True(t, errors.Is(err, models.ErrProductNotFound))
+	assert.Equal(t, 1, productQuantity(t, database, productID))
+}
+
+func TestReleaseStockOnce(t *testing.T) {
+	database := testDB(t)
+	repo := NewReservationRepository(database)
+	productID := createTestProduct(t, database, 5)
+	key := testKey("release")
+
+	_, err := repo.ReserveStock(key, []models.ReservedItem{{ProductID: productID, Quantity: 2}})
+	require.NoError(t, err)
+	require.NoError(t, repo.ReleaseStock(key))
+	require.NoError(t, repo.ReleaseStock(key))
+	assert.Equal(t, 5, productQuantity(t, database, productID))
+
+	_, err = repo.ReserveStock(key, []models.ReservedItem{{ProductID: productID, Quantity: 1}})
+	assert.True(t, errors.Is(err, models.ErrReservationReleased))
+	assert.Equal(t, 5, productQuantity(t, database, productID))
+
+	// Releasing first keeps a late reservation from taking stock.
+	late := testKey("late")
+	require.NoError(t, repo.ReleaseStock(late))
+	_, err = repo.ReserveStock(late, []models.ReservedItem{{ProductID: productID, Quantity: 1}})
+	assert.True(t, errors.Is(err, models.ErrReservationReleased))
+}
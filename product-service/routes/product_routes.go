@@ -15,4 +15,5 @@ func Routes(router *mux.Router, productController *controllers.ProductController
 	productsRouter.HandleFunc("/{id:[0-9]+}", productController.UpdateProductController).Methods(http.MethodPut)
 	productsRouter.HandleFunc("/{id:[0-9]+}", productController.DeleteProductController).Methods(http.MethodDelete)
 	productsRouter.HandleFunc("/search", productController.SearchProductController).Methods(http.MethodGet)
+	productsRouter.HandleFunc("/suggest", productController.SuggestProductsController).Methods(http.MethodGet)
 }
@@ -0,0 +1,15 @@
+package routes
+
+import (
+	"OnlineStore/product-service/controllers"
+	"github.com/gorilla/mux"
+	"net/http"
+)
+
+// ReservationRoutes serves stock reservations to other services.
+func ReservationRoutes(router *mux.Router, reservationController *controllers.ReservationController) {
+	reservationsRouter := router.PathPrefix("/products/reservations").Subrouter()
+
+	reservationsRouter.HandleFunc("/{key}", reservationController.ReserveStockController).Methods(http.MethodPut)
+	reservationsRouter.HandleFunc("/{key}", reservationController.ReleaseStockController).Methods(http.MethodDelete)
+}
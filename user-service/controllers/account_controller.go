@@ -0,0 +1,245 @@
+package controllers
+
+import (
+	"OnlineStore/apierror"
+	"OnlineStore/auth"
+	"OnlineStore/user-service/models"
+	"OnlineStore/user-service/services"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type registerRequest struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Address  string `json:"address"`
+	Password string `json:"password"`
+}
+
+// RegisterController signs up a customer. Unlike CreateUserController it
+// never takes a role from the request and always requires a password.
+func (uc *UserController) RegisterController(writer http.ResponseWriter, request *http.Request) {
+	var input registerRequest
+	err := json.NewDecoder(request.Body).Decode(&input)
+	if err != nil {
+		apierror.Write(writer, request, apierror.Wrap(apierror.Validation, "invalid JSON body", err))
+		return
+	}
+	if input.Username == "" || input.Email == "" {
+		apierror.Write(writer, request, apierror.New(apierror.Validation, "username and email are required"))
+		return
+	}
+	passwordHash, err := services.HashPassword(input.Password)
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	err = uc.UserModel.CreateUser(models.User{
+		Username:     input.Username,
+		Email:        input.Email,
+		Address:      input.Address,
+		Role:         auth.RoleCustomer,
+		PasswordHash: passwordHash,
+	})
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	writer.WriteHeader(http.StatusCreated)
+}
+
+type changePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// ChangePasswordController lets a user change their own password. Other
+// users' accounts are reported as not found, for admins too; an admin who
+// needs to get someone back in uses the reset flow.
+func (uc *UserController) ChangePasswordController(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		apierror.Write(writer, request, apierror.New(apierror.Validation, "id must be a number"))
+		return
+	}
+	if auth.CallerFromRequest(request).UserID != id {
+		apierror.Write(writer, request, models.ErrUserNotFound)
+		return
+	}
+	var input changePasswordRequest
+	err = json.NewDecoder(request.Body).Decode(&input)
+	if err != nil {
+		apierror.Write(writer, request, apierror.Wrap(apierror.Validation, "invalid JSON body", err))
+		return
+	}
+
+	user, err := uc.UserModel.GetUserByID(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = models.ErrUserNotFound
+	}
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	if !uc.checkPassword(writer, request, user, input.CurrentPassword, apierror.Forbidden) {
+		return
+	}
+	passwordHash, err := services.HashPassword(input.NewPassword)
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	err = uc.UserModel.SetPassword(id, passwordHash)
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	writer.WriteHeader(http.StatusOK)
+}
+
+type forgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+// ForgotPasswordController sends a one-time reset token to the account's
+// owner. It answers 202 whether or not the email is registered, so it cannot
+// be used to find out which addresses have accounts, and 503 for everyone if
+// there is no ResetSender to deliver tokens with.
+func (uc *UserController) ForgotPasswordController(writer http.ResponseWriter, request *http.Request) {
+	if uc.Resets == nil {
+		apierror.Write(writer, request, apierror.New(apierror.Unavailable, "password reset is not available"))
+		return
+	}
+	var input forgotPasswordRequest
+	err := json.NewDecoder(request.Body).Decode(&input)
+	if err != nil {
+		apierror.Write(writer, request, apierror.Wrap(apierror.Validation, "invalid JSON body", err))
+		return
+	}
+	if !uc.allow(writer, request, "reset") {
+		return
+	}
+
+	user, err := uc.UserModel.GetUserByEmail(input.Email)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writer.WriteHeader(http.StatusAccepted)
+			return
+		}
+		apierror.Write(writer, request, err)
+		return
+	}
+	token, tokenHash, err := services.NewResetToken()
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	expiresAt := time.Now().Add(uc.Policy.ResetTTL)
+	err = uc.UserModel.CreatePasswordReset(user.ID, tokenHash, expiresAt)
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	err = uc.Resets.SendPasswordReset(request.Context(), user, token, expiresAt)
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	writer.WriteHeader(http.StatusAccepted)
+}
+
+type resetPasswordRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+// ResetPasswordController sets a new password using a token from
+// ForgotPasswordController. The token is spent even if it was for an
+// account that has since changed its password another way.
+func (uc *UserController) ResetPasswordController(writer http.ResponseWriter, request *http.Request) {
+	var input resetPasswordRequest
+	err := json.NewDecoder(request.Body).Decode(&input)
+	if err != nil {
+		apierror.Write(writer, request, apierror.Wrap(apierror.Validation, "invalid JSON body", err))
+		return
+	}
+	passwordHash, err := services.HashPassword(input.NewPassword)
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	_, err = uc.UserModel.ResetPassword(services.HashResetToken(input.Token), passwordHash)
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	writer.WriteHeader(http.StatusOK)
+}
+
+// allow applies the per-address rate limit for action, answering 429 once it
+// is exhausted.
+func (uc *UserController) allow(writer http.ResponseWriter, request *http.Request, action string) bool {
+	ok, retryAfter := uc.Limiter.Allow(action + ":" + clientIP(request))
+	if !ok {
+		tooManyRequests(writer, request, retryAfter, "too many attempts, try again later")
+	}
+	return ok
+}
+
+// checkPassword verifies password for user, which may be nil if the account
+// does not exist, answering with a problem of failKind if it is wrong. Failures count
+// towards a lockout, and a locked account is refused without checking.
+func (uc *UserController) checkPassword(writer http.ResponseWriter, request *http.Request, user *models.User, password string, failKind apierror.Kind) bool {
+	if user != nil && time.Now().Before(user.LockedUntil) {
+		tooManyRequests(writer, request, time.Until(user.LockedUntil), "account is locked after repeated failed logins, try again later")
+		return false
+	}
+	passwordHash := ""
+	if user != nil {
+		passwordHash = user.PasswordHash
+	}
+	if err := services.CheckPassword(passwordHash, password); err != nil {
+		if user != nil {
+			if err := uc.UserModel.RecordFailedLogin(user.ID, uc.Policy.MaxAttempts, uc.Policy.Lockout); err != nil {
+				log.Printf("Failed to record failed login for user %d: %v", user.ID, err)
+			}
+		}
+		apierror.Write(writer, request, apierror.New(failKind, err.Error()))
+		return false
+	}
+	if err := uc.UserModel.ResetFailedLogins(user.ID); err != nil {
+		log.Printf("Failed to reset failed logins for user %d: %v", user.ID, err)
+	}
+	return true
+}
+
+func tooManyRequests(writer http.ResponseWriter, request *http.Request, retryAfter time.Duration, message string) {
+	seconds := int(retryAfter.Seconds() + 0.999)
+	writer.Header().Set("Retry-After", strconv.Itoa(seconds))
+	problem := apierror.NewProblem(request, apierror.New(apierror.RateLimited, message))
+	problem.RetryAfter = seconds
+	apierror.WriteProblem(writer, problem)
+}
+
+// clientIP is the address the api-gateway received the request from, or the
+// direct peer when called without the gateway.
+func clientIP(request *http.Request) string {
+	if forwarded := request.Header.Get("X-Forwarded-For"); forwarded != "" {
+		first, _, _ := strings.Cut(forwarded, ",")
+		return strings.TrimSpace(first)
+	}
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return host
+}
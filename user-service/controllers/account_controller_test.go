@@ -0,0 +1,161 @@
+package controllers
+
+import (
+	"OnlineStore/auth"
+	"OnlineStore/user-service/models"
+	"OnlineStore/user-service/services"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func postJSON(handler http.HandlerFunc, path string, body any) *httptest.ResponseRecorder {
+	jsonBody, _ := json.Marshal(body)
+	req := httptest.NewRequest("POST", path, strings.NewReader(string(jsonBody)))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestRegisterController(t *testing.T) {
+	mockModel := &MockUserModel{}
+	controller := NewUserController(mockModel, testTokens, testPolicy, &MockResetSender{})
+	handler := http.HandlerFunc(controller.RegisterController)
+
+	rr := postJSON(handler, "/users/register", map[string]string{
+		"username": "eve", "email": "eve@example.com", "password": "correct horse", "role": auth.RoleAdmin,
+	})
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.Equal(t, auth.RoleCustomer, mockModel.Users[0].Role)
+	assert.NoError(t, services.CheckPassword(mockModel.Users[0].PasswordHash, "correct horse"))
+
+	// Test duplicate email, missing password and weak password
+	rr = postJSON(handler, "/users/register", map[string]string{"username": "eve", "email": "eve@example.com", "password": "correct horse"})
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	rr = postJSON(handler, "/users/register", map[string]string{"username": "bob", "email": "bob@example.com"})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	rr = postJSON(handler, "/users/register", map[string]string{"username": "bob", "email": "bob@example.com", "password": "short"})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, 1, len(mockModel.Users))
+}
+
+func TestLoginLockout(t *testing.T) {
+	hash, err := services.HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mockModel := &MockUserModel{Users: []*models.User{{ID: 1, Email: "user1@example.com", PasswordHash: hash}}}
+	controller := NewUserController(mockModel, testTokens, testPolicy, &MockResetSender{})
+	handler := http.HandlerFunc(controller.LoginController)
+	login := func(password string) *httptest.ResponseRecorder {
+		return postJSON(handler, "/users/login", map[string]string{"email": "user1@example.com", "password": password})
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, login("wrong password").Code)
+	assert.Equal(t, http.StatusOK, login("correct horse").Code)
+	assert.Equal(t, 0, mockModel.FailedLogins[1])
+
+	for i := 0; i < testPolicy.MaxAttempts; i++ {
+		assert.Equal(t, http.StatusUnauthorized, login("wrong password").Code)
+	}
+	// Test the right password is refused while locked
+	rr := login("correct horse")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.NotEmpty(t, rr.Header().Get("Retry-After"))
+}
+
+func TestLoginRateLimit(t *testing.T) {
+	mockModel := &MockUserModel{}
+	policy := testPolicy
+	policy.RateLimit = 2
+	controller := NewUserController(mockModel, testTokens, policy, &MockResetSender{})
+	handler := http.HandlerFunc(controller.LoginController)
+	login := func(clientIP string) int {
+		jsonBody, _ := json.Marshal(map[string]string{"email": "nobody@example.com", "password": "guess"})
+		req := httptest.NewRequest("POST", "/users/login", strings.NewReader(string(jsonBody)))
+		req.Header.Set("X-Forwarded-For", clientIP)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, login("203.0.113.1"))
+	assert.Equal(t, http.StatusUnauthorized, login("203.0.113.1"))
+	assert.Equal(t, http.StatusTooManyRequests, login("203.0.113.1"))
+	// Test another client is unaffected
+	assert.Equal(t, http.StatusUnauthorized, login("203.0.113.2"))
+}
+
+func TestChangePasswordController(t *testing.T) {
+	hash, err := services.HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mockModel := &MockUserModel{Users: []*models.User{{ID: 1, Email: "user1@example.com", PasswordHash: hash}}}
+	controller := NewUserController(mockModel, testTokens, testPolicy, &MockResetSender{})
+	router := mux.NewRouter()
+	router.HandleFunc("/users/{id}/password", controller.ChangePasswordController).Methods("PUT")
+	change := func(callerID, current, next string) int {
+		jsonBody, _ := json.Marshal(map[string]string{"current_password": current, "new_password": next})
+		req := httptest.NewRequest("PUT", "/users/1/password", strings.NewReader(string(jsonBody)))
+		req.Header.Set(auth.UserIDHeader, callerID)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// Test another user, a wrong current password and a weak new one
+	assert.Equal(t, http.StatusNotFound, change("2", "correct horse", "battery staple"))
+	assert.Equal(t, http.StatusForbidden, change("1", "wrong password", "battery staple"))
+	assert.Equal(t, http.StatusBadRequest, change("1", "correct horse", "short"))
+
+	assert.Equal(t, http.StatusOK, change("1", "correct horse", "battery staple"))
+	assert.NoError(t, services.CheckPassword(mockModel.Users[0].PasswordHash, "battery staple"))
+}
+
+func TestPasswordReset(t *testing.T) {
+	mockModel := &MockUserModel{Users: []*models.User{{ID: 1, Email: "user1@example.com"}}}
+	sender := &MockResetSender{}
+	controller := NewUserController(mockModel, testTokens, testPolicy, sender)
+	forgot := http.HandlerFunc(controller.ForgotPasswordController)
+	reset := http.HandlerFunc(controller.ResetPasswordController)
+
+	// Test an unknown email looks the same as a known one
+	rr := postJSON(forgot, "/users/password/forgot", map[string]string{"email": "nobody@example.com"})
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	assert.Empty(t, sender.Tokens)
+
+	rr = postJSON(forgot, "/users/password/forgot", map[string]string{"email": "user1@example.com"})
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	token := sender.Tokens[1]
+	assert.NotEmpty(t, token)
+	assert.NotContains(t, mockModel.Resets, token)
+
+	rr = postJSON(reset, "/users/password/reset", map[string]string{"token": "not a token", "new_password": "battery staple"})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	rr = postJSON(reset, "/users/password/reset", map[string]string{"token": token, "new_password": "battery staple"})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NoError(t, services.CheckPassword(mockModel.Users[0].PasswordHash, "battery staple"))
+
+	// Test the token is one-time
+	rr = postJSON(reset, "/users/password/reset", map[string]string{"token": token, "new_password": "another password"})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestPasswordResetUnavailable(t *testing.T) {
+	mockModel := &MockUserModel{Users: []*models.User{{ID: 1, Email: "user1@example.com"}}}
+	controller := NewUserController(mockModel, testTokens, testPolicy, nil)
+	forgot := http.HandlerFunc(controller.ForgotPasswordController)
+
+	// Test known and unknown emails get the same answer
+	for _, email := range []string{"user1@example.com", "nobody@example.com"} {
+		rr := postJSON(forgot, "/users/password/forgot", map[string]string{"email": email})
+		assert.Equal(t, http.StatusServiceUnavailable, rr.Code, email)
+	}
+	assert.Empty(t, mockModel.Resets)
+}
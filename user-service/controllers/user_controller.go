@@ -1,35 +1,62 @@
 package controllers
 
 import (
+	"OnlineStore/apierror"
+	"OnlineStore/auth"
+	"OnlineStore/pagination"
 	"OnlineStore/user-service/models"
+	"OnlineStore/user-service/services"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"github.com/gorilla/mux"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 type UserController struct {
 	UserModel models.UserModel
+	Tokens    *auth.Tokens
+	Policy    services.AccountPolicy
+	// Limiter applies Policy's per-address rate limit to logins and reset
+	// requests.
+	Limiter *services.RateLimiter
+	Resets  services.ResetSender
 }
 
-func NewUserController(userModel models.UserModel) *UserController {
-	return &UserController{UserModel: userModel}
+func NewUserController(userModel models.UserModel, tokens *auth.Tokens, policy services.AccountPolicy, resets services.ResetSender) *UserController {
+	return &UserController{
+		UserModel: userModel,
+		Tokens:    tokens,
+		Policy:    policy,
+		Limiter:   services.NewRateLimiter(policy.RateLimit, policy.RateWindow),
+		Resets:    resets,
+	}
 }
 
+// GetUsersController lists a page of users, optionally filtered by role.
+// Customers only ever list themselves.
 func (uc *UserController) GetUsersController(writer http.ResponseWriter, request *http.Request) {
-	users, err := uc.UserModel.GetUsers()
+	query := request.URL.Query()
+	page, err := pagination.FromQuery(query, models.UserSorts...)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		apierror.Write(writer, request, err)
 		return
 	}
-	if len(users) == 0 {
-		writer.WriteHeader(http.StatusNotFound)
+	filter := models.UserFilter{Role: query.Get("role")}
+	if caller := auth.CallerFromRequest(request); !caller.IsAdmin() {
+		filter.ID = caller.UserID
+	}
+
+	users, total, err := uc.UserModel.ListUsers(filter, page)
+	if err != nil {
+		apierror.Write(writer, request, err)
 		return
 	}
-	jsonUsers, err := json.Marshal(users)
+	jsonUsers, err := json.Marshal(pagination.NewPage(users, total, page))
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		apierror.Write(writer, request, err)
 		return
 	}
 	writer.Header().Set("Content-Type", "application/json")
@@ -41,23 +68,26 @@ func (uc *UserController) GetUserByIDController(writer http.ResponseWriter, requ
 	vars := mux.Vars(request)
 	id, err := strconv.Atoi(vars["id"])
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		apierror.Write(writer, request, apierror.New(apierror.Validation, "id must be a number"))
+		return
+	}
+	if !auth.CallerFromRequest(request).Owns(id) {
+		apierror.Write(writer, request, models.ErrUserNotFound)
 		return
 	}
 
 	user, err := uc.UserModel.GetUserByID(id)
+	if err == sql.ErrNoRows {
+		err = models.ErrUserNotFound
+	}
 	if err != nil {
-		if err == sql.ErrNoRows {
-			writer.WriteHeader(http.StatusNotFound)
-			return
-		}
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		apierror.Write(writer, request, err)
 		return
 	}
 
 	jsonUser, err := json.Marshal(user)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		apierror.Write(writer, request, err)
 		return
 	}
 
@@ -65,20 +95,39 @@ func (uc *UserController) GetUserByIDController(writer http.ResponseWriter, requ
 	writer.WriteHeader(http.StatusOK)
 	_, err = writer.Write(jsonUser)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		apierror.Write(writer, request, err)
 	}
 }
 
+// createUserRequest is the body of POST /users: the user plus the password,
+// which is only ever stored hashed.
+type createUserRequest struct {
+	models.User
+	Password string `json:"password"`
+}
+
 func (uc *UserController) CreateUserController(writer http.ResponseWriter, request *http.Request) {
-	var user models.User
-	err := json.NewDecoder(request.Body).Decode(&user)
+	var input createUserRequest
+	err := json.NewDecoder(request.Body).Decode(&input)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		apierror.Write(writer, request, apierror.Wrap(apierror.Validation, "invalid JSON body", err))
 		return
 	}
+	user := input.User
+	if !auth.CallerFromRequest(request).IsAdmin() {
+		// Only admins may create other admins.
+		user.Role = auth.RoleCustomer
+	}
+	if input.Password != "" {
+		user.PasswordHash, err = services.HashPassword(input.Password)
+		if err != nil {
+			apierror.Write(writer, request, err)
+			return
+		}
+	}
 	err = uc.UserModel.CreateUser(user)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		apierror.Write(writer, request, err)
 		return
 	}
 	writer.WriteHeader(http.StatusCreated)
@@ -88,19 +137,36 @@ func (uc *UserController) UpdateUserController(writer http.ResponseWriter, reque
 	vars := mux.Vars(request)
 	id, err := strconv.Atoi(vars["id"])
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		apierror.Write(writer, request, apierror.New(apierror.Validation, "id must be a number"))
 		return
 	}
 	var user models.User
 	err = json.NewDecoder(request.Body).Decode(&user)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		apierror.Write(writer, request, apierror.Wrap(apierror.Validation, "invalid JSON body", err))
 		return
 	}
 	user.ID = id
+	caller := auth.CallerFromRequest(request)
+	if !caller.Owns(id) {
+		apierror.Write(writer, request, models.ErrUserNotFound)
+		return
+	}
+	if !caller.IsAdmin() {
+		// Only admins may change roles.
+		existing, err := uc.UserModel.GetUserByID(id)
+		if err == sql.ErrNoRows {
+			err = models.ErrUserNotFound
+		}
+		if err != nil {
+			apierror.Write(writer, request, err)
+			return
+		}
+		user.Role = existing.Role
+	}
 	err = uc.UserModel.UpdateUser(user)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		apierror.Write(writer, request, err)
 		return
 	}
 	writer.WriteHeader(http.StatusOK)
@@ -110,37 +176,47 @@ func (uc *UserController) DeleteUserController(writer http.ResponseWriter, reque
 	vars := mux.Vars(request)
 	id, err := strconv.Atoi(vars["id"])
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		apierror.Write(writer, request, apierror.New(apierror.Validation, "id must be a number"))
+		return
+	}
+	if !auth.CallerFromRequest(request).Owns(id) {
+		apierror.Write(writer, request, models.ErrUserNotFound)
 		return
 	}
 	err = uc.UserModel.DeleteUser(id)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		apierror.Write(writer, request, err)
 		return
 	}
 	writer.WriteHeader(http.StatusOK)
 }
 
+// SearchUserController finds users by email or name. Customers only ever
+// find themselves.
 func (uc *UserController) SearchUserController(writer http.ResponseWriter, request *http.Request) {
+	caller := auth.CallerFromRequest(request)
 	email := request.URL.Query().Get("email")
 	name := request.URL.Query().Get("name")
+	if email == "" && name == "" {
+		apierror.Write(writer, request, apierror.New(apierror.Validation, "search by email or name"))
+		return
+	}
 	if email != "" {
 		user, err := uc.UserModel.GetUserByEmail(email)
+		if err == sql.ErrNoRows {
+			err = models.ErrUserNotFound
+		}
 		if err != nil {
-			if err == sql.ErrNoRows {
-				writer.WriteHeader(http.StatusNotFound)
-				return
-			}
-			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			apierror.Write(writer, request, err)
 			return
 		}
-		if user == nil {
-			writer.WriteHeader(http.StatusNotFound)
+		if user == nil || !caller.Owns(user.ID) {
+			apierror.Write(writer, request, models.ErrUserNotFound)
 			return
 		}
 		jsonUser, err := json.Marshal(user)
 		if err != nil {
-			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			apierror.Write(writer, request, err)
 			return
 		}
 		writer.Header().Set("Content-Type", "application/json")
@@ -151,20 +227,17 @@ func (uc *UserController) SearchUserController(writer http.ResponseWriter, reque
 		username := request.URL.Query().Get("name")
 		users, err := uc.UserModel.GetUserByUsername(username)
 		if err != nil {
-			if err == sql.ErrNoRows {
-				writer.WriteHeader(http.StatusNotFound)
-				return
-			}
-			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			apierror.Write(writer, request, err)
 			return
 		}
+		users = ownedUsers(caller, users)
 		if len(users) == 0 {
-			writer.WriteHeader(http.StatusNotFound)
+			apierror.Write(writer, request, apierror.New(apierror.NotFound, "no users found"))
 			return
 		}
 		jsonUsers, err := json.Marshal(users)
 		if err != nil {
-			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			apierror.Write(writer, request, err)
 			return
 		}
 		writer.Header().Set("Content-Type", "application/json")
@@ -173,3 +246,64 @@ func (uc *UserController) SearchUserController(writer http.ResponseWriter, reque
 	}
 
 }
+
+func ownedUsers(caller auth.Caller, users []*models.User) []*models.User {
+	owned := make([]*models.User, 0, len(users))
+	for _, user := range users {
+		if caller.Owns(user.ID) {
+			owned = append(owned, user)
+		}
+	}
+	return owned
+}
+
+type loginRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+type loginResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// LoginController exchanges an email and password for an access token.
+func (uc *UserController) LoginController(writer http.ResponseWriter, request *http.Request) {
+	var input loginRequest
+	err := json.NewDecoder(request.Body).Decode(&input)
+	if err != nil {
+		apierror.Write(writer, request, apierror.Wrap(apierror.Validation, "invalid JSON body", err))
+		return
+	}
+	if !uc.allow(writer, request, "login") {
+		return
+	}
+
+	user, err := uc.UserModel.GetUserByEmail(input.Email)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		apierror.Write(writer, request, err)
+		return
+	}
+	if !uc.checkPassword(writer, request, user, input.Password, apierror.Unauthorized) {
+		return
+	}
+
+	token, expiresAt, err := uc.Tokens.Issue(user.ID, user.Role)
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	jsonToken, err := json.Marshal(loginResponse{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(time.Until(expiresAt).Seconds()),
+	})
+	if err != nil {
+		apierror.Write(writer, request, err)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	_, err = writer.Write(jsonToken)
+}
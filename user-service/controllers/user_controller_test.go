@@ -1,28 +1,78 @@
 package controllers
 
 import (
+	"OnlineStore/auth"
+	"OnlineStore/pagination"
 	"OnlineStore/user-service/models"
+	"OnlineStore/user-service/services"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/assert"
 )
 
+var testTokens = auth.NewTokens("test-secret", time.Hour)
+
+var testPolicy = services.AccountPolicy{
+	RateLimit:   100,
+	RateWindow:  time.Minute,
+	MaxAttempts: 3,
+	Lockout:     time.Minute,
+	ResetTTL:    time.Hour,
+}
+
 // MockUserModel is a mock implementation of the UserModel interface
 type MockUserModel struct {
-	Users []*models.User
+	Users        []*models.User
+	FailedLogins map[int]int
+	Resets       map[string]*mockReset
+}
+
+type mockReset struct {
+	userID    int
+	expiresAt time.Time
+	used      bool
+}
+
+// MockResetSender records the reset tokens it is asked to send.
+type MockResetSender struct {
+	Tokens map[int]string
 }
 
-func (m *MockUserModel) GetUsers() ([]*models.User, error) {
-	return m.Users, nil
+func (m *MockResetSender) SendPasswordReset(ctx context.Context, user *models.User, token string, expiresAt time.Time) error {
+	if m.Tokens == nil {
+		m.Tokens = make(map[int]string)
+	}
+	m.Tokens[user.ID] = token
+	return nil
+}
+
+func (m *MockUserModel) ListUsers(filter models.UserFilter, page pagination.Params) ([]*models.User, int, error) {
+	var users []*models.User
+	for _, user := range m.Users {
+		if (filter.ID == 0 || user.ID == filter.ID) && (filter.Role == "" || user.Role == filter.Role) {
+			users = append(users, user)
+		}
+	}
+	total := len(users)
+	users = users[min(page.Offset, total):min(page.Offset+page.Limit, total)]
+	return users, total, nil
 }
 
 func (m *MockUserModel) CreateUser(user models.User) error {
+	for _, u := range m.Users {
+		if u.Email == user.Email {
+			return models.ErrEmailTaken
+		}
+	}
+	user.ID = len(m.Users) + 1
 	m.Users = append(m.Users, &user)
 	return nil
 }
@@ -75,6 +125,60 @@ func (m *MockUserModel) GetUserByUsername(username string) ([]*models.User, erro
 	return users, nil
 }
 
+func (m *MockUserModel) SetPassword(id int, passwordHash string) error {
+	user, err := m.GetUserByID(id)
+	if err != nil {
+		return err
+	}
+	user.PasswordHash = passwordHash
+	user.LockedUntil = time.Time{}
+	delete(m.FailedLogins, id)
+	for _, reset := range m.Resets {
+		if reset.userID == id {
+			reset.used = true
+		}
+	}
+	return nil
+}
+
+func (m *MockUserModel) RecordFailedLogin(id int, maxAttempts int, lockout time.Duration) error {
+	if m.FailedLogins == nil {
+		m.FailedLogins = make(map[int]int)
+	}
+	m.FailedLogins[id]++
+	if m.FailedLogins[id] >= maxAttempts {
+		user, err := m.GetUserByID(id)
+		if err != nil {
+			return err
+		}
+		user.LockedUntil = time.Now().Add(lockout)
+		m.FailedLogins[id] = 0
+	}
+	return nil
+}
+
+func (m *MockUserModel) ResetFailedLogins(id int) error {
+	delete(m.FailedLogins, id)
+	return nil
+}
+
+func (m *MockUserModel) CreatePasswordReset(userID int, tokenHash string, expiresAt time.Time) error {
+	if m.Resets == nil {
+		m.Resets = make(map[string]*mockReset)
+	}
+	m.Resets[tokenHash] = &mockReset{userID: userID, expiresAt: expiresAt}
+	return nil
+}
+
+func (m *MockUserModel) ResetPassword(tokenHash string, passwordHash string) (int, error) {
+	reset, ok := m.Resets[tokenHash]
+	if !ok || reset.used || time.Now().After(reset.expiresAt) {
+		return 0, models.ErrInvalidResetToken
+	}
+	reset.used = true
+	return reset.userID, m.SetPassword(reset.userID, passwordHash)
+}
+
 func TestGetUsersController(t *testing.T) {
 	mockModel := &MockUserModel{
 		Users: []*models.User{
@@ -82,12 +186,13 @@ func TestGetUsersController(t *testing.T) {
 			{ID: 2, Username: "user2", Email: "user2@example.com"},
 		},
 	}
-	controller := NewUserController(mockModel)
+	controller := NewUserController(mockModel, testTokens, testPolicy, &MockResetSender{})
 
 	req, err := http.NewRequest("GET", "/users", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
 
 	rr := httptest.NewRecorder()
 	handler := http.HandlerFunc(controller.GetUsersController)
@@ -95,18 +200,35 @@ func TestGetUsersController(t *testing.T) {
 
 	assert.Equal(t, http.StatusOK, rr.Code)
 
-	var users []*models.User
-	err = json.Unmarshal(rr.Body.Bytes(), &users)
+	var page pagination.Page[*models.User]
+	err = json.Unmarshal(rr.Body.Bytes(), &page)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 2, len(page.Items))
+	assert.Equal(t, 2, page.Total)
+
+	// Test paging
+	req, err = http.NewRequest("GET", "/users?limit=1&sort=email", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
 
-	assert.Equal(t, 2, len(users))
+	err = json.Unmarshal(rr.Body.Bytes(), &page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(page.Items))
+	assert.Equal(t, 1, *page.Next)
 }
 
 func TestCreateUserController(t *testing.T) {
 	mockModel := &MockUserModel{}
-	controller := NewUserController(mockModel)
+	controller := NewUserController(mockModel, testTokens, testPolicy, &MockResetSender{})
 
 	newUser := models.User{Username: "newuser", Email: "newuser@example.com", Address: "123 Street", Role: "user"}
 	userJson, _ := json.Marshal(newUser)
@@ -115,6 +237,7 @@ func TestCreateUserController(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
 	req.Header.Set("Content-Type", "application/json")
 
 	rr := httptest.NewRecorder()
@@ -126,18 +249,92 @@ func TestCreateUserController(t *testing.T) {
 	assert.Equal(t, newUser.Username, mockModel.Users[0].Username)
 }
 
+func TestCreateUserControllerRole(t *testing.T) {
+	mockModel := &MockUserModel{}
+	controller := NewUserController(mockModel, testTokens, testPolicy, &MockResetSender{})
+	handler := http.HandlerFunc(controller.CreateUserController)
+	body := `{"username": "eve", "email": "eve@example.com", "role": "admin", "password": "correct horse"}`
+
+	// Test customer trying to create an admin
+	req := httptest.NewRequest("POST", "/users", strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.Equal(t, auth.RoleCustomer, mockModel.Users[0].Role)
+	assert.NotEmpty(t, mockModel.Users[0].PasswordHash)
+	assert.NotContains(t, mockModel.Users[0].PasswordHash, "correct horse")
+
+	// Test admin creating an admin
+	body = strings.Replace(body, "eve@", "alice@", 1)
+	req = httptest.NewRequest("POST", "/users", strings.NewReader(body))
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.Equal(t, auth.RoleAdmin, mockModel.Users[1].Role)
+
+	// Test duplicate email
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/users", strings.NewReader(body)))
+
+	assert.Equal(t, http.StatusConflict, rr.Code)
+}
+
+func TestLoginController(t *testing.T) {
+	hash, err := services.HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mockModel := &MockUserModel{
+		Users: []*models.User{
+			{ID: 1, Username: "user1", Email: "user1@example.com", Role: auth.RoleCustomer, PasswordHash: hash},
+			{ID: 2, Username: "user2", Email: "user2@example.com", Role: auth.RoleCustomer},
+		},
+	}
+	controller := NewUserController(mockModel, testTokens, testPolicy, &MockResetSender{})
+	handler := http.HandlerFunc(controller.LoginController)
+	login := func(email, password string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]string{"email": email, "password": password})
+		req := httptest.NewRequest("POST", "/users/login", strings.NewReader(string(body)))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := login("user1@example.com", "correct horse")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var response loginResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	claims, err := testTokens.Verify(response.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, claims.UserID)
+	assert.Equal(t, auth.RoleCustomer, claims.Role)
+
+	// Test wrong password, unknown email and a user without a password
+	assert.Equal(t, http.StatusUnauthorized, login("user1@example.com", "wrong password").Code)
+	assert.Equal(t, http.StatusUnauthorized, login("nobody@example.com", "correct horse").Code)
+	assert.Equal(t, http.StatusUnauthorized, login("user2@example.com", "").Code)
+}
+
 func TestGetUserByIDController(t *testing.T) {
 	mockModel := &MockUserModel{
 		Users: []*models.User{
 			{ID: 1, Username: "user1", Email: "user1@example.com"},
 		},
 	}
-	controller := NewUserController(mockModel)
+	controller := NewUserController(mockModel, testTokens, testPolicy, &MockResetSender{})
 
 	req, err := http.NewRequest("GET", "/users/1", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
 
 	rr := httptest.NewRecorder()
 	router := mux.NewRouter()
@@ -161,7 +358,7 @@ func TestUpdateUserController(t *testing.T) {
 			{ID: 1, Username: "user1", Email: "user1@example.com"},
 		},
 	}
-	controller := NewUserController(mockModel)
+	controller := NewUserController(mockModel, testTokens, testPolicy, &MockResetSender{})
 
 	updatedUser := models.User{ID: 1, Username: "updateduser", Email: "user1@example.com", Address: "123 Street", Role: "admin"}
 	userJson, _ := json.Marshal(updatedUser)
@@ -170,6 +367,7 @@ func TestUpdateUserController(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
 	req.Header.Set("Content-Type", "application/json")
 
 	rr := httptest.NewRecorder()
@@ -187,12 +385,13 @@ func TestDeleteUserController(t *testing.T) {
 			{ID: 1, Username: "user1", Email: "user1@example.com"},
 		},
 	}
-	controller := NewUserController(mockModel)
+	controller := NewUserController(mockModel, testTokens, testPolicy, &MockResetSender{})
 
 	req, err := http.NewRequest("DELETE", "/users/1", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
 
 	rr := httptest.NewRecorder()
 	router := mux.NewRouter()
@@ -210,13 +409,14 @@ func TestSearchUserController(t *testing.T) {
 			{ID: 2, Username: "user2", Email: "user2@example.com"},
 		},
 	}
-	controller := NewUserController(mockModel)
+	controller := NewUserController(mockModel, testTokens, testPolicy, &MockResetSender{})
 
 	// Test search by email
 	req, err := http.NewRequest("GET", "/users/search?email=user1@example.com", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
 
 	rr := httptest.NewRecorder()
 	router := mux.NewRouter()
@@ -238,6 +438,7 @@ func TestSearchUserController(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	req.Header.Set(auth.UserRoleHeader, auth.RoleAdmin)
 
 	rr = httptest.NewRecorder()
 	router.ServeHTTP(rr, req)
@@ -253,3 +454,45 @@ func TestSearchUserController(t *testing.T) {
 	assert.Equal(t, 1, len(users))
 	assert.Equal(t, "user2", users[0].Username)
 }
+
+func TestUserOwnership(t *testing.T) {
+	mockModel := &MockUserModel{
+		Users: []*models.User{
+			{ID: 1, Username: "user1", Email: "user1@example.com", Role: auth.RoleCustomer},
+			{ID: 2, Username: "user2", Email: "user2@example.com", Role: auth.RoleCustomer},
+		},
+	}
+	controller := NewUserController(mockModel, testTokens, testPolicy, &MockResetSender{})
+	router := mux.NewRouter()
+	router.HandleFunc("/users", controller.GetUsersController).Methods("GET")
+	router.HandleFunc("/users/search", controller.SearchUserController).Methods("GET")
+	router.HandleFunc("/users/{id}", controller.GetUserByIDController).Methods("GET")
+	router.HandleFunc("/users/{id}", controller.UpdateUserController).Methods("PUT")
+	router.HandleFunc("/users/{id}", controller.DeleteUserController).Methods("DELETE")
+	asUser := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set(auth.UserIDHeader, "1")
+		req.Header.Set(auth.UserRoleHeader, auth.RoleCustomer)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Test another user's profile looks like a missing one
+	assert.Equal(t, http.StatusOK, asUser("GET", "/users/1", "").Code)
+	assert.Equal(t, http.StatusNotFound, asUser("GET", "/users/2", "").Code)
+	assert.Equal(t, http.StatusNotFound, asUser("PUT", "/users/2", `{"username": "mallory"}`).Code)
+	assert.Equal(t, http.StatusNotFound, asUser("DELETE", "/users/2", "").Code)
+	assert.Equal(t, http.StatusNotFound, asUser("GET", "/users/search?email=user2@example.com", "").Code)
+	assert.Equal(t, http.StatusNotFound, asUser("GET", "/users/search?name=user2", "").Code)
+	assert.Equal(t, 2, len(mockModel.Users))
+	assert.Equal(t, "user2", mockModel.Users[1].Username)
+
+	// Test listing only finds the caller
+	var page pagination.Page[*models.User]
+	if err := json.Unmarshal(asUser("GET", "/users", "").Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(page.Items))
+	assert.Equal(t, 1, page.Items[0].ID)
+}
@@ -3,9 +3,13 @@ package main
 
 import (
 	db "OnlineStore"
+	"OnlineStore/apierror"
+	"OnlineStore/auth"
+	"OnlineStore/outbox"
 	"OnlineStore/user-service/controllers"
 	"OnlineStore/user-service/repository"
 	"OnlineStore/user-service/routes"
+	"OnlineStore/user-service/services"
 	"context"
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
@@ -23,28 +27,43 @@ func main() {
 		log.Println("Error loading .env file")
 	}
 
-	database, err := db.InitializeDB()
+	database, err := db.InitializeDB("user")
 	if err != nil {
 		log.Fatalf("Error initializing database: %v", err)
 	}
 
-	// Uncomment to run migrations
-	// if err := db.MigrateUp(database); err != nil {
-	//     log.Fatalf("Error running migrations: %v", err)
-	// }
+	if db.MigrationsEnabled() {
+		if err := db.MigrateUp(database, "user"); err != nil {
+			log.Fatalf("Error running migrations: %v", err)
+		}
+	}
+
+	tokens, err := auth.TokensFromEnv()
+	if err != nil {
+		log.Fatalf("Error configuring tokens: %v", err)
+	}
+
+	resets, err := services.NewResetSenderFromEnv()
+	if err != nil {
+		log.Fatalf("Error configuring password reset: %v", err)
+	}
+	if resets == nil {
+		log.Println("PASSWORD_RESET_SENDER is not set, password reset is unavailable")
+	}
 
 	userModel := repository.NewUserRepository(database)
-	userController := controllers.NewUserController(userModel)
+	userController := controllers.NewUserController(userModel, tokens, services.AccountPolicyFromEnv(), resets)
 
 	router := mux.NewRouter()
+	apierror.Routes(router)
 	routes.Routes(router, userController)
 
 	corsHandler := cors.New(cors.Options{
 		AllowedOrigins:   []string{os.Getenv("BASE_URL")},
 		AllowedMethods:   []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete},
-		AllowedHeaders:   []string{"Authorization", "Content-Type"},
+		AllowedHeaders:   []string{"Authorization", "Content-Type", apierror.RequestIDHeader},
 		AllowCredentials: true,
-	}).Handler(router)
+	}).Handler(apierror.RequestID(router))
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -56,6 +75,12 @@ func main() {
 		Handler: corsHandler,
 	}
 
+	relayCtx, stopRelay := context.WithCancel(context.Background())
+	defer stopRelay()
+	if err := outbox.StartRelay(relayCtx, database); err != nil {
+		log.Fatalf("Error configuring outbox broker: %v", err)
+	}
+
 	go gracefulShutdown(server)
 
 	log.Printf("Server is starting on port %s\n", port)
@@ -0,0 +1,16 @@
+-- Users created before passwords existed have no password_hash and cannot
+-- log in until one is set.
+CREATE TABLE IF NOT EXISTS users
+(
+    id                SERIAL PRIMARY KEY,
+    username          VARCHAR(50)  NOT NULL,
+    email             VARCHAR(50)  NOT NULL UNIQUE,
+    address           VARCHAR(50)  NOT NULL DEFAULT '',
+    registration_date TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    role              VARCHAR(50)  NOT NULL DEFAULT 'customer',
+    password_hash     VARCHAR(255),
+    failed_logins     INT          NOT NULL DEFAULT 0,
+    locked_until      TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_users_username ON users (username);
@@ -0,0 +1,12 @@
+-- Only a SHA-256 hash of each reset token is kept, so a leaked table cannot
+-- be used to take over accounts.
+CREATE TABLE IF NOT EXISTS password_resets
+(
+    token_hash CHAR(64) PRIMARY KEY,
+    user_id    INT         NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at    TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_password_resets_user_id ON password_resets (user_id);
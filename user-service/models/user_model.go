@@ -1,5 +1,25 @@
 package models
 
+import (
+	"OnlineStore/apierror"
+	"OnlineStore/pagination"
+	"time"
+)
+
+var (
+	ErrUserNotFound      = apierror.New(apierror.NotFound, "user not found")
+	ErrEmailTaken        = apierror.New(apierror.Conflict, "email is already registered")
+	ErrInvalidResetToken = apierror.New(apierror.Validation, "password reset token is invalid or expired")
+)
+
+// Events recorded in the outbox when a user changes. Their payload is the
+// User as it is afterwards; for user.deleted only its ID is set.
+const (
+	EventUserCreated = "user.created"
+	EventUserUpdated = "user.updated"
+	EventUserDeleted = "user.deleted"
+)
+
 type User struct {
 	ID               int    `json:"id"`
 	Username         string `json:"username"`
@@ -7,14 +27,44 @@ type User struct {
 	Address          string `json:"address"`
 	RegistrationDate string `json:"registration_date"`
 	Role             string `json:"role"`
+	// PasswordHash is the bcrypt hash of the user's password, empty if none
+	// was ever set.
+	PasswordHash string `json:"-"`
+	// LockedUntil is when a lockout after repeated failed logins ends, zero
+	// if the account is not locked.
+	LockedUntil time.Time `json:"-"`
+}
+
+// UserSorts are the keys users can be listed by; the first is the default.
+var UserSorts = []string{"id", "username", "email", "registration_date", "role"}
+
+// UserFilter narrows a list of users. Zero fields match every user; ID is how
+// customers are limited to themselves.
+type UserFilter struct {
+	ID   int
+	Role string
 }
 
 type UserModel interface {
-	GetUsers() ([]*User, error)
+	// ListUsers returns one page of the users matching filter, and how many
+	// match in total.
+	ListUsers(filter UserFilter, page pagination.Params) ([]*User, int, error)
 	CreateUser(user User) error
 	GetUserByID(id int) (*User, error)
 	UpdateUser(user User) error
 	DeleteUser(id int) error
 	GetUserByEmail(email string) (*User, error)
 	GetUserByUsername(username string) ([]*User, error)
+	// SetPassword replaces the user's password, clears any lockout and
+	// revokes outstanding reset tokens.
+	SetPassword(id int, passwordHash string) error
+	// RecordFailedLogin counts a failed login and locks the account for
+	// lockout once maxAttempts failures have accumulated.
+	RecordFailedLogin(id int, maxAttempts int, lockout time.Duration) error
+	ResetFailedLogins(id int) error
+	CreatePasswordReset(userID int, tokenHash string, expiresAt time.Time) error
+	// ResetPassword spends the reset token with the given hash and sets the
+	// password of its user, returning the user's ID. It returns
+	// ErrInvalidResetToken if the token is unknown, used or expired.
+	ResetPassword(tokenHash string, passwordHash string) (int, error)
 }
@@ -1,10 +1,30 @@
 package repository
 
 import (
+	"OnlineStore/outbox"
+	"OnlineStore/pagination"
 	"OnlineStore/user-service/models"
 	"database/sql"
+	"time"
 )
 
+const userColumns = "id, username, email, address, registration_date, role, COALESCE(password_hash, ''), locked_until"
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanUser(row rowScanner) (*models.User, error) {
+	user := &models.User{}
+	var lockedUntil sql.NullTime
+	err := row.Scan(&user.ID, &user.Username, &user.Email, &user.Address, &user.RegistrationDate, &user.Role, &user.PasswordHash, &lockedUntil)
+	if err != nil {
+		return nil, err
+	}
+	user.LockedUntil = lockedUntil.Time
+	return user, nil
+}
+
 type UserRepository struct {
 	DB *sql.DB
 }
@@ -13,71 +33,134 @@ func NewUserRepository(db *sql.DB) *UserRepository {
 	return &UserRepository{DB: db}
 }
 
-func (ur *UserRepository) GetUsers() ([]*models.User, error) {
-	rows, err := ur.DB.Query("SELECT * FROM users")
+var userSortColumns = map[string]string{
+	"id":                "id",
+	"username":          "username",
+	"email":             "email",
+	"registration_date": "registration_date",
+	"role":              "role",
+}
+
+func (ur *UserRepository) ListUsers(filter models.UserFilter, page pagination.Params) ([]*models.User, int, error) {
+	var where pagination.Where
+	if filter.ID != 0 {
+		where.Equal("id", filter.ID)
+	}
+	if filter.Role != "" {
+		where.Equal("role", filter.Role)
+	}
+	var total int
+	err := ur.DB.QueryRow("SELECT COUNT(*) FROM users"+where.String(), where.Args...).Scan(&total)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+
+	query := "SELECT " + userColumns + " FROM users" + where.String()
+	query += page.OrderBy(userSortColumns, &where)
+	rows, err := ur.DB.Query(query, where.Args...)
+	if err != nil {
+		return nil, 0, err
 	}
 	defer rows.Close()
 
 	users := []*models.User{}
 	for rows.Next() {
-		user := &models.User{}
-		err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.Address, &user.RegistrationDate, &user.Role)
+		user, err := scanUser(rows)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 		users = append(users, user)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
 
-	return users, nil
+	return users, total, nil
 }
 
 func (ur *UserRepository) GetUserByID(id int) (*models.User, error) {
-	user := &models.User{}
-	err := ur.DB.QueryRow("SELECT * FROM users WHERE id = $1", id).Scan(&user.ID, &user.Username, &user.Email, &user.Address, &user.RegistrationDate, &user.Role)
-	if err != nil {
-		return nil, err
-	}
-
-	return user, nil
+	return scanUser(ur.DB.QueryRow("SELECT "+userColumns+" FROM users WHERE id = $1", id))
 }
 
+// CreateUser returns models.ErrEmailTaken if the email is already registered.
 func (ur *UserRepository) CreateUser(user models.User) error {
-	_, err := ur.DB.Exec("INSERT INTO users (username, email, address, role) VALUES ($1, $2, $3, $4)", user.Username, user.Email, user.Address, user.Role)
+	tx, err := ur.DB.Begin()
 	if err != nil {
 		return err
 	}
-	return nil
+	defer tx.Rollback()
+
+	created, err := scanUser(tx.QueryRow(`
+        INSERT INTO users (username, email, address, role, password_hash) VALUES ($1, $2, $3, $4, NULLIF($5, ''))
+        ON CONFLICT (email) DO NOTHING
+        RETURNING `+userColumns, user.Username, user.Email, user.Address, user.Role, user.PasswordHash))
+	if err == sql.ErrNoRows {
+		return models.ErrEmailTaken
+	}
+	if err != nil {
+		return err
+	}
+	err = outbox.Record(tx, models.EventUserCreated, created.ID, created)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 func (ur *UserRepository) UpdateUser(user models.User) error {
-	_, err := ur.DB.Exec("UPDATE users SET username = $1, email = $2, address = $3, role = $4 WHERE id = $5", user.Username, user.Email, user.Address, user.Role, user.ID)
+	tx, err := ur.DB.Begin()
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	return nil
+	updated, err := scanUser(tx.QueryRow("UPDATE users SET username = $1, email = $2, address = $3, role = $4 WHERE id = $5 RETURNING "+userColumns, user.Username, user.Email, user.Address, user.Role, user.ID))
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = outbox.Record(tx, models.EventUserUpdated, updated.ID, updated)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 func (ur *UserRepository) DeleteUser(id int) error {
-	_, err := ur.DB.Exec("DELETE FROM users WHERE id = $1", id)
+	tx, err := ur.DB.Begin()
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	return nil
+	result, err := tx.Exec("DELETE FROM users WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return nil
+	}
+	err = outbox.Record(tx, models.EventUserDeleted, id, models.User{ID: id})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 func (ur *UserRepository) GetUserByUsername(username string) ([]*models.User, error) {
 	var users []*models.User
-	rows, err := ur.DB.Query("SELECT * FROM users WHERE username = $1", username)
+	rows, err := ur.DB.Query("SELECT "+userColumns+" FROM users WHERE username = $1", username)
 	if err != nil {
 		return nil, err
 	}
 	for rows.Next() {
-		user := &models.User{}
-		err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.Address, &user.RegistrationDate, &user.Role)
+		user, err := scanUser(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -88,11 +171,82 @@ func (ur *UserRepository) GetUserByUsername(username string) ([]*models.User, er
 }
 
 func (ur *UserRepository) GetUserByEmail(email string) (*models.User, error) {
-	user := &models.User{}
-	err := ur.DB.QueryRow("SELECT * FROM users WHERE email = $1", email).Scan(&user.ID, &user.Username, &user.Email, &user.Address, &user.RegistrationDate, &user.Role)
+	return scanUser(ur.DB.QueryRow("SELECT "+userColumns+" FROM users WHERE email = $1", email))
+}
+
+func (ur *UserRepository) SetPassword(id int, passwordHash string) error {
+	tx, err := ur.DB.Begin()
 	if err != nil {
-		return nil, err
+		return err
 	}
+	defer tx.Rollback()
 
-	return user, nil
+	result, err := tx.Exec("UPDATE users SET password_hash = $1, failed_logins = 0, locked_until = NULL WHERE id = $2", passwordHash, id)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return sql.ErrNoRows
+	}
+	_, err = tx.Exec("UPDATE password_resets SET used_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND used_at IS NULL", id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RecordFailedLogin starts counting afresh once it locks the account, so the
+// next lockout again takes maxAttempts failures.
+func (ur *UserRepository) RecordFailedLogin(id int, maxAttempts int, lockout time.Duration) error {
+	_, err := ur.DB.Exec(`
+        UPDATE users SET
+            failed_logins = CASE WHEN failed_logins + 1 >= $2 THEN 0 ELSE failed_logins + 1 END,
+            locked_until  = CASE WHEN failed_logins + 1 >= $2 THEN CURRENT_TIMESTAMP + $3 * INTERVAL '1 second' ELSE locked_until END
+        WHERE id = $1`, id, maxAttempts, lockout.Seconds())
+	return err
+}
+
+func (ur *UserRepository) ResetFailedLogins(id int) error {
+	_, err := ur.DB.Exec("UPDATE users SET failed_logins = 0, locked_until = NULL WHERE id = $1 AND (failed_logins <> 0 OR locked_until IS NOT NULL)", id)
+	return err
+}
+
+func (ur *UserRepository) CreatePasswordReset(userID int, tokenHash string, expiresAt time.Time) error {
+	_, err := ur.DB.Exec("INSERT INTO password_resets (token_hash, user_id, expires_at) VALUES ($1, $2, $3)", tokenHash, userID, expiresAt)
+	return err
+}
+
+// ResetPassword marks the token used in the same statement that checks it,
+// so a token can be spent only once even by concurrent requests.
+func (ur *UserRepository) ResetPassword(tokenHash string, passwordHash string) (int, error) {
+	tx, err := ur.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	err = tx.QueryRow(`
+        UPDATE password_resets SET used_at = CURRENT_TIMESTAMP
+        WHERE token_hash = $1 AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+        RETURNING user_id`, tokenHash).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, models.ErrInvalidResetToken
+	}
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec("UPDATE users SET password_hash = $1, failed_logins = 0, locked_until = NULL WHERE id = $2", passwordHash, userID)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec("UPDATE password_resets SET used_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND used_at IS NULL", userID)
+	if err != nil {
+		return 0, err
+	}
+	return userID, tx.Commit()
 }
@@ -15,4 +15,9 @@ func Routes(router *mux.Router, userController *controllers.UserController) {
 	usersRouter.HandleFunc("/{id:[0-9]+}", userController.UpdateUserController).Methods(http.MethodPut)
 	usersRouter.HandleFunc("/{id:[0-9]+}", userController.DeleteUserController).Methods(http.MethodDelete)
 	usersRouter.HandleFunc("/search", userController.SearchUserController).Methods(http.MethodGet)
+	usersRouter.HandleFunc("/login", userController.LoginController).Methods(http.MethodPost)
+	usersRouter.HandleFunc("/register", userController.RegisterController).Methods(http.MethodPost)
+	usersRouter.HandleFunc("/{id:[0-9]+}/password", userController.ChangePasswordController).Methods(http.MethodPut)
+	usersRouter.HandleFunc("/password/forgot", userController.ForgotPasswordController).Methods(http.MethodPost)
+	usersRouter.HandleFunc("/password/reset", userController.ResetPasswordController).Methods(http.MethodPost)
 }
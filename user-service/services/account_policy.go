@@ -0,0 +1,93 @@
+package services
+
+import (
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AccountPolicy bounds password guessing and reset tokens: each client
+// address gets RateLimit login attempts per RateWindow, an account is locked
+// for Lockout after MaxAttempts consecutive failures, and reset tokens are
+// valid for ResetTTL.
+type AccountPolicy struct {
+	RateLimit   int
+	RateWindow  time.Duration
+	MaxAttempts int
+	Lockout     time.Duration
+	ResetTTL    time.Duration
+}
+
+// AccountPolicyFromEnv reads LOGIN_RATE_LIMIT (attempts per minute),
+// LOGIN_MAX_ATTEMPTS, LOGIN_LOCKOUT and PASSWORD_RESET_TTL (both minutes).
+func AccountPolicyFromEnv() AccountPolicy {
+	return AccountPolicy{
+		RateLimit:   positiveEnv("LOGIN_RATE_LIMIT", 10),
+		RateWindow:  time.Minute,
+		MaxAttempts: positiveEnv("LOGIN_MAX_ATTEMPTS", 5),
+		Lockout:     time.Duration(positiveEnv("LOGIN_LOCKOUT", 15)) * time.Minute,
+		ResetTTL:    time.Duration(positiveEnv("PASSWORD_RESET_TTL", 60)) * time.Minute,
+	}
+}
+
+func positiveEnv(name string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+// RateLimiter allows up to limit events per key in each fixed window.
+type RateLimiter struct {
+	limit  int
+	window time.Duration
+	now    func() time.Time
+
+	mu        sync.Mutex
+	windows   map[string]*rateWindow
+	lastEvict time.Time
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
+	return &RateLimiter{limit: limit, window: window, now: time.Now, windows: make(map[string]*rateWindow)}
+}
+
+// Allow counts an event for key. When the limit is exhausted it returns false
+// and how long until the key may try again.
+func (rl *RateLimiter) Allow(key string) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := rl.now()
+	w, ok := rl.windows[key]
+	if !ok || now.Sub(w.start) >= rl.window {
+		rl.evict(now)
+		w = &rateWindow{start: now}
+		rl.windows[key] = w
+	}
+	if w.count >= rl.limit {
+		return false, w.start.Add(rl.window).Sub(now)
+	}
+	w.count++
+	return true, 0
+}
+
+// evict drops expired windows, at most once per window, so keys that stop
+// sending do not accumulate.
+func (rl *RateLimiter) evict(now time.Time) {
+	if now.Sub(rl.lastEvict) < rl.window {
+		return
+	}
+	rl.lastEvict = now
+	for key, w := range rl.windows {
+		if now.Sub(w.start) >= rl.window {
+			delete(rl.windows, key)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package services
+
+import (
+	"OnlineStore/apierror"
+	"fmt"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const minPasswordLength = 8
+
+var (
+	ErrWeakPassword       = apierror.New(apierror.Validation, fmt.Sprintf("password must be at least %d characters", minPasswordLength))
+	ErrLongPassword       = apierror.New(apierror.Validation, "password must be at most 72 bytes")
+	ErrInvalidCredentials = apierror.New(apierror.Unauthorized, "invalid email or password")
+)
+
+// dummyHash is compared against when a user has no password, so a failed
+// login takes as long whether or not the account exists.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+
+func HashPassword(password string) (string, error) {
+	if len(password) < minPasswordLength {
+		return "", ErrWeakPassword
+	}
+	// bcrypt only looks at the first 72 bytes and refuses longer input.
+	if len(password) > 72 {
+		return "", ErrLongPassword
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// CheckPassword reports ErrInvalidCredentials unless password matches hash.
+// An empty hash never matches.
+func CheckPassword(hash, password string) error {
+	if hash == "" {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return ErrInvalidCredentials
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
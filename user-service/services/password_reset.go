@@ -0,0 +1,123 @@
+package services
+
+import (
+	"OnlineStore/user-service/models"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// NewResetToken returns a random one-time token for the user and the hash
+// under which it is stored.
+func NewResetToken() (token, hash string, err error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(buf)
+	return token, HashResetToken(token), nil
+}
+
+func HashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ResetSender delivers a password reset token to the user it belongs to.
+type ResetSender interface {
+	SendPasswordReset(ctx context.Context, user *models.User, token string, expiresAt time.Time) error
+}
+
+// NewResetSenderFromEnv builds the sender selected by PASSWORD_RESET_SENDER:
+// "smtp", configured with the SMTP_* variables, or "log" for local
+// development only. Left unset, it returns nil: there is no way to deliver
+// reset tokens, and password reset is unavailable.
+func NewResetSenderFromEnv() (ResetSender, error) {
+	switch name := os.Getenv("PASSWORD_RESET_SENDER"); name {
+	case "":
+		return nil, nil
+	case "smtp":
+		sender := &SMTPResetSender{
+			Addr:     os.Getenv("SMTP_ADDR"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     os.Getenv("SMTP_FROM"),
+		}
+		if sender.Addr == "" || sender.From == "" {
+			return nil, fmt.Errorf("SMTP_ADDR and SMTP_FROM must be set")
+		}
+		if _, err := mail.ParseAddress(sender.From); err != nil {
+			return nil, fmt.Errorf("invalid SMTP_FROM: %w", err)
+		}
+		return sender, nil
+	case "log":
+		return LogResetSender{}, nil
+	default:
+		return nil, fmt.Errorf("unknown PASSWORD_RESET_SENDER %q", name)
+	}
+}
+
+// SMTPResetSender emails reset tokens through an SMTP server, logging in
+// with Username and Password if they are set.
+type SMTPResetSender struct {
+	// Addr is the server's host:port.
+	Addr     string
+	Username string
+	Password string
+	From     string
+	// send is smtp.SendMail, replaced in tests.
+	send func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+func (s *SMTPResetSender) SendPasswordReset(ctx context.Context, user *models.User, token string, expiresAt time.Time) error {
+	from, err := mail.ParseAddress(s.From)
+	if err != nil {
+		return err
+	}
+	to, err := mail.ParseAddress(user.Email)
+	if err != nil {
+		return fmt.Errorf("user %d has no valid email: %w", user.ID, err)
+	}
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, err := net.SplitHostPort(s.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	msg.WriteString("Subject: Reset your password\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	fmt.Fprintf(&msg, "Use this token to choose a new password. It is valid until %s.\r\n\r\n%s\r\n\r\n",
+		expiresAt.UTC().Format(time.RFC1123), token)
+	msg.WriteString("If you did not ask to reset your password, ignore this email.\r\n")
+
+	send := s.send
+	if send == nil {
+		send = smtp.SendMail
+	}
+	return send(s.Addr, auth, from.Address, []string{to.Address}, []byte(msg.String()))
+}
+
+// LogResetSender writes reset tokens to the service log. It stands in for
+// email delivery in local environments and must not be used in production.
+type LogResetSender struct{}
+
+func (LogResetSender) SendPasswordReset(ctx context.Context, user *models.User, token string, expiresAt time.Time) error {
+	log.Printf("Password reset token for user %d (%s), valid until %s: %s", user.ID, user.Email, expiresAt.Format(time.RFC3339), token)
+	return nil
+}
@@ -0,0 +1,67 @@
+package services
+
+import (
+	"OnlineStore/user-service/models"
+	"context"
+	"net/smtp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewResetSenderFromEnv(t *testing.T) {
+	t.Setenv("PASSWORD_RESET_SENDER", "")
+	sender, err := NewResetSenderFromEnv()
+	require.NoError(t, err)
+	assert.Nil(t, sender, "reset is unavailable unless a sender is chosen")
+
+	t.Setenv("PASSWORD_RESET_SENDER", "log")
+	sender, err = NewResetSenderFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, LogResetSender{}, sender)
+
+	t.Setenv("PASSWORD_RESET_SENDER", "smtp")
+	t.Setenv("SMTP_ADDR", "")
+	_, err = NewResetSenderFromEnv()
+	assert.Error(t, err)
+	t.Setenv("SMTP_ADDR", "mail.example.com:587")
+	t.Setenv("SMTP_FROM", "Online Store <no-reply@example.com>")
+	sender, err = NewResetSenderFromEnv()
+	require.NoError(t, err)
+	assert.IsType(t, &SMTPResetSender{}, sender)
+
+	t.Setenv("PASSWORD_RESET_SENDER", "email")
+	_, err = NewResetSenderFromEnv()
+	assert.Error(t, err)
+}
+
+func TestSMTPResetSender(t *testing.T) {
+	var gotAddr, gotFrom string
+	var gotTo []string
+	var gotMsg []byte
+	sender := &SMTPResetSender{
+		Addr:     "mail.example.com:587",
+		Username: "store",
+		Password: "secret",
+		From:     "Online Store <no-reply@example.com>",
+		send: func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+			gotAddr, gotFrom, gotTo, gotMsg = addr, from, to, msg
+			return nil
+		},
+	}
+	user := &models.User{ID: 1, Email: "user1@example.com"}
+	expiresAt := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	require.NoError(t, sender.SendPasswordReset(context.Background(), user, "the-token", expiresAt))
+	assert.Equal(t, "mail.example.com:587", gotAddr)
+	assert.Equal(t, "no-reply@example.com", gotFrom)
+	assert.Equal(t, []string{"user1@example.com"}, gotTo)
+	assert.Contains(t, string(gotMsg), "To: <user1@example.com>\r\n")
+	assert.Contains(t, string(gotMsg), "the-token")
+	assert.Contains(t, string(gotMsg), "Fri, 02 Jan 2026 15:04:05 UTC")
+
+	user.Email = "user1@example.com\r\nBcc: someone@example.com"
+	assert.Error(t, sender.SendPasswordReset(context.Background(), user, "the-token", expiresAt))
+}